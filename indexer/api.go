@@ -3,30 +3,45 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
 	"github.com/sgraph-protocol/sgraph/indexer/types"
 	graph "github.com/sgraph-protocol/sgraph/sdk/go"
 )
 
 type API struct {
-	repo Mongo
+	repo Store
 }
 
-func NewAPI(m Mongo) API {
-	return API{m}
+func NewAPI(s Store) API {
+	return API{s}
 }
 
 type GetRelationsParams struct {
 	From      string   `json:"from"`
 	To        string   `json:"to"`
 	Providers []string `json:"providers"`
-	After     string   `json:"after"`
-	Limit     uint     `json:"limit"`
+	Tree      string   `json:"tree"`
+	Kinds     []string `json:"kinds"`
+	Status    string   `json:"status"` // active (default), closed or all
+	// status is evaluated at the slot or block time rather than now
+	AsOfSlot uint64     `json:"asOfSlot"`
+	AsOfTime *time.Time `json:"asOfTime"`
+	// values of decoded extra fields, strings, numbers or booleans
+	ExtraFields map[string]any `json:"extraFields"`
+	// inserted (default), connectedAt or slot, desc (default) or asc
+	Sort  string `json:"sort"`
+	Order string `json:"order"`
+	// nextCursor of the previous page, made with the same sort and order
+	After string `json:"after"`
+	Limit uint   `json:"limit"`
 }
 
 type GetRelationsResp struct {
-	Relations []types.Relation `json:"relations"`
+	Relations  []types.Relation `json:"relations"`
+	NextCursor string           `json:"nextCursor,omitempty"` // empty on the last page
 }
 
 func (a API) FindRelations(ctx context.Context, params GetRelationsParams) (GetRelationsResp, error) {
@@ -37,23 +52,525 @@ func (a API) FindRelations(ctx context.Context, params GetRelationsParams) (GetR
 		return GetRelationsResp{}, fmt.Errorf("invalid limit")
 	}
 
-	relations, err := a.repo.FetchRelations(ctx, params.From, params.To, params.Providers, params.After, params.Limit)
+	switch params.Status {
+	case "":
+		params.Status = repo.RelationsActive
+	case repo.RelationsActive, repo.RelationsClosed, repo.RelationsAll:
+	default:
+		return GetRelationsResp{}, fmt.Errorf("invalid status")
+	}
+
+	asOf, err := relationsPoint(params.AsOfSlot, params.AsOfTime)
+	if err != nil {
+		return GetRelationsResp{}, fmt.Errorf("as of: %w", err)
+	}
+
+	if err := validateKinds(params.Kinds); err != nil {
+		return GetRelationsResp{}, err
+	}
+
+	if err := validateExtraFields(params.ExtraFields); err != nil {
+		return GetRelationsResp{}, err
+	}
+
+	if params.Sort, params.Order, err = relationsSort(params.Sort, params.Order); err != nil {
+		return GetRelationsResp{}, err
+	}
+
+	relations, next, err := a.repo.FetchRelations(ctx, repo.RelationsQuery{
+		From:        params.From,
+		To:          params.To,
+		Providers:   params.Providers,
+		Tree:        params.Tree,
+		Kinds:       params.Kinds,
+		Status:      params.Status,
+		AsOf:        asOf,
+		ExtraFields: params.ExtraFields,
+		Sort:        params.Sort,
+		Order:       params.Order,
+		After:       params.After,
+		Limit:       params.Limit,
+	})
 	if err != nil {
 		return GetRelationsResp{}, fmt.Errorf("fetch relations: %w", err)
 	}
 
-	return GetRelationsResp{
-		Relations: sliceMap(relations, func(r graph.Relation) types.Relation {
-			return types.Relation{
-				From:           r.From.ToBase58(),
-				To:             r.To.ToBase58(),
-				Provider:       r.Provider.ToBase58(),
-				ConnectedAt:    time.Unix(r.ConnectedAt, 0),
-				DisconnectedAt: optionMap(r.DisconnectedAt, func(ts int64) time.Time { return time.Unix(ts, 0) }),
-				Extra:          r.Extra,
+	return GetRelationsResp{Relations: relations, NextCursor: next}, nil
+}
+
+// relationsSort validates sort and order of relations, defaulting to the newest inserted first
+func relationsSort(sort, order string) (string, string, error) {
+	switch sort {
+	case "":
+		sort = repo.SortInserted
+	case repo.SortInserted, repo.SortConnectedAt, repo.SortSlot:
+	default:
+		return "", "", fmt.Errorf("invalid sort")
+	}
+
+	switch order {
+	case "":
+		order = repo.OrderDesc
+	case repo.OrderDesc, repo.OrderAsc:
+	default:
+		return "", "", fmt.Errorf("invalid order")
+	}
+
+	return sort, order, nil
+}
+
+type DiffRelationsParams struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Providers []string `json:"providers"`
+	Kinds     []string `json:"kinds"`
+	// points graph is compared at, both slots or both block times
+	SinceSlot uint64     `json:"sinceSlot"`
+	UntilSlot uint64     `json:"untilSlot"`
+	SinceTime *time.Time `json:"sinceTime"`
+	UntilTime *time.Time `json:"untilTime"`
+	// added and removed relations are paged separately, with nextAdded and nextRemoved of the previous page
+	AfterAdded   string `json:"afterAdded"`
+	AfterRemoved string `json:"afterRemoved"`
+	Limit        uint   `json:"limit"`
+}
+
+type DiffRelationsResp struct {
+	Added       []types.Relation `json:"added"`   // active at until, but not at since
+	Removed     []types.Relation `json:"removed"` // active at since, but not at until
+	NextAdded   string           `json:"nextAdded,omitempty"`
+	NextRemoved string           `json:"nextRemoved,omitempty"`
+}
+
+// DiffRelations returns how the graph has changed between two points. Relations both added and closed
+// between them are in neither list
+func (a API) DiffRelations(ctx context.Context, params DiffRelationsParams) (DiffRelationsResp, error) {
+	if params.Limit == 0 {
+		params.Limit = 100
+	}
+	if params.Limit > 1000 {
+		return DiffRelationsResp{}, fmt.Errorf("invalid limit")
+	}
+
+	since, err := relationsPoint(params.SinceSlot, params.SinceTime)
+	if err != nil {
+		return DiffRelationsResp{}, fmt.Errorf("since: %w", err)
+	}
+	until, err := relationsPoint(params.UntilSlot, params.UntilTime)
+	if err != nil {
+		return DiffRelationsResp{}, fmt.Errorf("until: %w", err)
+	}
+
+	switch {
+	case since == nil || until == nil:
+		return DiffRelationsResp{}, fmt.Errorf("since and until are required")
+	case (since.Time == nil) != (until.Time == nil):
+		return DiffRelationsResp{}, fmt.Errorf("since and until must be both slots or both times")
+	case since.Time == nil && since.Slot >= until.Slot, since.Time != nil && !since.Time.Before(*until.Time):
+		return DiffRelationsResp{}, fmt.Errorf("since must be before until")
+	}
+
+	if err := validateKinds(params.Kinds); err != nil {
+		return DiffRelationsResp{}, err
+	}
+
+	query := repo.RelationsQuery{
+		From:      params.From,
+		To:        params.To,
+		Providers: params.Providers,
+		Kinds:     params.Kinds,
+		Status:    repo.RelationsActive,
+		Sort:      repo.SortInserted,
+		Order:     repo.OrderDesc,
+		Limit:     params.Limit,
+	}
+
+	added := query
+	added.AsOf, added.AddedAfter, added.After = until, since, params.AfterAdded
+
+	removed := query
+	removed.AsOf, removed.ClosedBy, removed.After = since, until, params.AfterRemoved
+
+	var resp DiffRelationsResp
+	if resp.Added, resp.NextAdded, err = a.repo.FetchRelations(ctx, added); err != nil {
+		return DiffRelationsResp{}, fmt.Errorf("fetch added relations: %w", err)
+	}
+	if resp.Removed, resp.NextRemoved, err = a.repo.FetchRelations(ctx, removed); err != nil {
+		return DiffRelationsResp{}, fmt.Errorf("fetch removed relations: %w", err)
+	}
+
+	return resp, nil
+}
+
+// maxPairs is 100 objects checked in both directions
+const maxPairs = 200
+
+// maxCellRelations is how many relations of a pair a matrix cell lists at most, newest first
+const maxCellRelations = 10
+
+type CheckRelationsParams struct {
+	// either pairs, or subject with objects
+	Pairs   []repo.RelationPair `json:"pairs"`
+	Subject string              `json:"subject"`
+	Objects []string            `json:"objects"`
+	// out (default) checks subject to objects, in objects to subject, both checks each object both ways
+	Direction string   `json:"direction"`
+	Providers []string `json:"providers"`
+	Kinds     []string `json:"kinds"`
+	// lists up to maxCellRelations newest active relations of each pair, cells only tell existence otherwise
+	WithRelations bool `json:"withRelations"`
+}
+
+type CheckRelationsResp struct {
+	// a cell per requested pair in the same order, repeated pairs included.
+	// With both directions out and in pairs of each object go in turn
+	Matrix []RelationsCell `json:"matrix"`
+}
+
+type RelationsCell struct {
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Exists    bool             `json:"exists"`
+	Relations []types.Relation `json:"relations,omitempty"` // newest active relations from to, if requested
+}
+
+// CheckRelations reports which of the pairs have active relations. Reads are bounded by number of pairs:
+// a single lookup, and one per pair it left short if some pairs crowded others out of it
+func (a API) CheckRelations(ctx context.Context, params CheckRelationsParams) (CheckRelationsResp, error) {
+	pairs, err := relationPairs(params)
+	if err != nil {
+		return CheckRelationsResp{}, err
+	}
+	if len(pairs) > maxPairs {
+		return CheckRelationsResp{}, fmt.Errorf("too many pairs, max is %d", maxPairs)
+	}
+	if len(pairs) == 0 {
+		return CheckRelationsResp{Matrix: []RelationsCell{}}, nil
+	}
+
+	if err := validateKinds(params.Kinds); err != nil {
+		return CheckRelationsResp{}, err
+	}
+
+	// existence takes a single relation of a pair
+	perCell := 1
+	if params.WithRelations {
+		perCell = maxCellRelations
+	}
+
+	unique := uniquePairs(pairs)
+	q := repo.RelationsQuery{
+		Pairs:     unique,
+		Providers: params.Providers,
+		Kinds:     params.Kinds,
+		Status:    repo.RelationsActive,
+		Sort:      repo.SortInserted,
+		Order:     repo.OrderDesc,
+		Limit:     uint(len(unique) * perCell),
+	}
+
+	relations, next, err := a.repo.FetchRelations(ctx, q)
+	if err != nil {
+		return CheckRelationsResp{}, fmt.Errorf("fetch relations: %w", err)
+	}
+	byPair := relationsByPair(relations, perCell)
+
+	// pairs with many relations filled the page, ones short of a full cell may have more past it
+	if next != "" {
+		for _, p := range unique {
+			if len(byPair[p]) == perCell {
+				continue
+			}
+
+			pq := q
+			pq.Pairs, pq.Limit = []repo.RelationPair{p}, uint(perCell)
+			if byPair[p], _, err = a.repo.FetchRelations(ctx, pq); err != nil {
+				return CheckRelationsResp{}, fmt.Errorf("fetch relations: %w", err)
 			}
-		}),
-	}, nil
+		}
+	}
+
+	return CheckRelationsResp{Matrix: relationsMatrix(pairs, byPair, params.WithRelations)}, nil
+}
+
+// relationPairs returns pairs params check, in the requested order, duplicates included
+func relationPairs(params CheckRelationsParams) ([]repo.RelationPair, error) {
+	pairs := params.Pairs
+	switch {
+	case len(params.Pairs) > 0 && (params.Subject != "" || len(params.Objects) > 0):
+		return nil, fmt.Errorf("pairs and subject are exclusive")
+	case params.Subject == "" && len(params.Objects) > 0:
+		return nil, fmt.Errorf("subject is required")
+	case len(params.Objects) > maxPairs:
+		return nil, fmt.Errorf("too many objects, max is %d", maxPairs)
+	}
+
+	switch params.Direction {
+	case "", "out", "in", "both":
+	default:
+		return nil, fmt.Errorf("invalid direction")
+	}
+
+	for _, object := range params.Objects {
+		out := repo.RelationPair{From: params.Subject, To: object}
+		in := repo.RelationPair{From: object, To: params.Subject}
+		switch params.Direction {
+		case "in":
+			pairs = append(pairs, in)
+		case "both":
+			pairs = append(pairs, out, in)
+		default:
+			pairs = append(pairs, out)
+		}
+	}
+
+	for _, p := range pairs {
+		if p.From == "" || p.To == "" {
+			return nil, fmt.Errorf("pair needs from and to")
+		}
+	}
+	return pairs, nil
+}
+
+// uniquePairs drops repeated pairs, so each one is looked up once
+func uniquePairs(pairs []repo.RelationPair) []repo.RelationPair {
+	seen := make(map[repo.RelationPair]struct{}, len(pairs))
+	unique := make([]repo.RelationPair, 0, len(pairs))
+	for _, p := range pairs {
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		unique = append(unique, p)
+	}
+	return unique
+}
+
+// relationsByPair files up to perCell relations under their pairs, keeping order of relations within a pair
+func relationsByPair(relations []types.Relation, perCell int) map[repo.RelationPair][]types.Relation {
+	byPair := make(map[repo.RelationPair][]types.Relation)
+	for _, r := range relations {
+		p := repo.RelationPair{From: r.From, To: r.To}
+		if len(byPair[p]) < perCell {
+			byPair[p] = append(byPair[p], r)
+		}
+	}
+	return byPair
+}
+
+// relationsMatrix makes a cell of each pair, listing its relations only if withRelations is set
+func relationsMatrix(pairs []repo.RelationPair, byPair map[repo.RelationPair][]types.Relation, withRelations bool) []RelationsCell {
+	matrix := make([]RelationsCell, 0, len(pairs))
+	for _, p := range pairs {
+		cell := RelationsCell{From: p.From, To: p.To, Exists: len(byPair[p]) > 0}
+		if withRelations {
+			cell.Relations = byPair[p]
+		}
+		matrix = append(matrix, cell)
+	}
+	return matrix
+}
+
+// relationsPoint returns point of either slot or time, nil if neither is set
+func relationsPoint(slot uint64, t *time.Time) (*repo.Point, error) {
+	switch {
+	case slot != 0 && t != nil:
+		return nil, fmt.Errorf("slot and time are exclusive")
+	case slot != 0:
+		return &repo.Point{Slot: slot}, nil
+	case t != nil:
+		return &repo.Point{Time: t}, nil
+	default:
+		return nil, nil
+	}
+}
+
+const (
+	maxKinds       = 10
+	maxExtraFields = 10
+)
+
+func validateKinds(kinds []string) error {
+	if len(kinds) > maxKinds {
+		return fmt.Errorf("too many kinds, max is %d", maxKinds)
+	}
+	for _, kind := range kinds {
+		if !graph.ValidKind(kind) {
+			return fmt.Errorf("invalid kind %q", kind)
+		}
+	}
+	return nil
+}
+
+// validateExtraFields keeps filter to plain field names and scalar values, which every store compares alike
+func validateExtraFields(fields map[string]any) error {
+	if len(fields) > maxExtraFields {
+		return fmt.Errorf("too many extra fields, max is %d", maxExtraFields)
+	}
+
+	for name, value := range fields {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		}) >= 0 {
+			return fmt.Errorf("invalid extra field %q", name)
+		}
+
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			return fmt.Errorf("extra field %s: value must be a string, number or boolean", name)
+		}
+	}
+	return nil
+}
+
+type GetCountersParams struct {
+	Address string `json:"address"`
+}
+
+func (a API) GetCounters(ctx context.Context, params GetCountersParams) (types.Counters, error) {
+	if params.Address == "" {
+		return types.Counters{}, fmt.Errorf("address is required")
+	}
+
+	counters, err := a.repo.FetchCounters(ctx, []string{params.Address})
+	if err != nil {
+		return types.Counters{}, fmt.Errorf("fetch counters: %w", err)
+	}
+
+	return counters[0], nil
+}
+
+type GetCountersBatchParams struct {
+	Addresses []string `json:"addresses"`
+}
+
+type GetCountersBatchResp struct {
+	// in the same order as requested addresses
+	Counters []types.Counters `json:"counters"`
+}
+
+func (a API) GetCountersBatch(ctx context.Context, params GetCountersBatchParams) (GetCountersBatchResp, error) {
+	if len(params.Addresses) > 100 {
+		return GetCountersBatchResp{}, fmt.Errorf("too many addresses")
+	}
+	if len(params.Addresses) == 0 {
+		return GetCountersBatchResp{Counters: []types.Counters{}}, nil
+	}
+
+	counters, err := a.repo.FetchCounters(ctx, params.Addresses)
+	if err != nil {
+		return GetCountersBatchResp{}, fmt.Errorf("fetch counters: %w", err)
+	}
+
+	return GetCountersBatchResp{Counters: counters}, nil
+}
+
+type GetLedgerParams struct {
+	Providers []string `json:"providers"`
+}
+
+type GetLedgerResp struct {
+	Ledger []types.LedgerEntry `json:"ledger"`
+}
+
+func (a API) GetLedger(ctx context.Context, params GetLedgerParams) (GetLedgerResp, error) {
+	if len(params.Providers) > 100 {
+		return GetLedgerResp{}, fmt.Errorf("too many providers")
+	}
+
+	ledger, err := a.repo.FetchLedger(ctx, params.Providers)
+	if err != nil {
+		return GetLedgerResp{}, fmt.Errorf("fetch ledger: %w", err)
+	}
+
+	return GetLedgerResp{Ledger: ledger}, nil
+}
+
+type FindSkippedParams struct {
+	Provider string `json:"provider"`
+	After    string `json:"after"` // position of the last skipped relation of previous page
+	Limit    uint   `json:"limit"`
+}
+
+type FindSkippedResp struct {
+	Skipped []types.SkippedRelation `json:"skipped"`
+}
+
+func (a API) FindSkipped(ctx context.Context, params FindSkippedParams) (FindSkippedResp, error) {
+	if params.Provider == "" {
+		return FindSkippedResp{}, fmt.Errorf("provider is required")
+	}
+	if params.Limit == 0 {
+		params.Limit = 100
+	}
+	if params.Limit > 1000 {
+		return FindSkippedResp{}, fmt.Errorf("invalid limit")
+	}
+
+	skipped, err := a.repo.FetchSkipped(ctx, params.Provider, params.After, params.Limit)
+	if err != nil {
+		return FindSkippedResp{}, fmt.Errorf("fetch skipped relations: %w", err)
+	}
+
+	return FindSkippedResp{Skipped: skipped}, nil
+}
+
+type GetTreesParams struct{}
+
+type GetTreesResp struct {
+	Trees []types.Tree `json:"trees"`
+}
+
+func (a API) GetTrees(ctx context.Context, _ GetTreesParams) (GetTreesResp, error) {
+	trees, err := a.repo.FetchTrees(ctx)
+	if err != nil {
+		return GetTreesResp{}, fmt.Errorf("fetch trees: %w", err)
+	}
+
+	return GetTreesResp{Trees: trees}, nil
+}
+
+type GetEventsParams struct {
+	Actor             string    `json:"actor"`
+	Target            string    `json:"target"`
+	Providers         []string  `json:"providers"`
+	Since             time.Time `json:"since"`
+	Until             time.Time `json:"until"`
+	IncludeUnverified bool      `json:"includeUnverified"`
+	// nextCursor of the previous page
+	After string `json:"after"`
+	Limit uint   `json:"limit"`
+}
+
+type GetEventsResp struct {
+	Events     []types.Event `json:"events"`
+	NextCursor string        `json:"nextCursor,omitempty"` // empty on the last page
+}
+
+func (a API) FindEvents(ctx context.Context, params GetEventsParams) (GetEventsResp, error) {
+	if params.Limit == 0 {
+		params.Limit = 100
+	}
+	if params.Limit > 1000 {
+		return GetEventsResp{}, fmt.Errorf("invalid limit")
+	}
+
+	events, next, err := a.repo.FetchEvents(ctx, repo.EventsQuery{
+		Actor:             params.Actor,
+		Target:            params.Target,
+		Providers:         params.Providers,
+		Since:             params.Since,
+		Until:             params.Until,
+		IncludeUnverified: params.IncludeUnverified,
+		After:             params.After,
+		Limit:             params.Limit,
+	})
+	if err != nil {
+		return GetEventsResp{}, fmt.Errorf("fetch events: %w", err)
+	}
+
+	return GetEventsResp{Events: events, NextCursor: next}, nil
 }
 
 func sliceMap[T, U any](input []T, f func(T) U) []U {
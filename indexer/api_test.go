@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+func TestRelationsMatrix(t *testing.T) {
+	pairs, err := relationPairs(CheckRelationsParams{Subject: "viewer", Objects: []string{"a", "b", "a"}, Direction: "both"})
+	if err != nil {
+		t.Fatalf("relationPairs() error = %v", err)
+	}
+	out, in := repo.RelationPair{From: "viewer", To: "a"}, repo.RelationPair{From: "a", To: "viewer"}
+	want := []repo.RelationPair{out, in, {From: "viewer", To: "b"}, {From: "b", To: "viewer"}, out, in}
+	if !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("relationPairs() = %v, want %v", pairs, want)
+	}
+	// repeated pairs are looked up once
+	if unique := uniquePairs(pairs); !reflect.DeepEqual(unique, want[:4]) {
+		t.Errorf("uniquePairs() = %v, want %v", unique, want[:4])
+	}
+
+	follow := types.Relation{From: "viewer", To: "a", Provider: "p1"}
+	subscribe := types.Relation{From: "viewer", To: "a", Provider: "p2"}
+	back := types.Relation{From: "b", To: "viewer", Provider: "p1"}
+
+	got := relationsMatrix(pairs, relationsByPair([]types.Relation{follow, back, subscribe}, 10), true)
+	wantMatrix := []RelationsCell{
+		{From: "viewer", To: "a", Exists: true, Relations: []types.Relation{follow, subscribe}},
+		{From: "a", To: "viewer"},
+		{From: "viewer", To: "b"},
+		{From: "b", To: "viewer", Exists: true, Relations: []types.Relation{back}},
+		{From: "viewer", To: "a", Exists: true, Relations: []types.Relation{follow, subscribe}},
+		{From: "a", To: "viewer"},
+	}
+	if !reflect.DeepEqual(got, wantMatrix) {
+		t.Errorf("relationsMatrix() = %+v, want %+v", got, wantMatrix)
+	}
+
+	for _, params := range []CheckRelationsParams{
+		{Pairs: []repo.RelationPair{{From: "a", To: "b"}}, Subject: "viewer"},
+		{Objects: []string{"a"}},
+		{Subject: "viewer", Objects: []string{"a"}, Direction: "sideways"},
+		{Pairs: []repo.RelationPair{{From: "a"}}},
+	} {
+		if _, err := relationPairs(params); err == nil {
+			t.Errorf("relationPairs(%+v) error = nil, want error", params)
+		}
+	}
+}
+
+// countingStore counts relations read through it
+type countingStore struct {
+	Store
+	read int
+}
+
+func (s *countingStore) FetchRelations(ctx context.Context, q repo.RelationsQuery) ([]types.Relation, string, error) {
+	relations, next, err := s.Store.FetchRelations(ctx, q)
+	s.read += len(relations)
+	return relations, next, err
+}
+
+func TestCheckRelationsBoundsReads(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBolt(t)
+
+	// older relation of a quiet pair, then a busy pair
+	leafIndex := uint32(0)
+	relations := []types.Relation{{From: "c", To: "d", Provider: "p", Tree: "t", LeafIndex: &leafIndex, ConnectedAt: time.Unix(1, 0)}}
+	for i := 1; i <= 50; i++ {
+		leafIndex := uint32(i)
+		relations = append(relations, types.Relation{From: "a", To: "b", Provider: "p", Tree: "t", LeafIndex: &leafIndex,
+			ConnectedAt: time.Unix(int64(i), 0)})
+	}
+	if err := store.SaveRelations(ctx, relations); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		withRelations bool
+		listed        []int // relations listed by cells
+		maxRead       int
+	}{
+		{false, []int{0, 0, 0}, 3 + 3},
+		{true, []int{maxCellRelations, 1, 0}, 3*maxCellRelations + 3*maxCellRelations},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(fmt.Sprintf("withRelations %v", tt.withRelations), func(t *testing.T) {
+			counting := &countingStore{Store: store}
+			resp, err := NewAPI(counting).CheckRelations(ctx, CheckRelationsParams{
+				Pairs:         []repo.RelationPair{{From: "a", To: "b"}, {From: "c", To: "d"}, {From: "e", To: "f"}},
+				WithRelations: tt.withRelations,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			exists := sliceMap(resp.Matrix, func(c RelationsCell) bool { return c.Exists })
+			if want := []bool{true, true, false}; !reflect.DeepEqual(exists, want) {
+				t.Errorf("exists = %v, want %v", exists, want)
+			}
+			listed := sliceMap(resp.Matrix, func(c RelationsCell) int { return len(c.Relations) })
+			if !reflect.DeepEqual(listed, tt.listed) {
+				t.Errorf("listed relations = %v, want %v", listed, tt.listed)
+			}
+			if counting.read > tt.maxRead {
+				t.Errorf("read %d relations, want at most %d", counting.read, tt.maxRead)
+			}
+		})
+	}
+}
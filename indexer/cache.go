@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-pkgz/lgr"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// cachedStore serves relation lookups through cache. Writes of relations invalidate lookups they affect
+type cachedStore struct {
+	Store
+	cache RelationsCache
+	l     lgr.L
+
+	// fetches relations on cache miss. Has to see every write invalidation was made for,
+	// otherwise stale relations are cached under the fresh version until ttl
+	fill func(ctx context.Context, q repo.RelationsQuery) ([]types.Relation, string, error)
+}
+
+func newCachedStore(store Store, cache RelationsCache, l lgr.L) cachedStore {
+	fill := store.FetchRelations
+	// API reads may go to lagging secondaries
+	if m, ok := store.(repo.Mongo); ok {
+		fill = m.PrimaryReads().FetchRelations
+	}
+	return cachedStore{store, cache, l, fill}
+}
+
+func (s cachedStore) FetchRelations(ctx context.Context, q repo.RelationsQuery) ([]types.Relation, string, error) {
+	return s.cache.FetchRelations(ctx, q, func() ([]types.Relation, string, error) {
+		return s.fill(ctx, q)
+	})
+}
+
+func (s cachedStore) SaveRelations(ctx context.Context, relations []types.Relation) error {
+	if err := s.Store.SaveRelations(ctx, relations); err != nil {
+		return err
+	}
+
+	// relations are saved already, failing the write would make it retried and duplicated.
+	// stale entries live until ttl
+	if err := s.cache.Invalidate(ctx, relations); err != nil {
+		s.l.Logf("[ERROR] %v", err)
+	}
+	return nil
+}
+
+func (s cachedStore) UpdateRelations(ctx context.Context, updates []types.RelationUpdate) ([]types.Relation, error) {
+	updated, err := s.Store.UpdateRelations(ctx, updates)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.cache.Invalidate(ctx, updated); err != nil {
+		s.l.Logf("[ERROR] %v", err)
+	}
+	return updated, nil
+}
+
+func (s cachedStore) RebuildProjections(ctx context.Context, build func(repo.Projections) error) error {
+	if err := s.Store.RebuildProjections(ctx, build); err != nil {
+		return err
+	}
+	return s.cache.InvalidateAll(ctx)
+}
+
+func (s cachedStore) CacheStats() repo.CacheStats {
+	return s.cache.Stats()
+}
+
+func reportCacheStats(l lgr.L, stats repo.CacheStats) {
+	ratio := 0.0
+	if total := stats.Hits + stats.Misses; total > 0 {
+		ratio = float64(stats.Hits) / float64(total) * 100
+	}
+	l.Logf("[INFO] relations cache: hits = %d; misses = %d; hit ratio = %.1f%%", stats.Hits, stats.Misses, ratio)
+}
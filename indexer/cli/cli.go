@@ -89,24 +89,31 @@ func (r RPC) fetchBlocks(keys []uint64) ([]Block, []error) {
 		block := resp.Result
 
 		txs := make([]Tx, 0, len(block.Transactions))
+		var failed []FailedTx
 
-		for _, btx := range block.Transactions {
-			tx, include, err := TxFromBlockTransaction(r.l, btx)
+		for j := range block.Transactions {
+			btx := &block.Transactions[j]
+
+			tx, include, err := TxFromBlockTransaction(r.l, *btx)
 			if err != nil {
-				errors[i] = err
+				// don't fail the whole block because of a single transaction
+				failed = append(failed, FailedTx{Raw: btx, Err: err})
 				continue
 			}
 
 			if include {
+				tx.Raw = btx
 				txs = append(txs, tx)
 			}
 		}
 
 		results[i] = Block{
+			Slot:         keys[i],
 			ParentSlot:   block.ParentSlot,
 			BlockTime:    block.BlockTime,
 			Blockhash:    block.Blockhash,
 			Transactions: txs,
+			Failed:       failed,
 		}
 	}
 
@@ -132,20 +139,34 @@ type TokenBalanceChange struct {
 //easyjson:skip
 type Tx struct {
 	TxHash     string
+	Signers    []common.PublicKey
 	Meta       TxMeta
 	Insts      []types.Instruction
 	InnerInsts map[int][]types.Instruction
+
+	// transaction as it was received from rpc
+	Raw *BlockRawTransaction
+}
+
+// Transaction that could not be parsed
+//
+//easyjson:skip
+type FailedTx struct {
+	Raw *BlockRawTransaction
+	Err error
 }
 
 // Parsed block
 //
 //easyjson:skip
 type Block struct {
+	Slot       uint64
 	ParentSlot uint64
 	BlockTime  uint64
 	Blockhash  string
 
 	Transactions []Tx
+	Failed       []FailedTx
 }
 
 type generaResponse struct {
@@ -179,6 +200,21 @@ type BlockRawTransaction struct {
 	Version     any       `json:"version"`
 }
 
+// Signature is the first signature of transaction, read straight from its wire format, so it's known
+// even when the rest fails to parse. Empty if it can't be read
+func (t BlockRawTransaction) Signature() string {
+	raw, err := base64.StdEncoding.DecodeString(t.Transaction[0])
+	if err != nil || len(raw) < 1+64 {
+		return ""
+	}
+
+	// signatures are prefixed by compact-u16 count, which is a single byte below 128
+	if n := raw[0]; n == 0 || n >= 0x80 {
+		return ""
+	}
+	return base58.Encode(raw[1 : 1+64])
+}
+
 type txMeta struct {
 	Err               any                               `json:"err"`
 	Fee               uint64                            `json:"fee"`
@@ -290,6 +326,34 @@ func (r RPC) GetLatestBlock(ctx context.Context) (uint64, error) {
 	return res.AbsoluteSlot, nil
 }
 
+type getGenesisHashRpcResponse struct {
+	generaResponse
+	Result string `json:"result"`
+}
+
+// GetGenesisHash returns hash of genesis block, which identifies the cluster
+func (r RPC) GetGenesisHash(ctx context.Context) (string, error) {
+	resp, err := r.batchRequest(ctx, call{method: "getGenesisHash"})
+	if err != nil {
+		return "", fmt.Errorf("get genesis hash: %w", err)
+	}
+	defer resp.Close()
+
+	var response []getGenesisHashRpcResponse
+
+	if err := json.NewDecoder(resp).Decode(&response); err != nil {
+		return "", fmt.Errorf("unmarshal genesis hash: %w", err)
+	}
+	if len(response) == 0 {
+		return "", fmt.Errorf("get genesis hash: empty response")
+	}
+	if response[0].Error != nil {
+		return "", fmt.Errorf("get genesis hash: %v", response[0].Error)
+	}
+
+	return response[0].Result, nil
+}
+
 type commitmentConfig struct {
 	Commitment rpc.Commitment `json:"commitment"`
 }
@@ -411,13 +475,15 @@ func TxFromBlockTransaction(l lgr.L, blockTx BlockRawTransaction) (transaction T
 
 	balanceChanges := parseSolChange(meta, tx.Message.Accounts)
 
+	// token balances are nice to have, they must never make us drop the transaction
 	tokenBalanceChanges, err := parseTokenChange(l, meta, tx.Message.Accounts)
 	if err != nil {
-		return handleErr(fmt.Errorf("parse token balance changes: %w", err))
+		l.Logf("[WARN] parse token balance changes of %s: %v", txHash, err)
 	}
 
 	return Tx{
-		TxHash: txHash,
+		TxHash:  txHash,
+		Signers: signers(tx.Message),
 		Meta: TxMeta{
 			BalanceChanges:      balanceChanges,
 			TokenBalanceChanges: tokenBalanceChanges,
@@ -428,6 +494,14 @@ func TxFromBlockTransaction(l lgr.L, blockTx BlockRawTransaction) (transaction T
 	}, true, nil
 }
 
+func signers(m types.Message) []common.PublicKey {
+	n := int(m.Header.NumRequireSignatures)
+	if n > len(m.Accounts) {
+		n = len(m.Accounts)
+	}
+	return m.Accounts[:n]
+}
+
 func decompileInnerInstructions(meta txMeta, tx types.Transaction) map[int][]types.Instruction {
 	result := make(map[int][]types.Instruction, len(meta.InnerInstructions))
 
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/go-pkgz/lgr"
+)
+
+// extraDecoder turns Extra of relations into fields, stored and returned next to the raw bytes
+type extraDecoder interface {
+	decode(extra []byte) (map[string]any, error)
+}
+
+// extraDecoderConfig configures decoder of a single provider. Decoders are configured in a file
+// mapping provider addresses to them, paths are relative to the file
+//
+//	{
+//	  "s1gsZrDJAXNYSCRhQZk5X3mYyBjAmaVBTYnNhCzj8t2": {"format": "json"},
+//	  "HS1pxuGdbkHs6kAX9h1DZ2hQ48pWFZhqaVFqVhqMyPb": {"format": "borsh", "idl": "idl/nft.json", "type": "FollowExtra"},
+//	  "9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin": {"format": "protobuf", "message": {"fields": [
+//	    {"number": 1, "name": "kind", "type": "string"},
+//	    {"number": 2, "name": "tags", "type": "string", "repeated": true}
+//	  ]}}
+//	}
+type extraDecoderConfig struct {
+	Format string `json:"format"` // json, borsh or protobuf
+
+	// borsh: anchor idl and name of struct among its types or accounts
+	IDL  string `json:"idl"`
+	Type string `json:"type"`
+
+	// protobuf: schema of the message
+	Message *protoMessage `json:"message"`
+}
+
+// extraDecoders is registry of decoders by provider. Nil registry decodes nothing
+type extraDecoders struct {
+	l          lgr.L
+	byProvider map[string]extraDecoder
+}
+
+func loadExtraDecoders(l lgr.L, path string) (*extraDecoders, error) {
+	handleErr := func(err error) (*extraDecoders, error) {
+		return nil, fmt.Errorf("load extra decoders %s: %w", path, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var configs map[string]extraDecoderConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return handleErr(err)
+	}
+
+	d := &extraDecoders{l: l, byProvider: make(map[string]extraDecoder, len(configs))}
+	for provider, cfg := range configs {
+		decoder, err := newExtraDecoder(cfg, filepath.Dir(path))
+		if err != nil {
+			return handleErr(fmt.Errorf("provider %s: %w", provider, err))
+		}
+		d.byProvider[provider] = decoder
+	}
+
+	l.Logf("[INFO] loaded extra decoders of %d providers", len(d.byProvider))
+	return d, nil
+}
+
+func newExtraDecoder(cfg extraDecoderConfig, dir string) (extraDecoder, error) {
+	switch cfg.Format {
+	case "json":
+		return jsonExtra{}, nil
+
+	case "borsh":
+		path := cfg.IDL
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read idl: %w", err)
+		}
+		return newBorshExtra(data, cfg.Type)
+
+	case "protobuf":
+		if cfg.Message == nil {
+			return nil, fmt.Errorf("message schema is required")
+		}
+		if err := cfg.Message.validate(0); err != nil {
+			return nil, err
+		}
+		return protobufExtra{cfg.Message}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown format %q", cfg.Format)
+	}
+}
+
+// decode returns fields of provider's relation extra, nil when provider has no decoder or extra doesn't fit it
+func (d *extraDecoders) decode(provider string, extra []byte) map[string]any {
+	if d == nil {
+		return nil
+	}
+
+	decoder, ok := d.byProvider[provider]
+	if !ok {
+		return nil
+	}
+
+	fields, err := decoder.decode(extra)
+	if err != nil {
+		d.l.Logf("[WARN] decode extra of provider %s: %v", provider, err)
+		return nil
+	}
+	return fields
+}
+
+var errShortExtra = errors.New("extra is too short")
+
+// jsonExtra is extra holding a JSON object
+type jsonExtra struct{}
+
+func (jsonExtra) decode(extra []byte) (map[string]any, error) {
+	var fields map[string]any
+	if err := json.Unmarshal(extra, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, fmt.Errorf("extra is not an object")
+	}
+	return fields, nil
+}
+
+// maxSafeInt is the largest integer JSON consumers represent exactly
+const maxSafeInt = 1<<53 - 1
+
+// decodedInt keeps integers numbers while they are exact in JSON, larger ones become decimal strings
+func decodedInt(v int64) any {
+	if v > maxSafeInt || v < -maxSafeInt {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+func decodedUint(v uint64) any {
+	if v > maxSafeInt {
+		return fmt.Sprint(v)
+	}
+	return int64(v)
+}
+
+func decodedFloat(v float64) any {
+	// NaN and infinities have no JSON form
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprint(v)
+	}
+	return v
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"unicode/utf8"
+
+	"github.com/mr-tron/base58"
+)
+
+// borshExtra is extra serialized with borsh as a struct of anchor idl
+type borshExtra struct {
+	root borshType
+}
+
+// idl is the part of anchor idl describing types
+type idl struct {
+	Types    []idlTypeDef `json:"types"`
+	Accounts []idlTypeDef `json:"accounts"`
+}
+
+type idlTypeDef struct {
+	Name string `json:"name"`
+	Type struct {
+		Kind     string       `json:"kind"` // struct or enum
+		Fields   []idlField   `json:"fields"`
+		Variants []idlVariant `json:"variants"`
+	} `json:"type"`
+}
+
+type idlField struct {
+	Name string          `json:"name"`
+	Type json.RawMessage `json:"type"`
+}
+
+// idlVariant has either named fields, or types of tuple fields
+type idlVariant struct {
+	Name   string            `json:"name"`
+	Fields []json.RawMessage `json:"fields"`
+}
+
+// idl types nest no deeper, which also rejects recursive ones
+const maxBorshDepth = 32
+
+func newBorshExtra(data []byte, typeName string) (borshExtra, error) {
+	var doc idl
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return borshExtra{}, fmt.Errorf("parse idl: %w", err)
+	}
+
+	defs := make(map[string]idlTypeDef)
+	for _, def := range append(doc.Types, doc.Accounts...) {
+		defs[def.Name] = def
+	}
+
+	def, ok := defs[typeName]
+	if !ok {
+		return borshExtra{}, fmt.Errorf("type %q is not in idl", typeName)
+	}
+	if def.Type.Kind != "struct" {
+		return borshExtra{}, fmt.Errorf("type %q is not a struct", typeName)
+	}
+
+	root, err := compileBorshDef(def, defs, 0)
+	if err != nil {
+		return borshExtra{}, fmt.Errorf("type %q: %w", typeName, err)
+	}
+
+	return borshExtra{root}, nil
+}
+
+func (b borshExtra) decode(extra []byte) (map[string]any, error) {
+	r := &borshReader{data: extra}
+
+	v := b.root.read(r)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+
+	return v.(map[string]any), nil
+}
+
+// borshType reads a value of idl type. Errors stick to reader
+type borshType interface {
+	read(r *borshReader) any
+}
+
+type (
+	borshPrimitive func(r *borshReader) any
+	borshVec       struct{ elem borshType }
+	borshOption    struct{ elem borshType }
+	borshArray     struct {
+		elem borshType
+		len  int
+	}
+	borshStruct struct{ fields []borshField }
+	borshEnum   struct{ variants []borshVariant }
+)
+
+type borshField struct {
+	name string
+	typ  borshType
+}
+
+// borshVariant without fields is decoded as its name, with fields as {name: fields}
+type borshVariant struct {
+	name   string
+	fields borshType // nil, borshStruct or borshTuple
+}
+
+type borshTuple []borshType
+
+var borshPrimitives = map[string]borshPrimitive{
+	"bool": func(r *borshReader) any {
+		switch r.byte() {
+		case 0:
+			return false
+		case 1:
+			return true
+		default:
+			r.fail(errors.New("invalid bool"))
+			return nil
+		}
+	},
+	"u8":  func(r *borshReader) any { return decodedUint(uint64(r.byte())) },
+	"i8":  func(r *borshReader) any { return decodedInt(int64(int8(r.byte()))) },
+	"u16": func(r *borshReader) any { return decodedUint(uint64(r.uint(2))) },
+	"i16": func(r *borshReader) any { return decodedInt(int64(int16(r.uint(2)))) },
+	"u32": func(r *borshReader) any { return decodedUint(uint64(r.uint(4))) },
+	"i32": func(r *borshReader) any { return decodedInt(int64(int32(r.uint(4)))) },
+	"u64": func(r *borshReader) any { return decodedUint(r.uint(8)) },
+	"i64": func(r *borshReader) any { return decodedInt(int64(r.uint(8))) },
+	"u128": func(r *borshReader) any {
+		return r.int128(false)
+	},
+	"i128": func(r *borshReader) any {
+		return r.int128(true)
+	},
+	"f32": func(r *borshReader) any { return decodedFloat(float64(math.Float32frombits(uint32(r.uint(4))))) },
+	"f64": func(r *borshReader) any { return decodedFloat(math.Float64frombits(r.uint(8))) },
+	"string": func(r *borshReader) any {
+		b := r.bytes()
+		if r.err == nil && !utf8.Valid(b) {
+			r.fail(errors.New("string is not valid utf-8"))
+		}
+		return string(b)
+	},
+	"bytes": func(r *borshReader) any { return r.bytes() },
+	"publicKey": func(r *borshReader) any {
+		key := r.next(32)
+		if key == nil {
+			return nil
+		}
+		return base58.Encode(key)
+	},
+}
+
+func compileBorshType(raw json.RawMessage, defs map[string]idlTypeDef, depth int) (borshType, error) {
+	if depth > maxBorshDepth {
+		return nil, errors.New("types are nested too deep")
+	}
+
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		p, ok := borshPrimitives[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type %q", name)
+		}
+		return p, nil
+	}
+
+	var composite struct {
+		Vec     json.RawMessage   `json:"vec"`
+		Option  json.RawMessage   `json:"option"`
+		Array   []json.RawMessage `json:"array"`
+		Defined string            `json:"defined"`
+	}
+	if err := json.Unmarshal(raw, &composite); err != nil {
+		return nil, fmt.Errorf("invalid type %s", raw)
+	}
+
+	switch {
+	case composite.Vec != nil:
+		elem, err := compileBorshType(composite.Vec, defs, depth+1)
+		return borshVec{elem}, err
+
+	case composite.Option != nil:
+		elem, err := compileBorshType(composite.Option, defs, depth+1)
+		return borshOption{elem}, err
+
+	case composite.Array != nil:
+		var n int
+		if len(composite.Array) != 2 || json.Unmarshal(composite.Array[1], &n) != nil || n < 0 {
+			return nil, fmt.Errorf("invalid array %s", raw)
+		}
+		elem, err := compileBorshType(composite.Array[0], defs, depth+1)
+		return borshArray{elem, n}, err
+
+	case composite.Defined != "":
+		def, ok := defs[composite.Defined]
+		if !ok {
+			return nil, fmt.Errorf("type %q is not in idl", composite.Defined)
+		}
+		return compileBorshDef(def, defs, depth+1)
+
+	default:
+		return nil, fmt.Errorf("invalid type %s", raw)
+	}
+}
+
+func compileBorshDef(def idlTypeDef, defs map[string]idlTypeDef, depth int) (borshType, error) {
+	switch def.Type.Kind {
+	case "struct":
+		return compileBorshFields(def.Type.Fields, defs, depth)
+
+	case "enum":
+		var enum borshEnum
+		for _, v := range def.Type.Variants {
+			variant := borshVariant{name: v.Name}
+			if len(v.Fields) > 0 {
+				var err error
+				if variant.fields, err = compileBorshVariantFields(v.Fields, defs, depth); err != nil {
+					return nil, fmt.Errorf("variant %s: %w", v.Name, err)
+				}
+			}
+			enum.variants = append(enum.variants, variant)
+		}
+		return enum, nil
+
+	default:
+		return nil, fmt.Errorf("type %q has unsupported kind %q", def.Name, def.Type.Kind)
+	}
+}
+
+func compileBorshFields(fields []idlField, defs map[string]idlTypeDef, depth int) (borshStruct, error) {
+	var s borshStruct
+	for _, f := range fields {
+		typ, err := compileBorshType(f.Type, defs, depth+1)
+		if err != nil {
+			return borshStruct{}, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		s.fields = append(s.fields, borshField{f.Name, typ})
+	}
+	return s, nil
+}
+
+// compileBorshVariantFields tells named fields from tuple ones by the first of them
+func compileBorshVariantFields(fields []json.RawMessage, defs map[string]idlTypeDef, depth int) (borshType, error) {
+	var named idlField
+	if json.Unmarshal(fields[0], &named) == nil && named.Name != "" {
+		idlFields := make([]idlField, len(fields))
+		for i, raw := range fields {
+			if err := json.Unmarshal(raw, &idlFields[i]); err != nil {
+				return nil, err
+			}
+		}
+		return compileBorshFields(idlFields, defs, depth)
+	}
+
+	var tuple borshTuple
+	for _, raw := range fields {
+		typ, err := compileBorshType(raw, defs, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		tuple = append(tuple, typ)
+	}
+	return tuple, nil
+}
+
+func (p borshPrimitive) read(r *borshReader) any { return p(r) }
+
+func (v borshVec) read(r *borshReader) any {
+	n := r.uint(4)
+	// every element takes at least a byte, so no huge allocations here
+	if n > uint64(len(r.data)) {
+		r.fail(errShortExtra)
+		return nil
+	}
+	items := make([]any, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		items = append(items, v.elem.read(r))
+	}
+	return items
+}
+
+func (o borshOption) read(r *borshReader) any {
+	switch r.byte() {
+	case 0:
+		return nil
+	case 1:
+		return o.elem.read(r)
+	default:
+		r.fail(errors.New("invalid option tag"))
+		return nil
+	}
+}
+
+func (a borshArray) read(r *borshReader) any {
+	items := make([]any, 0, a.len)
+	for i := 0; i < a.len && r.err == nil; i++ {
+		items = append(items, a.elem.read(r))
+	}
+	return items
+}
+
+func (s borshStruct) read(r *borshReader) any {
+	fields := make(map[string]any, len(s.fields))
+	for _, f := range s.fields {
+		fields[f.name] = f.typ.read(r)
+	}
+	return fields
+}
+
+func (t borshTuple) read(r *borshReader) any {
+	items := make([]any, len(t))
+	for i, typ := range t {
+		items[i] = typ.read(r)
+	}
+	return items
+}
+
+func (e borshEnum) read(r *borshReader) any {
+	i := int(r.byte())
+	if r.err != nil {
+		return nil
+	}
+	if i >= len(e.variants) {
+		r.fail(fmt.Errorf("invalid enum variant %d", i))
+		return nil
+	}
+
+	v := e.variants[i]
+	if v.fields == nil {
+		return v.name
+	}
+	return map[string]any{v.name: v.fields.read(r)}
+}
+
+// borshReader reads borsh data. First error sticks, subsequent reads return zero values
+type borshReader struct {
+	data []byte
+	err  error
+}
+
+func (r *borshReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *borshReader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.fail(errShortExtra)
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *borshReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// uint reads little endian unsigned integer of n bytes, n is up to 8
+func (r *borshReader) uint(n uint64) uint64 {
+	b := r.next(n)
+	if b == nil {
+		return 0
+	}
+	var buf [8]byte
+	copy(buf[:], b)
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// int128 reads 128-bit integer as decimal string
+func (r *borshReader) int128(signed bool) any {
+	b := r.next(16)
+	if b == nil {
+		return nil
+	}
+
+	be := make([]byte, 16)
+	for i := range b {
+		be[15-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if signed && be[0]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), 128))
+	}
+	return v.String()
+}
+
+func (r *borshReader) bytes() []byte {
+	n := r.uint(4)
+	return append([]byte{}, r.next(n)...)
+}
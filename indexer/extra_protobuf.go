@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// protobufExtra is extra serialized as protobuf message. Schema is given in config rather than as compiled
+// descriptor, the way message is declared in .proto file
+type protobufExtra struct {
+	message *protoMessage
+}
+
+type protoMessage struct {
+	Fields []protoField `json:"fields"`
+}
+
+type protoField struct {
+	Number   uint64        `json:"number"`
+	Name     string        `json:"name"`
+	Type     string        `json:"type"` // scalar type of .proto, enum or message
+	Repeated bool          `json:"repeated"`
+	Message  *protoMessage `json:"message"` // schema of message type
+}
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// wireTypes of scalar types, length delimited ones are not packable
+var protoWireTypes = map[string]uint64{
+	"int32": wireVarint, "int64": wireVarint, "uint32": wireVarint, "uint64": wireVarint,
+	"sint32": wireVarint, "sint64": wireVarint, "bool": wireVarint, "enum": wireVarint,
+	"fixed64": wireFixed64, "sfixed64": wireFixed64, "double": wireFixed64,
+	"fixed32": wireFixed32, "sfixed32": wireFixed32, "float": wireFixed32,
+	"string": wireBytes, "bytes": wireBytes, "message": wireBytes,
+}
+
+// messages nest no deeper
+const maxProtoDepth = 32
+
+func (m *protoMessage) validate(depth int) error {
+	if depth > maxProtoDepth {
+		return errors.New("messages are nested too deep")
+	}
+
+	names := make(map[string]bool)
+	numbers := make(map[uint64]bool)
+	for _, f := range m.Fields {
+		if f.Name == "" || names[f.Name] {
+			return fmt.Errorf("field %d: name is empty or not unique", f.Number)
+		}
+		if f.Number == 0 || f.Number >= 1<<29 || numbers[f.Number] {
+			return fmt.Errorf("field %s: number is invalid or not unique", f.Name)
+		}
+		names[f.Name], numbers[f.Number] = true, true
+
+		if _, ok := protoWireTypes[f.Type]; !ok {
+			return fmt.Errorf("field %s: unsupported type %q", f.Name, f.Type)
+		}
+		if (f.Type == "message") != (f.Message != nil) {
+			return fmt.Errorf("field %s: message schema goes with message type only", f.Name)
+		}
+		if f.Message != nil {
+			if err := f.Message.validate(depth + 1); err != nil {
+				return fmt.Errorf("field %s: %w", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p protobufExtra) decode(extra []byte) (map[string]any, error) {
+	return p.message.decode(extra)
+}
+
+func (m *protoMessage) decode(data []byte) (map[string]any, error) {
+	fields := make(map[string]any)
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid field key")
+		}
+		data = data[n:]
+
+		number, wireType := key>>3, key&7
+
+		var value []byte
+		switch wireType {
+		case wireVarint:
+			_, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("invalid varint")
+			}
+			value, data = data[:n], data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, errShortExtra
+			}
+			value, data = data[:8], data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, errShortExtra
+			}
+			value, data = data[:4], data[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return nil, errShortExtra
+			}
+			value, data = data[n:n+int(l)], data[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", wireType)
+		}
+
+		f, ok := m.field(number)
+		if !ok {
+			// unknown fields are skipped, as protobuf does
+			continue
+		}
+
+		values, err := f.decode(wireType, value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+
+		if f.Repeated {
+			list, _ := fields[f.Name].([]any)
+			fields[f.Name] = append(list, values...)
+		} else if len(values) > 0 {
+			// last one wins for singular fields
+			fields[f.Name] = values[len(values)-1]
+		}
+	}
+
+	return fields, nil
+}
+
+func (m *protoMessage) field(number uint64) (protoField, bool) {
+	for _, f := range m.Fields {
+		if f.Number == number {
+			return f, true
+		}
+	}
+	return protoField{}, false
+}
+
+// decode returns values of a field record, several of them for packed repeated scalars
+func (f protoField) decode(wireType uint64, value []byte) ([]any, error) {
+	expected := protoWireTypes[f.Type]
+
+	if wireType == expected {
+		v, err := f.scalar(value)
+		if err != nil {
+			return nil, err
+		}
+		return []any{v}, nil
+	}
+
+	if wireType != wireBytes || expected == wireBytes || !f.Repeated {
+		return nil, fmt.Errorf("unexpected wire type %d", wireType)
+	}
+
+	var values []any
+	for len(value) > 0 {
+		var n int
+		switch expected {
+		case wireVarint:
+			if _, n = binary.Uvarint(value); n <= 0 {
+				return nil, errors.New("invalid varint")
+			}
+		case wireFixed64:
+			n = 8
+		case wireFixed32:
+			n = 4
+		}
+		if n > len(value) {
+			return nil, errShortExtra
+		}
+
+		v, err := f.scalar(value[:n])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		value = value[n:]
+	}
+	return values, nil
+}
+
+// scalar decodes value of field's own wire type
+func (f protoField) scalar(value []byte) (any, error) {
+	varint, _ := binary.Uvarint(value)
+
+	switch f.Type {
+	case "int32", "enum":
+		return int64(int32(varint)), nil
+	case "int64":
+		return decodedInt(int64(varint)), nil
+	case "uint32":
+		return int64(uint32(varint)), nil
+	case "uint64":
+		return decodedUint(varint), nil
+	case "sint32":
+		return int64(int32(uint32(varint>>1) ^ -uint32(varint&1))), nil
+	case "sint64":
+		return decodedInt(int64(varint>>1) ^ -int64(varint&1)), nil
+	case "bool":
+		return varint != 0, nil
+	case "fixed64":
+		return decodedUint(binary.LittleEndian.Uint64(value)), nil
+	case "sfixed64":
+		return decodedInt(int64(binary.LittleEndian.Uint64(value))), nil
+	case "double":
+		return decodedFloat(math.Float64frombits(binary.LittleEndian.Uint64(value))), nil
+	case "fixed32":
+		return int64(binary.LittleEndian.Uint32(value)), nil
+	case "sfixed32":
+		return int64(int32(binary.LittleEndian.Uint32(value))), nil
+	case "float":
+		return decodedFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(value)))), nil
+	case "string":
+		if !utf8.Valid(value) {
+			return nil, errors.New("string is not valid utf-8")
+		}
+		return string(value), nil
+	case "bytes":
+		return append([]byte{}, value...), nil
+	case "message":
+		return f.Message.decode(value)
+	default:
+		return nil, fmt.Errorf("unsupported type %q", f.Type)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+const testIDL = `{
+	"types": [
+		{"name": "Kind", "type": {"kind": "enum", "variants": [
+			{"name": "Follow"},
+			{"name": "Subscribe", "fields": [{"name": "tier", "type": "u8"}]}
+		]}}
+	],
+	"accounts": [
+		{"name": "FollowExtra", "type": {"kind": "struct", "fields": [
+			{"name": "kind", "type": {"defined": "Kind"}},
+			{"name": "note", "type": {"option": "string"}},
+			{"name": "weight", "type": "u64"},
+			{"name": "tags", "type": {"vec": "u16"}}
+		]}}
+	]
+}`
+
+func TestExtraDecoders(t *testing.T) {
+	borsh, err := newBorshExtra([]byte(testIDL), "FollowExtra")
+	if err != nil {
+		t.Fatalf("newBorshExtra() error = %v", err)
+	}
+
+	proto := &protoMessage{Fields: []protoField{
+		{Number: 1, Name: "kind", Type: "string"},
+		{Number: 2, Name: "tags", Type: "uint32", Repeated: true},
+		{Number: 3, Name: "delta", Type: "sint64"},
+	}}
+	if err := proto.validate(0); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		decoder extraDecoder
+		extra   []byte
+		want    map[string]any
+		wantErr bool
+	}{
+		{"json object", jsonExtra{}, []byte(`{"kind":"follow","weight":2}`), map[string]any{"kind": "follow", "weight": 2.0}, false},
+		{"json array", jsonExtra{}, []byte(`[1,2]`), nil, true},
+		{"json null", jsonExtra{}, []byte(`null`), nil, true},
+		{
+			"borsh",
+			borsh,
+			[]byte{1, 3, 1, 2, 0, 0, 0, 'h', 'i', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0, 7, 0},
+			map[string]any{
+				"kind":   map[string]any{"Subscribe": map[string]any{"tier": int64(3)}},
+				"note":   "hi",
+				"weight": "18446744073709551615",
+				"tags":   []any{int64(7)},
+			},
+			false,
+		},
+		{
+			"borsh unit variant and none",
+			borsh,
+			[]byte{0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			map[string]any{"kind": "Follow", "note": nil, "weight": int64(5), "tags": []any{}},
+			false,
+		},
+		{"borsh short", borsh, []byte{0, 0, 5}, nil, true},
+		{"borsh trailing bytes", borsh, []byte{0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, nil, true},
+		{"borsh invalid variant", borsh, []byte{2}, nil, true},
+		{"borsh huge vec", borsh, []byte{0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}, nil, true},
+		{
+			"protobuf",
+			protobufExtra{proto},
+			// kind, packed tags, unpacked tag, unknown field 9, delta = -2
+			[]byte{0x0a, 2, 'h', 'i', 0x12, 2, 1, 2, 0x10, 3, 0x48, 1, 0x18, 3},
+			map[string]any{"kind": "hi", "tags": []any{int64(1), int64(2), int64(3)}, "delta": int64(-2)},
+			false,
+		},
+		{"protobuf truncated", protobufExtra{proto}, []byte{0x0a, 5, 'h'}, nil, true},
+		{"protobuf wrong wire type", protobufExtra{proto}, []byte{0x08, 1}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.decoder.decode(tt.extra)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decode() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBorshExtraRejectsRecursiveTypes(t *testing.T) {
+	idl := `{"types": [{"name": "Node", "type": {"kind": "struct", "fields": [
+		{"name": "next", "type": {"option": {"defined": "Node"}}}
+	]}}]}`
+
+	if _, err := newBorshExtra([]byte(idl), "Node"); err == nil {
+		t.Error("newBorshExtra() error = nil, want error")
+	}
+}
+
+func TestDecodeExtraKind(t *testing.T) {
+	const provider = "s1gsZrDJAXNYSCRhQZk5X3mYyBjAmaVBTYnNhCzj8t2"
+	d := decoded{extras: &extraDecoders{byProvider: map[string]extraDecoder{provider: jsonExtra{}}}}
+
+	extra, err := graph.EncodeKind("flag/spam", []byte(`{"reason":"ads"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kind, fields := d.decodeExtra(provider, extra)
+	if kind != "flag/spam" || !reflect.DeepEqual(fields, map[string]any{"reason": "ads"}) {
+		t.Errorf("decodeExtra() = %q, %v", kind, fields)
+	}
+
+	// without kind header extra is payload as a whole
+	kind, fields = d.decodeExtra(provider, []byte(`{"reason":"ads"}`))
+	if kind != "" || !reflect.DeepEqual(fields, map[string]any{"reason": "ads"}) {
+		t.Errorf("decodeExtra() = %q, %v", kind, fields)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/portto/solana-go-sdk/common"
+
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+// ingestRules decide which relations are indexed. Relation is skipped when it matches any deny rule,
+// or when there are allow rules and it matches none of them. Empty rules index everything
+//
+//	{
+//	  "allow": {"providers": ["s1gsZrDJAXNYSCRhQZk5X3mYyBjAmaVBTYnNhCzj8t2"], "from": [], "to": []},
+//	  "deny": {"providers": [], "from": [], "to": []}
+//	}
+type ingestRules struct {
+	Allow ruleSet `json:"allow"`
+	Deny  ruleSet `json:"deny"`
+}
+
+// ruleSet matches relation by any of its lists
+type ruleSet struct {
+	Providers []string `json:"providers"`
+	From      []string `json:"from"`
+	To        []string `json:"to"`
+}
+
+func (s ruleSet) empty() bool {
+	return len(s.Providers) == 0 && len(s.From) == 0 && len(s.To) == 0
+}
+
+func (s ruleSet) matches(r graph.Relation) bool {
+	return contains(s.Providers, r.Provider.ToBase58()) ||
+		contains(s.From, r.From.ToBase58()) ||
+		contains(s.To, r.To.ToBase58())
+}
+
+func (r ingestRules) allows(rel graph.Relation) bool {
+	if r.Deny.matches(rel) {
+		return false
+	}
+	return r.Allow.empty() || r.Allow.matches(rel)
+}
+
+// ingestFilter holds rules loaded from file. Rules are reloaded when file changes, without restart
+type ingestFilter struct {
+	l    lgr.L
+	path string
+
+	rules atomic.Pointer[ingestRules]
+
+	mu      sync.Mutex // guards reloads
+	modTime time.Time
+}
+
+func loadIngestFilter(l lgr.L, path string) (*ingestFilter, error) {
+	f := &ingestFilter{l: l, path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Allows reports whether relation should be indexed. Nil filter allows everything
+func (f *ingestFilter) Allows(r graph.Relation) bool {
+	if f == nil {
+		return true
+	}
+	return f.rules.Load().allows(r)
+}
+
+// Reload rereads rules if file has changed since the last load. Broken file keeps previous rules
+func (f *ingestFilter) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("reload ingest rules: %w", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	return f.reload()
+}
+
+func (f *ingestFilter) reload() error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("load ingest rules %s: %w", f.path, err)
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var rules ingestRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return handleErr(err)
+	}
+
+	for _, list := range [][]string{
+		rules.Allow.Providers, rules.Allow.From, rules.Allow.To,
+		rules.Deny.Providers, rules.Deny.From, rules.Deny.To,
+	} {
+		for _, key := range list {
+			// invalid keys would silently never match
+			if common.PublicKeyFromString(key).ToBase58() != key {
+				return handleErr(fmt.Errorf("invalid public key %q", key))
+			}
+		}
+	}
+
+	f.rules.Store(&rules)
+	f.modTime = info.ModTime()
+
+	f.l.Logf("[INFO] loaded ingest rules: allow %d providers, %d from, %d to; deny %d providers, %d from, %d to",
+		len(rules.Allow.Providers), len(rules.Allow.From), len(rules.Allow.To),
+		len(rules.Deny.Providers), len(rules.Deny.From), len(rules.Deny.To))
+	return nil
+}
+
+func contains[T comparable](items []T, item T) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/portto/solana-go-sdk/common"
+
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+func TestIngestRulesAllows(t *testing.T) {
+	var (
+		alice    = "3iiJ2Zk1SBGyRpydWEQ5Zp2tAn3pASbgdBkjqyeoCdhu"
+		bob      = "9xQeWvG816bUx9EPjHmaT23yvVM2ZWbrrpZb9PusVFin"
+		usersig  = "s1gsZrDJAXNYSCRhQZk5X3mYyBjAmaVBTYnNhCzj8t2"
+		hmnNFT   = "HS1pxuGdbkHs6kAX9h1DZ2hQ48pWFZhqaVFqVhqMyPb"
+		relation = func(from, to, provider string) graph.Relation {
+			return graph.Relation{
+				From:     common.PublicKeyFromString(from),
+				To:       common.PublicKeyFromString(to),
+				Provider: common.PublicKeyFromString(provider),
+			}
+		}
+	)
+
+	tests := []struct {
+		name  string
+		rules ingestRules
+		rel   graph.Relation
+		want  bool
+	}{
+		{"empty rules", ingestRules{}, relation(alice, bob, usersig), true},
+		{"allowed provider", ingestRules{Allow: ruleSet{Providers: []string{usersig}}}, relation(alice, bob, usersig), true},
+		{"not allowed provider", ingestRules{Allow: ruleSet{Providers: []string{usersig}}}, relation(alice, bob, hmnNFT), false},
+		{"allowed by to", ingestRules{Allow: ruleSet{Providers: []string{usersig}, To: []string{bob}}}, relation(alice, bob, hmnNFT), true},
+		{"denied from", ingestRules{Deny: ruleSet{From: []string{alice}}}, relation(alice, bob, usersig), false},
+		{
+			"deny wins over allow",
+			ingestRules{Allow: ruleSet{Providers: []string{usersig}}, Deny: ruleSet{To: []string{bob}}},
+			relation(alice, bob, usersig),
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rules.allows(tt.rel); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-pkgz/lgr"
+
+	"github.com/sgraph-protocol/sgraph/indexer/mocks"
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+)
+
+// harvestOnce runs harvester until the first enqueue attempt
+func harvestOnce(t *testing.T, rpc *mocks.RpcMock, redis *mocks.RedisMock) error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	enqueue := redis.EnqueueBlocksFunc
+	redis.EnqueueBlocksFunc = func(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+		cancel()
+		return enqueue(ctx, blocks, lastSeen)
+	}
+
+	h, err := NewBlockHarvester(lgr.NoOp, rpc, redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h.HarvestBlocks(ctx)
+}
+
+func TestHarvestBlocksCheckpointsWithEnqueue(t *testing.T) {
+	rpc := &mocks.RpcMock{
+		GetBlocksWithLimitFunc: func(ctx context.Context, from, limit uint64) ([]uint64, error) {
+			return []uint64{from, from + 1, from + 3}, nil
+		},
+	}
+	redis := &mocks.RedisMock{
+		GetLastSeenBlockFunc: func(ctx context.Context) (uint64, error) {
+			return 100, nil
+		},
+		EnqueueBlocksFunc: func(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+			return nil
+		},
+	}
+
+	if err := harvestOnce(t, rpc, redis); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	calls := redis.EnqueueBlocksCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected single enqueue, got %d", len(calls))
+	}
+	if want := []uint64{100, 101, 103}; !reflect.DeepEqual(calls[0].Blocks, want) {
+		t.Errorf("enqueued %v, want %v", calls[0].Blocks, want)
+	}
+	if calls[0].LastSeen != 104 {
+		t.Errorf("checkpoint %d, want 104", calls[0].LastSeen)
+	}
+}
+
+func TestHarvestBlocksStartsFromLatest(t *testing.T) {
+	rpc := &mocks.RpcMock{
+		GetLatestBlockFunc: func(ctx context.Context) (uint64, error) {
+			return 500, nil
+		},
+		GetBlocksWithLimitFunc: func(ctx context.Context, from, limit uint64) ([]uint64, error) {
+			return nil, nil
+		},
+	}
+	redis := &mocks.RedisMock{
+		GetLastSeenBlockFunc: func(ctx context.Context) (uint64, error) {
+			return 0, nil
+		},
+		EnqueueBlocksFunc: func(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+			return nil
+		},
+	}
+
+	if err := harvestOnce(t, rpc, redis); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if calls := rpc.GetBlocksWithLimitCalls(); len(calls) != 1 || calls[0].From != 500 {
+		t.Fatalf("expected blocks to be fetched from latest block, got %+v", calls)
+	}
+
+	// checkpoint is saved even without new blocks, so restart doesn't skip ahead
+	calls := redis.EnqueueBlocksCalls()
+	if len(calls) != 1 || len(calls[0].Blocks) != 0 || calls[0].LastSeen != 500 {
+		t.Fatalf("unexpected enqueue calls: %+v", calls)
+	}
+}
+
+func TestHarvestBlocksStopsOnEnqueueError(t *testing.T) {
+	rpc := &mocks.RpcMock{
+		GetBlocksWithLimitFunc: func(ctx context.Context, from, limit uint64) ([]uint64, error) {
+			return []uint64{from}, nil
+		},
+	}
+	redis := &mocks.RedisMock{
+		GetLastSeenBlockFunc: func(ctx context.Context) (uint64, error) {
+			return 10, nil
+		},
+		EnqueueBlocksFunc: func(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+			return fmt.Errorf("enqueue blocks: %w", repo.ErrCheckpointRegress)
+		},
+	}
+
+	if err := harvestOnce(t, rpc, redis); !errors.Is(err, repo.ErrCheckpointRegress) {
+		t.Fatalf("expected checkpoint regress error, got %v", err)
+	}
+
+	if n := len(redis.EnqueueBlocksCalls()); n != 1 {
+		t.Fatalf("expected harvester to stop after failed enqueue, got %d calls", n)
+	}
+}
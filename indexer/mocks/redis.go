@@ -7,6 +7,8 @@ import (
 	"context"
 	"sync"
 	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
 )
 
 // RedisMock is a mock implementation of main.Redis.
@@ -21,6 +23,12 @@ import (
 //			AddBlocksFunc: func(ctx context.Context, blocks []uint64) error {
 //				panic("mock out the AddBlocks method")
 //			},
+//			CheckpointFunc: func(ctx context.Context) (repo.Checkpoint, error) {
+//				panic("mock out the Checkpoint method")
+//			},
+//			EnqueueBlocksFunc: func(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+//				panic("mock out the EnqueueBlocks method")
+//			},
 //			FetchStreamEventsFunc: func(ctx context.Context, consumerID string, batchSize uint) (map[string]uint64, error) {
 //				panic("mock out the FetchStreamEvents method")
 //			},
@@ -30,8 +38,11 @@ import (
 //			GetLastSeenBlockFunc: func(ctx context.Context) (uint64, error) {
 //				panic("mock out the GetLastSeenBlock method")
 //			},
-//			SaveLastSeenBlockFunc: func(ctx context.Context, block uint64) error {
-//				panic("mock out the SaveLastSeenBlock method")
+//			StreamHealthFunc: func(ctx context.Context) (repo.StreamHealth, error) {
+//				panic("mock out the StreamHealth method")
+//			},
+//			TrimStreamFunc: func(ctx context.Context) error {
+//				panic("mock out the TrimStream method")
 //			},
 //		}
 //
@@ -46,6 +57,12 @@ type RedisMock struct {
 	// AddBlocksFunc mocks the AddBlocks method.
 	AddBlocksFunc func(ctx context.Context, blocks []uint64) error
 
+	// CheckpointFunc mocks the Checkpoint method.
+	CheckpointFunc func(ctx context.Context) (repo.Checkpoint, error)
+
+	// EnqueueBlocksFunc mocks the EnqueueBlocks method.
+	EnqueueBlocksFunc func(ctx context.Context, blocks []uint64, lastSeen uint64) error
+
 	// FetchStreamEventsFunc mocks the FetchStreamEvents method.
 	FetchStreamEventsFunc func(ctx context.Context, consumerID string, batchSize uint) (map[string]uint64, error)
 
@@ -55,8 +72,11 @@ type RedisMock struct {
 	// GetLastSeenBlockFunc mocks the GetLastSeenBlock method.
 	GetLastSeenBlockFunc func(ctx context.Context) (uint64, error)
 
-	// SaveLastSeenBlockFunc mocks the SaveLastSeenBlock method.
-	SaveLastSeenBlockFunc func(ctx context.Context, block uint64) error
+	// StreamHealthFunc mocks the StreamHealth method.
+	StreamHealthFunc func(ctx context.Context) (repo.StreamHealth, error)
+
+	// TrimStreamFunc mocks the TrimStream method.
+	TrimStreamFunc func(ctx context.Context) error
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -74,6 +94,20 @@ type RedisMock struct {
 			// Blocks is the blocks argument value.
 			Blocks []uint64
 		}
+		// Checkpoint holds details about calls to the Checkpoint method.
+		Checkpoint []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+		// EnqueueBlocks holds details about calls to the EnqueueBlocks method.
+		EnqueueBlocks []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Blocks is the blocks argument value.
+			Blocks []uint64
+			// LastSeen is the lastSeen argument value.
+			LastSeen uint64
+		}
 		// FetchStreamEvents holds details about calls to the FetchStreamEvents method.
 		FetchStreamEvents []struct {
 			// Ctx is the ctx argument value.
@@ -99,20 +133,26 @@ type RedisMock struct {
 			// Ctx is the ctx argument value.
 			Ctx context.Context
 		}
-		// SaveLastSeenBlock holds details about calls to the SaveLastSeenBlock method.
-		SaveLastSeenBlock []struct {
+		// StreamHealth holds details about calls to the StreamHealth method.
+		StreamHealth []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+		// TrimStream holds details about calls to the TrimStream method.
+		TrimStream []struct {
 			// Ctx is the ctx argument value.
 			Ctx context.Context
-			// Block is the block argument value.
-			Block uint64
 		}
 	}
 	lockAcknowledgeBlocks sync.RWMutex
 	lockAddBlocks         sync.RWMutex
+	lockCheckpoint        sync.RWMutex
+	lockEnqueueBlocks     sync.RWMutex
 	lockFetchStreamEvents sync.RWMutex
 	lockFindStaleBlocks   sync.RWMutex
 	lockGetLastSeenBlock  sync.RWMutex
-	lockSaveLastSeenBlock sync.RWMutex
+	lockStreamHealth      sync.RWMutex
+	lockTrimStream        sync.RWMutex
 }
 
 // AcknowledgeBlocks calls AcknowledgeBlocksFunc.
@@ -187,6 +227,78 @@ func (mock *RedisMock) AddBlocksCalls() []struct {
 	return calls
 }
 
+// Checkpoint calls CheckpointFunc.
+func (mock *RedisMock) Checkpoint(ctx context.Context) (repo.Checkpoint, error) {
+	if mock.CheckpointFunc == nil {
+		panic("RedisMock.CheckpointFunc: method is nil but Redis.Checkpoint was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockCheckpoint.Lock()
+	mock.calls.Checkpoint = append(mock.calls.Checkpoint, callInfo)
+	mock.lockCheckpoint.Unlock()
+	return mock.CheckpointFunc(ctx)
+}
+
+// CheckpointCalls gets all the calls that were made to Checkpoint.
+// Check the length with:
+//
+//	len(mockedRedis.CheckpointCalls())
+func (mock *RedisMock) CheckpointCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockCheckpoint.RLock()
+	calls = mock.calls.Checkpoint
+	mock.lockCheckpoint.RUnlock()
+	return calls
+}
+
+// EnqueueBlocks calls EnqueueBlocksFunc.
+func (mock *RedisMock) EnqueueBlocks(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+	if mock.EnqueueBlocksFunc == nil {
+		panic("RedisMock.EnqueueBlocksFunc: method is nil but Redis.EnqueueBlocks was just called")
+	}
+	callInfo := struct {
+		Ctx      context.Context
+		Blocks   []uint64
+		LastSeen uint64
+	}{
+		Ctx:      ctx,
+		Blocks:   blocks,
+		LastSeen: lastSeen,
+	}
+	mock.lockEnqueueBlocks.Lock()
+	mock.calls.EnqueueBlocks = append(mock.calls.EnqueueBlocks, callInfo)
+	mock.lockEnqueueBlocks.Unlock()
+	return mock.EnqueueBlocksFunc(ctx, blocks, lastSeen)
+}
+
+// EnqueueBlocksCalls gets all the calls that were made to EnqueueBlocks.
+// Check the length with:
+//
+//	len(mockedRedis.EnqueueBlocksCalls())
+func (mock *RedisMock) EnqueueBlocksCalls() []struct {
+	Ctx      context.Context
+	Blocks   []uint64
+	LastSeen uint64
+} {
+	var calls []struct {
+		Ctx      context.Context
+		Blocks   []uint64
+		LastSeen uint64
+	}
+	mock.lockEnqueueBlocks.RLock()
+	calls = mock.calls.EnqueueBlocks
+	mock.lockEnqueueBlocks.RUnlock()
+	return calls
+}
+
 // FetchStreamEvents calls FetchStreamEventsFunc.
 func (mock *RedisMock) FetchStreamEvents(ctx context.Context, consumerID string, batchSize uint) (map[string]uint64, error) {
 	if mock.FetchStreamEventsFunc == nil {
@@ -303,38 +415,66 @@ func (mock *RedisMock) GetLastSeenBlockCalls() []struct {
 	return calls
 }
 
-// SaveLastSeenBlock calls SaveLastSeenBlockFunc.
-func (mock *RedisMock) SaveLastSeenBlock(ctx context.Context, block uint64) error {
-	if mock.SaveLastSeenBlockFunc == nil {
-		panic("RedisMock.SaveLastSeenBlockFunc: method is nil but Redis.SaveLastSeenBlock was just called")
+// StreamHealth calls StreamHealthFunc.
+func (mock *RedisMock) StreamHealth(ctx context.Context) (repo.StreamHealth, error) {
+	if mock.StreamHealthFunc == nil {
+		panic("RedisMock.StreamHealthFunc: method is nil but Redis.StreamHealth was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockStreamHealth.Lock()
+	mock.calls.StreamHealth = append(mock.calls.StreamHealth, callInfo)
+	mock.lockStreamHealth.Unlock()
+	return mock.StreamHealthFunc(ctx)
+}
+
+// StreamHealthCalls gets all the calls that were made to StreamHealth.
+// Check the length with:
+//
+//	len(mockedRedis.StreamHealthCalls())
+func (mock *RedisMock) StreamHealthCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockStreamHealth.RLock()
+	calls = mock.calls.StreamHealth
+	mock.lockStreamHealth.RUnlock()
+	return calls
+}
+
+// TrimStream calls TrimStreamFunc.
+func (mock *RedisMock) TrimStream(ctx context.Context) error {
+	if mock.TrimStreamFunc == nil {
+		panic("RedisMock.TrimStreamFunc: method is nil but Redis.TrimStream was just called")
 	}
 	callInfo := struct {
-		Ctx   context.Context
-		Block uint64
+		Ctx context.Context
 	}{
-		Ctx:   ctx,
-		Block: block,
+		Ctx: ctx,
 	}
-	mock.lockSaveLastSeenBlock.Lock()
-	mock.calls.SaveLastSeenBlock = append(mock.calls.SaveLastSeenBlock, callInfo)
-	mock.lockSaveLastSeenBlock.Unlock()
-	return mock.SaveLastSeenBlockFunc(ctx, block)
+	mock.lockTrimStream.Lock()
+	mock.calls.TrimStream = append(mock.calls.TrimStream, callInfo)
+	mock.lockTrimStream.Unlock()
+	return mock.TrimStreamFunc(ctx)
 }
 
-// SaveLastSeenBlockCalls gets all the calls that were made to SaveLastSeenBlock.
+// TrimStreamCalls gets all the calls that were made to TrimStream.
 // Check the length with:
 //
-//	len(mockedRedis.SaveLastSeenBlockCalls())
-func (mock *RedisMock) SaveLastSeenBlockCalls() []struct {
-	Ctx   context.Context
-	Block uint64
+//	len(mockedRedis.TrimStreamCalls())
+func (mock *RedisMock) TrimStreamCalls() []struct {
+	Ctx context.Context
 } {
 	var calls []struct {
-		Ctx   context.Context
-		Block uint64
+		Ctx context.Context
 	}
-	mock.lockSaveLastSeenBlock.RLock()
-	calls = mock.calls.SaveLastSeenBlock
-	mock.lockSaveLastSeenBlock.RUnlock()
+	mock.lockTrimStream.RLock()
+	calls = mock.calls.TrimStream
+	mock.lockTrimStream.RUnlock()
 	return calls
 }
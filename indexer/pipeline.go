@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/cli"
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// pipelineCfg sets concurrency of each processing stage.
+// Stages are connected with channels of `prefetch` capacity, so a slow stage
+// eventually blocks the ones before it (and reading from the stream) instead of
+// piling up batches in memory
+type pipelineCfg struct {
+	fetchers int
+	decoders int
+	writers  int
+	prefetch int
+}
+
+// batch is a unit of work passed between pipeline stages
+type batch struct {
+	events map[repo.EventID]uint64
+	ids    []uint64
+
+	// filled by fetch stage
+	blocks []cli.Block
+	failed []uint64 // blocks we failed to fetch
+
+	// filled by decode stage
+	txs []decodedTx
+
+	// transactions we failed to decode, filled by decode stage
+	quarantined []types.QuarantinedTx
+}
+
+// processed returns blocks of the batch that were fetched
+func (b *batch) processed() []uint64 {
+	var processed []uint64
+	for _, id := range b.ids {
+		if !contains(b.failed, id) {
+			processed = append(processed, id)
+		}
+	}
+	return processed
+}
+
+type decodedTx struct {
+	slot uint64
+	tx   cli.Tx
+	decoded
+}
+
+const staleTimeout = time.Minute * 4
+
+// Run processes blocks from the stream until ctx is cancelled.
+// Stream is read -> blocks are fetched from rpc -> decoded -> written -> ack'ed.
+// Once ctx is cancelled reading stops, and batches that are already in flight are processed to the end
+func (p *Processor) Run(ctx context.Context, consumerID string, cfg pipelineCfg) {
+	read := make(chan *batch, cfg.prefetch)
+	fetched := make(chan *batch, cfg.prefetch)
+	decoded := make(chan *batch, cfg.prefetch)
+	written := make(chan *batch, cfg.prefetch)
+
+	var wg sync.WaitGroup
+	spawn := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
+	spawn(func() { p.readStream(ctx, consumerID, read) })
+	spawn(func() { p.stage("fetch", cfg.fetchers, read, fetched, p.fetchBatch) })
+	spawn(func() { p.stage("decode", cfg.decoders, fetched, decoded, p.decodeBatch) })
+	spawn(func() { p.stage("write", cfg.writers, decoded, written, p.writeBatch) })
+	spawn(func() { p.stage("ack", 1, written, nil, p.ackBatch) })
+
+	wg.Wait()
+}
+
+// readStream pulls stale and new blocks from the stream. Closes out on exit
+func (p *Processor) readStream(pctx context.Context, consumerID string, out chan<- *batch) {
+	defer close(out)
+
+	for {
+		select {
+		case <-pctx.Done():
+			return
+		default:
+		}
+
+		// manage separate context cancellation to gracefully process remaining batches
+		ctx := context.Background()
+
+		b, err := p.readBatch(ctx, consumerID)
+		if err != nil {
+			p.l.Logf("[ERROR] occured while reading blocks: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if b == nil {
+			continue
+		}
+
+		p.watermark.read(b.ids)
+		out <- b
+	}
+}
+
+func (p *Processor) readBatch(ctx context.Context, consumerID string) (*batch, error) {
+	const batchSize = 20
+
+	staleBatch, err := p.redis.FindStaleBlocks(ctx, consumerID, staleTimeout, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("await new transaction events: %w", err)
+	}
+
+	if len(staleBatch) > 0 {
+		p.l.Logf("[WARN] found some stale blocks: %v", values(staleBatch))
+	}
+
+	remaining := uint(batchSize - len(staleBatch))
+
+	events, err := p.redis.FetchStreamEvents(ctx, consumerID, remaining)
+	if err != nil {
+		return nil, fmt.Errorf("await new transaction events: %w", err)
+	}
+
+	// merge the two
+	for id, b := range staleBatch {
+		events[id] = b
+	}
+
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	return &batch{events: events, ids: values(events)}, nil
+}
+
+// stage runs f on `workers` goroutines and closes out once in is drained.
+// Batches f failed on are dropped: they are not ack'ed and will be picked up again as stale
+func (p *Processor) stage(name string, workers int, in <-chan *batch, out chan<- *batch, f func(context.Context, *batch) error) {
+	if out != nil {
+		defer close(out)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for b := range in {
+				if err := f(context.Background(), b); err != nil {
+					p.l.Logf("[ERROR] %s stage failed on blocks %v: %v", name, b.ids, err)
+					continue
+				}
+
+				if out != nil {
+					out <- b
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Processor) fetchBatch(ctx context.Context, b *batch) error {
+	now := time.Now()
+
+	const retries = 4 // 5 attemps in total
+
+	// batch rpc get transactions
+	blocks, failedIdx, err := p.rpc.GetBlocks(ctx, retries, b.ids...)
+	if err != nil {
+		return fmt.Errorf("get blocks: %w", err)
+	}
+
+	if len(failedIdx) != 0 {
+		b.failed = make([]uint64, len(failedIdx))
+
+		for i, f := range failedIdx {
+			b.failed[i] = b.ids[f]
+		}
+
+		p.l.Logf("failed to fetch blocks. Adding them to the back of the queue: %v", b.failed)
+
+		// failed blocks are zero-valued, don't pass them further
+		failed := make(map[int]bool, len(failedIdx))
+		for _, f := range failedIdx {
+			failed[f] = true
+		}
+
+		fetched := make([]cli.Block, 0, len(blocks)-len(failedIdx))
+		for i, block := range blocks {
+			if !failed[i] {
+				fetched = append(fetched, block)
+			}
+		}
+		blocks = fetched
+	}
+
+	p.l.Logf("[TRACE] got %d blocks from rpc in %dms", len(blocks), time.Since(now).Milliseconds())
+
+	b.blocks = blocks
+	return nil
+}
+
+func (p *Processor) decodeBatch(ctx context.Context, b *batch) error {
+	for _, block := range b.blocks {
+		for _, failed := range block.Failed {
+			p.l.Logf("[WARN] quarantining transaction in block %d: %v", block.Slot, failed.Err)
+			var signature string
+			if failed.Raw != nil {
+				signature = failed.Raw.Signature()
+			}
+			b.quarantined = append(b.quarantined, p.quarantine(block.Slot, signature, "decode", failed.Err, failed.Raw))
+		}
+
+		for i, tx := range block.Transactions {
+			d, err := p.decode(tx, block.Slot, block.BlockTime, i)
+			if err != nil {
+				p.l.Logf("[WARN] quarantining transaction %s: %v", tx.TxHash, err)
+				b.quarantined = append(b.quarantined, p.quarantine(block.Slot, tx.TxHash, "decode", err, tx.Raw))
+				continue
+			}
+
+			if d.empty() {
+				continue
+			}
+
+			b.txs = append(b.txs, decodedTx{block.Slot, tx, d})
+		}
+	}
+
+	// blocks are not needed anymore, let them be collected while batch waits for the writer
+	b.blocks = nil
+	return nil
+}
+
+// writeBatch saves results transaction by transaction, then transactions decode stage has quarantined.
+// Only decoding fails the same way every time, store errors fail the whole batch to be retried.
+// Writes are idempotent, so transactions saved before the failure are not saved twice by the retry.
+// Replayed blocks release transactions quarantined before, those failing again are quarantined anew
+func (p *Processor) writeBatch(ctx context.Context, b *batch) error {
+	for _, tx := range b.txs {
+		if err := p.writeTx(ctx, tx); err != nil {
+			return fmt.Errorf("write transaction %s: %w", tx.tx.TxHash, err)
+		}
+	}
+
+	if released := p.watermark.quarantinedAmong(b.processed()); len(released) > 0 {
+		if err := p.store.ReleaseQuarantine(ctx, released); err != nil {
+			return fmt.Errorf("release quarantine: %w", err)
+		}
+	}
+
+	if len(b.quarantined) == 0 {
+		return nil
+	}
+
+	if err := p.store.QuarantineTransactions(ctx, b.quarantined); err != nil {
+		return fmt.Errorf("quarantine transactions: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Processor) writeTx(ctx context.Context, tx decodedTx) error {
+	if len(tx.skipped) > 0 {
+		if err := p.store.SaveSkipped(ctx, tx.skipped); err != nil {
+			return fmt.Errorf("save skipped relations: %w", err)
+		}
+	}
+
+	// log is the source of truth, projections below can always be rebuilt from it
+	if len(tx.instructions) > 0 {
+		if err := p.store.SaveInstructions(ctx, tx.instructions); err != nil {
+			return fmt.Errorf("save instructions: %w", err)
+		}
+	}
+
+	// state is advanced even by skipped relations, their leaves are in the tree all the same
+	if len(tx.trees) > 0 {
+		p.l.Logf("New trees: %v", tx.trees)
+		if err := p.store.SaveTrees(ctx, tx.trees); err != nil {
+			return fmt.Errorf("save trees: %w", err)
+		}
+	}
+	if len(tx.treeStates) > 0 {
+		if err := p.store.AdvanceTrees(ctx, tx.treeStates); err != nil {
+			return fmt.Errorf("advance trees: %w", err)
+		}
+	}
+
+	// providers go first: events of the same transaction may need them for verification
+	if len(tx.providers) > 0 {
+		p.l.Logf("New providers: %v", tx.providers)
+		if err := p.store.SaveProviders(ctx, tx.providers); err != nil {
+			return fmt.Errorf("save providers: %w", err)
+		}
+	}
+
+	if len(tx.relations) > 0 {
+		p.l.Logf("New relations: %v", tx.relations)
+		if err := p.store.SaveRelations(ctx, tx.relations); err != nil {
+			return fmt.Errorf("save relations: %w", err)
+		}
+	}
+
+	// relation may be closed or edited by the transaction that adds it
+	if len(tx.updates) > 0 {
+		if _, err := p.store.UpdateRelations(ctx, tx.updates); err != nil {
+			return fmt.Errorf("update relations: %w", err)
+		}
+	}
+
+	if len(tx.events) > 0 {
+		if err := p.verifyEvents(ctx, tx.tx, tx.events); err != nil {
+			return fmt.Errorf("verify events: %w", err)
+		}
+
+		if err := p.store.SaveEvents(ctx, tx.events); err != nil {
+			return fmt.Errorf("save events: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// verifyEvents marks events not emitted by graph program as verified
+// if transaction is signed by authority of the provider
+func (p *Processor) verifyEvents(ctx context.Context, tx cli.Tx, events []types.Event) error {
+	var addresses []string
+	for _, e := range events {
+		if !e.Verified {
+			addresses = append(addresses, e.Provider)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	providers, err := p.store.FetchProviders(ctx, addresses)
+	if err != nil {
+		return err
+	}
+
+	authorities := make(map[string]string, len(providers))
+	for _, provider := range providers {
+		authorities[provider.Address] = provider.Authority
+	}
+
+	signers := make(map[string]bool, len(tx.Signers))
+	for _, s := range tx.Signers {
+		signers[s.ToBase58()] = true
+	}
+
+	for i, e := range events {
+		if authority, ok := authorities[e.Provider]; ok && signers[authority] {
+			events[i].Verified = true
+		}
+	}
+
+	return nil
+}
+
+func (p *Processor) quarantine(slot uint64, signature, stage string, cause error, raw *cli.BlockRawTransaction) types.QuarantinedTx {
+	q := types.QuarantinedTx{
+		Slot:          slot,
+		Signature:     signature,
+		Stage:         stage,
+		Error:         cause.Error(),
+		QuarantinedAt: time.Now(),
+	}
+
+	if raw != nil {
+		data, err := raw.MarshalJSON()
+		if err != nil {
+			p.l.Logf("[ERROR] marshal quarantined transaction: %v", err)
+		}
+		q.Raw = data
+	}
+
+	return q
+}
+
+func (p *Processor) ackBatch(ctx context.Context, b *batch) error {
+	if len(b.failed) > 0 {
+		if err := p.redis.AddBlocks(ctx, b.failed); err != nil {
+			return fmt.Errorf("adding failed blocks: %w", err)
+		}
+	}
+
+	if err := p.redis.AcknowledgeBlocks(ctx, keys(b.events)); err != nil {
+		return fmt.Errorf("aknowledge blocks: %w", err)
+	}
+
+	var latest uint64
+	for _, id := range b.ids {
+		if id > latest {
+			latest = id
+		}
+	}
+
+	p.watermark.quarantine(b.processed(), sliceMap(b.quarantined, func(q types.QuarantinedTx) uint64 { return q.Slot }))
+	p.watermark.processed(b.ids, b.failed)
+	storeMax(&p.lastProcessedBlock, latest)
+	atomic.AddUint64(&p.processedBlocksCount, uint64(len(b.ids)))
+
+	return nil
+}
+
+// storeMax raises value at addr to v, batches finish out of order and must not move it back
+func storeMax(addr *uint64, v uint64) {
+	for {
+		current := atomic.LoadUint64(addr)
+		if v <= current || atomic.CompareAndSwapUint64(addr, current, v) {
+			return
+		}
+	}
+}
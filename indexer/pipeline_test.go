@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/mr-tron/base58"
+
+	"github.com/sgraph-protocol/sgraph/indexer/cli"
+	"github.com/sgraph-protocol/sgraph/indexer/mocks"
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// testStream serves blocks 1 to last, a block per read, and records acknowledged ones
+type testStream struct {
+	mu          sync.Mutex
+	next, last  uint64
+	read, acked []uint64
+}
+
+func (s *testStream) redis() *mocks.RedisMock {
+	return &mocks.RedisMock{
+		FindStaleBlocksFunc: func(ctx context.Context, consumerID string, staleTimeout time.Duration, batchSize uint) (map[string]uint64, error) {
+			return map[string]uint64{}, nil
+		},
+		FetchStreamEventsFunc: func(ctx context.Context, consumerID string, batchSize uint) (map[string]uint64, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.next > s.last {
+				// real stream blocks while it's empty
+				time.Sleep(time.Millisecond)
+				return map[string]uint64{}, nil
+			}
+			slot := s.next
+			s.next++
+			s.read = append(s.read, slot)
+			return map[string]uint64{strconv.FormatUint(slot, 10): slot}, nil
+		},
+		AcknowledgeBlocksFunc: func(ctx context.Context, events []string) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			for _, e := range events {
+				slot, _ := strconv.ParseUint(e, 10, 64)
+				s.acked = append(s.acked, slot)
+			}
+			return nil
+		},
+	}
+}
+
+func (s *testStream) counts() (read, acked int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.read), len(s.acked)
+}
+
+func newTestProcessor(rpc RPC, redis Redis) *Processor {
+	return &Processor{l: lgr.NoOp, rpc: rpc, redis: redis, watermark: newWatermark(repo.Checkpoint{}), lastReportTime: time.Now()}
+}
+
+// emptyBlocks fetches blocks without transactions
+func emptyBlocks(ids ...uint64) []cli.Block {
+	return sliceMap(ids, func(id uint64) cli.Block { return cli.Block{Slot: id} })
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestPipelineBoundsPrefetchAndDrains(t *testing.T) {
+	stream := &testStream{next: 1, last: 100}
+	release := make(chan struct{})
+	rpc := &mocks.RpcMock{
+		GetBlocksFunc: func(ctx context.Context, retries uint, ids ...uint64) ([]cli.Block, []int, error) {
+			<-release
+			return emptyBlocks(ids...), nil, nil
+		},
+	}
+	p := newTestProcessor(rpc, stream.redis())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx, "test", pipelineCfg{fetchers: 1, decoders: 1, writers: 1, prefetch: 2})
+	}()
+
+	// one batch in the fetcher, two buffered and one waiting to be sent
+	const inFlight = 4
+	waitFor(t, "stream reads", func() bool { read, _ := stream.counts(); return read == inFlight })
+	time.Sleep(20 * time.Millisecond)
+	if read, _ := stream.counts(); read != inFlight {
+		t.Fatalf("read %d batches with stuck fetcher, want %d", read, inFlight)
+	}
+
+	cancel()
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline hasn't stopped")
+	}
+
+	// batches read before cancellation are processed to the end
+	if read, acked := stream.counts(); acked != read {
+		t.Errorf("acked %d of %d read batches", acked, read)
+	}
+}
+
+func TestPipelineDropsFailedBatches(t *testing.T) {
+	stream := &testStream{next: 1, last: 3}
+	rpc := &mocks.RpcMock{
+		GetBlocksFunc: func(ctx context.Context, retries uint, ids ...uint64) ([]cli.Block, []int, error) {
+			if ids[0] == 2 {
+				return nil, nil, errors.New("rpc is down")
+			}
+			return emptyBlocks(ids...), nil, nil
+		},
+	}
+	p := newTestProcessor(rpc, stream.redis())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx, "test", pipelineCfg{fetchers: 2, decoders: 2, writers: 2, prefetch: 1})
+	}()
+
+	waitFor(t, "acks", func() bool { _, acked := stream.counts(); return acked == 2 })
+	cancel()
+	<-done
+
+	sort.Slice(stream.acked, func(i, j int) bool { return stream.acked[i] < stream.acked[j] })
+	if !reflect.DeepEqual(stream.acked, []uint64{1, 3}) {
+		t.Errorf("acked %v, want [1 3]: failed batch stays pending to be retried", stream.acked)
+	}
+
+	if got := p.watermark.get().Slot; got != 1 {
+		t.Errorf("watermark = %d, want 1 while block 2 is pending", got)
+	}
+	if got := p.lastProcessedBlock; got != 3 {
+		t.Errorf("last processed block = %d, want 3", got)
+	}
+}
+
+func TestStoreMax(t *testing.T) {
+	var v uint64
+
+	var wg sync.WaitGroup
+	for i := uint64(1); i <= 100; i++ {
+		wg.Add(1)
+		go func(i uint64) {
+			defer wg.Done()
+			storeMax(&v, i)
+		}(i)
+	}
+	wg.Wait()
+
+	if v != 100 {
+		t.Errorf("storeMax() = %d, want 100", v)
+	}
+	if storeMax(&v, 5); v != 100 {
+		t.Errorf("storeMax() moved value back to %d", v)
+	}
+}
+
+func newTestBolt(t *testing.T) repo.Bolt {
+	t.Helper()
+
+	db, closeDB, err := repo.OpenBolt(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeDB() })
+
+	store, err := repo.NewBolt(db, lgr.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestWriteBatchUpdatesRelationWrittenLater(t *testing.T) {
+	ctx := context.Background()
+	p := newTestProcessor(nil, nil)
+	p.store = newTestBolt(t)
+
+	leafIndex := uint32(0)
+	relation := types.Relation{From: "a", To: "b", Provider: "p", Tree: "t", LeafIndex: &leafIndex, Extra: []byte("original")}
+	edit := types.RelationUpdate{Tree: "t", LeafIndex: 0, Seq: 1, Extra: []byte("edited"), UpdatedAt: time.Unix(2, 0)}
+	closing := types.RelationUpdate{Tree: "t", LeafIndex: 0, Seq: 2, Close: true, Slot: 3, UpdatedAt: time.Unix(3, 0)}
+
+	// blocks are written concurrently, the one closing relation goes first
+	batches := []*batch{
+		{txs: []decodedTx{{slot: 2, decoded: decoded{updates: []types.RelationUpdate{edit}}}}},
+		{txs: []decodedTx{{slot: 3, decoded: decoded{updates: []types.RelationUpdate{closing}}}}},
+		{txs: []decodedTx{{slot: 1, decoded: decoded{relations: []types.Relation{relation}}}}},
+	}
+	for _, b := range batches {
+		if err := p.writeBatch(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		if len(b.quarantined) > 0 {
+			t.Fatalf("quarantined %v", b.quarantined)
+		}
+	}
+
+	relations, _, err := p.store.FetchRelations(ctx, repo.RelationsQuery{From: "a", Status: repo.RelationsAll, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 {
+		t.Fatalf("found %d relations, want 1", len(relations))
+	}
+	if r := relations[0]; r.DisconnectedAt == nil || string(r.Extra) != "edited" {
+		t.Errorf("relation = %+v, want edited and closed", r)
+	}
+
+	counters, err := p.store.FetchCounters(ctx, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters[0].Followers != 0 {
+		t.Errorf("followers = %d, want 0", counters[0].Followers)
+	}
+}
+
+// flakyStore fails the first save of relations, as if the store went away for a moment
+type flakyStore struct {
+	Store
+	failed      bool
+	quarantined []types.QuarantinedTx
+}
+
+func (s *flakyStore) SaveRelations(ctx context.Context, relations []types.Relation) error {
+	if !s.failed {
+		s.failed = true
+		return errors.New("connection reset")
+	}
+	return s.Store.SaveRelations(ctx, relations)
+}
+
+func (s *flakyStore) QuarantineTransactions(ctx context.Context, txs []types.QuarantinedTx) error {
+	s.quarantined = append(s.quarantined, txs...)
+	return s.Store.QuarantineTransactions(ctx, txs)
+}
+
+func TestWriteBatchRetriesStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	store := &flakyStore{Store: newTestBolt(t)}
+	p := newTestProcessor(nil, nil)
+	p.store = store
+
+	leafIndex := uint32(0)
+	relation := types.Relation{From: "a", To: "b", Provider: "p", Tree: "t", LeafIndex: &leafIndex}
+	provider := types.Provider{Address: "p", Name: "provider"}
+	b := &batch{
+		txs: []decodedTx{{slot: 1, decoded: decoded{providers: []types.Provider{provider}, relations: []types.Relation{relation}}}},
+		// decode stage has failed on another transaction
+		quarantined: []types.QuarantinedTx{{Slot: 1, Signature: "bad", Stage: "decode"}},
+	}
+
+	if err := p.writeBatch(ctx, b); err == nil {
+		t.Fatal("writeBatch() succeeded with failing store")
+	}
+	if len(store.quarantined) != 0 {
+		t.Fatalf("quarantined %v on store error", store.quarantined)
+	}
+
+	// batch is picked up again as stale
+	if err := p.writeBatch(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.quarantined) != 1 || store.quarantined[0].Signature != "bad" {
+		t.Errorf("quarantined %v, want the transaction decode has failed on", store.quarantined)
+	}
+
+	relations, _, err := store.FetchRelations(ctx, repo.RelationsQuery{From: "a", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 {
+		t.Errorf("found %d relations after retry, want 1", len(relations))
+	}
+}
+
+func TestQuarantinedBlocksAreReportedUntilReplayed(t *testing.T) {
+	ctx := context.Background()
+	redis := &mocks.RedisMock{
+		AcknowledgeBlocksFunc: func(ctx context.Context, events []string) error { return nil },
+	}
+	p := newTestProcessor(nil, redis)
+	p.store = newTestBolt(t)
+
+	process := func(b *batch) {
+		t.Helper()
+		p.watermark.read(b.ids)
+		if err := p.writeBatch(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.ackBatch(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	process(&batch{events: map[repo.EventID]uint64{"1-0": 1, "2-0": 2}, ids: []uint64{1, 2},
+		quarantined: []types.QuarantinedTx{{Slot: 2, Signature: "bad", Stage: "decode"}}})
+	if wm := p.watermark.get(); wm.Slot != 2 || !reflect.DeepEqual(wm.Quarantined, []uint64{2}) {
+		t.Errorf("watermark = %+v, want slot 2 with 2 quarantined", wm)
+	}
+
+	// once decoding is fixed, the block is replayed
+	process(&batch{events: map[repo.EventID]uint64{"3-0": 2}, ids: []uint64{2}})
+	if wm := p.watermark.get(); len(wm.Quarantined) != 0 {
+		t.Errorf("watermark = %+v, want nothing quarantined after replay", wm)
+	}
+	slots, err := p.store.QuarantinedSlots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slots) != 0 {
+		t.Errorf("quarantined slots %v after replay, want none", slots)
+	}
+}
+
+func TestDecodeBatchQuarantinesWithSignature(t *testing.T) {
+	signature := bytes.Repeat([]byte{7}, 64)
+	// a signature followed by message that can't be parsed
+	wire := append(append([]byte{1}, signature...), 0xff, 0xff)
+	raw := &cli.BlockRawTransaction{Transaction: [2]string{base64.StdEncoding.EncodeToString(wire), "base64"}}
+
+	p := newTestProcessor(nil, nil)
+	b := &batch{blocks: []cli.Block{{Slot: 5, Failed: []cli.FailedTx{{Raw: raw, Err: errors.New("parse tx")}}}}}
+	if err := p.decodeBatch(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(b.quarantined) != 1 {
+		t.Fatalf("quarantined %d transactions, want 1", len(b.quarantined))
+	}
+	q := b.quarantined[0]
+	if want := base58.Encode(signature); q.Signature != want || q.Slot != 5 || q.Stage != "decode" {
+		t.Errorf("quarantined %+v, want signature %s of slot 5", q, want)
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	var added []uint64
+	redis := &mocks.RedisMock{
+		AddBlocksFunc: func(ctx context.Context, blocks []uint64) error {
+			added = append(added, blocks...)
+			return nil
+		},
+	}
+
+	if err := runReplay(context.Background(), lgr.NoOp, redis, []string{"5", "x"}); err == nil {
+		t.Error("runReplay() accepted invalid slot")
+	}
+	if err := runReplay(context.Background(), lgr.NoOp, redis, []string{"5", "9"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(added, []uint64{5, 9}) {
+		t.Errorf("added %v, want [5 9]", added)
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-pkgz/lgr"
-	"github.com/hmn-fnd/borsh-go"
 	"github.com/portto/solana-go-sdk/common"
-	"github.com/portto/solana-go-sdk/types"
+	soltypes "github.com/portto/solana-go-sdk/types"
 	"github.com/sgraph-protocol/sgraph/indexer/cli"
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
 	graph "github.com/sgraph-protocol/sgraph/sdk/go"
 )
 
@@ -20,7 +20,15 @@ type Processor struct {
 	rpc RPC
 
 	redis Redis
-	mongo Mongo
+	store Store
+
+	// nil indexes everything
+	filter *ingestFilter
+
+	// nil decodes no extras
+	extras *extraDecoders
+
+	watermark *watermark
 
 	lastProcessedBlock   uint64 // atomic
 	processedBlocksCount uint64 // atomic
@@ -30,12 +38,16 @@ type Processor struct {
 	lastReportBlock uint64
 }
 
-func NewProcesor(l lgr.L, rpc cli.RPC, redis Redis, mongo Mongo) (*Processor, error) {
+func NewProcesor(l lgr.L, rpc cli.RPC, redis Redis, store Store, filter *ingestFilter, extras *extraDecoders,
+	watermark *watermark) (*Processor, error) {
 	return &Processor{
 		l,
 		rpc,
 		redis,
-		mongo,
+		store,
+		filter,
+		extras,
+		watermark,
 		0,
 		0,
 		time.Now(),
@@ -43,26 +55,6 @@ func NewProcesor(l lgr.L, rpc cli.RPC, redis Redis, mongo Mongo) (*Processor, er
 	}, nil
 }
 
-func (h *Processor) StartProcessingBlocks(pctx context.Context, consumerID, threadID uint) error {
-
-	id := fmt.Sprintf("replica-%d-consumer-%d", consumerID, threadID)
-
-	for {
-		select {
-		case <-pctx.Done():
-			return pctx.Err()
-		default:
-		}
-
-		// manage separate context cancellation to gracefully process remaining batches
-		ctx := context.Background()
-
-		if err := h.ProcessBlocks(ctx, id); err != nil {
-			h.l.Logf("[ERROR] occured while processing blocks: %v", err)
-		}
-	}
-}
-
 func (p *Processor) ReportProgress() {
 	ctx, cleanup := context.WithTimeout(context.Background(), time.Second*15)
 	defer cleanup()
@@ -87,6 +79,23 @@ func (p *Processor) ReportProgress() {
 
 	p.lastReportTime = time.Now()
 	p.lastReportBlock = lastProcessed
+
+	health, err := p.redis.StreamHealth(ctx)
+	if err != nil {
+		p.l.Logf("[ERROR] %v", err)
+		return
+	}
+
+	lag := "unknown"
+	if health.Lag >= 0 {
+		lag = fmt.Sprint(health.Lag)
+	}
+
+	p.l.Logf("[INFO] block queue: length = %d; pending = %d; oldest pending = %s; lag = %s",
+		health.Length, health.Pending, health.OldestPendingAge.Truncate(time.Second), lag)
+	for _, c := range health.Consumers {
+		p.l.Logf("[INFO] block queue consumer %s: pending = %d; idle = %s", c.Name, c.Pending, c.Idle.Truncate(time.Second))
+	}
 }
 
 func calcStatus(latestBlock, lastProcessed uint64, gainRate float64) string {
@@ -109,178 +118,362 @@ func calcStatus(latestBlock, lastProcessed uint64, gainRate float64) string {
 	}
 }
 
-const staleTimeout = time.Minute * 4
+// decoded is everything indexer extracts from a single transaction
+type decoded struct {
+	instructions []types.Instruction
+	relations    []types.Relation
+	updates      []types.RelationUpdate
+	providers    []types.Provider
+	events       []types.Event
 
-func (p *Processor) ProcessBlocks(ctx context.Context, consumerID string) error {
-	const batchSize = 20
+	// left out by ingest rules
+	skipped []types.SkippedRelation
 
-	staleBatch, err := p.redis.FindStaleBlocks(ctx, consumerID, staleTimeout, batchSize)
-	if err != nil {
-		return fmt.Errorf("await new transaction events: %w", err)
-	}
+	// trees are not projections: change logs of skipped relations advance them too
+	trees      []types.Tree
+	treeStates map[string]types.TreeState
 
-	if len(staleBatch) > 0 {
-		p.l.Logf("[WARN] found some stale blocks: %v", values(staleBatch))
-	}
+	// leaves out relations of projection, and decodes extras of projected ones
+	filter *ingestFilter
+	extras *extraDecoders
+}
 
-	remaining := uint(batchSize - len(staleBatch))
+func (d decoded) empty() bool {
+	return len(d.instructions) == 0 && len(d.relations) == 0 && len(d.updates) == 0 && len(d.providers) == 0 &&
+		len(d.events) == 0 && len(d.skipped) == 0 && len(d.trees) == 0 && len(d.treeStates) == 0
+}
 
-	batch, err := p.redis.FetchStreamEvents(ctx, consumerID, remaining)
-	if err != nil {
-		return fmt.Errorf("await new transaction events: %w", err)
-	}
+// project applies logged instruction to relations and providers. Same code serves indexing and rebuilds from the log,
+// so relations ingest rules leave out can be indexed later by a rebuild. changeLog is nil when instruction has emitted none
+func (d *decoded) project(logged types.Instruction, inst graph.DecodedInstruction, changeLog *graph.ChangeLog) {
+	slot, blockTime := logged.Slot, uint64(logged.BlockTime.Unix())
+
+	switch ix := inst.(type) {
+	case graph.DecodedAddRelation:
+		added := addedRelation(ix, blockTime)
+
+		// ledger keeps leaves of skipped relations
+		if !d.filter.Allows(added) {
+			leaf := graph.LeafHash(added)
+			d.skipped = append(d.skipped, types.SkippedRelation{
+				Position:  repo.Position(slot, logged.TxIndex, logged.Outer, logged.Inner),
+				Slot:      slot,
+				Signature: logged.Signature,
+				Provider:  added.Provider.ToBase58(),
+				Tree:      ix.Accounts.Tree.ToBase58(),
+				LeafIndex: optionMap(changeLog, func(c graph.ChangeLog) uint32 { return c.Index }),
+				Leaf:      leaf[:],
+				SkippedAt: time.Now(),
+			})
+			return
+		}
 
-	// merge the two
-	for id, b := range staleBatch {
-		batch[id] = b
+		r := treeRelation(added, ix.Accounts.Tree, changeLog)
+		r.Kind, r.ExtraDecoded = d.decodeExtra(r.Provider, r.Extra)
+		r.Slot = slot
+		d.relations = append(d.relations, r)
+
+	case graph.DecodedCloseRelation:
+		d.updateRelation(types.RelationUpdate{Close: true}, ix.Accounts.Tree, changeLog, slot, blockTime)
+
+	case graph.DecodedEditExtra:
+		u := types.RelationUpdate{Extra: ix.Args.Extra}
+		u.Kind, u.ExtraDecoded = d.decodeExtra(ix.Accounts.Provider.ToBase58(), ix.Args.Extra)
+		d.updateRelation(u, ix.Accounts.Tree, changeLog, slot, blockTime)
+
+	case graph.DecodedInitializeProvider:
+		d.providers = append(d.providers, types.Provider{
+			Address:   ix.Accounts.Provider.ToBase58(),
+			Authority: ix.Args.Authority.ToBase58(),
+			Name:      ix.Args.Name,
+			Website:   ix.Args.Website,
+			CreatedAt: time.Unix(int64(blockTime), 0),
+		})
 	}
+}
 
-	if len(batch) == 0 {
-		return nil
+// updateRelation replaces leaf of change log. Without change log there is no telling which version
+// of the leaf is replaced, so such updates are dropped
+func (d *decoded) updateRelation(u types.RelationUpdate, tree common.PublicKey, changeLog *graph.ChangeLog,
+	slot, blockTime uint64) {
+	if changeLog == nil {
+		return
 	}
 
-	ids := values(batch)
-
-	p.l.Logf("[TRACE] processing %d blocks, latest is %d", len(batch), ids[0])
-	start := time.Now()
+	u.Tree, u.LeafIndex, u.Seq = tree.ToBase58(), changeLog.Index, changeLog.Seq
+	u.Slot, u.UpdatedAt = slot, time.Unix(int64(blockTime), 0)
+	d.updates = append(d.updates, u)
+}
 
-	failed, err := p.processBlocks(ctx, consumerID, ids)
+// decodeExtra returns kind extra declares and fields of its payload.
+// Malformed kind header declares no kind, and the whole extra is payload then
+func (d *decoded) decodeExtra(provider string, extra []byte) (string, map[string]any) {
+	kind, payload, err := graph.DecodeKind(extra)
 	if err != nil {
-		return err
+		kind, payload = "", extra
 	}
+	return kind, d.extras.decode(provider, payload)
+}
 
-	elapsed := time.Since(start).Milliseconds()
-	// todo metrics
-	p.l.Logf("[TRACE] batch of %d blocks is processed in %dms, ACK'ing transactions", len(batch), elapsed)
-
-	if len(failed) > 0 {
-		if err := p.redis.AddBlocks(ctx, failed); err != nil {
-			return fmt.Errorf("adding failed blocks: %w", err)
-		}
+// advanceTree applies change log to state of its tree. appended tells if change log is of a new leaf
+func (d *decoded) advanceTree(changeLog graph.ChangeLog, appended bool) {
+	if d.treeStates == nil {
+		d.treeStates = map[string]types.TreeState{}
 	}
 
-	if err := p.redis.AcknowledgeBlocks(ctx, keys(batch)); err != nil {
-		return fmt.Errorf("aknowledge blocks: %w", err)
-	}
+	address := changeLog.Tree.ToBase58()
+	state := d.treeStates[address]
 
-	atomic.StoreUint64(&p.lastProcessedBlock, ids[len(ids)-1])
-	atomic.AddUint64(&p.processedBlocksCount, uint64(len(ids)))
+	if appended && uint64(changeLog.Index)+1 > state.LeafCount {
+		state.LeafCount = uint64(changeLog.Index) + 1
+	}
+	if changeLog.Seq >= state.Seq {
+		root := changeLog.Root()
+		state.Seq, state.Root = changeLog.Seq, root[:]
+	}
 
-	return nil
+	d.treeStates[address] = state
 }
 
-// returns blocks that we failed to process
-func (p *Processor) processBlocks(ctx context.Context, id string, ids []uint64) (failed []uint64, err error) {
-	handleErr := func(err error) ([]uint64, error) {
-		return nil, fmt.Errorf("process batch: %w", err)
+// addedRelation is relation as add_relation appends it to the tree
+func addedRelation(ix graph.DecodedAddRelation, blockTime uint64) graph.Relation {
+	return graph.Relation{
+		From:           ix.Args.From,
+		To:             ix.Args.To,
+		Provider:       ix.Accounts.Provider,
+		ConnectedAt:    int64(blockTime),
+		DisconnectedAt: nil,
+		Extra:          ix.Args.Extra,
 	}
+}
 
-	now := time.Now()
+// treeRelation is relation stored in the tree, at leaf of the change log
+func treeRelation(r graph.Relation, tree common.PublicKey, changeLog *graph.ChangeLog) types.Relation {
+	relation := types.Relation{
+		From:           r.From.ToBase58(),
+		To:             r.To.ToBase58(),
+		Provider:       r.Provider.ToBase58(),
+		ConnectedAt:    time.Unix(r.ConnectedAt, 0),
+		DisconnectedAt: optionMap(r.DisconnectedAt, func(ts int64) time.Time { return time.Unix(ts, 0) }),
+		Extra:          r.Extra,
+		Tree:           tree.ToBase58(),
+	}
+	if changeLog != nil {
+		index := changeLog.Index
+		relation.LeafIndex, relation.Seq = &index, changeLog.Seq
+	}
+	return relation
+}
 
-	const retries = 4 // 5 attemps in total
+func (p *Processor) decode(tx cli.Tx, slot, blockTime uint64, txIndex int) (decoded, error) {
+	result := decoded{filter: p.filter, extras: p.extras}
 
-	// batch rpc get transactions
-	blocks, failedIdx, err := p.rpc.GetBlocks(ctx, retries, ids...)
+	// logs let us reject instructions of failed inner invocations.
+	// if we can't parse them, we trust transaction status
+	programs := sliceMap(tx.Insts, func(inst soltypes.Instruction) common.PublicKey { return inst.ProgramID })
+	logs, err := graph.ParseLogs(tx.Meta.Logs, programs)
 	if err != nil {
-		return handleErr(fmt.Errorf("get blocks: %w", err))
+		p.l.Logf("[WARN] parse logs of %s: %v", tx.TxHash, err)
 	}
 
-	p.l.Logf("[TRACE] processing blocks %v on ID %s", ids, id)
+	insts, err := p.findGraphInsts(tx, logs)
+	if err != nil {
+		return decoded{}, err
+	}
 
-	if len(failedIdx) != 0 {
-		failed = make([]uint64, len(failedIdx))
+	ts := time.Unix(int64(blockTime), 0)
 
-		for i, f := range failedIdx {
-			failed[i] = ids[f]
+	for _, inst := range insts {
+		var changeLog *graph.ChangeLog
+		if inst.changeLog != nil {
+			c, err := graph.DecodeChangeLog(inst.changeLog)
+			if err != nil {
+				return decoded{}, fmt.Errorf("decode change log: %w", err)
+			}
+			changeLog = &c
 		}
 
-		p.l.Logf("failed to fetch blocks. Adding them to the back of the queue: %v", failed)
-	}
+		switch ix := inst.decoded.(type) {
+		case graph.DecodedInitializeTree:
+			result.trees = append(result.trees, types.Tree{
+				Address:    ix.Accounts.Tree.ToBase58(),
+				Controller: ix.Accounts.TreeController.ToBase58(),
+				Authority:  ix.Accounts.Authority.ToBase58(),
+				CreatedAt:  ts,
+			})
+			if changeLog != nil {
+				result.advanceTree(*changeLog, false)
+			}
 
-	p.l.Logf("[TRACE] got blocks from rpc in %dms", time.Since(now).Milliseconds())
+		case graph.DecodedCloseRelation, graph.DecodedEditExtra:
+			if changeLog != nil {
+				result.advanceTree(*changeLog, false)
+			}
 
-	// classify
-	for _, block := range blocks {
-		for _, tx := range block.Transactions {
-			// hello
-			if err := p.process(ctx, tx, block.BlockTime); err != nil {
-				return handleErr(err)
+		case graph.DecodedAddRelation:
+			if changeLog != nil {
+				result.advanceTree(*changeLog, true)
 			}
 		}
-	}
 
-	return failed, nil
-}
+		// every instruction is logged, ingest rules apply to projections only
+		logged := types.Instruction{
+			Slot:      slot,
+			BlockTime: ts,
+			Signature: tx.TxHash,
+			TxIndex:   txIndex,
+			Outer:     inst.pos.outer,
+			Inner:     inst.pos.inner,
+			Program:   inst.raw.ProgramID.ToBase58(),
+			Accounts: sliceMap(inst.raw.Accounts, func(a soltypes.AccountMeta) types.InstructionAccount {
+				return types.InstructionAccount{Address: a.PubKey.ToBase58(), Signer: a.IsSigner, Writable: a.IsWritable}
+			}),
+			Data:      inst.raw.Data,
+			ChangeLog: inst.changeLog,
+		}
+		result.instructions = append(result.instructions, logged)
 
-func (p *Processor) process(ctx context.Context, tx cli.Tx, blockTime uint64) error {
-	addTxs := p.findAddInst(tx)
-	if len(addTxs) == 0 {
-		return nil
+		result.project(logged, inst.decoded, changeLog)
 	}
 
-	relations := sliceMap(addTxs, func(tx addIx) graph.Relation {
-		return graph.Relation{
-			From:           tx.params.From,
-			To:             tx.params.To,
-			Provider:       tx.accounts[0].PubKey,
-			ConnectedAt:    int64(blockTime),
-			DisconnectedAt: nil,
-			Extra:          tx.params.Extra,
+	for _, e := range logs.AllEvents() {
+		if e.Discriminator != graph.GraphEventDiscriminator {
+			continue
+		}
+
+		event, err := graph.DecodeEvent(e)
+		if err != nil {
+			if e.ProgramID == graph.GraphProgramAddress {
+				return decoded{}, fmt.Errorf("decode graph event: %w", err)
+			}
+			// someone else's event with colliding name
+			continue
 		}
-	})
 
-	// save it
-	p.l.Logf("New relation: %v", relations)
-	if err := p.mongo.SaveRelations(ctx, relations); err != nil {
-		return fmt.Errorf("save relations: %w", err)
+		result.events = append(result.events, types.Event{
+			Provider:  event.Provider.ToBase58(),
+			Actor:     event.Actor.ToBase58(),
+			Target:    event.Target.ToBase58(),
+			Extra:     event.Extra,
+			Program:   e.ProgramID.ToBase58(),
+			Verified:  e.ProgramID == graph.GraphProgramAddress,
+			Signature: tx.TxHash,
+			Index:     len(result.events),
+			Slot:      slot,
+			EmittedAt: ts,
+		})
 	}
 
-	return nil
+	return result, nil
 }
 
-var (
-	graphProgramID = common.PublicKeyFromString("graph8zS8zjLVJHdiSvP7S9PP7hNJpnHdbnJLR81FMg")
-)
-
-type addRelationParams struct {
-	From, To common.PublicKey
-	Extra    []byte
+// instPosition is position of the instruction in transaction. inner is -1 for top level instructions
+type instPosition struct {
+	outer, inner int
 }
 
-type addIx struct {
-	params   addRelationParams
-	accounts []types.AccountMeta
+type graphInst struct {
+	pos     instPosition
+	raw     soltypes.Instruction
+	decoded graph.DecodedInstruction
+
+	// data of change log emitted by instruction, nil if there is none
+	changeLog []byte
 }
 
-func (p Processor) findAddInst(tx cli.Tx) []addIx {
-	var results []addIx
+// findGraphInsts returns successful graph program instructions of the transaction
+func (p Processor) findGraphInsts(tx cli.Tx, logs graph.TxLogs) ([]graphInst, error) {
+	var results []graphInst
 
 	// combine all outer and inner instructions
-	allInsts := tx.Insts
-	for _, insts := range tx.InnerInsts {
-		allInsts = append(allInsts, insts...)
+	var (
+		allInsts  []soltypes.Instruction
+		positions []instPosition
+	)
+	for i, inst := range tx.Insts {
+		allInsts = append(allInsts, inst)
+		positions = append(positions, instPosition{i, -1})
+
+		for j, inner := range tx.InnerInsts[i] {
+			allInsts = append(allInsts, inner)
+			positions = append(positions, instPosition{i, j})
+		}
 	}
 
-	for _, inst := range allInsts {
-		if inst.ProgramID != graphProgramID {
+	// change logs already attributed to preceding instructions
+	claimed := map[instPosition]bool{}
+
+	for i, inst := range allInsts {
+		if inst.ProgramID != graph.GraphProgramAddress {
 			continue
 		}
 
-		if len(inst.Data) < 8 && !bytes.Equal(inst.Data[:8], graph.AddRelationInstructionDiscriminator[:]) {
-			// not an add_relation instruction
-			continue
+		// transaction has succeeded, so failing to decode its instruction is our bug
+		decoded, err := graph.DecodeInstruction(inst)
+		if err != nil {
+			return nil, fmt.Errorf("decode graph instruction: %w", err)
 		}
 
-		var params addRelationParams
+		if _, ok := decoded.(graph.UnknownInstruction); ok {
+			continue
+		}
 
-		if err := borsh.Deserialize(&params, inst.Data[8:]); err != nil {
-			p.l.Logf("[WARN] parse add instruction: %v", err)
+		pos := positions[i]
+		succeeded, err := logs.Succeeded(graph.GraphProgramAddress, pos.outer, pos.inner)
+		if err != nil {
+			p.l.Logf("[TRACE] can't confirm instruction %d:%d of %s with logs: %v", pos.outer, pos.inner, tx.TxHash, err)
+		} else if !succeeded {
+			p.l.Logf("[WARN] skipping graph instruction %d:%d of %s: invocation failed", pos.outer, pos.inner, tx.TxHash)
 			continue
 		}
 
-		results = append(results, addIx{params, inst.Accounts})
+		var changeLog []byte
+		if tree, ok := modifiedTree(decoded); ok {
+			changeLog = findChangeLog(allInsts[i+1:], positions[i+1:], pos.outer, tree, claimed)
+			if changeLog == nil {
+				p.l.Logf("[WARN] no change log of graph instruction %d:%d of %s", pos.outer, pos.inner, tx.TxHash)
+			}
+		}
+
+		results = append(results, graphInst{pos, inst, decoded, changeLog})
+	}
+
+	return results, nil
+}
+
+// modifiedTree returns tree instruction modifies, if any
+func modifiedTree(inst graph.DecodedInstruction) (common.PublicKey, bool) {
+	switch ix := inst.(type) {
+	case graph.DecodedInitializeTree:
+		return ix.Accounts.Tree, true
+	case graph.DecodedAddRelation:
+		return ix.Accounts.Tree, true
+	case graph.DecodedCloseRelation:
+		return ix.Accounts.Tree, true
+	case graph.DecodedEditExtra:
+		return ix.Accounts.Tree, true
 	}
+	return common.PublicKey{}, false
+}
+
+// findChangeLog returns data of the first unclaimed change log of tree among inner instructions
+// of the same outer one, which follow graph instruction. Account compression emits it through noop program
+func findChangeLog(insts []soltypes.Instruction, positions []instPosition, outer int, tree common.PublicKey, claimed map[instPosition]bool) []byte {
+	for i, inst := range insts {
+		if positions[i].outer != outer {
+			break
+		}
+		if inst.ProgramID != graph.NoopProgramAddress || claimed[positions[i]] {
+			continue
+		}
 
-	return results
+		changeLog, err := graph.DecodeChangeLog(inst.Data)
+		if err != nil || changeLog.Tree != tree {
+			continue
+		}
 
+		claimed[positions[i]] = true
+		return inst.Data
+	}
+	return nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/portto/solana-go-sdk/common"
+	soltypes "github.com/portto/solana-go-sdk/types"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+const rebuildBatchSize = 1000
+
+// runRebuild replays instructions log into fresh projections and swaps them with current ones.
+// Indexer must be stopped while it runs. Relations older than the log would be lost,
+// so rebuild refuses to run unless forced
+func runRebuild(ctx context.Context, l lgr.L, store Store, filter *ingestFilter, extras *extraDecoders, args []string) error {
+	force := len(args) == 1 && args[0] == "--force"
+	if len(args) != 0 && !force {
+		return fmt.Errorf("usage: indexer rebuild [--force]")
+	}
+
+	if err := checkLogCoverage(ctx, store); err != nil {
+		if !force {
+			return fmt.Errorf("%w, pass --force to rebuild anyway", err)
+		}
+		l.Logf("[WARN] rebuilding anyway: %v", err)
+	}
+
+	var replayed int
+
+	err := store.RebuildProjections(ctx, func(proj repo.Projections) error {
+		batch := decoded{filter: filter, extras: extras}
+
+		// providers go first, so relations never reference missing ones
+		flush := func() error {
+			if len(batch.skipped) > 0 {
+				if err := proj.SaveSkipped(ctx, batch.skipped); err != nil {
+					return err
+				}
+			}
+			if len(batch.providers) > 0 {
+				if err := proj.SaveProviders(ctx, batch.providers); err != nil {
+					return err
+				}
+			}
+			if len(batch.relations) > 0 {
+				if err := proj.SaveRelations(ctx, batch.relations); err != nil {
+					return err
+				}
+			}
+			if len(batch.updates) > 0 {
+				if _, err := proj.UpdateRelations(ctx, batch.updates); err != nil {
+					return err
+				}
+			}
+			batch = decoded{filter: filter, extras: extras}
+			return nil
+		}
+
+		err := store.ScanInstructions(ctx, func(inst types.Instruction) error {
+			// decoding bugs fixed since instruction was logged are the reason to rebuild,
+			// so failure here means the fix is incomplete
+			decodedInst, err := graph.DecodeInstruction(rawInstruction(inst))
+			if err != nil {
+				return fmt.Errorf("decode instruction %d:%d of %s: %w", inst.Outer, inst.Inner, inst.Signature, err)
+			}
+
+			var changeLog *graph.ChangeLog
+			if inst.ChangeLog != nil {
+				c, err := graph.DecodeChangeLog(inst.ChangeLog)
+				if err != nil {
+					return fmt.Errorf("decode change log of %d:%d of %s: %w", inst.Outer, inst.Inner, inst.Signature, err)
+				}
+				changeLog = &c
+			}
+
+			batch.project(inst, decodedInst, changeLog)
+
+			if replayed++; replayed%rebuildBatchSize == 0 {
+				l.Logf("[INFO] replayed %d instructions, at slot %d", replayed, inst.Slot)
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	l.Logf("[INFO] rebuilt projections from %d instructions", replayed)
+	return nil
+}
+
+// checkLogCoverage fails if stored relations were added before the first logged instruction,
+// as with relations restored from snapshots without the log or indexed before the log was kept,
+// or if skipped relations are not logged, as they were not before ingest rules applied to projections only
+func checkLogCoverage(ctx context.Context, store Store) error {
+	errFound := errors.New("found")
+
+	var logged bool
+	var first uint64
+	err := store.ScanInstructions(ctx, func(inst types.Instruction) error {
+		logged, first = true, inst.Slot
+		return errFound
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return err
+	}
+
+	var uncovered int
+	oldest := ^uint64(0)
+	err = store.ScanRelations(ctx, func(r types.Relation) error {
+		if !logged || r.Slot < first {
+			uncovered++
+			if r.Slot < oldest {
+				oldest = r.Slot
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case uncovered == 0:
+	case !logged:
+		return fmt.Errorf("instructions log is empty, rebuild would drop %d stored relations", uncovered)
+	default:
+		return fmt.Errorf("instructions log starts at slot %d, rebuild would drop %d stored relations, the oldest added at slot %d",
+			first, uncovered, oldest)
+	}
+
+	unlogged := make(map[string]bool)
+	err = store.ScanSkipped(ctx, func(s types.SkippedRelation) error {
+		unlogged[s.Position] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unlogged) == 0 {
+		return nil
+	}
+
+	err = store.ScanInstructions(ctx, func(inst types.Instruction) error {
+		delete(unlogged, repo.Position(inst.Slot, inst.TxIndex, inst.Outer, inst.Inner))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unlogged) > 0 {
+		return fmt.Errorf("%d skipped relations are not in instructions log, rebuild would drop them from the ledger", len(unlogged))
+	}
+	return nil
+}
+
+// rawInstruction restores instruction from its log entry
+func rawInstruction(inst types.Instruction) soltypes.Instruction {
+	return soltypes.Instruction{
+		ProgramID: common.PublicKeyFromString(inst.Program),
+		Accounts: sliceMap(inst.Accounts, func(a types.InstructionAccount) soltypes.AccountMeta {
+			return soltypes.AccountMeta{PubKey: common.PublicKeyFromString(a.Address), IsSigner: a.Signer, IsWritable: a.Writable}
+		}),
+		Data: inst.Data,
+	}
+}
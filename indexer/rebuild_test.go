@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/portto/solana-go-sdk/common"
+	soltypes "github.com/portto/solana-go-sdk/types"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+func TestCheckLogCoverage(t *testing.T) {
+	tests := []struct {
+		name      string
+		logged    []uint64 // slots of logged instructions, each the first in its block
+		relations []uint64 // slots of stored relations
+		skipped   []uint64 // slots of skipped relations, each the first in its block
+		covered   bool
+	}{
+		{name: "empty store", covered: true},
+		{name: "log covers relations", logged: []uint64{5, 9}, relations: []uint64{5, 9}, covered: true},
+		{name: "relations without log", relations: []uint64{5}},
+		{name: "relation older than log", logged: []uint64{5}, relations: []uint64{4, 5}},
+		{name: "relation indexed before slots were recorded", logged: []uint64{5}, relations: []uint64{0}},
+		{name: "skipped relation logged", logged: []uint64{5, 7}, relations: []uint64{5}, skipped: []uint64{7}, covered: true},
+		{name: "skipped relation not logged", logged: []uint64{5}, relations: []uint64{5}, skipped: []uint64{7}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newTestBolt(t)
+
+			for _, slot := range tt.logged {
+				inst := types.Instruction{Slot: slot, Signature: "sig", Inner: -1}
+				if err := store.SaveInstructions(ctx, []types.Instruction{inst}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, slot := range tt.relations {
+				leafIndex := uint32(i)
+				r := types.Relation{From: "a", To: "b", Provider: "p", Tree: "t", LeafIndex: &leafIndex, Slot: slot}
+				if err := store.SaveRelations(ctx, []types.Relation{r}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, slot := range tt.skipped {
+				s := types.SkippedRelation{Position: repo.Position(slot, 0, 0, -1), Slot: slot, Provider: "p"}
+				if err := store.SaveSkipped(ctx, []types.SkippedRelation{s}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := checkLogCoverage(ctx, store); (err == nil) != tt.covered {
+				t.Errorf("checkLogCoverage() error = %v, want covered %v", err, tt.covered)
+			}
+		})
+	}
+}
+
+func TestRunRebuildKeepsRelationsMissingFromLog(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBolt(t)
+
+	// restored from a snapshot without the log
+	leafIndex := uint32(0)
+	r := types.Relation{From: "a", To: "b", Provider: "p", Tree: "t", LeafIndex: &leafIndex, Slot: 5}
+	if err := store.SaveRelations(ctx, []types.Relation{r}); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() int {
+		relations, _, err := store.FetchRelations(ctx, repo.RelationsQuery{Status: repo.RelationsAll, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(relations)
+	}
+
+	if err := runRebuild(ctx, lgr.NoOp, store, nil, nil, nil); err == nil {
+		t.Fatal("runRebuild() succeeded without the log of stored relations")
+	}
+	if n := count(); n != 1 {
+		t.Errorf("%d relations after refused rebuild, want 1", n)
+	}
+
+	// forced rebuild drops them
+	if err := runRebuild(ctx, lgr.NoOp, store, nil, nil, []string{"--force"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("%d relations after forced rebuild, want 0", n)
+	}
+}
+
+func TestRunRebuildAppliesIngestRules(t *testing.T) {
+	ctx := context.Background()
+	store := newTestBolt(t)
+
+	provider := common.PublicKeyFromString("s1gsZrDJAXNYSCRhQZk5X3mYyBjAmaVBTYnNhCzj8t2")
+	ix, err := graph.AddRelationInstruction(graph.AddRelationAccounts{Provider: provider},
+		graph.AddRelationParams{From: common.PublicKeyFromString("11111111111111111111111111111112"), Extra: []byte{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := types.Instruction{
+		Slot:      5,
+		BlockTime: time.Unix(1, 0),
+		Signature: "sig",
+		Inner:     -1,
+		Program:   ix.ProgramID.ToBase58(),
+		Accounts: sliceMap(ix.Accounts, func(a soltypes.AccountMeta) types.InstructionAccount {
+			return types.InstructionAccount{Address: a.PubKey.ToBase58(), Signer: a.IsSigner, Writable: a.IsWritable}
+		}),
+		Data: ix.Data,
+	}
+	if err := store.SaveInstructions(ctx, []types.Instruction{logged}); err != nil {
+		t.Fatal(err)
+	}
+
+	// relations skipped by rules are logged all the same, and indexed once rules let them in
+	deny := &ingestFilter{}
+	deny.rules.Store(&ingestRules{Deny: ruleSet{Providers: []string{provider.ToBase58()}}})
+
+	for _, step := range []struct {
+		name               string
+		filter             *ingestFilter
+		relations, skipped int
+	}{
+		{"denied", deny, 0, 1},
+		{"allowed", nil, 1, 0},
+	} {
+		if err := runRebuild(ctx, lgr.NoOp, store, step.filter, nil, nil); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		relations, _, err := store.FetchRelations(ctx, repo.RelationsQuery{Status: repo.RelationsAll, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		skipped, err := store.FetchSkipped(ctx, provider.ToBase58(), "", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(relations) != step.relations || len(skipped) != step.skipped {
+			t.Errorf("%s: %d relations and %d skipped, want %d and %d",
+				step.name, len(relations), len(skipped), step.relations, step.skipped)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-pkgz/lgr"
+)
+
+// runReplay puts blocks back into the stream, for transactions quarantined by a decoding bug once it's fixed.
+// Blocks are processed again as a whole, writes are idempotent, so transactions that made it are not duplicated
+func runReplay(ctx context.Context, l lgr.L, queue Redis, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: indexer replay <slot>...")
+	}
+
+	slots := make([]uint64, len(args))
+	for i, arg := range args {
+		slot, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid slot %q: %w", arg, err)
+		}
+		slots[i] = slot
+	}
+
+	if err := queue.AddBlocks(ctx, slots); err != nil {
+		return fmt.Errorf("replay blocks: %w", err)
+	}
+
+	l.Logf("[INFO] %d blocks are queued to be processed again", len(slots))
+	return nil
+}
@@ -0,0 +1,1782 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt implements storage on top of embedded bbolt database, for single binary deployments.
+// Records are stored as json under sequential ids, secondary indexes are buckets of `value|id` keys.
+// Pagination cursors are decimal ids of records
+type Bolt struct {
+	db *bolt.DB
+	l  lgr.L
+
+	// prefix of projection buckets, set while they are rebuilt
+	staging string
+}
+
+var (
+	bucketRelations         = []byte("relations")
+	bucketRelationsFrom     = []byte("relations_from")
+	bucketRelationsTo       = []byte("relations_to")
+	bucketRelationsProvider = []byte("relations_provider")
+	bucketRelationsTree     = []byte("relations_tree")
+	bucketRelationsLeaf     = []byte("relations_leaf") // `tree|leaf index`, leaves are unique
+	bucketRelationsKind     = []byte("relations_kind")
+	bucketRelationsPair     = []byte("relations_pair") // `from|to`
+	bucketRelationsSlot     = []byte("relations_slot") // `slot|id`, slot is big endian
+	// `connected_at|id`, block time in big endian seconds
+	bucketRelationsConnected = []byte("relations_connected")
+
+	// updates of relations not stored yet, keyed by `tree|leaf index|seq`
+	bucketPendingUpdates = []byte("pending_updates")
+
+	bucketQuarantine = []byte("quarantine")
+	bucketProviders  = []byte("providers")
+
+	bucketEvents          = []byte("events")
+	bucketEventsActor     = []byte("events_actor")
+	bucketEventsTarget    = []byte("events_target")
+	bucketEventsProvider  = []byte("events_provider")
+	bucketEventsEmittedAt = []byte("events_emitted_at")
+	bucketEventsSignature = []byte("events_signature")
+
+	bucketInstructions = []byte("instructions")
+
+	// keyed by `address|provider`, empty provider for total over all providers
+	bucketCounters = []byte("counters")
+	// keyed by `from|to|provider`, number of connected relations making the follow
+	bucketFollows = []byte("follows")
+
+	// keyed by position, provider index is `provider|position` keys
+	bucketSkipped         = []byte("skipped")
+	bucketSkippedProvider = []byte("skipped_provider")
+
+	// keyed by address
+	bucketTrees = []byte("trees")
+)
+
+// projectionBuckets are rebuilt from instructions log
+var projectionBuckets = [][]byte{
+	bucketProviders, bucketCounters, bucketFollows,
+	bucketRelations, bucketRelationsFrom, bucketRelationsTo, bucketRelationsProvider, bucketRelationsTree, bucketRelationsLeaf,
+	bucketRelationsKind, bucketRelationsPair, bucketRelationsSlot, bucketRelationsConnected, bucketPendingUpdates,
+	bucketSkipped, bucketSkippedProvider,
+}
+
+// instructions are scanned in chunks, each in its own transaction, so callbacks are free to write
+const instructionsScanChunk = 1000
+
+// OpenBolt opens (or creates) database in data directory
+func OpenBolt(dataDir string) (*bolt.DB, func() error, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("create data dir: %w", err)
+	}
+
+	db, err := bolt.Open(filepath.Join(dataDir, "indexer.db"), 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, nil, fmt.Errorf("open database: %w", err)
+	}
+
+	return db, db.Close, nil
+}
+
+func NewBolt(db *bolt.DB, l lgr.L) (Bolt, error) {
+	b := Bolt{db, l, ""}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		// relations saved before trees were tracked are of the program tree
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketRelationsTree) == nil {
+			if err := b.backfillTree(tx); err != nil {
+				return fmt.Errorf("backfill tree: %w", err)
+			}
+		}
+
+		// leaf index appeared after trees were tracked, so existing relations are indexed once, which appeared after trees were tracked
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketRelationsLeaf) == nil {
+			if err := b.backfillLeafIndex(tx); err != nil {
+				return fmt.Errorf("backfill leaf index: %w", err)
+			}
+		}
+
+		// and kind index, relations saved before kinds were extracted get them from extra
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketRelationsKind) == nil {
+			if err := b.backfillKind(tx); err != nil {
+				return fmt.Errorf("backfill kind: %w", err)
+			}
+		}
+
+		// and pair index
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketRelationsPair) == nil {
+			if err := b.backfillPairIndex(tx); err != nil {
+				return fmt.Errorf("backfill pair index: %w", err)
+			}
+		}
+
+		// and slot index, relations saved before slots were recorded get them from the log where it has them
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketRelationsSlot) == nil {
+			if err := b.backfillSlots(tx); err != nil {
+				return fmt.Errorf("backfill slots: %w", err)
+			}
+		}
+
+		// and connected at index
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketRelationsConnected) == nil {
+			if err := b.backfillConnectedIndex(tx); err != nil {
+				return fmt.Errorf("backfill connected at index: %w", err)
+			}
+		}
+
+		// counters used to count every relation, including ones saved twice by retried batches
+		if tx.Bucket(bucketRelations) != nil && tx.Bucket(bucketFollows) == nil {
+			if err := b.recountFollows(tx); err != nil {
+				return fmt.Errorf("recount follows: %w", err)
+			}
+		}
+
+		for _, name := range [][]byte{
+			bucketRelations, bucketRelationsFrom, bucketRelationsTo, bucketRelationsProvider, bucketRelationsTree, bucketRelationsLeaf,
+			bucketRelationsKind, bucketRelationsPair, bucketRelationsSlot, bucketRelationsConnected, bucketPendingUpdates,
+			bucketQuarantine, bucketProviders,
+			bucketEvents, bucketEventsActor, bucketEventsTarget, bucketEventsProvider, bucketEventsEmittedAt, bucketEventsSignature,
+			bucketInstructions, bucketCounters, bucketFollows,
+			bucketSkipped, bucketSkippedProvider,
+			bucketTrees,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Bolt{}, fmt.Errorf("initialize buckets: %w", err)
+	}
+
+	return b, nil
+}
+
+// projection returns projection bucket, staging one during rebuild
+func (b Bolt) projection(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	return tx.Bucket(append([]byte(b.staging), name...))
+}
+
+func (b Bolt) SaveRelations(ctx context.Context, relations []types.Relation) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		// leaves are unique, so retried batches insert only relations they haven't inserted before
+		var inserted []types.Relation
+		for _, r := range relations {
+			if r.LeafIndex != nil {
+				if _, ok := b.findLeaf(tx, r.Tree, *r.LeafIndex); ok {
+					continue
+				}
+			}
+			inserted = append(inserted, r)
+
+			id, err := insert(b.projection(tx, bucketRelations), r)
+			if err != nil {
+				return err
+			}
+
+			entries := []indexEntry{
+				{bucketRelationsFrom, r.From},
+				{bucketRelationsTo, r.To},
+				{bucketRelationsProvider, r.Provider},
+				{bucketRelationsPair, pairKey(r.From, r.To)},
+				{bucketRelationsSlot, slotKey(r.Slot)},
+				{bucketRelationsConnected, connectedKey(r.ConnectedAt)},
+			}
+			if r.Tree != "" {
+				entries = append(entries, indexEntry{bucketRelationsTree, r.Tree})
+			}
+			if r.LeafIndex != nil {
+				entries = append(entries, indexEntry{bucketRelationsLeaf, leafKey(r.Tree, *r.LeafIndex)})
+			}
+			if r.Kind != "" {
+				entries = append(entries, indexEntry{bucketRelationsKind, r.Kind})
+			}
+
+			if err := b.addToIndexes(tx, id, entries...); err != nil {
+				return err
+			}
+		}
+		if err := b.applyFollowDeltas(tx, followDeltas(inserted, 1)); err != nil {
+			return err
+		}
+
+		// updates may have been written before relations they update
+		var closed []types.Relation
+		for _, r := range inserted {
+			if r.LeafIndex == nil {
+				continue
+			}
+			updates, err := b.takePending(tx, r.Tree, *r.LeafIndex)
+			if err != nil {
+				return err
+			}
+			for _, u := range updates {
+				updated, ok, err := b.updateRelation(tx, u)
+				if err != nil {
+					return err
+				}
+				if ok && u.Close {
+					closed = append(closed, updated)
+				}
+			}
+		}
+		return b.applyFollowDeltas(tx, followDeltas(closed, -1))
+	})
+	if err != nil {
+		return fmt.Errorf("insert relations: %w", err)
+	}
+	return nil
+}
+
+// findLeaf returns id of relation stored under the leaf
+func (b Bolt) findLeaf(tx *bolt.Tx, tree string, leafIndex uint32) (uint64, bool) {
+	prefix := []byte(leafKey(tree, leafIndex) + "|")
+	k, _ := b.projection(tx, bucketRelationsLeaf).Cursor().Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return 0, false
+	}
+	return btoi(k[len(k)-8:]), true
+}
+
+// UpdateRelations applies updates in order and returns relations they have changed.
+// Already applied updates are ignored, updates of relations not stored yet wait for them in pending updates
+func (b Bolt) UpdateRelations(ctx context.Context, updates []types.RelationUpdate) ([]types.Relation, error) {
+	var updated []types.Relation
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		updated = nil
+
+		var closed []types.Relation
+		for _, u := range updates {
+			if _, ok := b.findLeaf(tx, u.Tree, u.LeafIndex); !ok {
+				data, err := json.Marshal(u)
+				if err != nil {
+					return err
+				}
+				if err := b.projection(tx, bucketPendingUpdates).Put(pendingKey(u), data); err != nil {
+					return err
+				}
+				continue
+			}
+
+			r, ok, err := b.updateRelation(tx, u)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if u.Close {
+				closed = append(closed, r)
+			}
+			updated = append(updated, r)
+		}
+
+		return b.applyFollowDeltas(tx, followDeltas(closed, -1))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update relations: %w", err)
+	}
+
+	return updated, nil
+}
+
+// updateRelation applies update to stored relation, unless it's applied already
+func (b Bolt) updateRelation(tx *bolt.Tx, u types.RelationUpdate) (types.Relation, bool, error) {
+	id, ok := b.findLeaf(tx, u.Tree, u.LeafIndex)
+	if !ok {
+		return types.Relation{}, false, nil
+	}
+
+	relations := b.projection(tx, bucketRelations)
+
+	var r types.Relation
+	if err := get(relations, id, &r); err != nil {
+		return types.Relation{}, false, err
+	}
+	if r.Seq >= u.Seq || (u.Close && r.DisconnectedAt != nil) {
+		return types.Relation{}, false, nil
+	}
+
+	r.Seq = u.Seq
+	if u.Close {
+		closedAt, closedSlot := u.UpdatedAt, u.Slot
+		r.DisconnectedAt, r.ClosedSlot = &closedAt, &closedSlot
+	} else {
+		r.History = append(r.History, types.ExtraEdit{
+			Extra: r.Extra, Kind: r.Kind, ExtraDecoded: r.ExtraDecoded, EditedAt: u.UpdatedAt, Slot: u.Slot,
+		})
+		// edit may declare another kind
+		if r.Kind != u.Kind {
+			kinds := b.projection(tx, bucketRelationsKind)
+			if r.Kind != "" {
+				if err := kinds.Delete(indexKey(r.Kind, id)); err != nil {
+					return types.Relation{}, false, err
+				}
+			}
+			if u.Kind != "" {
+				if err := b.addToIndexes(tx, id, indexEntry{bucketRelationsKind, u.Kind}); err != nil {
+					return types.Relation{}, false, err
+				}
+			}
+		}
+		r.Extra, r.Kind, r.ExtraDecoded = u.Extra, u.Kind, u.ExtraDecoded
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return types.Relation{}, false, err
+	}
+	if err := relations.Put(itob(id), data); err != nil {
+		return types.Relation{}, false, err
+	}
+	return r, true, nil
+}
+
+// takePending removes pending updates of the leaf and returns them in order of seq
+func (b Bolt) takePending(tx *bolt.Tx, tree string, leafIndex uint32) ([]types.RelationUpdate, error) {
+	pending := b.projection(tx, bucketPendingUpdates)
+	prefix := []byte(leafKey(tree, leafIndex) + "|")
+
+	var (
+		updates []types.RelationUpdate
+		keys    [][]byte
+	)
+	c := pending.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var u types.RelationUpdate
+		if err := json.Unmarshal(v, &u); err != nil {
+			return nil, err
+		}
+		updates = append(updates, u)
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	for _, k := range keys {
+		if err := pending.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return updates, nil
+}
+
+func (b Bolt) applyCounterDeltas(tx *bolt.Tx, deltas map[counterKey]counterDelta) error {
+	counters := b.projection(tx, bucketCounters)
+
+	for key, d := range deltas {
+		k := []byte(key.address + "|" + key.provider)
+
+		var current counterDelta
+		if data := counters.Get(k); data != nil {
+			if err := json.Unmarshal(data, &current); err != nil {
+				return err
+			}
+		}
+
+		current.Followers += d.Followers
+		current.Following += d.Following
+
+		data, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		if err := counters.Put(k, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFollowDeltas updates follows, and counters of the ones that have started or stopped
+func (b Bolt) applyFollowDeltas(tx *bolt.Tx, deltas map[followKey]int64) error {
+	follows := b.projection(tx, bucketFollows)
+
+	changes := make(map[followKey]int64)
+	for key, d := range deltas {
+		k := []byte(key.String())
+
+		var before int64
+		if data := follows.Get(k); data != nil {
+			if err := json.Unmarshal(data, &before); err != nil {
+				return err
+			}
+		}
+		after := before + d
+		if change := followChange(before, after); change != 0 {
+			changes[key] = change
+		}
+
+		if after <= 0 {
+			if err := follows.Delete(k); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		if err := follows.Put(k, data); err != nil {
+			return err
+		}
+	}
+
+	return b.applyCounterDeltas(tx, followCounterDeltas(changes))
+}
+
+// recountFollows drops relations saved twice for the same leaf and counts follows and counters from scratch
+func (b Bolt) recountFollows(tx *bolt.Tx) error {
+	relations := tx.Bucket(bucketRelations)
+
+	seen := make(map[string]bool)
+	duplicates := make(map[uint64]types.Relation)
+	deltas := make(map[followKey]int64)
+	err := relations.ForEach(func(k, v []byte) error {
+		var r types.Relation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if r.LeafIndex != nil {
+			leaf := leafKey(r.Tree, *r.LeafIndex)
+			if seen[leaf] {
+				duplicates[btoi(k)] = r
+				return nil
+			}
+			seen[leaf] = true
+		}
+		for key, d := range followDeltas([]types.Relation{r}, 1) {
+			deltas[key] += d
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the first copy stays
+	for id, r := range duplicates {
+		if err := relations.Delete(itob(id)); err != nil {
+			return err
+		}
+		entries := []indexEntry{
+			{bucketRelationsFrom, r.From},
+			{bucketRelationsTo, r.To},
+			{bucketRelationsProvider, r.Provider},
+			{bucketRelationsPair, pairKey(r.From, r.To)},
+			{bucketRelationsTree, r.Tree},
+			{bucketRelationsLeaf, leafKey(r.Tree, *r.LeafIndex)},
+			{bucketRelationsKind, r.Kind},
+			{bucketRelationsSlot, slotKey(r.Slot)},
+			{bucketRelationsConnected, connectedKey(r.ConnectedAt)},
+		}
+		for _, e := range entries {
+			// kind index may not exist yet
+			if index := tx.Bucket(e.bucket); index != nil {
+				if err := index.Delete(indexKey(e.value, id)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if tx.Bucket(bucketCounters) != nil {
+		if err := tx.DeleteBucket(bucketCounters); err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{bucketCounters, bucketFollows} {
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+
+	return b.applyFollowDeltas(tx, deltas)
+}
+
+// logScan scans instructions log within tx, for backfills run before buckets are created
+func logScan(tx *bolt.Tx) func(fn func(types.Instruction) error) error {
+	return func(fn func(types.Instruction) error) error {
+		insts := tx.Bucket(bucketInstructions)
+		if insts == nil {
+			return nil
+		}
+		return insts.ForEach(func(k, v []byte) error {
+			var inst types.Instruction
+			if err := json.Unmarshal(v, &inst); err != nil {
+				return err
+			}
+			return fn(inst)
+		})
+	}
+}
+
+func (b Bolt) backfillSlots(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(bucketRelationsSlot)
+	if err != nil {
+		return err
+	}
+
+	leaves, err := logSlots(logScan(tx))
+	if err != nil {
+		return fmt.Errorf("collect slots: %w", err)
+	}
+
+	relations := tx.Bucket(bucketRelations)
+	updated := make(map[string][]byte)
+	err = relations.ForEach(func(k, v []byte) error {
+		var r types.Relation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if fillSlots(&r, leaves) {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = data
+		}
+		return index.Put(indexKey(slotKey(r.Slot), btoi(k)), nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, data := range updated {
+		if err := relations.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b Bolt) backfillTree(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(bucketRelationsTree)
+	if err != nil {
+		return err
+	}
+
+	tree, err := programTree(logScan(tx))
+	if err != nil {
+		return fmt.Errorf("find program tree: %w", err)
+	}
+	// nothing to fill relations with until the log names the tree
+	if tree == "" {
+		return nil
+	}
+
+	treeJSON, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+
+	fill := func(bucket *bolt.Bucket, index *bolt.Bucket) error {
+		updated := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			// fields are kept as they are, relations and skipped relations alike
+			var record map[string]json.RawMessage
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			var current string
+			if t, ok := record["tree"]; ok {
+				if err := json.Unmarshal(t, &current); err != nil {
+					return err
+				}
+			}
+			if current != "" {
+				return nil
+			}
+			record["tree"] = treeJSON
+
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, data := range updated {
+			if err := bucket.Put([]byte(k), data); err != nil {
+				return err
+			}
+			if index != nil {
+				if err := index.Put(indexKey(tree, btoi([]byte(k))), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := fill(tx.Bucket(bucketRelations), index); err != nil {
+		return err
+	}
+	if skipped := tx.Bucket(bucketSkipped); skipped != nil {
+		return fill(skipped, nil)
+	}
+	return nil
+}
+
+func (b Bolt) backfillLeafIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(bucketRelationsLeaf)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketRelations).ForEach(func(k, v []byte) error {
+		var r types.Relation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if r.LeafIndex == nil {
+			return nil
+		}
+		return index.Put(indexKey(leafKey(r.Tree, *r.LeafIndex), btoi(k)), nil)
+	})
+}
+
+func (b Bolt) backfillKind(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(bucketRelationsKind)
+	if err != nil {
+		return err
+	}
+
+	relations := tx.Bucket(bucketRelations)
+	updated := make(map[string][]byte)
+	err = relations.ForEach(func(k, v []byte) error {
+		var r types.Relation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if r.Kind = extraKind(r.Extra); r.Kind == "" {
+			return nil
+		}
+
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		updated[string(k)] = data
+		return index.Put(indexKey(r.Kind, btoi(k)), nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, data := range updated {
+		if err := relations.Put([]byte(k), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b Bolt) backfillConnectedIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(bucketRelationsConnected)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketRelations).ForEach(func(k, v []byte) error {
+		var r types.Relation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		return index.Put(indexKey(connectedKey(r.ConnectedAt), btoi(k)), nil)
+	})
+}
+
+func (b Bolt) backfillPairIndex(tx *bolt.Tx) error {
+	index, err := tx.CreateBucket(bucketRelationsPair)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(bucketRelations).ForEach(func(k, v []byte) error {
+		var r types.Relation
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		return index.Put(indexKey(pairKey(r.From, r.To), btoi(k)), nil)
+	})
+}
+
+// FetchCounters returns counters of addresses, in the same order
+func (b Bolt) FetchCounters(ctx context.Context, addresses []string) ([]types.Counters, error) {
+	found := make(map[counterKey]counterDelta)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := b.projection(tx, bucketCounters).Cursor()
+
+		for _, address := range addresses {
+			prefix := []byte(address + "|")
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				var d counterDelta
+				if err := json.Unmarshal(v, &d); err != nil {
+					return err
+				}
+				found[counterKey{address, string(k[len(prefix):])}] = d
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch counters: %w", err)
+	}
+
+	return assembleCounters(addresses, found), nil
+}
+
+func (b Bolt) FetchRelations(ctx context.Context, q RelationsQuery) ([]types.Relation, string, error) {
+	handleErr := func(err error) ([]types.Relation, string, error) {
+		return nil, "", fmt.Errorf("fetch relations: %w", err)
+	}
+
+	after, err := decodeCursor(q)
+	if err != nil {
+		return handleErr(err)
+	}
+	var afterID uint64
+	if after != nil {
+		if afterID, err = strconv.ParseUint(after.ID, 10, 64); err != nil {
+			return handleErr(ErrInvalidCursor)
+		}
+	}
+
+	asc := q.Order == OrderAsc
+
+	// extra and its kind are matched as they were at AsOf
+	match := func(r types.Relation) bool {
+		r = q.asOf(r)
+		return (q.From == "" || r.From == q.From) &&
+			(q.To == "" || r.To == q.To) &&
+			q.matchesPairs(r) &&
+			(len(q.Providers) == 0 || contains(q.Providers, r.Provider)) &&
+			(q.Tree == "" || r.Tree == q.Tree) &&
+			(len(q.Kinds) == 0 || contains(q.Kinds, r.Kind)) &&
+			q.matchesPoints(r) &&
+			hasFields(r.ExtraDecoded, q.ExtraFields)
+	}
+
+	var (
+		relations []types.Relation
+		ids       []uint64
+	)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		records := b.projection(tx, bucketRelations)
+
+		var scans []scan
+		switch {
+		case len(q.Pairs) > 0:
+			for _, p := range q.Pairs {
+				scans = append(scans, scan{b.projection(tx, bucketRelationsPair), pairKey(p.From, p.To)})
+			}
+		case q.From != "":
+			scans = []scan{{b.projection(tx, bucketRelationsFrom), q.From}}
+		case q.To != "":
+			scans = []scan{{b.projection(tx, bucketRelationsTo), q.To}}
+		case len(q.Providers) > 0:
+			for _, p := range q.Providers {
+				scans = append(scans, scan{b.projection(tx, bucketRelationsProvider), p})
+			}
+		case q.Tree != "":
+			scans = []scan{{b.projection(tx, bucketRelationsTree), q.Tree}}
+		// kind index has current kinds only
+		case len(q.Kinds) > 0 && q.AsOf == nil:
+			for _, k := range q.Kinds {
+				scans = append(scans, scan{b.projection(tx, bucketRelationsKind), k})
+			}
+		}
+
+		var err error
+		switch {
+		// without selective filter relations are walked in order of the sort, a page reads no further than its end
+		case len(scans) == 0:
+			relations, ids, err = b.walkSorted(tx, q, after, afterID, match)
+
+		// filter indexes are ordered by insertion, their scans are merged
+		case q.Sort == SortInserted:
+			past := afterID
+			if after == nil && !asc {
+				past = ^uint64(0)
+			}
+			var found map[uint64]types.Relation
+			if found, err = collectFound(records, scans, past, asc, q.Limit, match); err != nil {
+				return err
+			}
+			ids = keysOf(found)
+			sort.Slice(ids, func(i, j int) bool { return (ids[i] < ids[j]) == asc })
+			if uint(len(ids)) > q.Limit {
+				ids = ids[:q.Limit]
+			}
+			relations = sliceMap(ids, func(id uint64) types.Relation { return found[id] })
+
+		// relations of selective filters are few, they are sorted in memory
+		default:
+			var found map[uint64]types.Relation
+			if found, err = collectFound(records, scans, ^uint64(0), false, ^uint(0), match); err != nil {
+				return err
+			}
+			relations, ids = sortFound(q, found, after, afterID)
+		}
+		return err
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	next, err := nextCursor(q, relations, func(i int) string { return strconv.FormatUint(ids[i], 10) })
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return sliceMap(relations, q.asOf), next, nil
+}
+
+// walkSorted reads up to Limit relations matching, past the cursor in order of the query. Sort indexes are keyed
+// by `value|id`, so ties are ordered by insertion
+func (b Bolt) walkSorted(tx *bolt.Tx, q RelationsQuery, after *relationsCursor, afterID uint64,
+	match func(types.Relation) bool) ([]types.Relation, []uint64, error) {
+	records := b.projection(tx, bucketRelations)
+
+	c, idOf := records.Cursor(), btoi
+	var from []byte
+	switch q.Sort {
+	case SortConnectedAt:
+		c, idOf = b.projection(tx, bucketRelationsConnected).Cursor(), indexID
+		if after != nil && after.Time != nil {
+			from = indexKey(connectedKey(*after.Time), afterID)
+		}
+	case SortSlot:
+		c, idOf = b.projection(tx, bucketRelationsSlot).Cursor(), indexID
+		if after != nil {
+			from = indexKey(slotKey(after.Slot), afterID)
+		}
+	default:
+		if after != nil {
+			from = itob(afterID)
+		}
+	}
+
+	var (
+		relations []types.Relation
+		ids       []uint64
+	)
+	err := walk(c, nil, from, q.Order == OrderAsc, func(k []byte) (bool, error) {
+		id := idOf(k)
+		var r types.Relation
+		if err := get(records, id, &r); err != nil {
+			return false, err
+		}
+		if match(r) {
+			relations, ids = append(relations, r), append(ids, id)
+		}
+		return uint(len(ids)) < q.Limit, nil
+	})
+	return relations, ids, err
+}
+
+// sortFound orders relations by the sort of the query and returns a page of them past the cursor
+func sortFound(q RelationsQuery, found map[uint64]types.Relation, after *relationsCursor,
+	afterID uint64) ([]types.Relation, []uint64) {
+	// compare orders relations by sort key, then by id, ascending
+	compare := func(a types.Relation, aID uint64, b types.Relation, bID uint64) bool {
+		switch {
+		case q.Sort == SortConnectedAt && !a.ConnectedAt.Equal(b.ConnectedAt):
+			return a.ConnectedAt.Before(b.ConnectedAt)
+		case q.Sort == SortSlot && a.Slot != b.Slot:
+			return a.Slot < b.Slot
+		}
+		return aID < bID
+	}
+	less := func(a types.Relation, aID uint64, b types.Relation, bID uint64) bool {
+		if q.Order == OrderAsc {
+			return compare(a, aID, b, bID)
+		}
+		return compare(b, bID, a, aID)
+	}
+
+	ids := keysOf(found)
+	if after != nil {
+		position := types.Relation{Slot: after.Slot}
+		if after.Time != nil {
+			position.ConnectedAt = *after.Time
+		}
+		remaining := ids[:0]
+		for _, id := range ids {
+			if less(position, afterID, found[id], id) {
+				remaining = append(remaining, id)
+			}
+		}
+		ids = remaining
+	}
+	sort.Slice(ids, func(i, j int) bool { return less(found[ids[i]], ids[i], found[ids[j]], ids[j]) })
+	if uint(len(ids)) > q.Limit {
+		ids = ids[:q.Limit]
+	}
+
+	return sliceMap(ids, func(id uint64) types.Relation { return found[id] }), ids
+}
+
+// ScanRelations calls fn for every stored relation, oldest first
+func (b Bolt) ScanRelations(ctx context.Context, fn func(types.Relation) error) error {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return b.projection(tx, bucketRelations).ForEach(func(k, v []byte) error {
+			var r types.Relation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			return fn(r)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("scan relations: %w", err)
+	}
+	return nil
+}
+
+// QuarantinedSlots returns slots with quarantined transactions
+func (b Bolt) QuarantinedSlots(ctx context.Context) ([]uint64, error) {
+	found := make(map[uint64]bool)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketQuarantine).ForEach(func(k, v []byte) error {
+			var q types.QuarantinedTx
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			found[q.Slot] = true
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("find quarantined slots: %w", err)
+	}
+	return keysOf(found), nil
+}
+
+// ReleaseQuarantine removes transactions quarantined in slots
+func (b Bolt) ReleaseQuarantine(ctx context.Context, slots []uint64) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketQuarantine)
+
+		var released [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			var q types.QuarantinedTx
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			if contains(slots, q.Slot) {
+				released = append(released, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range released {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("release quarantine: %w", err)
+	}
+	return nil
+}
+
+func (b Bolt) QuarantineTransactions(ctx context.Context, txs []types.QuarantinedTx) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, t := range txs {
+			if _, err := insert(tx.Bucket(bucketQuarantine), t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("insert quarantined transactions: %w", err)
+	}
+	return nil
+}
+
+func (b Bolt) SaveProviders(ctx context.Context, providers []types.Provider) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range providers {
+			data, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := b.projection(tx, bucketProviders).Put([]byte(p.Address), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("upsert providers: %w", err)
+	}
+	return nil
+}
+
+func (b Bolt) FetchProviders(ctx context.Context, addresses []string) ([]types.Provider, error) {
+	var providers []types.Provider
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, address := range addresses {
+			data := b.projection(tx, bucketProviders).Get([]byte(address))
+			if data == nil {
+				continue
+			}
+
+			var p types.Provider
+			if err := json.Unmarshal(data, &p); err != nil {
+				return err
+			}
+			providers = append(providers, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch providers: %w", err)
+	}
+
+	return providers, nil
+}
+
+// ScanSkipped calls fn for every skipped relation, in order of execution
+func (b Bolt) ScanSkipped(ctx context.Context, fn func(types.SkippedRelation) error) error {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return b.projection(tx, bucketSkipped).ForEach(func(k, v []byte) error {
+			var s types.SkippedRelation
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			return fn(s)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("scan skipped relations: %w", err)
+	}
+	return nil
+}
+
+// ScanProviders calls fn for every stored provider
+func (b Bolt) ScanProviders(ctx context.Context, fn func(types.Provider) error) error {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return b.projection(tx, bucketProviders).ForEach(func(k, v []byte) error {
+			var p types.Provider
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			return fn(p)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("scan providers: %w", err)
+	}
+	return nil
+}
+
+// SaveInstructions appends instructions to the log. Instructions are keyed by position, so retries overwrite them
+func (b Bolt) SaveInstructions(ctx context.Context, insts []types.Instruction) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, inst := range insts {
+			data, err := json.Marshal(inst)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketInstructions).Put(instructionKey(inst), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("insert instructions: %w", err)
+	}
+	return nil
+}
+
+// ScanInstructions calls fn for every logged instruction, in order of execution
+func (b Bolt) ScanInstructions(ctx context.Context, fn func(types.Instruction) error) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("scan instructions: %w", err)
+	}
+
+	var after []byte
+	for {
+		var chunk []types.Instruction
+
+		err := b.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(bucketInstructions).Cursor()
+
+			k, v := c.First()
+			if after != nil {
+				if k, v = c.Seek(after); bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+
+			for ; k != nil && len(chunk) < instructionsScanChunk; k, v = c.Next() {
+				var inst types.Instruction
+				if err := json.Unmarshal(v, &inst); err != nil {
+					return err
+				}
+				chunk = append(chunk, inst)
+				after = append(after[:0], k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return handleErr(err)
+		}
+
+		for _, inst := range chunk {
+			if err := fn(inst); err != nil {
+				return err
+			}
+		}
+
+		if len(chunk) < instructionsScanChunk {
+			return nil
+		}
+	}
+}
+
+// RebuildProjections lets build fill fresh projection buckets, then swaps them with current ones in a single
+// transaction. Indexer must be stopped during rebuild, otherwise whatever it writes meanwhile is lost
+func (b Bolt) RebuildProjections(ctx context.Context, build func(Projections) error) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("rebuild projections: %w", err)
+	}
+
+	staging := b
+	staging.staging = "rebuild_"
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range projectionBuckets {
+			name = append([]byte(staging.staging), name...)
+
+			// leftovers of interrupted rebuild
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	if err := build(staging); err != nil {
+		return handleErr(err)
+	}
+
+	// bbolt can't rename buckets, so staging ones are copied over
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range projectionBuckets {
+			src := staging.projection(tx, name)
+
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			dst, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+
+			// staging bucket is deleted within the same transaction, so its memory can't be referenced
+			err = src.ForEach(func(k, v []byte) error {
+				return dst.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+			})
+			if err != nil {
+				return fmt.Errorf("swap %s: %w", name, err)
+			}
+			if err := dst.SetSequence(src.Sequence()); err != nil {
+				return err
+			}
+
+			if err := tx.DeleteBucket(append([]byte(staging.staging), name...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return nil
+}
+
+// SaveSkipped records relations left out by ingest rules. Skipped relations are keyed by position, so retries overwrite them
+func (b Bolt) SaveSkipped(ctx context.Context, skipped []types.SkippedRelation) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, s := range skipped {
+			data, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if err := b.projection(tx, bucketSkipped).Put([]byte(s.Position), data); err != nil {
+				return err
+			}
+			if err := b.projection(tx, bucketSkippedProvider).Put([]byte(s.Provider+"|"+s.Position), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("insert skipped relations: %w", err)
+	}
+	return nil
+}
+
+// FetchSkipped returns skipped relations of provider in order of execution, starting after given position
+func (b Bolt) FetchSkipped(ctx context.Context, provider, after string, limit uint) ([]types.SkippedRelation, error) {
+	var skipped []types.SkippedRelation
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(provider + "|")
+		start := append(prefix, after...)
+
+		c := tx.Bucket(bucketSkippedProvider).Cursor()
+
+		k, _ := c.Seek(start)
+		if after != "" && bytes.Equal(k, start) {
+			k, _ = c.Next()
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix) && uint(len(skipped)) < limit; k, _ = c.Next() {
+			var s types.SkippedRelation
+			if err := json.Unmarshal(tx.Bucket(bucketSkipped).Get(k[len(prefix):]), &s); err != nil {
+				return err
+			}
+			skipped = append(skipped, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch skipped relations: %w", err)
+	}
+
+	return skipped, nil
+}
+
+// FetchLedger counts indexed and skipped relations of providers
+func (b Bolt) FetchLedger(ctx context.Context, providers []string) ([]types.LedgerEntry, error) {
+	count := func(index *bolt.Bucket, value string) int64 {
+		prefix := []byte(value + "|")
+
+		var n int64
+		c := index.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			n++
+		}
+		return n
+	}
+
+	var ledger []types.LedgerEntry
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		ledger = sliceMap(providers, func(provider string) types.LedgerEntry {
+			return types.LedgerEntry{
+				Provider: provider,
+				Indexed:  count(b.projection(tx, bucketRelationsProvider), provider),
+				Skipped:  count(tx.Bucket(bucketSkippedProvider), provider),
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch ledger: %w", err)
+	}
+
+	return ledger, nil
+}
+
+// SaveTrees records discovered trees. State of already known trees is kept
+func (b Bolt) SaveTrees(ctx context.Context, trees []types.Tree) error {
+	err := b.updateTrees(func(get func(string) (types.Tree, error), put func(types.Tree) error) error {
+		for _, t := range trees {
+			current, err := get(t.Address)
+			if err != nil {
+				return err
+			}
+			t.TreeState = current.TreeState
+			if err := put(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("upsert trees: %w", err)
+	}
+	return nil
+}
+
+// AdvanceTrees applies states of trees. Root is only replaced by the one of a later change log
+func (b Bolt) AdvanceTrees(ctx context.Context, states map[string]types.TreeState) error {
+	err := b.updateTrees(func(get func(string) (types.Tree, error), put func(types.Tree) error) error {
+		for address, s := range states {
+			t, err := get(address)
+			if err != nil {
+				return err
+			}
+			if s.LeafCount > t.LeafCount {
+				t.LeafCount = s.LeafCount
+			}
+			if s.Seq > t.Seq {
+				t.Seq, t.Root = s.Seq, s.Root
+			}
+			if err := put(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("advance trees: %w", err)
+	}
+	return nil
+}
+
+// updateTrees runs fn in a write transaction. get returns zero tree with given address when it's unknown
+func (b Bolt) updateTrees(fn func(get func(string) (types.Tree, error), put func(types.Tree) error) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketTrees)
+
+		get := func(address string) (types.Tree, error) {
+			t := types.Tree{Address: address}
+			if data := bucket.Get([]byte(address)); data != nil {
+				if err := json.Unmarshal(data, &t); err != nil {
+					return types.Tree{}, err
+				}
+			}
+			return t, nil
+		}
+		put := func(t types.Tree) error {
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(t.Address), data)
+		}
+
+		return fn(get, put)
+	})
+}
+
+func (b Bolt) FetchTrees(ctx context.Context) ([]types.Tree, error) {
+	var trees []types.Tree
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrees).ForEach(func(_, v []byte) error {
+			var t types.Tree
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			trees = append(trees, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch trees: %w", err)
+	}
+
+	return trees, nil
+}
+
+func (b Bolt) SaveEvents(ctx context.Context, events []types.Event) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		signatures := tx.Bucket(bucketEventsSignature)
+
+		for _, e := range events {
+			// retried batches must not duplicate events
+			key := []byte(e.Signature + "|" + strconv.Itoa(e.Index))
+			if signatures.Get(key) != nil {
+				continue
+			}
+
+			id, err := insert(tx.Bucket(bucketEvents), e)
+			if err != nil {
+				return err
+			}
+
+			if err := signatures.Put(key, itob(id)); err != nil {
+				return err
+			}
+
+			if err := b.addToIndexes(tx, id,
+				indexEntry{bucketEventsActor, e.Actor},
+				indexEntry{bucketEventsTarget, e.Target},
+				indexEntry{bucketEventsProvider, e.Provider},
+				indexEntry{bucketEventsEmittedAt, string(itob(uint64(e.EmittedAt.UnixNano())))},
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("insert events: %w", err)
+	}
+	return nil
+}
+
+func (b Bolt) FetchEvents(ctx context.Context, q EventsQuery) ([]types.Event, string, error) {
+	handleErr := func(err error) ([]types.Event, string, error) {
+		return nil, "", fmt.Errorf("fetch events: %w", err)
+	}
+
+	after, err := decodeEventsCursor(q)
+	if err != nil {
+		return handleErr(err)
+	}
+	before := ^uint64(0)
+	if after != "" {
+		if before, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return handleErr(ErrInvalidCursor)
+		}
+	}
+
+	match := func(e types.Event) bool {
+		return (q.Actor == "" || e.Actor == q.Actor) &&
+			(q.Target == "" || e.Target == q.Target) &&
+			(len(q.Providers) == 0 || contains(q.Providers, e.Provider)) &&
+			(q.IncludeUnverified || e.Verified) &&
+			(q.Since.IsZero() || !e.EmittedAt.Before(q.Since)) &&
+			(q.Until.IsZero() || e.EmittedAt.Before(q.Until))
+	}
+
+	var (
+		events []types.Event
+		ids    []uint64
+	)
+
+	err = b.db.View(func(tx *bolt.Tx) error {
+		var scans []scan
+		switch {
+		case q.Actor != "":
+			scans = []scan{{tx.Bucket(bucketEventsActor), q.Actor}}
+		case q.Target != "":
+			scans = []scan{{tx.Bucket(bucketEventsTarget), q.Target}}
+		case len(q.Providers) > 0:
+			for _, p := range q.Providers {
+				scans = append(scans, scan{tx.Bucket(bucketEventsProvider), p})
+			}
+		default:
+			scans = []scan{{nil, ""}}
+		}
+
+		events, ids, err = collect(tx.Bucket(bucketEvents), scans, before, q.Limit, match)
+		return err
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	next, err := nextEventsCursor(q, events, func(i int) string { return strconv.FormatUint(ids[i], 10) })
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return events, next, nil
+}
+
+// PruneEvents removes events older than retention
+func (b Bolt) PruneEvents(ctx context.Context, retention time.Duration) error {
+	cutoff := itob(uint64(time.Now().Add(-retention).UnixNano()))
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var ids []uint64
+
+		c := tx.Bucket(bucketEventsEmittedAt).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], cutoff) < 0; k, _ = c.Next() {
+			ids = append(ids, btoi(k[len(k)-8:]))
+		}
+
+		for _, id := range ids {
+			var e types.Event
+			if err := get(tx.Bucket(bucketEvents), id, &e); err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(bucketEvents).Delete(itob(id)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketEventsSignature).Delete([]byte(e.Signature + "|" + strconv.Itoa(e.Index))); err != nil {
+				return err
+			}
+			if err := removeFromIndexes(tx, id,
+				indexEntry{bucketEventsActor, e.Actor},
+				indexEntry{bucketEventsTarget, e.Target},
+				indexEntry{bucketEventsProvider, e.Provider},
+				indexEntry{bucketEventsEmittedAt, string(itob(uint64(e.EmittedAt.UnixNano())))},
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("prune events: %w", err)
+	}
+	return nil
+}
+
+type indexEntry struct {
+	bucket []byte
+	value  string
+}
+
+func instructionKey(inst types.Instruction) []byte {
+	return positionKey(inst.Slot, inst.TxIndex, inst.Outer, inst.Inner)
+}
+
+// hasFields reports whether fields have all wanted values. Values are compared in JSON form,
+// which is how decoded fields are stored
+func hasFields(fields, wanted map[string]any) bool {
+	for name, value := range wanted {
+		have, ok := fields[name]
+		if !ok {
+			return false
+		}
+		a, errA := json.Marshal(have)
+		b, errB := json.Marshal(value)
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+func pairKey(from, to string) string {
+	return from + "|" + to
+}
+
+// pendingKey orders pending updates of a leaf by seq
+func pendingKey(u types.RelationUpdate) []byte {
+	return append([]byte(leafKey(u.Tree, u.LeafIndex)+"|"), itob(u.Seq)...)
+}
+
+// slotKey orders slots numerically
+func slotKey(slot uint64) string {
+	return string(itob(slot))
+}
+
+// connectedKey orders block times numerically, they are whole seconds
+func connectedKey(t time.Time) string {
+	sec := t.Unix()
+	if sec < 0 {
+		sec = 0
+	}
+	return string(itob(uint64(sec)))
+}
+
+func leafKey(tree string, leafIndex uint32) string {
+	return tree + "|" + strconv.FormatUint(uint64(leafIndex), 10)
+}
+
+func indexKey(value string, id uint64) []byte {
+	return append([]byte(value+"|"), itob(id)...)
+}
+
+func (b Bolt) addToIndexes(tx *bolt.Tx, id uint64, entries ...indexEntry) error {
+	for _, e := range entries {
+		if err := b.projection(tx, e.bucket).Put(indexKey(e.value, id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeFromIndexes(tx *bolt.Tx, id uint64, entries ...indexEntry) error {
+	for _, e := range entries {
+		if err := tx.Bucket(e.bucket).Delete(indexKey(e.value, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insert(b *bolt.Bucket, record any) (uint64, error) {
+	id, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, b.Put(itob(id), data)
+}
+
+func get(b *bolt.Bucket, id uint64, record any) error {
+	data := b.Get(itob(id))
+	if data == nil {
+		return fmt.Errorf("record %d not found", id)
+	}
+	return json.Unmarshal(data, record)
+}
+
+// scan walks ids of index entries with given value. Nil index walks all records
+type scan struct {
+	index *bolt.Bucket
+	value string
+}
+
+// ids returns up to limit ids past `past`: below it newest first, above it oldest first when asc
+func (s scan) ids(records *bolt.Bucket, past uint64, asc bool, limit uint, match func(id uint64) (bool, error)) ([]uint64, error) {
+	var ids []uint64
+
+	c, prefix, from, idOf := records.Cursor(), []byte(nil), itob(past), btoi
+	if s.index != nil {
+		c, prefix, from, idOf = s.index.Cursor(), []byte(s.value+"|"), indexKey(s.value, past), indexID
+	}
+
+	err := walk(c, prefix, from, asc, func(k []byte) (bool, error) {
+		id := idOf(k)
+		ok, err := match(id)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			ids = append(ids, id)
+		}
+		return uint(len(ids)) < limit, nil
+	})
+	return ids, err
+}
+
+// walk calls fn with keys of prefix past `from`, descending unless asc, until fn asks to stop.
+// Nil from starts at the first (or last) key of prefix
+func walk(c *bolt.Cursor, prefix, from []byte, asc bool, fn func(k []byte) (bool, error)) error {
+	var k []byte
+	switch {
+	case asc && from == nil:
+		k, _ = c.Seek(prefix)
+	case asc:
+		if k, _ = c.Seek(from); bytes.Equal(k, from) {
+			k, _ = c.Next()
+		}
+	default:
+		if from == nil && len(prefix) > 0 {
+			// above every `prefix|id` key
+			from = append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xff}, 9)...)
+		}
+		// seek lands on the first key >= from, we need the ones strictly below it
+		if k = nil; from != nil {
+			k, _ = c.Seek(from)
+		}
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+	}
+
+	next := c.Prev
+	if asc {
+		next = c.Next
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, _ = next() {
+		more, err := fn(k)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexID is id index key ends with
+func indexID(k []byte) uint64 {
+	return btoi(k[len(k)-8:])
+}
+
+// collect merges results of scans, newest first, along with their ids
+func collect[T any](records *bolt.Bucket, scans []scan, before uint64, limit uint, match func(T) bool) ([]T, []uint64, error) {
+	found, err := collectFound(records, scans, before, false, limit, match)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := keysOf(found)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	if uint(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+
+	return sliceMap(ids, func(id uint64) T { return found[id] }), ids, nil
+}
+
+// collectFound returns records of scans matching, by id. Every scan contributes up to limit of them, past `past`
+func collectFound[T any](records *bolt.Bucket, scans []scan, past uint64, asc bool, limit uint, match func(T) bool) (map[uint64]T, error) {
+	found := make(map[uint64]T)
+
+	for _, s := range scans {
+		_, err := s.ids(records, past, asc, limit, func(id uint64) (bool, error) {
+			var record T
+			if err := get(records, id, &record); err != nil {
+				return false, err
+			}
+			if !match(record) {
+				return false, nil
+			}
+			found[id] = record
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return found, nil
+}
+
+func contains[T comparable](items []T, item T) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func keysOf[K comparable, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,643 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/portto/solana-go-sdk/common"
+	soltypes "github.com/portto/solana-go-sdk/types"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+func newTestBolt(t *testing.T) Bolt {
+	t.Helper()
+
+	db, closeDB, err := OpenBolt(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeDB() })
+
+	b, err := NewBolt(db, lgr.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func leafRelation(from, to string, leafIndex uint32) types.Relation {
+	return types.Relation{From: from, To: to, Provider: "p", Tree: "t", LeafIndex: &leafIndex, ConnectedAt: time.Unix(1, 0)}
+}
+
+// followers returns total followers and following of address
+func followers(t *testing.T, b Bolt, address string) (int64, int64) {
+	t.Helper()
+
+	counters, err := b.FetchCounters(context.Background(), []string{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counters[0].Followers, counters[0].Following
+}
+
+func TestBoltSaveRelationsIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	batch := []types.Relation{leafRelation("a", "b", 0), leafRelation("a", "c", 1)}
+	for i := 0; i < 2; i++ {
+		if err := b.SaveRelations(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	relations, _, err := b.FetchRelations(ctx, RelationsQuery{From: "a", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 2 {
+		t.Errorf("stored %d relations after retry, want 2", len(relations))
+	}
+	if _, following := followers(t, b, "a"); following != 2 {
+		t.Errorf("following = %d, want 2", following)
+	}
+}
+
+func TestBoltCountsDistinctFollows(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	if err := b.SaveRelations(ctx, []types.Relation{leafRelation("a", "b", 0), leafRelation("a", "b", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := followers(t, b, "b"); got != 1 {
+		t.Errorf("followers = %d, want 1 for two relations of the same pair", got)
+	}
+
+	for leafIndex, want := range []int64{1, 0} {
+		update := types.RelationUpdate{Tree: "t", LeafIndex: uint32(leafIndex), Seq: 1, Close: true, UpdatedAt: time.Unix(2, 0)}
+		if _, err := b.UpdateRelations(ctx, []types.RelationUpdate{update}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := followers(t, b, "b"); got != want {
+			t.Errorf("followers after closing leaf %d = %d, want %d", leafIndex, got, want)
+		}
+	}
+}
+
+func TestBoltRecountsFollows(t *testing.T) {
+	dir := t.TempDir()
+
+	// database of earlier version: a relation saved twice by a retried batch, counted every time
+	db, closeDB, err := OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketRelations, bucketRelationsFrom, bucketRelationsLeaf, bucketRelationsPair, bucketCounters} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, r := range []types.Relation{leafRelation("a", "b", 0), leafRelation("a", "b", 0), leafRelation("a", "c", 1)} {
+			id, err := insert(tx.Bucket(bucketRelations), r)
+			if err != nil {
+				return err
+			}
+			for _, e := range []indexEntry{{bucketRelationsFrom, r.From}, {bucketRelationsLeaf, leafKey(r.Tree, *r.LeafIndex)}} {
+				if err := tx.Bucket(e.bucket).Put(indexKey(e.value, id), nil); err != nil {
+					return err
+				}
+			}
+		}
+		data, err := json.Marshal(counterDelta{Following: 3})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketCounters).Put([]byte("a|"), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, closeDB, err = OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	b, err := NewBolt(db, lgr.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relations, _, err := b.FetchRelations(context.Background(), RelationsQuery{From: "a", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 2 {
+		t.Errorf("kept %d relations, want 2", len(relations))
+	}
+	if _, following := followers(t, b, "a"); following != 2 {
+		t.Errorf("following = %d, want 2", following)
+	}
+}
+
+func TestBoltAppliesUpdatesWrittenBeforeRelation(t *testing.T) {
+	ctx := context.Background()
+
+	edit := types.RelationUpdate{Tree: "t", LeafIndex: 0, Seq: 1, Extra: []byte("edited"), Kind: "k", UpdatedAt: time.Unix(2, 0)}
+	closing := types.RelationUpdate{Tree: "t", LeafIndex: 0, Seq: 2, Close: true, Slot: 9, UpdatedAt: time.Unix(3, 0)}
+
+	// pending updates are applied in order of seq, whatever order they were written in
+	tests := []struct {
+		name      string
+		updates   [][]types.RelationUpdate
+		wantExtra string
+	}{
+		{"close", [][]types.RelationUpdate{{closing}}, "original"},
+		{"edit then close", [][]types.RelationUpdate{{edit}, {closing}}, "edited"},
+		{"close then edit", [][]types.RelationUpdate{{closing}, {edit}}, "edited"},
+		{"retried close", [][]types.RelationUpdate{{closing}, {closing}}, "original"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBolt(t)
+
+			for _, updates := range tt.updates {
+				updated, err := b.UpdateRelations(ctx, updates)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(updated) != 0 {
+					t.Errorf("updated %d relations before they are saved", len(updated))
+				}
+			}
+
+			r := leafRelation("a", "b", 0)
+			r.Extra = []byte("original")
+			if err := b.SaveRelations(ctx, []types.Relation{r}); err != nil {
+				t.Fatal(err)
+			}
+
+			relations, _, err := b.FetchRelations(ctx, RelationsQuery{From: "a", Status: RelationsAll, Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(relations) != 1 {
+				t.Fatalf("found %d relations, want 1", len(relations))
+			}
+			got := relations[0]
+			if got.DisconnectedAt == nil || got.Seq != 2 || got.ClosedSlot == nil || *got.ClosedSlot != 9 {
+				t.Errorf("relation is not closed by pending update: %+v", got)
+			}
+			if followers, _ := followers(t, b, "b"); followers != 0 {
+				t.Errorf("followers = %d, want 0 for closed relation", followers)
+			}
+
+			if string(got.Extra) != tt.wantExtra {
+				t.Errorf("extra = %q, want %q", got.Extra, tt.wantExtra)
+			}
+
+			// pending updates are consumed
+			err = b.db.View(func(tx *bolt.Tx) error {
+				if n := tx.Bucket(bucketPendingUpdates).Stats().KeyN; n != 0 {
+					t.Errorf("%d pending updates left", n)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// loggedAddRelation is add_relation to tree as instructions log keeps it
+func loggedAddRelation(t *testing.T, tree common.PublicKey) types.Instruction {
+	t.Helper()
+
+	ix, err := graph.AddRelationInstruction(graph.AddRelationAccounts{Tree: tree},
+		graph.AddRelationParams{From: common.PublicKeyFromString("11111111111111111111111111111112"), Extra: []byte{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loggedInstruction(ix)
+}
+
+func loggedInstruction(ix soltypes.Instruction) types.Instruction {
+	return types.Instruction{
+		Program: ix.ProgramID.ToBase58(),
+		Accounts: sliceMap(ix.Accounts, func(a soltypes.AccountMeta) types.InstructionAccount {
+			return types.InstructionAccount{Address: a.PubKey.ToBase58(), Signer: a.IsSigner, Writable: a.IsWritable}
+		}),
+		Data: ix.Data,
+	}
+}
+
+// encodedChangeLog is change log of the leaf without path, as account compression emits it
+func encodedChangeLog(tree common.PublicKey, seq uint64, index uint32) []byte {
+	data := append([]byte{0, 0}, tree.Bytes()...)
+	data = binary.LittleEndian.AppendUint32(data, 0)
+	data = binary.LittleEndian.AppendUint64(data, seq)
+	return binary.LittleEndian.AppendUint32(data, index)
+}
+
+func TestBoltBackfillsSlots(t *testing.T) {
+	tree := common.PublicKeyFromString("SysvarC1ock11111111111111111111111111111111")
+	follow, err := graph.EncodeKind("follow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	accounts := graph.AddRelationAccounts{Tree: tree}
+	add, err := graph.AddRelationInstruction(accounts, graph.AddRelationParams{Extra: follow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit, err := graph.EditExtraInstruction(accounts, graph.EditExtraParams{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeIx, err := graph.CloseRelationInstruction(accounts, graph.CloseRelationParams{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []types.Instruction
+	for i, ix := range []soltypes.Instruction{add, edit, closeIx} {
+		inst := loggedInstruction(ix)
+		inst.Slot, inst.ChangeLog = uint64(5+2*i), encodedChangeLog(tree, uint64(i+1), 0)
+		logged = append(logged, inst)
+	}
+
+	// database of earlier version: relations without slots, one of them in the log
+	disconnectedAt := time.Unix(9, 0)
+	inLog := leafRelation("a", "b", 0)
+	inLog.Tree, inLog.DisconnectedAt = tree.ToBase58(), &disconnectedAt
+	inLog.History = []types.ExtraEdit{{Extra: follow, EditedAt: time.Unix(7, 0)}}
+	notInLog := leafRelation("a", "c", 1)
+	notInLog.Tree = tree.ToBase58()
+
+	db, closeDB, err := OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketRelations, bucketInstructions} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, r := range []types.Relation{inLog, notInLog} {
+			if _, err := insert(tx.Bucket(bucketRelations), r); err != nil {
+				return err
+			}
+		}
+		for _, inst := range logged {
+			data, err := json.Marshal(inst)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketInstructions).Put(instructionKey(inst), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, closeDB, err = OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	b, err := NewBolt(db, lgr.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relations, _, err := b.FetchRelations(context.Background(),
+		RelationsQuery{Status: RelationsAll, AsOf: &Point{Slot: 100}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 {
+		t.Fatalf("found %d relations as of slot, want 1 of known slot", len(relations))
+	}
+	r := relations[0]
+	if r.To != "b" || r.Slot != 5 || r.ClosedSlot == nil || *r.ClosedSlot != 9 || r.History[0].Slot != 7 ||
+		r.History[0].Kind != "follow" {
+		t.Errorf("relation = %+v, want slots 5, 9 and edit slot 7 filled from the log", r)
+	}
+
+	// extra and its kind as of slot before edit
+	relations, _, err = b.FetchRelations(context.Background(),
+		RelationsQuery{Status: RelationsActive, AsOf: &Point{Slot: 6}, Kinds: []string{"follow"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 || !bytes.Equal(relations[0].Extra, follow) || len(relations[0].History) != 0 {
+		t.Errorf("relations as of slot 6 = %+v, want the relation with extra before edit", relations)
+	}
+}
+
+func TestBoltBackfillsTree(t *testing.T) {
+	tree := common.PublicKeyFromString("SysvarC1ock11111111111111111111111111111111")
+	dir := t.TempDir()
+
+	// database of earlier version: relations without tree, and the log naming it
+	db, closeDB, err := OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketRelations, bucketInstructions} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		if _, err := insert(tx.Bucket(bucketRelations), types.Relation{From: "a", To: "b", Provider: "p", Slot: 7}); err != nil {
+			return err
+		}
+		data, err := json.Marshal(loggedAddRelation(t, tree))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketInstructions).Put([]byte("1"), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, closeDB, err = OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	b, err := NewBolt(db, lgr.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relations, _, err := b.FetchRelations(context.Background(), RelationsQuery{Tree: tree.ToBase58(), Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 {
+		t.Fatalf("found %d relations of the tree, want 1", len(relations))
+	}
+	if r := relations[0]; r.Tree != tree.ToBase58() || r.From != "a" || r.Slot != 7 {
+		t.Errorf("relation = %+v, want the stored one with tree filled", r)
+	}
+}
+
+func TestBoltBackfillsKind(t *testing.T) {
+	follow, err := graph.EncodeKind("follow", []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// database of earlier version: relations with kind headers in extra, but no kinds extracted
+	db, closeDB, err := OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		relations, err := tx.CreateBucket(bucketRelations)
+		if err != nil {
+			return err
+		}
+		for _, extra := range [][]byte{follow, []byte("sgk\x01\xffbroken"), nil} {
+			if _, err := insert(relations, types.Relation{From: "a", To: "b", Provider: "p", Extra: extra}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, closeDB, err = OpenBolt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	b, err := NewBolt(db, lgr.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relations, _, err := b.FetchRelations(context.Background(), RelationsQuery{Kinds: []string{"follow"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 {
+		t.Fatalf("found %d follow relations, want 1", len(relations))
+	}
+	if r := relations[0]; r.Kind != "follow" || !bytes.Equal(r.Extra, follow) {
+		t.Errorf("relation = %+v, want the stored one with kind filled", r)
+	}
+}
+
+func TestBoltPagesEvents(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	var events []types.Event
+	for i := 0; i < 5; i++ {
+		events = append(events, types.Event{Provider: "p", Actor: "a", Target: "b", Verified: true,
+			Signature: "s", Index: i, EmittedAt: time.Unix(int64(i), 0)})
+	}
+	if err := b.SaveEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		indexes []int
+		after   string
+		pages   int
+	)
+	for {
+		page, next, err := b.FetchEvents(ctx, EventsQuery{Actor: "a", After: after, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range page {
+			indexes = append(indexes, e.Index)
+		}
+		if pages++; next == "" || pages > 5 {
+			break
+		}
+		after = next
+	}
+	if want := []int{4, 3, 2, 1, 0}; fmt.Sprint(indexes) != fmt.Sprint(want) {
+		t.Errorf("paged events %v, want %v", indexes, want)
+	}
+
+	if _, _, err := b.FetchEvents(ctx, EventsQuery{After: "42", Limit: 2}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("FetchEvents() with bare id error = %v, want %v", err, ErrInvalidCursor)
+	}
+}
+
+func TestBoltFetchesRelationsByIndex(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	var relations []types.Relation
+	for i, r := range []struct{ from, to, provider, tree, kind string }{
+		{"a", "b", "p", "t1", "follow"},
+		{"a", "c", "p", "t1", "like"},
+		{"b", "c", "q", "t2", "follow"},
+		{"a", "b", "q", "t2", ""},
+		{"c", "a", "p", "t2", "follow"},
+	} {
+		leafIndex := uint32(i)
+		relations = append(relations, types.Relation{From: r.from, To: r.to, Provider: r.provider, Tree: r.tree,
+			Kind: r.kind, LeafIndex: &leafIndex, Slot: uint64(10 - i), ConnectedAt: time.Unix(int64(i%2*10+i), 0)})
+	}
+	if err := b.SaveRelations(ctx, relations); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    RelationsQuery
+		want []uint32 // leaf indexes in insertion order
+	}{
+		{"from", RelationsQuery{From: "a"}, []uint32{0, 1, 3}},
+		{"to", RelationsQuery{To: "c"}, []uint32{1, 2}},
+		{"pairs", RelationsQuery{Pairs: []RelationPair{{From: "a", To: "b"}, {From: "c", To: "a"}}}, []uint32{0, 3, 4}},
+		{"providers", RelationsQuery{Providers: []string{"q"}}, []uint32{2, 3}},
+		{"tree", RelationsQuery{Tree: "t1"}, []uint32{0, 1}},
+		{"kinds", RelationsQuery{Kinds: []string{"follow"}}, []uint32{0, 2, 4}},
+		{"from and provider", RelationsQuery{From: "a", Providers: []string{"q"}}, []uint32{3}},
+		{"everything", RelationsQuery{}, []uint32{0, 1, 2, 3, 4}},
+	}
+
+	// sort keys of relations, insertion order is leaf index
+	keys := map[string]func(r types.Relation) int64{
+		SortInserted:    func(r types.Relation) int64 { return int64(*r.LeafIndex) },
+		SortConnectedAt: func(r types.Relation) int64 { return r.ConnectedAt.Unix() },
+		SortSlot:        func(r types.Relation) int64 { return int64(r.Slot) },
+	}
+
+	for _, tt := range tests {
+		for sortBy, key := range keys {
+			for _, order := range []string{OrderDesc, OrderAsc} {
+				tt, sortBy, key, order := tt, sortBy, key, order
+				t.Run(fmt.Sprintf("%s %s %s", tt.name, sortBy, order), func(t *testing.T) {
+					want := make([]types.Relation, 0, len(tt.want))
+					for _, i := range tt.want {
+						want = append(want, relations[i])
+					}
+					sort.Slice(want, func(i, j int) bool {
+						if order == OrderAsc {
+							return key(want[i]) < key(want[j])
+						}
+						return key(want[i]) > key(want[j])
+					})
+
+					q := tt.q
+					q.Status, q.Sort, q.Order, q.Limit = RelationsAll, sortBy, order, 2
+
+					var got []types.Relation
+					for pages := 0; pages <= len(relations); pages++ {
+						page, next, err := b.FetchRelations(ctx, q)
+						if err != nil {
+							t.Fatal(err)
+						}
+						got = append(got, page...)
+						if next == "" {
+							break
+						}
+						q.After = next
+					}
+
+					leafIndexes := func(rs []types.Relation) []uint32 {
+						return sliceMap(rs, func(r types.Relation) uint32 { return *r.LeafIndex })
+					}
+					if fmt.Sprint(leafIndexes(got)) != fmt.Sprint(leafIndexes(want)) {
+						t.Errorf("paged relations %v, want %v", leafIndexes(got), leafIndexes(want))
+					}
+				})
+			}
+		}
+	}
+}
+
+// without selective filter relations are walked in order of sort indexes, ties in order of insertion
+func TestBoltWalksSortIndexes(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	var relations []types.Relation
+	for i := 0; i < 5; i++ {
+		r := leafRelation("a", "b", uint32(i))
+		r.Slot, r.ConnectedAt = uint64(10+i/2), time.Unix(int64(100-i/2), 0)
+		relations = append(relations, r)
+	}
+	if err := b.SaveRelations(ctx, relations); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sort, order string
+		want        []uint32 // leaf indexes
+	}{
+		{SortSlot, OrderAsc, []uint32{0, 1, 2, 3, 4}},
+		{SortSlot, OrderDesc, []uint32{4, 3, 2, 1, 0}},
+		{SortConnectedAt, OrderAsc, []uint32{4, 2, 3, 0, 1}},
+		{SortConnectedAt, OrderDesc, []uint32{1, 0, 3, 2, 4}},
+		{SortInserted, OrderAsc, []uint32{0, 1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.sort+" "+tt.order, func(t *testing.T) {
+			q := RelationsQuery{Status: RelationsActive, Sort: tt.sort, Order: tt.order, Limit: 2}
+
+			var got []uint32
+			for pages := 0; pages <= len(relations); pages++ {
+				page, next, err := b.FetchRelations(ctx, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, sliceMap(page, func(r types.Relation) uint32 { return *r.LeafIndex })...)
+				if next == "" {
+					break
+				}
+				q.After = next
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("paged relations %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
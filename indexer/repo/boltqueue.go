@@ -0,0 +1,354 @@
+package repo
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltQueue is an in-process durable replacement of Redis stream used in embedded mode.
+// It has the same semantics: entries are delivered once, stay pending until ack'ed,
+// and pending entries idle for too long can be claimed again
+type BoltQueue struct {
+	db     *bolt.DB
+	notify chan struct{} // signalled when new entries are added
+}
+
+var (
+	bucketQueueMeta    = []byte("queue_meta")
+	bucketQueueStream  = []byte("queue_stream")
+	bucketQueuePending = []byte("queue_pending")
+
+	keyLastSeenBlock  = []byte("last_seen_block")
+	keyLastDelivered  = []byte("last_delivered")
+	queueBlockTimeout = 500 * time.Millisecond // same as BLOCK of XREADGROUP
+)
+
+type pendingEntry struct {
+	Consumer    string    `json:"consumer"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+func NewBoltQueue(db *bolt.DB) (BoltQueue, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketQueueMeta, bucketQueueStream, bucketQueuePending} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return BoltQueue{}, fmt.Errorf("initialize queue: %w", err)
+	}
+
+	return BoltQueue{db, make(chan struct{}, 1)}, nil
+}
+
+func (q BoltQueue) GetLastSeenBlock(ctx context.Context) (uint64, error) {
+	var block uint64
+	err := q.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketQueueMeta).Get(keyLastSeenBlock); v != nil {
+			block = btoi(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error getting last seen block: %w", err)
+	}
+	return block, nil
+}
+
+func (q BoltQueue) AddBlocks(ctx context.Context, blocks []uint64) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		stream := tx.Bucket(bucketQueueStream)
+		for _, block := range blocks {
+			seq, err := stream.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := stream.Put(itob(seq), itob(block)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("adding blocks to pipeline: %w", err)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// EnqueueBlocks adds blocks and saves lastSeen checkpoint in one transaction
+func (q BoltQueue) EnqueueBlocks(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketQueueMeta)
+		if v := meta.Get(keyLastSeenBlock); v != nil && btoi(v) > lastSeen {
+			return fmt.Errorf("%w: %d > %d", ErrCheckpointRegress, btoi(v), lastSeen)
+		}
+
+		var current uint64
+		if v := meta.Get(keyLastSeenBlock); v != nil {
+			current = btoi(v)
+		}
+
+		stream := tx.Bucket(bucketQueueStream)
+		for _, block := range blocks {
+			// enqueued already by the call that has advanced last seen block past it
+			if block < current {
+				continue
+			}
+			seq, err := stream.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := stream.Put(itob(seq), itob(block)); err != nil {
+				return err
+			}
+		}
+
+		return meta.Put(keyLastSeenBlock, itob(lastSeen))
+	})
+	if err != nil {
+		return fmt.Errorf("enqueue blocks: %w", err)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// FetchStreamEvents delivers entries that were never delivered. Waits a bit for new entries if there are none
+func (q BoltQueue) FetchStreamEvents(ctx context.Context, consumerID string, batchSize uint) (map[EventID]uint64, error) {
+	if batchSize == 0 {
+		return map[EventID]uint64{}, nil
+	}
+
+	batch, err := q.deliver(consumerID, batchSize)
+	if err != nil || len(batch) > 0 {
+		return batch, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-q.notify:
+	case <-time.After(queueBlockTimeout):
+	}
+
+	return q.deliver(consumerID, batchSize)
+}
+
+func (q BoltQueue) deliver(consumerID string, batchSize uint) (map[EventID]uint64, error) {
+	batch := make(map[EventID]uint64)
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketQueueMeta)
+		pending := tx.Bucket(bucketQueuePending)
+
+		var lastDelivered uint64
+		if v := meta.Get(keyLastDelivered); v != nil {
+			lastDelivered = btoi(v)
+		}
+
+		entry, err := json.Marshal(pendingEntry{consumerID, time.Now()})
+		if err != nil {
+			return err
+		}
+
+		c := tx.Bucket(bucketQueueStream).Cursor()
+		for k, v := c.Seek(itob(lastDelivered + 1)); k != nil && uint(len(batch)) < batchSize; k, v = c.Next() {
+			if err := pending.Put(k, entry); err != nil {
+				return err
+			}
+			batch[strconv.FormatUint(btoi(k), 10)] = btoi(v)
+			lastDelivered = btoi(k)
+		}
+
+		return meta.Put(keyLastDelivered, itob(lastDelivered))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch event streams: %w", err)
+	}
+
+	return batch, nil
+}
+
+// FindStaleBlocks claims entries that are pending for longer than timeout
+func (q BoltQueue) FindStaleBlocks(ctx context.Context, consumerID string, timeout time.Duration, batchSize uint) (map[EventID]uint64, error) {
+	batch := make(map[EventID]uint64)
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		stream := tx.Bucket(bucketQueueStream)
+		pending := tx.Bucket(bucketQueuePending)
+
+		claimed, err := json.Marshal(pendingEntry{consumerID, time.Now()})
+		if err != nil {
+			return err
+		}
+
+		var stale [][]byte
+
+		c := pending.Cursor()
+		for k, v := c.First(); k != nil && uint(len(stale)) < batchSize; k, v = c.Next() {
+			var e pendingEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if time.Since(e.DeliveredAt) >= timeout {
+				stale = append(stale, k)
+			}
+		}
+
+		// can't modify bucket while iterating it
+		for _, k := range stale {
+			if err := pending.Put(k, claimed); err != nil {
+				return err
+			}
+			batch[strconv.FormatUint(btoi(k), 10)] = btoi(stream.Get(k))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("find stale events: %w", err)
+	}
+
+	return batch, nil
+}
+
+func (q BoltQueue) AcknowledgeBlocks(ctx context.Context, events []EventID) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		stream := tx.Bucket(bucketQueueStream)
+		pending := tx.Bucket(bucketQueuePending)
+
+		for _, e := range events {
+			id, err := strconv.ParseUint(e, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid event id %q: %w", e, err)
+			}
+			if err := pending.Delete(itob(id)); err != nil {
+				return err
+			}
+			if err := stream.Delete(itob(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Checkpoint returns current queue position. It's consistent only when indexer is stopped
+func (q BoltQueue) Checkpoint(ctx context.Context) (Checkpoint, error) {
+	var checkpoint Checkpoint
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketQueueMeta)
+		stream := tx.Bucket(bucketQueueStream)
+
+		var lastDelivered uint64
+		if v := meta.Get(keyLastDelivered); v != nil {
+			lastDelivered = btoi(v)
+		}
+
+		var undelivered []uint64
+		c := stream.Cursor()
+		for k, v := c.Seek(itob(lastDelivered + 1)); k != nil; k, v = c.Next() {
+			undelivered = append(undelivered, btoi(v))
+		}
+
+		if len(undelivered) > 0 {
+			checkpoint.undelivered(undelivered)
+		} else if v := meta.Get(keyLastSeenBlock); v != nil {
+			checkpoint.NextBlock = btoi(v)
+		}
+
+		return tx.Bucket(bucketQueuePending).ForEach(func(k, _ []byte) error {
+			checkpoint.Pending = append(checkpoint.Pending, btoi(stream.Get(k)))
+			return nil
+		})
+	})
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("checkpoint: %w", err)
+	}
+
+	return checkpoint, nil
+}
+
+// TrimStream is a no-op, acknowledged entries are removed right away
+func (q BoltQueue) TrimStream(ctx context.Context) error {
+	return nil
+}
+
+// StreamHealth reports queue state. Entries don't keep time they were added at,
+// so ages are measured since delivery
+func (q BoltQueue) StreamHealth(ctx context.Context) (StreamHealth, error) {
+	var health StreamHealth
+
+	consumers := make(map[string]*ConsumerHealth)
+	var names []string
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		// acknowledged entries are deleted, so stream holds only pending and undelivered ones
+		health.Length = int64(tx.Bucket(bucketQueueStream).Stats().KeyN)
+
+		return tx.Bucket(bucketQueuePending).ForEach(func(k, v []byte) error {
+			var e pendingEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+
+			age := time.Since(e.DeliveredAt)
+
+			health.Pending++
+			if age > health.OldestPendingAge {
+				health.OldestPendingAge = age
+			}
+
+			c, ok := consumers[e.Consumer]
+			if !ok {
+				c = &ConsumerHealth{Name: e.Consumer, Idle: age}
+				consumers[e.Consumer] = c
+				names = append(names, e.Consumer)
+			}
+			c.Pending++
+			if age < c.Idle {
+				c.Idle = age
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return StreamHealth{}, fmt.Errorf("stream health: %w", err)
+	}
+
+	health.Lag = health.Length - health.Pending
+	health.Consumers = sliceMap(names, func(name string) ConsumerHealth { return *consumers[name] })
+
+	return health, nil
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
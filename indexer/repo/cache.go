@@ -0,0 +1,412 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// RelationsCache keeps results of relation lookups in redis.
+//
+// Every query is filed under a tag: `from:<key>` (for each from of its pairs), `to:<key>`, `provider:<key>`
+// for each provider, `tree:<key>` or `all`, whichever of its filters is the most selective. Saved relation can only change results of queries
+// under tags of its from, to, provider and tree, and of unfiltered ones. Each tag has a version, which is part
+// of cache keys of its queries, so bumping versions invalidates exactly those queries, even the ones
+// being filled concurrently. Stale entries are left to expire
+type RelationsCache struct {
+	pool *redis.Pool
+	l    lgr.L
+
+	namespace string
+	ttl       time.Duration
+
+	stats *cacheStats
+}
+
+type cacheStats struct {
+	hits, misses uint64 // atomic
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// RelationsQuery is normalized form of relation lookup
+type RelationsQuery struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// relations of any of the pairs
+	Pairs     []RelationPair `json:"pairs"`
+	Providers []string       `json:"providers"`
+	Tree      string         `json:"tree"`
+	Kinds     []string       `json:"kinds"`
+	Status    string         `json:"status"` // one of RelationsActive, RelationsClosed or RelationsAll
+	// point Status is evaluated at, nil for now
+	AsOf *Point `json:"asOf"`
+	// relations added after AddedAfter or closed by ClosedBy only. Points are of the same kind as AsOf
+	AddedAfter *Point `json:"addedAfter"`
+	ClosedBy   *Point `json:"closedBy"`
+	// top level fields of decoded extra relations have, compared for equality
+	ExtraFields map[string]any `json:"extraFields"`
+	// one of Sort* and Order* constants
+	Sort  string `json:"sort"`
+	Order string `json:"order"`
+	// opaque cursor of the page, nextCursor of the previous one
+	After string `json:"after"`
+	Limit uint   `json:"limit"`
+}
+
+type RelationPair struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// matchesPairs reports whether relation is of any of pairs, with no pairs every relation is
+func (q RelationsQuery) matchesPairs(r types.Relation) bool {
+	if len(q.Pairs) == 0 {
+		return true
+	}
+	for _, p := range q.Pairs {
+		if p.From == r.From && p.To == r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Point is a moment of graph history, either slot or block time
+type Point struct {
+	Slot uint64     `json:"slot,omitempty"`
+	Time *time.Time `json:"time,omitempty"` // used instead of Slot when set
+}
+
+// addedBy reports whether relation was added at or before the point
+func (p Point) addedBy(r types.Relation) bool {
+	if p.Time != nil {
+		return !r.ConnectedAt.After(*p.Time)
+	}
+	return r.Slot <= p.Slot
+}
+
+// closedBy reports whether relation was closed at or before the point
+func (p Point) closedBy(r types.Relation) bool {
+	if p.Time != nil {
+		return r.DisconnectedAt != nil && !r.DisconnectedAt.After(*p.Time)
+	}
+	return r.ClosedSlot != nil && *r.ClosedSlot <= p.Slot
+}
+
+// replacedAfter reports whether edit replaced extra after the point
+func (p Point) replacedAfter(e types.ExtraEdit) bool {
+	if p.Time != nil {
+		return e.EditedAt.After(*p.Time)
+	}
+	return e.Slot > p.Slot
+}
+
+// at returns relation as it was at the point: extra and fields derived from it are of the first edit that replaced
+// them after the point, history is of edits made by then
+func (p Point) at(r types.Relation) types.Relation {
+	for i, e := range r.History {
+		if p.replacedAfter(e) {
+			r.Extra, r.Kind, r.ExtraDecoded = e.Extra, e.Kind, e.ExtraDecoded
+			r.History = r.History[:i:i]
+			if len(r.History) == 0 {
+				r.History = nil
+			}
+			break
+		}
+	}
+	return r
+}
+
+// asOf returns relation as it was at AsOf, as it is now without it
+func (q RelationsQuery) asOf(r types.Relation) types.Relation {
+	if q.AsOf == nil {
+		return r
+	}
+	return q.AsOf.at(r)
+}
+
+// bySlot reports whether points of the query are slots
+func (q RelationsQuery) bySlot() bool {
+	for _, p := range []*Point{q.AsOf, q.AddedAfter, q.ClosedBy} {
+		if p != nil && p.Time == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPoints reports whether relation has Status at AsOf, and was added or closed within bounds of the query.
+// Relations of unknown slots match no slot points
+func (q RelationsQuery) matchesPoints(r types.Relation) bool {
+	if q.bySlot() && r.Slot == 0 {
+		return false
+	}
+	if q.AddedAfter != nil && q.AddedAfter.addedBy(r) {
+		return false
+	}
+	if q.ClosedBy != nil && !q.ClosedBy.closedBy(r) {
+		return false
+	}
+
+	closed := r.DisconnectedAt != nil
+	if q.AsOf != nil {
+		if !q.AsOf.addedBy(r) {
+			return false
+		}
+		closed = q.AsOf.closedBy(r)
+	}
+
+	switch q.Status {
+	case RelationsActive:
+		return !closed
+	case RelationsClosed:
+		return closed
+	default:
+		return true
+	}
+}
+
+// statuses of relations queries select
+const (
+	RelationsActive = "active" // not closed yet
+	RelationsClosed = "closed"
+	RelationsAll    = "all"
+)
+
+func NewRelationsCache(l lgr.L, pool *redis.Pool, namespace string, ttl time.Duration) RelationsCache {
+	return RelationsCache{pool, l, namespace, ttl, &cacheStats{}}
+}
+
+const (
+	cacheEntryKey      = "cache:relations:"
+	cacheVersionKey    = "cache:relations:version:"
+	cacheGenerationKey = "cache:relations:generation" // bumped when everything is invalidated
+)
+
+func (c RelationsCache) key(name string) string {
+	return namespaced(c.namespace, name)
+}
+
+// cacheEntry is a cached page of relations
+type cacheEntry struct {
+	Relations []types.Relation `json:"relations"`
+	Next      string           `json:"next"`
+}
+
+// FetchRelations serves query from cache, falling back to fetch on miss. Cache failures never fail the lookup
+func (c RelationsCache) FetchRelations(ctx context.Context, q RelationsQuery, fetch func() ([]types.Relation, string, error)) ([]types.Relation, string, error) {
+	q.Providers = normalizeSet(q.Providers)
+	q.Kinds = normalizeSet(q.Kinds)
+
+	key, err := c.entryKey(ctx, q)
+	if err != nil {
+		c.l.Logf("[WARN] relations cache: %v", err)
+		return fetch()
+	}
+
+	cached, found, err := c.get(ctx, key)
+	if err != nil {
+		c.l.Logf("[WARN] relations cache: %v", err)
+	}
+	if found {
+		atomic.AddUint64(&c.stats.hits, 1)
+		return cached.Relations, cached.Next, nil
+	}
+	atomic.AddUint64(&c.stats.misses, 1)
+
+	relations, next, err := fetch()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := c.set(ctx, key, cacheEntry{relations, next}); err != nil {
+		c.l.Logf("[WARN] relations cache: %v", err)
+	}
+
+	return relations, next, nil
+}
+
+// Invalidate drops cached queries which results may include relations
+func (c RelationsCache) Invalidate(ctx context.Context, relations []types.Relation) error {
+	return c.bump(ctx, relationTags(relations)...)
+}
+
+// relationTags are tags of every query which results may include relations
+func relationTags(relations []types.Relation) []string {
+	tags := map[string]struct{}{"all": {}}
+	for _, r := range relations {
+		tags["from:"+r.From] = struct{}{}
+		tags["to:"+r.To] = struct{}{}
+		tags["provider:"+r.Provider] = struct{}{}
+		tags["tree:"+r.Tree] = struct{}{}
+	}
+	return keysOf(tags)
+}
+
+// queryTags are tags query is filed under, by the most selective of its filters
+func queryTags(q RelationsQuery) []string {
+	switch {
+	case len(q.Pairs) > 0:
+		froms := normalizeSet(sliceMap(q.Pairs, func(p RelationPair) string { return p.From }))
+		return sliceMap(froms, func(from string) string { return "from:" + from })
+	case q.From != "":
+		return []string{"from:" + q.From}
+	case q.To != "":
+		return []string{"to:" + q.To}
+	case len(q.Providers) > 0:
+		return sliceMap(q.Providers, func(p string) string { return "provider:" + p })
+	case q.Tree != "":
+		return []string{"tree:" + q.Tree}
+	default:
+		return []string{"all"}
+	}
+}
+
+// InvalidateAll drops every cached query
+func (c RelationsCache) InvalidateAll(ctx context.Context) error {
+	return c.bump(ctx)
+}
+
+func (c RelationsCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.stats.hits),
+		Misses: atomic.LoadUint64(&c.stats.misses),
+	}
+}
+
+// bump increments versions of tags, generation when there are none
+func (c RelationsCache) bump(ctx context.Context, tags ...string) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("invalidate relations cache: %w", err)
+	}
+
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer conn.Close()
+
+	keys := sliceMap(tags, func(tag string) string { return c.key(cacheVersionKey + tag) })
+	if len(tags) == 0 {
+		keys = []string{c.key(cacheGenerationKey)}
+	}
+
+	for _, k := range keys {
+		if err := conn.Send("INCR", k); err != nil {
+			return handleErr(err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return handleErr(err)
+	}
+	for range keys {
+		if _, err := conn.Receive(); err != nil {
+			return handleErr(err)
+		}
+	}
+
+	return nil
+}
+
+// entryKey is hash of query along with current versions of its tags
+func (c RelationsCache) entryKey(ctx context.Context, q RelationsQuery) (string, error) {
+	tags := queryTags(q)
+
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	args := []any{c.key(cacheGenerationKey)}
+	for _, tag := range tags {
+		args = append(args, c.key(cacheVersionKey+tag))
+	}
+
+	// missing versions read as 0, first bump makes them 1
+	versions, err := redis.Int64s(conn.Do("MGET", args...))
+	if err != nil {
+		return "", fmt.Errorf("get versions: %w", err)
+	}
+
+	data, err := json.Marshal(struct {
+		Query    RelationsQuery `json:"query"`
+		Versions []int64        `json:"versions"`
+	}{q, versions})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return c.key(cacheEntryKey + hex.EncodeToString(hash[:])), nil
+}
+
+func (c RelationsCache) get(ctx context.Context, key string) (cacheEntry, bool, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return cacheEntry{}, false, err
+	}
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return cacheEntry{}, false, nil
+	}
+	if err != nil {
+		return cacheEntry{}, false, fmt.Errorf("get entry: %w", err)
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return cacheEntry{}, false, fmt.Errorf("decode entry: %w", err)
+	}
+
+	return entry, true, nil
+}
+
+func (c RelationsCache) set(ctx context.Context, key string, entry cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encode entry: %w", err)
+	}
+
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", key, data, "PX", c.ttl.Milliseconds()); err != nil {
+		return fmt.Errorf("set entry: %w", err)
+	}
+	return nil
+}
+
+// normalizeSet sorts and deduplicates values, so equivalent queries share entries
+func normalizeSet(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+
+	normalized := keysOf(set)
+	sort.Strings(normalized)
+	return normalized
+}
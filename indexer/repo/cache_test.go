@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// cached query has to be invalidated by every relation it may select
+func TestInvalidateTagsCoverQueries(t *testing.T) {
+	r := types.Relation{From: "a", To: "b", Provider: "p", Tree: "t", Kind: "follow"}
+
+	tests := []struct {
+		name string
+		q    RelationsQuery
+	}{
+		{"from", RelationsQuery{From: "a"}},
+		{"to", RelationsQuery{To: "b"}},
+		{"from and to", RelationsQuery{From: "a", To: "b"}},
+		{"pairs", RelationsQuery{Pairs: []RelationPair{{From: "c", To: "d"}, {From: "a", To: "b"}}}},
+		{"providers", RelationsQuery{Providers: []string{"q", "p"}}},
+		{"tree", RelationsQuery{Tree: "t"}},
+		{"kinds", RelationsQuery{Kinds: []string{"follow"}}},
+		{"everything", RelationsQuery{}},
+	}
+
+	invalidated := map[string]bool{}
+	for _, tag := range relationTags([]types.Relation{r}) {
+		invalidated[tag] = true
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tags := queryTags(tt.q)
+			if len(tags) == 0 {
+				t.Fatal("query has no tags")
+			}
+			for _, tag := range tags {
+				if invalidated[tag] {
+					return
+				}
+			}
+			t.Errorf("query tags %v miss every invalidated tag %v", tags, keysOf(invalidated))
+		})
+	}
+}
+
+func TestQueryTagsOfPairsAreDeduplicated(t *testing.T) {
+	q := RelationsQuery{Pairs: []RelationPair{{From: "b", To: "c"}, {From: "a", To: "c"}, {From: "b", To: "d"}}}
+	if got, want := queryTags(q), []string{"from:a", "from:b"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("queryTags() = %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeSet(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []string
+	}{
+		{nil, nil},
+		{[]string{}, nil},
+		{[]string{"b", "a", "b"}, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeSet(tt.values); fmt.Sprint(got) != fmt.Sprint(tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("normalizeSet(%v) = %#v, want %#v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesPoints(t *testing.T) {
+	closedSlot := uint64(8)
+	connectedAt, disconnectedAt := time.Unix(10, 0), time.Unix(20, 0)
+	active := types.Relation{Slot: 5, ConnectedAt: connectedAt}
+	closed := types.Relation{Slot: 5, ConnectedAt: connectedAt, ClosedSlot: &closedSlot, DisconnectedAt: &disconnectedAt}
+	unknown := types.Relation{ConnectedAt: connectedAt}
+	at := func(sec int64) *Point {
+		t := time.Unix(sec, 0)
+		return &Point{Time: &t}
+	}
+
+	tests := []struct {
+		name string
+		q    RelationsQuery
+		r    types.Relation
+		want bool
+	}{
+		{"active now", RelationsQuery{Status: RelationsActive}, active, true},
+		{"closed is not active", RelationsQuery{Status: RelationsActive}, closed, false},
+		{"closed now", RelationsQuery{Status: RelationsClosed}, closed, true},
+		{"all", RelationsQuery{Status: RelationsAll}, closed, true},
+		{"active before closed slot", RelationsQuery{Status: RelationsActive, AsOf: &Point{Slot: 7}}, closed, true},
+		{"closed at closed slot", RelationsQuery{Status: RelationsClosed, AsOf: &Point{Slot: 8}}, closed, true},
+		{"not added yet", RelationsQuery{Status: RelationsAll, AsOf: &Point{Slot: 4}}, active, false},
+		{"active before disconnected", RelationsQuery{Status: RelationsActive, AsOf: at(15)}, closed, true},
+		{"closed after disconnected", RelationsQuery{Status: RelationsClosed, AsOf: at(20)}, closed, true},
+		{"added after bound", RelationsQuery{Status: RelationsAll, AddedAfter: &Point{Slot: 4}}, active, true},
+		{"added at bound", RelationsQuery{Status: RelationsAll, AddedAfter: &Point{Slot: 5}}, active, false},
+		{"closed by bound", RelationsQuery{Status: RelationsAll, ClosedBy: &Point{Slot: 8}}, closed, true},
+		{"closed after bound", RelationsQuery{Status: RelationsAll, ClosedBy: &Point{Slot: 7}}, closed, false},
+		{"never closed", RelationsQuery{Status: RelationsAll, ClosedBy: &Point{Slot: 100}}, active, false},
+		{"unknown slot as of slot", RelationsQuery{Status: RelationsAll, AsOf: &Point{Slot: 100}}, unknown, false},
+		{"unknown slot added after", RelationsQuery{Status: RelationsAll, AddedAfter: &Point{Slot: 4}}, unknown, false},
+		{"unknown slot as of time", RelationsQuery{Status: RelationsActive, AsOf: at(15)}, unknown, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.matchesPoints(tt.r); got != tt.want {
+				t.Errorf("matchesPoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPointAt(t *testing.T) {
+	edited := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	r := types.Relation{
+		Extra: []byte("c"), Kind: "flag",
+		History: []types.ExtraEdit{
+			{Extra: []byte("a"), Kind: "follow", EditedAt: edited(20), Slot: 20},
+			{Extra: []byte("b"), EditedAt: edited(30), Slot: 30},
+		},
+	}
+	at := func(sec int64) Point {
+		t := time.Unix(sec, 0)
+		return Point{Time: &t}
+	}
+
+	tests := []struct {
+		name    string
+		p       Point
+		extra   string
+		kind    string
+		history int
+	}{
+		{"before edits", Point{Slot: 10}, "a", "follow", 0},
+		{"at first edit", Point{Slot: 20}, "b", "", 1},
+		{"between edits by time", at(25), "b", "", 1},
+		{"after edits", Point{Slot: 30}, "c", "flag", 2},
+		{"now", at(100), "c", "flag", 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.p.at(r)
+			if string(got.Extra) != tt.extra || got.Kind != tt.kind || len(got.History) != tt.history {
+				t.Errorf("at() = extra %q, kind %q, %d edits, want %q, %q, %d",
+					got.Extra, got.Kind, len(got.History), tt.extra, tt.kind, tt.history)
+			}
+		})
+	}
+
+	if len(r.History) != 2 || string(r.Extra) != "c" {
+		t.Errorf("at() has modified relation")
+	}
+}
@@ -0,0 +1,142 @@
+package repo
+
+import (
+	"sort"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// counterKey addresses a single counter pair. Empty provider is the total over all providers
+type counterKey struct {
+	address  string
+	provider string
+}
+
+type counterDelta struct {
+	Followers int64 `json:"followers"`
+	Following int64 `json:"following"`
+}
+
+// followKey is a pair of addresses related by a provider, or by any provider when it's empty.
+// Counters count follows rather than relations, so relating the same addresses twice counts once
+type followKey struct {
+	from     string
+	to       string
+	provider string
+}
+
+func (k followKey) String() string {
+	return k.from + "|" + k.to + "|" + k.provider
+}
+
+// followDeltas are changes of numbers of connected relations of follows. Saving relations changes them
+// with sign 1, disconnecting relations with sign -1
+func followDeltas(relations []types.Relation, sign int64) map[followKey]int64 {
+	deltas := make(map[followKey]int64)
+	for _, r := range relations {
+		if r.DisconnectedAt != nil && sign > 0 {
+			continue
+		}
+		deltas[followKey{r.From, r.To, r.Provider}] += sign
+		deltas[followKey{r.From, r.To, ""}] += sign
+	}
+	return deltas
+}
+
+// followChange is 1 when follow gets its first connected relation, -1 when it loses the last one
+func followChange(before, after int64) int64 {
+	switch {
+	case before <= 0 && after > 0:
+		return 1
+	case before > 0 && after <= 0:
+		return -1
+	}
+	return 0
+}
+
+// followCounterDeltas are counter changes made by follows that have started (1) or stopped (-1)
+func followCounterDeltas(changes map[followKey]int64) map[counterKey]counterDelta {
+	deltas := make(map[counterKey]counterDelta)
+
+	add := func(key counterKey, followers, following int64) {
+		d := deltas[key]
+		d.Followers += followers
+		d.Following += following
+		deltas[key] = d
+	}
+
+	for key, change := range changes {
+		add(counterKey{key.from, key.provider}, 0, change)
+		add(counterKey{key.to, key.provider}, change, 0)
+	}
+	return deltas
+}
+
+// sortedFollowKeys orders keys of deltas, so concurrent writers lock follows in the same order
+func sortedFollowKeys(deltas map[followKey]int64) []followKey {
+	keys := keysOf(deltas)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
+
+// relationDeltas are counter changes made by relations, counting every relation. Counters of
+// relation counters migration are made with it, follows migration recounts them
+func relationDeltas(relations []types.Relation, sign int64) map[counterKey]counterDelta {
+	deltas := make(map[counterKey]counterDelta)
+
+	add := func(key counterKey, followers, following int64) {
+		d := deltas[key]
+		d.Followers += followers
+		d.Following += following
+		deltas[key] = d
+	}
+
+	for _, r := range relations {
+		if r.DisconnectedAt != nil && sign > 0 {
+			continue
+		}
+
+		from, to, provider := r.From, r.To, r.Provider
+
+		add(counterKey{from, ""}, 0, sign)
+		add(counterKey{from, provider}, 0, sign)
+		add(counterKey{to, ""}, sign, 0)
+		add(counterKey{to, provider}, sign, 0)
+	}
+
+	return deltas
+}
+
+// sortedCounterKeys orders keys of deltas, so concurrent writers lock counters in the same order
+func sortedCounterKeys(deltas map[counterKey]counterDelta) []counterKey {
+	keys := keysOf(deltas)
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].address != keys[j].address {
+			return keys[i].address < keys[j].address
+		}
+		return keys[i].provider < keys[j].provider
+	})
+	return keys
+}
+
+// assembleCounters builds counters of addresses in requested order, addresses without relations get zeros
+func assembleCounters(addresses []string, rows map[counterKey]counterDelta) []types.Counters {
+	byAddress := make(map[string]*types.Counters, len(addresses))
+	for _, address := range addresses {
+		byAddress[address] = &types.Counters{Address: address, Providers: make(map[string]types.ProviderCounters)}
+	}
+
+	for key, d := range rows {
+		c, ok := byAddress[key.address]
+		if !ok {
+			continue
+		}
+		if key.provider == "" {
+			c.Followers, c.Following = d.Followers, d.Following
+		} else {
+			c.Providers[key.provider] = types.ProviderCounters{Followers: d.Followers, Following: d.Following}
+		}
+	}
+
+	return sliceMap(addresses, func(address string) types.Counters { return *byAddress[address] })
+}
@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+func TestFollowDeltas(t *testing.T) {
+	closedAt := time.Now()
+	relations := []types.Relation{
+		{From: "a", To: "b", Provider: "p"},
+		{From: "a", To: "b", Provider: "p"},
+		{From: "a", To: "b", Provider: "q"},
+		{From: "a", To: "c", Provider: "p", DisconnectedAt: &closedAt},
+	}
+
+	want := map[followKey]int64{
+		{"a", "b", "p"}: 2,
+		{"a", "b", "q"}: 1,
+		{"a", "b", ""}:  3,
+	}
+	if got := followDeltas(relations, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("followDeltas(1) = %v, want %v", got, want)
+	}
+
+	// closed relations are uncounted
+	want = map[followKey]int64{{"a", "c", "p"}: -1, {"a", "c", ""}: -1}
+	if got := followDeltas(relations[3:], -1); !reflect.DeepEqual(got, want) {
+		t.Errorf("followDeltas(-1) = %v, want %v", got, want)
+	}
+}
+
+func TestFollowChange(t *testing.T) {
+	tests := []struct {
+		before, after, want int64
+	}{
+		{0, 1, 1},
+		{0, 3, 1},
+		{1, 2, 0},
+		{2, 1, 0},
+		{1, 0, -1},
+		{3, 0, -1},
+		{0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := followChange(tt.before, tt.after); got != tt.want {
+			t.Errorf("followChange(%d, %d) = %d, want %d", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestFollowCounterDeltas(t *testing.T) {
+	changes := map[followKey]int64{
+		{"a", "b", ""}:  1,
+		{"a", "b", "p"}: 1,
+		{"c", "a", ""}:  -1,
+		{"d", "d", ""}:  1,
+	}
+
+	want := map[counterKey]counterDelta{
+		{"a", ""}:  {Followers: -1, Following: 1},
+		{"a", "p"}: {Following: 1},
+		{"b", ""}:  {Followers: 1},
+		{"b", "p"}: {Followers: 1},
+		{"c", ""}:  {Following: -1},
+		// following oneself counts both ways
+		{"d", ""}: {Followers: 1, Following: 1},
+	}
+	if got := followCounterDeltas(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("followCounterDeltas() = %v, want %v", got, want)
+	}
+}
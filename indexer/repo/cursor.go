@@ -0,0 +1,117 @@
+package repo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+// sort keys of relations. Record id breaks ties, so order is total and pages never overlap
+const (
+	SortInserted    = "inserted" // order relations were indexed in
+	SortConnectedAt = "connectedAt"
+	SortSlot        = "slot"
+)
+
+const (
+	OrderDesc = "desc"
+	OrderAsc  = "asc"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// relationsCursor is position right after the last relation of a page. Clients get it encoded, as an opaque string
+type relationsCursor struct {
+	Sort  string     `json:"sort"`
+	Order string     `json:"order"`
+	Time  *time.Time `json:"time,omitempty"` // sorted by connectedAt
+	Slot  uint64     `json:"slot,omitempty"` // sorted by slot
+	ID    string     `json:"id"`             // store specific id of the record
+}
+
+// decodeCursor returns cursor of After, nil when query starts from the beginning.
+// Cursors are valid only with sort and order they were made for
+func decodeCursor(q RelationsQuery) (*relationsCursor, error) {
+	if q.After == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(q.After)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c relationsCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != q.Sort || c.Order != q.Order || c.ID == "" || (c.Sort == SortConnectedAt) != (c.Time != nil) {
+		return nil, fmt.Errorf("%w: it's of another sort order", ErrInvalidCursor)
+	}
+
+	return &c, nil
+}
+
+// nextCursor returns cursor of the page after relations, empty if it is the last one.
+// id returns store specific id of i-th relation
+func nextCursor(q RelationsQuery, relations []types.Relation, id func(i int) string) (string, error) {
+	if len(relations) == 0 || uint(len(relations)) < q.Limit {
+		return "", nil
+	}
+
+	last := relations[len(relations)-1]
+	c := relationsCursor{Sort: q.Sort, Order: q.Order, ID: id(len(relations) - 1)}
+	switch q.Sort {
+	case SortConnectedAt:
+		c.Time = &last.ConnectedAt
+	case SortSlot:
+		c.Slot = last.Slot
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// eventsCursor is position right after the last event of a page, events are listed newest first
+type eventsCursor struct {
+	ID string `json:"id"` // store specific id of the record
+}
+
+// decodeEventsCursor returns store specific id of the event After points past, empty when query starts from the newest
+func decodeEventsCursor(q EventsQuery) (string, error) {
+	if q.After == "" {
+		return "", nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(q.After)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+
+	var c eventsCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return "", ErrInvalidCursor
+	}
+	return c.ID, nil
+}
+
+// nextEventsCursor returns cursor of the page after events, empty if it is the last one.
+// id returns store specific id of i-th event
+func nextEventsCursor(q EventsQuery, events []types.Event, id func(i int) string) (string, error) {
+	if len(events) == 0 || uint(len(events)) < q.Limit {
+		return "", nil
+	}
+
+	data, err := json.Marshal(eventsCursor{ID: id(len(events) - 1)})
+	if err != nil {
+		return "", fmt.Errorf("encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	connectedAt := time.Unix(100, 0).UTC()
+	relations := []types.Relation{
+		{From: "a", To: "b", Slot: 5, ConnectedAt: time.Unix(50, 0).UTC()},
+		{From: "a", To: "c", Slot: 7, ConnectedAt: connectedAt},
+	}
+	id := func(i int) string { return strconv.Itoa(i + 10) }
+
+	tests := []struct {
+		sort, order string
+		want        relationsCursor
+	}{
+		{SortInserted, OrderDesc, relationsCursor{Sort: SortInserted, Order: OrderDesc, ID: "11"}},
+		{SortInserted, OrderAsc, relationsCursor{Sort: SortInserted, Order: OrderAsc, ID: "11"}},
+		{SortConnectedAt, OrderDesc, relationsCursor{Sort: SortConnectedAt, Order: OrderDesc, Time: &connectedAt, ID: "11"}},
+		{SortConnectedAt, OrderAsc, relationsCursor{Sort: SortConnectedAt, Order: OrderAsc, Time: &connectedAt, ID: "11"}},
+		{SortSlot, OrderDesc, relationsCursor{Sort: SortSlot, Order: OrderDesc, Slot: 7, ID: "11"}},
+		{SortSlot, OrderAsc, relationsCursor{Sort: SortSlot, Order: OrderAsc, Slot: 7, ID: "11"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.sort+" "+tt.order, func(t *testing.T) {
+			q := RelationsQuery{Sort: tt.sort, Order: tt.order, Limit: 2}
+
+			next, err := nextCursor(q, relations, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next == "" {
+				t.Fatal("nextCursor() of a full page is empty")
+			}
+
+			q.After = next
+			got, err := decodeCursor(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Sort != tt.want.Sort || got.Order != tt.want.Order || got.Slot != tt.want.Slot || got.ID != tt.want.ID {
+				t.Errorf("decodeCursor() = %+v, want %+v", got, tt.want)
+			}
+			if (got.Time == nil) != (tt.want.Time == nil) || (got.Time != nil && !got.Time.Equal(*tt.want.Time)) {
+				t.Errorf("decodeCursor() time = %v, want %v", got.Time, tt.want.Time)
+			}
+
+			// cursor is bound to sort and order it was made for
+			for _, other := range []RelationsQuery{
+				{Sort: tt.sort, Order: reverse(tt.order), After: next},
+				{Sort: otherSort(tt.sort), Order: tt.order, After: next},
+			} {
+				if _, err := decodeCursor(other); !errors.Is(err, ErrInvalidCursor) {
+					t.Errorf("decodeCursor() with %s %s error = %v, want %v", other.Sort, other.Order, err, ErrInvalidCursor)
+				}
+			}
+		})
+	}
+}
+
+func reverse(order string) string {
+	if order == OrderAsc {
+		return OrderDesc
+	}
+	return OrderAsc
+}
+
+func otherSort(sort string) string {
+	if sort == SortSlot {
+		return SortInserted
+	}
+	return SortSlot
+}
+
+func TestNextCursorOfLastPage(t *testing.T) {
+	id := func(i int) string { return strconv.Itoa(i) }
+	tests := []struct {
+		name      string
+		relations []types.Relation
+		limit     uint
+	}{
+		{"empty page", nil, 2},
+		{"short page", []types.Relation{{From: "a"}}, 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			next, err := nextCursor(RelationsQuery{Sort: SortInserted, Order: OrderDesc, Limit: tt.limit}, tt.relations, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != "" {
+				t.Errorf("nextCursor() = %q, want none", next)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejectsMalformed(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name  string
+		sort  string
+		after string
+	}{
+		{"not base64", SortInserted, "not a cursor!"},
+		{"not json", SortInserted, encode("42")},
+		{"no id", SortInserted, encode(`{"sort":"inserted","order":"desc"}`)},
+		{"connectedAt without time", SortConnectedAt, encode(`{"sort":"connectedAt","order":"desc","id":"1"}`)},
+		{"time without connectedAt", SortInserted, encode(`{"sort":"inserted","order":"desc","time":"2020-01-01T00:00:00Z","id":"1"}`)},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(RelationsQuery{Sort: tt.sort, Order: OrderDesc, After: tt.after}); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("decodeCursor() error = %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+
+	if c, err := decodeCursor(RelationsQuery{Sort: SortInserted, Order: OrderDesc}); c != nil || err != nil {
+		t.Errorf("decodeCursor() without After = %+v, %v, want none", c, err)
+	}
+}
+
+func TestEventsCursorRoundTrip(t *testing.T) {
+	events := []types.Event{{Index: 0}, {Index: 1}}
+	id := func(i int) string { return strconv.Itoa(i + 10) }
+
+	next, err := nextEventsCursor(EventsQuery{Limit: 2}, events, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeEventsCursor(EventsQuery{After: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "11" {
+		t.Errorf("decodeEventsCursor() = %q, want 11", got)
+	}
+
+	if next, _ := nextEventsCursor(EventsQuery{Limit: 3}, events, id); next != "" {
+		t.Errorf("nextEventsCursor() of a short page = %q, want none", next)
+	}
+	for _, after := range []string{"11", base64.RawURLEncoding.EncodeToString([]byte(`{}`))} {
+		if _, err := decodeEventsCursor(EventsQuery{After: after}); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeEventsCursor(%q) error = %v, want %v", after, err, ErrInvalidCursor)
+		}
+	}
+}
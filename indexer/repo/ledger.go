@@ -0,0 +1,18 @@
+package repo
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Position orders instructions by execution, top level instruction goes before its inner ones
+func Position(slot uint64, txIndex, outer, inner int) string {
+	return hex.EncodeToString(positionKey(slot, txIndex, outer, inner))
+}
+
+func positionKey(slot uint64, txIndex, outer, inner int) []byte {
+	key := itob(slot)
+	key = binary.BigEndian.AppendUint32(key, uint32(txIndex))
+	key = binary.BigEndian.AppendUint32(key, uint32(outer))
+	return binary.BigEndian.AppendUint32(key, uint32(inner+1))
+}
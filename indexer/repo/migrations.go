@@ -0,0 +1,585 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migration is a single versioned schema change. Migrations are applied in order, exactly once.
+// Never edit or reorder migrations that have been released, add a new one instead
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// relationsIndexes are shared with rebuilds, which create relations collection from scratch
+var relationsIndexes = []bson.D{
+	{{Key: "from", Value: 1}, {Key: "_id", Value: -1}},
+	{{Key: "to", Value: 1}, {Key: "_id", Value: -1}},
+	{{Key: "provider", Value: 1}, {Key: "_id", Value: -1}},
+}
+
+// relationsTreeIndex, relationsLeafIndex, relationsKindIndex and relationsPairIndex came later than relationsIndexes,
+// rebuilds create them as well
+var (
+	relationsTreeIndex = bson.D{{Key: "tree", Value: 1}, {Key: "_id", Value: -1}}
+	relationsLeafIndex = bson.D{{Key: "tree", Value: 1}, {Key: "leaf_index", Value: 1}}
+	relationsKindIndex = bson.D{{Key: "kind", Value: 1}, {Key: "_id", Value: -1}}
+	relationsPairIndex = bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}, {Key: "_id", Value: -1}}
+
+	// pending updates of a leaf in order
+	pendingIndex = bson.D{{Key: "tree", Value: 1}, {Key: "leaf_index", Value: 1}, {Key: "seq", Value: 1}}
+
+	// skipped relations of a provider in order of execution
+	skippedProviderIndex = bson.D{{Key: "provider", Value: 1}, {Key: "_id", Value: 1}}
+
+	// makes retried inserts of relations idempotent, relations without leaf index are not covered
+	relationsLeafUnique = mongo.IndexModel{
+		Keys: relationsLeafIndex,
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"leaf_index": bson.M{"$exists": true}}),
+	}
+
+	// relations of an address sorted by other fields than _id
+	relationsSortIndexes = []bson.D{
+		{{Key: "from", Value: 1}, {Key: "connected_at", Value: -1}, {Key: "_id", Value: -1}},
+		{{Key: "to", Value: 1}, {Key: "connected_at", Value: -1}, {Key: "_id", Value: -1}},
+		{{Key: "from", Value: 1}, {Key: "slot", Value: -1}, {Key: "_id", Value: -1}},
+		{{Key: "to", Value: 1}, {Key: "slot", Value: -1}, {Key: "_id", Value: -1}},
+	}
+)
+
+// projectionIndexes are all indexes of projection collections. Migrations create them on current collections
+// and rebuilds on staging ones, so a migration indexing a projection adds its index here as well
+var projectionIndexes = map[string][]mongo.IndexModel{
+	collectionEvents: func() []mongo.IndexModel {
+		keys := append([]bson.D{relationsTreeIndex, relationsKindIndex, relationsPairIndex}, relationsIndexes...)
+		keys = append(keys, relationsSortIndexes...)
+		return append(indexModels(keys...), relationsLeafUnique)
+	}(),
+	collectionPending: indexModels(pendingIndex),
+	collectionSkipped: indexModels(skippedProviderIndex),
+}
+
+var migrations = []migration{
+	{1, "relations query indexes", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db.Collection(collectionEvents), relationsIndexes...)
+	}},
+	{2, "events query indexes", func(ctx context.Context, db *mongo.Database) error {
+		c := db.Collection(collectionBroadcasts)
+
+		// makes retried batches idempotent
+		_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "signature", Value: 1}, {Key: "index", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return err
+		}
+
+		return createIndexes(ctx, c,
+			bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: -1}},
+			bson.D{{Key: "target", Value: 1}, {Key: "_id", Value: -1}},
+			bson.D{{Key: "provider", Value: 1}, {Key: "_id", Value: -1}},
+		)
+	}},
+	{3, "quarantine slot index", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db.Collection(collectionQuarantine),
+			bson.D{{Key: "slot", Value: 1}},
+		)
+	}},
+	{4, "instructions log indexes", func(ctx context.Context, db *mongo.Database) error {
+		c := db.Collection(collectionInsts)
+
+		// makes retried batches idempotent
+		_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "signature", Value: 1}, {Key: "outer", Value: 1}, {Key: "inner", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			return err
+		}
+
+		return createIndexes(ctx, c,
+			bson.D{{Key: "slot", Value: 1}, {Key: "tx_index", Value: 1}, {Key: "outer", Value: 1}, {Key: "inner", Value: 1}},
+		)
+	}},
+	{5, "relation counters", func(ctx context.Context, db *mongo.Database) error {
+		const batchSize = 1000
+
+		counters := db.Collection(collectionCounters)
+
+		// partial counters of interrupted migration
+		if err := counters.Drop(ctx); err != nil {
+			return err
+		}
+
+		cur, err := db.Collection(collectionEvents).Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+
+		var batch []types.Relation
+		for cur.Next(ctx) {
+			var r types.Relation
+			if err := cur.Decode(&r); err != nil {
+				return err
+			}
+			if batch = append(batch, r); len(batch) == batchSize {
+				if err := applyCounterDeltas(ctx, counters, relationDeltas(batch, 1)); err != nil {
+					return err
+				}
+				batch = batch[:0]
+			}
+		}
+		if err := cur.Err(); err != nil {
+			return err
+		}
+
+		return applyCounterDeltas(ctx, counters, relationDeltas(batch, 1))
+	}},
+	{6, "skipped relations provider index", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db.Collection(collectionSkipped), skippedProviderIndex)
+	}},
+	{7, "relations tree index", func(ctx context.Context, db *mongo.Database) error {
+		tree, err := programTree(func(fn func(types.Instruction) error) error {
+			return scanProgramInstructions(ctx, db, fn)
+		})
+		if err != nil {
+			return fmt.Errorf("find program tree: %w", err)
+		}
+
+		// relations and skipped ones recorded before trees were tracked, nothing to fill them with until
+		// the log names the tree
+		if tree != "" {
+			fill := func(bson.Raw) (any, error) { return tree, nil }
+			for _, c := range []string{collectionEvents, collectionSkipped} {
+				if err := backfill(ctx, db.Collection(c), "tree", fill); err != nil {
+					return err
+				}
+			}
+		}
+
+		return createIndexes(ctx, db.Collection(collectionEvents), relationsTreeIndex)
+	}},
+	{8, "relations leaf index", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db.Collection(collectionEvents), relationsLeafIndex)
+	}},
+	{9, "relations kind index", func(ctx context.Context, db *mongo.Database) error {
+		// relations indexed before kinds were extracted, extras declaring no kind get an empty one
+		err := backfill(ctx, db.Collection(collectionEvents), "kind", func(doc bson.Raw) (any, error) {
+			_, extra, _ := doc.Lookup("extra").BinaryOK()
+			return extraKind(extra), nil
+		})
+		if err != nil {
+			return err
+		}
+		return createIndexes(ctx, db.Collection(collectionEvents), relationsKindIndex)
+	}},
+	{10, "relations sort indexes", func(ctx context.Context, db *mongo.Database) error {
+		// relations indexed before slots were recorded are of unknown slot, zero. Missing slots would sort
+		// before zero ones, which would break their ties. Migration #14 fills ones the log has
+		err := backfill(ctx, db.Collection(collectionEvents), "slot", func(bson.Raw) (any, error) { return int64(0), nil })
+		if err != nil {
+			return err
+		}
+		return createIndexes(ctx, db.Collection(collectionEvents), relationsSortIndexes...)
+	}},
+	{11, "relations pair index", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db.Collection(collectionEvents), relationsPairIndex)
+	}},
+	{12, "unique relation leaves and distinct follows", func(ctx context.Context, db *mongo.Database) error {
+		relations := db.Collection(collectionEvents)
+
+		// retried batches inserted relations more than once, the first copy stays
+		cur, err := relations.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"leaf_index": bson.M{"$exists": true}}}},
+			{{Key: "$group", Value: bson.M{
+				"_id":  bson.M{"tree": "$tree", "leaf_index": "$leaf_index"},
+				"keep": bson.M{"$min": "$_id"},
+				"n":    bson.M{"$sum": 1},
+			}}},
+			{{Key: "$match", Value: bson.M{"n": bson.M{"$gt": 1}}}},
+		}, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+
+		var duplicates []struct {
+			Leaf struct {
+				Tree      string `bson:"tree"`
+				LeafIndex int64  `bson:"leaf_index"`
+			} `bson:"_id"`
+			Keep primitive.ObjectID `bson:"keep"`
+		}
+		if err := cur.All(ctx, &duplicates); err != nil {
+			return err
+		}
+		for _, d := range duplicates {
+			filter := bson.M{"tree": d.Leaf.Tree, "leaf_index": d.Leaf.LeafIndex, "_id": bson.M{"$ne": d.Keep}}
+			if _, err := relations.DeleteMany(ctx, filter); err != nil {
+				return err
+			}
+		}
+
+		// unique index can't share keys with the plain one
+		if _, err := relations.Indexes().DropOne(ctx, "tree_1_leaf_index_1"); err != nil {
+			return err
+		}
+		if _, err := relations.Indexes().CreateOne(ctx, relationsLeafUnique); err != nil {
+			return err
+		}
+
+		return recountFollows(ctx, db)
+	}},
+	{13, "pending updates index", func(ctx context.Context, db *mongo.Database) error {
+		return createIndexes(ctx, db.Collection(collectionPending), pendingIndex)
+	}},
+	{14, "relation and edit slots from instructions log", func(ctx context.Context, db *mongo.Database) error {
+		const batchSize = 1000
+
+		leaves, err := logSlots(func(fn func(types.Instruction) error) error {
+			return scanProgramInstructions(ctx, db, fn)
+		})
+		if err != nil {
+			return fmt.Errorf("collect slots: %w", err)
+		}
+
+		relations := db.Collection(collectionEvents)
+		cur, err := relations.Find(ctx, bson.M{"$or": bson.A{
+			bson.M{"slot": int64(0)},
+			bson.M{"history.0": bson.M{"$exists": true}},
+		}})
+		if err != nil {
+			return err
+		}
+		defer cur.Close(ctx)
+
+		var models []mongo.WriteModel
+		flush := func() error {
+			if len(models) == 0 {
+				return nil
+			}
+			_, err := relations.BulkWrite(ctx, models)
+			models = models[:0]
+			return err
+		}
+		for cur.Next(ctx) {
+			var r types.Relation
+			if err := cur.Decode(&r); err != nil {
+				return err
+			}
+			if !fillSlots(&r, leaves) {
+				continue
+			}
+
+			set := bson.M{"slot": int64(r.Slot), "history": r.History}
+			if r.ClosedSlot != nil {
+				set["closed_slot"] = int64(*r.ClosedSlot)
+			}
+			models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": r.ID}).SetUpdate(bson.M{"$set": set}))
+			if len(models) == batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := cur.Err(); err != nil {
+			return err
+		}
+		return flush()
+	}},
+}
+
+// scanProgramInstructions calls fn for logged instructions of graph program, in order of slots
+func scanProgramInstructions(ctx context.Context, db *mongo.Database, fn func(types.Instruction) error) error {
+	cur, err := db.Collection(collectionInsts).Find(ctx, bson.M{"program": graph.GraphProgramAddress.ToBase58()},
+		options.Find().SetSort(bson.D{{Key: "slot", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var inst types.Instruction
+		if err := cur.Decode(&inst); err != nil {
+			return err
+		}
+		if err := fn(inst); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+const (
+	collectionMigrations    = "migrations"
+	collectionMigrationLock = "migrations_lock"
+
+	migrationLockID       = "lock"
+	migrationLockTTL      = 5 * time.Minute
+	migrationLockRetry    = 5 * time.Second
+	migrationLockInterval = time.Minute // how often held lock is extended
+)
+
+type appliedMigration struct {
+	Version     int           `bson:"_id"`
+	Description string        `bson:"description"`
+	AppliedAt   time.Time     `bson:"applied_at"`
+	Took        time.Duration `bson:"took"`
+}
+
+// Migrate applies pending migrations. Only one indexer instance migrates at a time,
+// others wait for the lock and find nothing left to do
+func (m Mongo) Migrate(ctx context.Context) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	db := m.c.Database(m.database)
+
+	release, err := m.acquireMigrationLock(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer release()
+
+	// swap of rebuilt projections may have been interrupted, until it's finished they are a mix of old and new ones
+	if err := m.finishRebuildSwap(ctx); err != nil {
+		return handleErr(err)
+	}
+
+	// rebuild swap progress is kept along with migrations
+	cur, err := db.Collection(collectionMigrations).Find(ctx, bson.M{"_id": bson.M{"$type": "number"}})
+	if err != nil {
+		return handleErr(fmt.Errorf("fetch applied migrations: %w", err))
+	}
+
+	var applied []appliedMigration
+	if err := cur.All(ctx, &applied); err != nil {
+		return handleErr(fmt.Errorf("decode applied migrations: %w", err))
+	}
+
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	for _, mig := range migrations {
+		if done[mig.version] {
+			continue
+		}
+
+		m.l.Logf("[INFO] applying migration #%d: %s", mig.version, mig.description)
+		start := time.Now()
+
+		if err := mig.up(ctx, db); err != nil {
+			return handleErr(fmt.Errorf("migration #%d: %w", mig.version, err))
+		}
+
+		_, err := db.Collection(collectionMigrations).InsertOne(ctx, appliedMigration{
+			Version:     mig.version,
+			Description: mig.description,
+			AppliedAt:   time.Now(),
+			Took:        time.Since(start),
+		})
+		if err != nil {
+			return handleErr(fmt.Errorf("record migration #%d: %w", mig.version, err))
+		}
+	}
+
+	return nil
+}
+
+// acquireMigrationLock blocks until lock is taken. Lock expires if holder dies,
+// so it's extended in background while migrations run
+func (m Mongo) acquireMigrationLock(ctx context.Context) (release func(), err error) {
+	c := m.c.Database(m.database).Collection(collectionMigrationLock)
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+
+	take := func(ctx context.Context) error {
+		now := time.Now()
+		filter := bson.M{
+			"_id": migrationLockID,
+			"$or": bson.A{bson.M{"owner": owner}, bson.M{"expires_at": bson.M{"$lt": now}}},
+		}
+		update := bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(migrationLockTTL)}}
+
+		// when lock is held by someone else filter doesn't match, and upsert fails with duplicate _id
+		_, err := c.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		return err
+	}
+
+	for {
+		err := take(ctx)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("acquire migration lock: %w", err)
+		}
+
+		m.l.Logf("[INFO] migration lock is held by another instance, waiting")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(migrationLockRetry):
+		}
+	}
+
+	extendCtx, stop := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(migrationLockInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-extendCtx.Done():
+				return
+			case <-ticker.C:
+				if err := take(extendCtx); err != nil && !errors.Is(err, context.Canceled) {
+					m.l.Logf("[ERROR] extend migration lock: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		stop()
+		<-stopped
+
+		if _, err := c.DeleteOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner}); err != nil {
+			m.l.Logf("[ERROR] release migration lock: %v", err)
+		}
+	}, nil
+}
+
+// recountFollows builds follows and counters from scratch, out of connected relations
+func recountFollows(ctx context.Context, db *mongo.Database) error {
+	const batchSize = 1000
+
+	counters, follows := db.Collection(collectionCounters), db.Collection(collectionFollows)
+	if err := counters.Drop(ctx); err != nil {
+		return err
+	}
+
+	// every relation makes a follow of its provider and a follow of any provider
+	cur, err := db.Collection(collectionEvents).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"disconnected_at": nil}}},
+		{{Key: "$project", Value: bson.M{"keys": bson.A{
+			bson.M{"from": "$from", "to": "$to", "provider": "$provider"},
+			bson.M{"from": "$from", "to": "$to", "provider": ""},
+		}}}},
+		{{Key: "$unwind", Value: "$keys"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       bson.M{"$concat": bson.A{"$keys.from", "|", "$keys.to", "|", "$keys.provider"}},
+			"from":      bson.M{"$first": "$keys.from"},
+			"to":        bson.M{"$first": "$keys.to"},
+			"provider":  bson.M{"$first": "$keys.provider"},
+			"relations": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$out", Value: collectionFollows}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("count follows: %w", err)
+	}
+	if err := cur.Close(ctx); err != nil {
+		return err
+	}
+
+	cur, err = follows.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	started := make(map[followKey]int64)
+	for cur.Next(ctx) {
+		var f follow
+		if err := cur.Decode(&f); err != nil {
+			return err
+		}
+		if started[followKey{f.From, f.To, f.Provider}] = 1; len(started) == batchSize {
+			if err := applyCounterDeltas(ctx, counters, followCounterDeltas(started)); err != nil {
+				return err
+			}
+			started = make(map[followKey]int64)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	return applyCounterDeltas(ctx, counters, followCounterDeltas(started))
+}
+
+func createIndexes(ctx context.Context, c *mongo.Collection, keys ...bson.D) error {
+	if _, err := c.Indexes().CreateMany(ctx, indexModels(keys...)); err != nil {
+		return fmt.Errorf("create indexes on %s: %w", c.Name(), err)
+	}
+	return nil
+}
+
+func indexModels(keys ...bson.D) []mongo.IndexModel {
+	models := make([]mongo.IndexModel, len(keys))
+	for i, k := range keys {
+		models[i] = mongo.IndexModel{Keys: k}
+	}
+	return models
+}
+
+// backfill sets `field` on documents that don't have it yet, in batches.
+// Since it only looks at documents missing the field, interrupted backfill resumes where it stopped
+func backfill(ctx context.Context, c *mongo.Collection, field string, compute func(doc bson.Raw) (any, error)) error {
+	const batchSize = 1000
+
+	for {
+		opts := options.Find().SetLimit(batchSize)
+		cur, err := c.Find(ctx, bson.M{field: bson.M{"$exists": false}}, opts)
+		if err != nil {
+			return fmt.Errorf("backfill %s: find: %w", field, err)
+		}
+
+		var models []mongo.WriteModel
+		for cur.Next(ctx) {
+			value, err := compute(cur.Current)
+			if err != nil {
+				cur.Close(ctx)
+				return fmt.Errorf("backfill %s: compute: %w", field, err)
+			}
+
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": cur.Current.Lookup("_id")}).
+				SetUpdate(bson.M{"$set": bson.M{field: value}}))
+		}
+		if err := cur.Err(); err != nil {
+			return fmt.Errorf("backfill %s: cursor: %w", field, err)
+		}
+		cur.Close(ctx)
+
+		if len(models) == 0 {
+			return nil
+		}
+
+		if _, err := c.BulkWrite(ctx, models); err != nil {
+			return fmt.Errorf("backfill %s: write: %w", field, err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+// newTestMongo connects to MONGO_TEST_URI and uses a fresh database, dropped after the test
+func newTestMongo(t *testing.T) Mongo {
+	t.Helper()
+
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMongo(ctx, client, lgr.NoOp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.database = fmt.Sprintf("sgraph_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		if err := client.Database(m.database).Drop(ctx); err != nil {
+			t.Errorf("drop test database: %v", err)
+		}
+		client.Disconnect(ctx)
+	})
+	return m
+}
+
+func appliedMigrations(t *testing.T, m Mongo) []appliedMigration {
+	t.Helper()
+
+	ctx := context.Background()
+	cur, err := m.c.Database(m.database).Collection(collectionMigrations).Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []appliedMigration
+	if err := cur.All(ctx, &applied); err != nil {
+		t.Fatal(err)
+	}
+	return applied
+}
+
+func TestMongoMigrate(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMongo(t)
+	relations := m.c.Database(m.database).Collection(collectionEvents)
+
+	// relation indexed before slots and kinds were recorded
+	extra, err := graph.EncodeKind("follow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relations.InsertOne(ctx, bson.M{"from": "a", "to": "b", "provider": "p", "extra": extra}); err != nil {
+		t.Fatal(err)
+	}
+
+	// instance holding the lock keeps others waiting
+	release, err := m.acquireMigrationLock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	err = m.Migrate(waitCtx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Migrate() with lock held error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if applied := appliedMigrations(t, m); len(applied) != 0 {
+		t.Fatalf("applied %d migrations without the lock", len(applied))
+	}
+	release()
+
+	// concurrent instances apply every migration once
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = m.Migrate(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Migrate() error = %v", err)
+		}
+	}
+
+	applied := appliedMigrations(t, m)
+	if len(applied) != len(migrations) {
+		t.Fatalf("recorded %d migrations, want %d", len(applied), len(migrations))
+	}
+	for i, a := range applied {
+		if a.Version != migrations[i].version || a.Description != migrations[i].description {
+			t.Errorf("recorded migration #%d %q, want #%d %q",
+				a.Version, a.Description, migrations[i].version, migrations[i].description)
+		}
+	}
+
+	var r bson.M
+	if err := relations.FindOne(ctx, bson.M{"from": "a"}).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	// the log has no trace of it
+	if r["slot"] != int64(0) {
+		t.Errorf("slot = %v, want backfilled 0 of unknown slot", r["slot"])
+	}
+	if r["kind"] != "follow" {
+		t.Errorf("kind = %v, want follow decoded from extra", r["kind"])
+	}
+
+	// re-run is a no-op
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range appliedMigrations(t, m) {
+		if !a.AppliedAt.Equal(applied[i].AppliedAt) {
+			t.Errorf("migration #%d is applied again", a.Version)
+		}
+	}
+}
+
+// rebuilds create projection indexes from projectionIndexes, it must list everything migrations create
+func TestMongoMigrateCreatesProjectionIndexes(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMongo(t)
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, indexes := range projectionIndexes {
+		var want []string
+		for _, idx := range indexes {
+			want = append(want, indexName(idx.Keys.(bson.D)))
+		}
+
+		specs, err := m.c.Database(m.database).Collection(name).Indexes().ListSpecifications(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, spec := range specs {
+			if spec.Name != "_id_" {
+				got = append(got, spec.Name)
+			}
+		}
+
+		sort.Strings(got)
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("migrated indexes of %s = %v, projectionIndexes list %v", name, got, want)
+		}
+	}
+}
+
+// indexName is default name mongo gives index of keys
+func indexName(keys bson.D) string {
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func TestMongoFinishesInterruptedRebuildSwap(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMongo(t)
+	db := m.c.Database(m.database)
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// swap stopped after providers, staging relations are left
+	if _, err := db.Collection(collectionEvents).InsertOne(ctx, bson.M{"from": "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection(collectionEvents+rebuildSuffix).InsertOne(ctx, bson.M{"from": "rebuilt"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Collection(collectionMigrations).InsertOne(ctx, rebuildSwap{ID: rebuildSwapID,
+		Swapped: []string{collectionProviders}, StartedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var r bson.M
+	if err := db.Collection(collectionEvents).FindOne(ctx, bson.M{}).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r["from"] != "rebuilt" {
+		t.Errorf("relations are %v after restart, want rebuilt ones", r["from"])
+	}
+	if n, err := db.Collection(collectionMigrations).CountDocuments(ctx, bson.M{"_id": rebuildSwapID}); err != nil || n != 0 {
+		t.Errorf("swap progress is kept after swap is finished: %d, %v", n, err)
+	}
+}
+
+func TestFillSlots(t *testing.T) {
+	follow, err := graph.EncodeKind("follow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedSlot := uint64(30)
+	leaf := func(index uint32) *uint32 { return &index }
+	leaves := map[string]*leafSlots{
+		leafKey("t", 1): {added: 10, edits: []leafEdit{{seq: 2, slot: 20}}},
+		leafKey("t", 2): {added: 10, closed: &closedSlot},
+		leafKey("t", 3): {added: 10, edits: []leafEdit{{seq: 2, slot: 20}}},
+	}
+	now := time.Unix(100, 0)
+
+	tests := []struct {
+		name      string
+		r         types.Relation
+		changed   bool
+		slot      uint64
+		closed    *uint64
+		editSlots []uint64
+	}{
+		{"edited", types.Relation{Tree: "t", LeafIndex: leaf(1), History: []types.ExtraEdit{{Extra: follow}}},
+			true, 10, nil, []uint64{20}},
+		{"closed", types.Relation{Tree: "t", LeafIndex: leaf(2), DisconnectedAt: &now}, true, 10, &closedSlot, nil},
+		{"edits missing from log", types.Relation{Tree: "t", LeafIndex: leaf(3), History: []types.ExtraEdit{{}, {}}},
+			false, 0, nil, []uint64{0, 0}},
+		{"known slot, edit missing from log", types.Relation{Tree: "t", LeafIndex: leaf(2), Slot: 10,
+			History: []types.ExtraEdit{{}}}, true, 0, nil, []uint64{0}},
+		{"not logged", types.Relation{Tree: "t", LeafIndex: leaf(4)}, false, 0, nil, nil},
+		{"no leaf index", types.Relation{Tree: "t"}, false, 0, nil, nil},
+		{"known slots", types.Relation{Tree: "t", LeafIndex: leaf(4), Slot: 5, History: []types.ExtraEdit{{Slot: 7}}},
+			false, 5, nil, []uint64{7}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.r
+			if changed := fillSlots(&r, leaves); changed != tt.changed {
+				t.Errorf("fillSlots() = %v, want %v", changed, tt.changed)
+			}
+			if r.Slot != tt.slot {
+				t.Errorf("slot = %d, want %d", r.Slot, tt.slot)
+			}
+			if (r.ClosedSlot == nil) != (tt.closed == nil) || (r.ClosedSlot != nil && *r.ClosedSlot != *tt.closed) {
+				t.Errorf("closed slot = %v, want %v", r.ClosedSlot, tt.closed)
+			}
+			editSlots := sliceMap(r.History, func(e types.ExtraEdit) uint64 { return e.Slot })
+			if fmt.Sprint(editSlots) != fmt.Sprint(nonNil(tt.editSlots)) {
+				t.Errorf("edit slots = %v, want %v", editSlots, tt.editSlots)
+			}
+		})
+	}
+
+	// kinds of replaced extras are filled in whether slots are found or not
+	r := types.Relation{History: []types.ExtraEdit{{Extra: follow}}}
+	if !fillSlots(&r, leaves) || r.History[0].Kind != "follow" {
+		t.Errorf("kind of replaced extra = %q, want follow", r.History[0].Kind)
+	}
+}
@@ -2,17 +2,17 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/go-pkgz/lgr"
-	"github.com/portto/solana-go-sdk/common"
 	"github.com/sgraph-protocol/sgraph/indexer/types"
-	graph "github.com/sgraph-protocol/sgraph/sdk/go"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type Mongo struct {
@@ -20,57 +20,908 @@ type Mongo struct {
 
 	c *mongo.Client
 	l lgr.L
+
+	// read preference of API queries. Everything else uses client's one
+	apiReads *readpref.ReadPref
+
+	// suffix of projection collections, set while they are rebuilt
+	staging string
+
+	// deployment is a replica set or sharded cluster, so writes of relations and counters share a transaction
+	transactions bool
 }
 
-func NewMongo(c *mongo.Client, l lgr.L) Mongo {
+func NewMongo(ctx context.Context, c *mongo.Client, l lgr.L, apiReads *readpref.ReadPref) (Mongo, error) {
 	const database = "sgraph"
-	return Mongo{database, c, l}
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := c.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return Mongo{}, fmt.Errorf("detect mongo topology: %w", err)
+	}
+	transactions := hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !transactions {
+		l.Logf("[WARN] mongo is a standalone server, counters may drift if indexer fails while updating them")
+	}
+
+	return Mongo{database, c, l, apiReads, "", transactions}, nil
+}
+
+// inTransaction runs fn in a transaction when deployment supports them, as is otherwise
+func (m Mongo) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !m.transactions {
+		return fn(ctx)
+	}
+
+	sess, err := m.c.StartSession()
+	if err != nil {
+		return fmt.Errorf("start session: %w", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (any, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// PrimaryReads returns store serving API queries from primary, whatever read preference is configured
+func (m Mongo) PrimaryReads() Mongo {
+	m.apiReads = readpref.Primary()
+	return m
+}
+
+// apiDB is database handle for API queries, which may be served by secondaries
+func (m Mongo) apiDB() *mongo.Database {
+	return m.c.Database(m.database, options.Database().SetReadPreference(m.apiReads))
+}
+
+const (
+	collectionEvents     string = "relations"
+	collectionQuarantine string = "quarantine"
+	collectionProviders  string = "providers"
+	collectionBroadcasts string = "events"
+	collectionInsts      string = "instructions"
+	collectionCounters   string = "counters"
+	collectionSkipped    string = "skipped"
+	collectionTrees      string = "trees"
+	collectionFollows    string = "follows"
+	collectionPending    string = "pending_updates"
+)
+
+// projectionCollections are rebuilt from instructions log
+var projectionCollections = []string{collectionProviders, collectionCounters, collectionFollows, collectionPending,
+	collectionSkipped, collectionEvents}
+
+// projection returns projection collection, staging one during rebuild
+func (m Mongo) projection(name string) *mongo.Collection {
+	return m.c.Database(m.database).Collection(name + m.staging)
+}
+
+// InitializeEvents sets up events retention. Events older than retention are removed by mongo.
+// Retention is configuration rather than schema, so unlike other indexes it's not managed by migrations
+func (m Mongo) InitializeEvents(ctx context.Context, retention time.Duration) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("initialize events: %w", err)
+	}
+
+	c := m.c.Database(m.database).Collection(collectionBroadcasts)
+
+	const ttlIndex = "emitted_at_ttl"
+	expireAfter := int32(retention.Seconds())
+
+	_, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "emitted_at", Value: 1}},
+		Options: options.Index().SetName(ttlIndex).SetExpireAfterSeconds(expireAfter),
+	})
+
+	const indexOptionsConflict = 85
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == indexOptionsConflict {
+		// retention has changed since index was created
+		err = m.c.Database(m.database).RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collectionBroadcasts},
+			{Key: "index", Value: bson.D{{Key: "name", Value: ttlIndex}, {Key: "expireAfterSeconds", Value: expireAfter}}},
+		}).Err()
+	}
+	if err != nil {
+		return handleErr(fmt.Errorf("ttl index: %w", err))
+	}
+
+	return nil
+}
+
+// storedRelation is relation with state of its counting. Follows are updated after relation is written,
+// the flags let retries find relations whose follows were not updated
+type storedRelation struct {
+	types.Relation `bson:",inline"`
+
+	// follows reflect current state of relation. Relations stored before flags were introduced have none,
+	// they were counted along with their insert
+	Counted bool `bson:"counted"`
+	// follows count relation as connected
+	Follows bool `bson:"follows"`
+}
+
+func (m Mongo) SaveRelations(ctx context.Context, relations []types.Relation) error {
+	return m.inTransaction(ctx, func(ctx context.Context) error {
+		return m.saveRelations(ctx, relations)
+	})
+}
+
+func (m Mongo) saveRelations(ctx context.Context, relations []types.Relation) error {
+	if len(relations) == 0 {
+		return nil
+	}
+
+	// relations of the batch, whether inserted by this attempt or by a failed one
+	batch := bson.A{}
+	var leaves bson.A
+	for _, r := range relations {
+		if r.LeafIndex != nil {
+			leaf := bson.M{"tree": r.Tree, "leaf_index": *r.LeafIndex}
+			leaves = append(leaves, leaf)
+			batch = append(batch, leaf)
+		}
+	}
+
+	stored := make(map[string]bool)
+	if len(leaves) > 0 {
+		cur, err := m.projection(collectionEvents).Find(ctx, bson.M{"$or": leaves},
+			options.Find().SetProjection(bson.M{"tree": 1, "leaf_index": 1}))
+		if err != nil {
+			return fmt.Errorf("find stored relations: %w", err)
+		}
+		var found []types.Relation
+		if err := cur.All(ctx, &found); err != nil {
+			return fmt.Errorf("find stored relations: %w", err)
+		}
+		for _, r := range found {
+			stored[leafKey(r.Tree, *r.LeafIndex)] = true
+		}
+	}
+
+	// leaves stored by previous attempts are left out, inside transaction duplicates would abort it
+	var (
+		documents []any
+		ids       bson.A
+	)
+	for _, r := range relations {
+		if r.LeafIndex != nil && stored[leafKey(r.Tree, *r.LeafIndex)] {
+			continue
+		}
+		if r.ID.IsZero() {
+			r.ID = primitive.NewObjectID()
+		}
+		documents = append(documents, storedRelation{Relation: r})
+		ids = append(ids, r.ID)
+	}
+	if len(ids) > 0 {
+		batch = append(batch, bson.M{"_id": bson.M{"$in": ids}})
+	}
+
+	if len(documents) > 0 {
+		// leaves are unique, so concurrent writers insert each of them once
+		_, err := m.projection(collectionEvents).InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+		if err != nil && !onlyDuplicates(err) {
+			return fmt.Errorf("insert documents: %w", err)
+		}
+	}
+
+	// updates may have been written before relations they update
+	if len(leaves) > 0 {
+		if _, err := m.applyPending(ctx, bson.M{"$or": leaves}); err != nil {
+			return fmt.Errorf("apply pending updates: %w", err)
+		}
+	}
+
+	if err := m.countRelations(ctx, bson.M{"$or": batch}); err != nil {
+		return fmt.Errorf("update counters: %w", err)
+	}
+	return nil
+}
+
+// countRelations updates follows of relations matching filter which are not counted yet.
+// Each relation is claimed before its follows are updated, so concurrent writers count it once.
+// Without transactions, relation claimed by a writer that fails right after stays uncounted
+func (m Mongo) countRelations(ctx context.Context, filter bson.M) error {
+	relations := m.projection(collectionEvents)
+
+	cur, err := relations.Find(ctx, bson.M{"$and": bson.A{filter, bson.M{"counted": false}}})
+	if err != nil {
+		return fmt.Errorf("find uncounted relations: %w", err)
+	}
+	var uncounted []storedRelation
+	if err := cur.All(ctx, &uncounted); err != nil {
+		return fmt.Errorf("find uncounted relations: %w", err)
+	}
+
+	for _, r := range uncounted {
+		connected := r.DisconnectedAt == nil
+
+		// relation closed meanwhile is claimed by writer that has closed it
+		claim := bson.M{"_id": r.ID, "counted": false, "follows": r.Follows, "disconnected_at": nil}
+		if !connected {
+			claim["disconnected_at"] = bson.M{"$ne": nil}
+		}
+		res, err := relations.UpdateOne(ctx, claim, bson.M{"$set": bson.M{"counted": true, "follows": connected}})
+		if err != nil {
+			return fmt.Errorf("claim relation: %w", err)
+		}
+		if res.ModifiedCount == 0 || connected == r.Follows {
+			continue
+		}
+
+		sign := int64(1)
+		if !connected {
+			sign = -1
+		}
+		if err := m.applyFollowDeltas(ctx, followDeltas([]types.Relation{r.Relation}, sign)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// follow is a followKey with number of its connected relations
+type follow struct {
+	ID        string `bson:"_id"`
+	From      string `bson:"from"`
+	To        string `bson:"to"`
+	Provider  string `bson:"provider"`
+	Relations int64  `bson:"relations"`
+}
+
+// applyFollowDeltas updates follows, and counters of the ones that have started or stopped.
+// $inc is atomic, so of concurrent writers exactly one sees a follow start or stop
+func (m Mongo) applyFollowDeltas(ctx context.Context, deltas map[followKey]int64) error {
+	follows := m.projection(collectionFollows)
+
+	changes := make(map[followKey]int64)
+	for _, key := range sortedFollowKeys(deltas) {
+		d := deltas[key]
+		if d == 0 {
+			continue
+		}
+
+		update := bson.M{
+			"$inc":         bson.M{"relations": d},
+			"$setOnInsert": bson.M{"from": key.from, "to": key.to, "provider": key.provider},
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+		var f follow
+		if err := follows.FindOneAndUpdate(ctx, bson.M{"_id": key.String()}, update, opts).Decode(&f); err != nil {
+			return fmt.Errorf("update follows: %w", err)
+		}
+		if change := followChange(f.Relations-d, f.Relations); change != 0 {
+			changes[key] = change
+		}
+
+		// unless it has been started again meanwhile
+		if f.Relations <= 0 {
+			if _, err := follows.DeleteOne(ctx, bson.M{"_id": key.String(), "relations": f.Relations}); err != nil {
+				return fmt.Errorf("delete follow: %w", err)
+			}
+		}
+	}
+
+	return applyCounterDeltas(ctx, m.projection(collectionCounters), followCounterDeltas(changes))
+}
+
+// UpdateRelations applies updates in order and returns relations they have changed.
+// Already applied updates are ignored, updates of relations not stored yet wait for them in pending updates
+func (m Mongo) UpdateRelations(ctx context.Context, updates []types.RelationUpdate) ([]types.Relation, error) {
+	var updated []types.Relation
+	err := m.inTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		updated, err = m.updateRelations(ctx, updates)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update relations: %w", err)
+	}
+	return updated, nil
+}
+
+func (m Mongo) updateRelations(ctx context.Context, updates []types.RelationUpdate) ([]types.Relation, error) {
+	handleErr := func(err error) ([]types.Relation, error) {
+		return nil, err
+	}
+
+	var updated []types.Relation
+	for _, u := range updates {
+		r, ok, err := m.updateRelation(ctx, u)
+		if err != nil {
+			return handleErr(err)
+		}
+		if ok {
+			updated = append(updated, r)
+			continue
+		}
+
+		leaf := bson.M{"tree": u.Tree, "leaf_index": u.LeafIndex}
+		n, err := m.projection(collectionEvents).CountDocuments(ctx, leaf, options.Count().SetLimit(1))
+		if err != nil {
+			return handleErr(err)
+		}
+		// applied already
+		if n > 0 {
+			continue
+		}
+
+		p := pendingUpdate{ID: fmt.Sprintf("%s|%d", leafKey(u.Tree, u.LeafIndex), u.Seq), Tree: u.Tree, LeafIndex: u.LeafIndex, Seq: u.Seq, Update: u}
+		_, err = m.projection(collectionPending).ReplaceOne(ctx, bson.M{"_id": p.ID}, p, options.Replace().SetUpsert(true))
+		if err != nil {
+			return handleErr(fmt.Errorf("park update: %w", err))
+		}
+
+		// relation may have been saved meanwhile, without seeing the update
+		applied, err := m.applyPending(ctx, leaf)
+		if err != nil {
+			return handleErr(fmt.Errorf("apply pending updates: %w", err))
+		}
+		updated = append(updated, applied...)
+	}
+
+	// closes applied by this attempt or by a failed one
+	if len(updates) > 0 {
+		leaves := sliceMap(updates, func(u types.RelationUpdate) any { return bson.M{"tree": u.Tree, "leaf_index": u.LeafIndex} })
+		if err := m.countRelations(ctx, bson.M{"$or": bson.A(leaves)}); err != nil {
+			return handleErr(fmt.Errorf("update counters: %w", err))
+		}
+	}
+
+	return updated, nil
+}
+
+// pendingUpdate is an update of a relation not stored yet
+type pendingUpdate struct {
+	ID        string               `bson:"_id"`
+	Tree      string               `bson:"tree"`
+	LeafIndex uint32               `bson:"leaf_index"`
+	Seq       uint64               `bson:"seq"`
+	Update    types.RelationUpdate `bson:"update"`
+}
+
+// applyPending applies pending updates matching filter in order of seq. Every update is claimed by deleting it,
+// so concurrent writers don't apply it twice
+func (m Mongo) applyPending(ctx context.Context, filter bson.M) ([]types.Relation, error) {
+	pending := m.projection(collectionPending)
+
+	cur, err := pending.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var updates []pendingUpdate
+	if err := cur.All(ctx, &updates); err != nil {
+		return nil, err
+	}
+
+	var applied []types.Relation
+	for _, p := range updates {
+		res, err := pending.DeleteOne(ctx, bson.M{"_id": p.ID})
+		if err != nil {
+			return nil, err
+		}
+		if res.DeletedCount == 0 {
+			continue
+		}
+
+		r, ok, err := m.updateRelation(ctx, p.Update)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			applied = append(applied, r)
+		}
+	}
+	return applied, nil
+}
+
+// updateRelation applies update to stored relation, unless it's applied already
+func (m Mongo) updateRelation(ctx context.Context, u types.RelationUpdate) (types.Relation, bool, error) {
+	filter := bson.M{"tree": u.Tree, "leaf_index": u.LeafIndex, "seq": bson.M{"$lt": u.Seq}}
+
+	var set bson.M
+	if u.Close {
+		// follows are updated by countRelations. Relations stored before counting flags were counted as connected
+		filter["disconnected_at"] = nil
+		set = bson.M{"disconnected_at": u.UpdatedAt, "closed_slot": int64(u.Slot), "seq": u.Seq,
+			"counted": false, "follows": bson.M{"$ifNull": bson.A{"$follows", true}}}
+	} else {
+		edit := bson.M{"extra": "$extra", "kind": "$kind", "extra_decoded": "$extra_decoded",
+			"edited_at": u.UpdatedAt, "slot": int64(u.Slot)}
+		set = bson.M{
+			"history":       bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$history", bson.A{}}}, bson.A{edit}}},
+			"extra":         bson.M{"$literal": u.Extra},
+			"kind":          u.Kind,
+			"extra_decoded": bson.M{"$literal": u.ExtraDecoded},
+			"seq":           u.Seq,
+		}
+	}
+
+	var r types.Relation
+	err := m.projection(collectionEvents).FindOneAndUpdate(ctx, filter, bson.A{bson.M{"$set": set}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return types.Relation{}, false, nil
+	}
+	if err != nil {
+		return types.Relation{}, false, err
+	}
+	return r, true, nil
+}
+
+// FetchCounters returns counters of addresses, in the same order
+func (m Mongo) FetchCounters(ctx context.Context, addresses []string) ([]types.Counters, error) {
+	cur, err := m.apiDB().Collection(collectionCounters).Find(ctx, bson.M{"_id": bson.M{"$in": addresses}})
+	if err != nil {
+		return nil, fmt.Errorf("fetch counters: %w", err)
+	}
+
+	var found []types.Counters
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("fetch counters: %w", err)
+	}
+
+	rows := make(map[counterKey]counterDelta)
+	for _, c := range found {
+		rows[counterKey{c.Address, ""}] = counterDelta{c.Followers, c.Following}
+		for provider, pc := range c.Providers {
+			rows[counterKey{c.Address, provider}] = counterDelta{pc.Followers, pc.Following}
+		}
+	}
+
+	return assembleCounters(addresses, rows), nil
+}
+
+// applyCounterDeltas increments counters, a single upsert per address
+func applyCounterDeltas(ctx context.Context, c *mongo.Collection, deltas map[counterKey]counterDelta) error {
+	incs := make(map[string]bson.M)
+	for key, d := range deltas {
+		inc, ok := incs[key.address]
+		if !ok {
+			inc = bson.M{}
+			incs[key.address] = inc
+		}
+
+		prefix := ""
+		if key.provider != "" {
+			prefix = "providers." + key.provider + "."
+		}
+		inc[prefix+"followers"] = d.Followers
+		inc[prefix+"following"] = d.Following
+	}
+
+	if len(incs) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(incs))
+	for address, inc := range incs {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": address}).
+			SetUpdate(bson.M{"$inc": inc}).
+			SetUpsert(true))
+	}
+
+	_, err := c.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// QuarantinedSlots returns slots with quarantined transactions
+func (m Mongo) QuarantinedSlots(ctx context.Context) ([]uint64, error) {
+	values, err := m.c.Database(m.database).Collection(collectionQuarantine).Distinct(ctx, "slot", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("find quarantined slots: %w", err)
+	}
+
+	slots := make([]uint64, 0, len(values))
+	for _, v := range values {
+		switch slot := v.(type) {
+		case int64:
+			slots = append(slots, uint64(slot))
+		case int32:
+			slots = append(slots, uint64(slot))
+		default:
+			return nil, fmt.Errorf("find quarantined slots: unexpected slot %v", v)
+		}
+	}
+	return slots, nil
+}
+
+// ReleaseQuarantine removes transactions quarantined in slots
+func (m Mongo) ReleaseQuarantine(ctx context.Context, slots []uint64) error {
+	filter := bson.M{"slot": bson.M{"$in": sliceMap(slots, func(s uint64) int64 { return int64(s) })}}
+	if _, err := m.c.Database(m.database).Collection(collectionQuarantine).DeleteMany(ctx, filter); err != nil {
+		return fmt.Errorf("release quarantine: %w", err)
+	}
+	return nil
+}
+
+func (m Mongo) QuarantineTransactions(ctx context.Context, txs []types.QuarantinedTx) error {
+	documents := make([]any, len(txs))
+	for i := range txs {
+		documents[i] = txs[i]
+	}
+
+	_, err := m.c.Database(m.database).Collection(collectionQuarantine).InsertMany(ctx, documents)
+	if err != nil {
+		return fmt.Errorf("insert quarantined transactions: %w", err)
+	}
+	return nil
+}
+
+func (m Mongo) SaveProviders(ctx context.Context, providers []types.Provider) error {
+	models := make([]mongo.WriteModel, len(providers))
+	for i, p := range providers {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": p.Address}).SetReplacement(p).SetUpsert(true)
+	}
+
+	_, err := m.projection(collectionProviders).BulkWrite(ctx, models)
+	if err != nil {
+		return fmt.Errorf("upsert providers: %w", err)
+	}
+	return nil
+}
+
+func (m Mongo) FetchProviders(ctx context.Context, addresses []string) ([]types.Provider, error) {
+	handleErr := func(err error) ([]types.Provider, error) {
+		return nil, fmt.Errorf("fetch providers: %w", err)
+	}
+
+	cur, err := m.c.Database(m.database).Collection(collectionProviders).Find(ctx, bson.M{"_id": bson.M{"$in": addresses}})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var providers []types.Provider
+	if err := cur.All(ctx, &providers); err != nil {
+		return handleErr(fmt.Errorf("decode cursor: %w", err))
+	}
+
+	return providers, nil
+}
+
+// SaveInstructions appends instructions to the log. Instructions that are already there are skipped
+func (m Mongo) SaveInstructions(ctx context.Context, insts []types.Instruction) error {
+	documents := make([]any, len(insts))
+	for i := range insts {
+		documents[i] = insts[i]
+	}
+
+	opts := options.InsertMany().SetOrdered(false)
+
+	_, err := m.c.Database(m.database).Collection(collectionInsts).InsertMany(ctx, documents, opts)
+	if err != nil && !onlyDuplicates(err) {
+		return fmt.Errorf("insert instructions: %w", err)
+	}
+	return nil
+}
+
+// ScanInstructions calls fn for every logged instruction, in order of execution
+func (m Mongo) ScanInstructions(ctx context.Context, fn func(types.Instruction) error) error {
+	opts := options.Find().SetSort(bson.D{
+		{Key: "slot", Value: 1}, {Key: "tx_index", Value: 1}, {Key: "outer", Value: 1}, {Key: "inner", Value: 1},
+	})
+	cur, err := m.c.Database(m.database).Collection(collectionInsts).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return fmt.Errorf("scan instructions: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var inst types.Instruction
+		if err := cur.Decode(&inst); err != nil {
+			return fmt.Errorf("scan instructions: %w", err)
+		}
+		if err := fn(inst); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("scan instructions: %w", err)
+	}
+
+	return nil
+}
+
+// RebuildProjections lets build fill fresh projection collections, then renames them over current ones.
+// Unlike postgres and bolt swaps, renames are not atomic together: progress of the swap is recorded, and swap
+// interrupted halfway is finished on the next start, see finishRebuildSwap. Indexer must be stopped during rebuild,
+// otherwise whatever it writes meanwhile is lost
+func (m Mongo) RebuildProjections(ctx context.Context, build func(Projections) error) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("rebuild projections: %w", err)
+	}
+
+	staging := m
+	staging.staging = rebuildSuffix
+
+	// staging collections of unfinished swap are complete, they go in before being replaced
+	if err := m.finishRebuildSwap(ctx); err != nil {
+		return handleErr(err)
+	}
+
+	// leftovers of interrupted rebuild
+	for _, name := range projectionCollections {
+		if err := staging.projection(name).Drop(ctx); err != nil {
+			return handleErr(err)
+		}
+	}
+
+	for name, indexes := range projectionIndexes {
+		if _, err := staging.projection(name).Indexes().CreateMany(ctx, indexes); err != nil {
+			return handleErr(fmt.Errorf("create indexes on %s: %w", name, err))
+		}
+	}
+
+	if err := build(staging); err != nil {
+		return handleErr(err)
+	}
+
+	_, err := m.c.Database(m.database).Collection(collectionMigrations).InsertOne(ctx, rebuildSwap{
+		ID:        rebuildSwapID,
+		StartedAt: time.Now(),
+	})
+	if err != nil {
+		return handleErr(fmt.Errorf("record swap: %w", err))
+	}
+
+	if err := m.finishRebuildSwap(ctx); err != nil {
+		return handleErr(err)
+	}
+	return nil
 }
 
 const (
-	collectionEvents string = "relations"
+	rebuildSuffix = "_rebuild" // of staging collections
+	rebuildSwapID = "rebuild_swap"
 )
 
-func (m Mongo) SaveRelations(ctx context.Context, relations []graph.Relation) error {
-	documents := make([]any, len(relations))
-	for i := range relations {
-		documents[i] = transformRelation(relations[i])
+// rebuildSwap is progress of swapping rebuilt projections in. It's recorded once all staging collections
+// are complete, and removed once all of them are swapped in
+type rebuildSwap struct {
+	ID        string    `bson:"_id"`
+	Swapped   []string  `bson:"swapped"`
+	StartedAt time.Time `bson:"started_at"`
+}
+
+// finishRebuildSwap renames staging collections of recorded swap over current ones, skipping already swapped.
+// Does nothing if there's no swap in progress
+func (m Mongo) finishRebuildSwap(ctx context.Context) error {
+	db := m.c.Database(m.database)
+	migrations := db.Collection(collectionMigrations)
+
+	var swap rebuildSwap
+	err := migrations.FindOne(ctx, bson.M{"_id": rebuildSwapID}).Decode(&swap)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fetch swap progress: %w", err)
+	}
+
+	if len(swap.Swapped) > 0 {
+		m.l.Logf("[WARN] finishing swap of rebuilt projections started at %s, swapped so far: %v",
+			swap.StartedAt.Format(time.RFC3339), swap.Swapped)
+	}
+
+	for _, name := range projectionCollections {
+		if contains(swap.Swapped, name) {
+			continue
+		}
+
+		// staging collection is gone if swap stopped right after renaming it
+		staged, err := db.ListCollectionNames(ctx, bson.M{"name": name + rebuildSuffix})
+		if err != nil {
+			return fmt.Errorf("swap %s: %w (swapped %v, the rest are swapped on next start)", name, err, swap.Swapped)
+		}
+
+		if len(staged) > 0 {
+			err = m.c.Database("admin").RunCommand(ctx, bson.D{
+				{Key: "renameCollection", Value: m.database + "." + name + rebuildSuffix},
+				{Key: "to", Value: m.database + "." + name},
+				{Key: "dropTarget", Value: true},
+			}).Err()
+			if err != nil {
+				return fmt.Errorf("swap %s: %w (swapped %v, the rest are swapped on next start)", name, err, swap.Swapped)
+			}
+		}
+
+		_, err = migrations.UpdateOne(ctx, bson.M{"_id": rebuildSwapID}, bson.M{"$push": bson.M{"swapped": name}})
+		if err != nil {
+			return fmt.Errorf("record swap of %s: %w (swapped %v, the rest are swapped on next start)", name, err, swap.Swapped)
+		}
+		swap.Swapped = append(swap.Swapped, name)
+		m.l.Logf("[INFO] swapped %s.%s", db.Name(), name)
+	}
+
+	if _, err := migrations.DeleteOne(ctx, bson.M{"_id": rebuildSwapID}); err != nil {
+		return fmt.Errorf("finish swap: %w", err)
+	}
+	return nil
+}
+
+// SaveSkipped records relations left out by ingest rules. Already recorded ones are skipped
+func (m Mongo) SaveSkipped(ctx context.Context, skipped []types.SkippedRelation) error {
+	documents := make([]any, len(skipped))
+	for i := range skipped {
+		documents[i] = skipped[i]
 	}
 
-	_, err := m.c.Database(m.database).Collection(collectionEvents).InsertMany(ctx, documents)
+	opts := options.InsertMany().SetOrdered(false)
+
+	_, err := m.projection(collectionSkipped).InsertMany(ctx, documents, opts)
+	if err != nil && !onlyDuplicates(err) {
+		return fmt.Errorf("insert skipped relations: %w", err)
+	}
+	return nil
+}
+
+// FetchSkipped returns skipped relations of provider in order of execution, starting after given position
+func (m Mongo) FetchSkipped(ctx context.Context, provider, after string, limit uint) ([]types.SkippedRelation, error) {
+	query := bson.M{"provider": provider}
+	if after != "" {
+		query["_id"] = bson.M{"$gt": after}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+
+	cur, err := m.apiDB().Collection(collectionSkipped).Find(ctx, query, opts)
+	if err != nil {
+		return nil, fmt.Errorf("fetch skipped relations: %w", err)
+	}
+
+	var skipped []types.SkippedRelation
+	if err := cur.All(ctx, &skipped); err != nil {
+		return nil, fmt.Errorf("fetch skipped relations: %w", err)
+	}
+	return skipped, nil
+}
+
+// FetchLedger counts indexed and skipped relations of providers
+func (m Mongo) FetchLedger(ctx context.Context, providers []string) ([]types.LedgerEntry, error) {
+	handleErr := func(err error) ([]types.LedgerEntry, error) {
+		return nil, fmt.Errorf("fetch ledger: %w", err)
+	}
+
+	db := m.apiDB()
+
+	ledger := make([]types.LedgerEntry, len(providers))
+	for i, provider := range providers {
+		indexed, err := db.Collection(collectionEvents).CountDocuments(ctx, bson.M{"provider": provider})
+		if err != nil {
+			return handleErr(err)
+		}
+		skipped, err := db.Collection(collectionSkipped).CountDocuments(ctx, bson.M{"provider": provider})
+		if err != nil {
+			return handleErr(err)
+		}
+		ledger[i] = types.LedgerEntry{Provider: provider, Indexed: indexed, Skipped: skipped}
+	}
+
+	return ledger, nil
+}
+
+// SaveTrees records discovered trees. State of already known trees is kept
+func (m Mongo) SaveTrees(ctx context.Context, trees []types.Tree) error {
+	models := make([]mongo.WriteModel, len(trees))
+	for i, t := range trees {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": t.Address}).
+			SetUpdate(bson.M{"$set": bson.M{"controller": t.Controller, "authority": t.Authority, "created_at": t.CreatedAt}}).
+			SetUpsert(true)
+	}
+
+	_, err := m.c.Database(m.database).Collection(collectionTrees).BulkWrite(ctx, models)
+	if err != nil {
+		return fmt.Errorf("upsert trees: %w", err)
+	}
+	return nil
+}
+
+// AdvanceTrees applies states of trees. Root is only replaced by the one of a later change log
+func (m Mongo) AdvanceTrees(ctx context.Context, states map[string]types.TreeState) error {
+	var models []mongo.WriteModel
+	for address, s := range states {
+		models = append(models,
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": address}).
+				SetUpdate(bson.M{"$max": bson.M{"leaf_count": s.LeafCount}}).
+				SetUpsert(true),
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": address, "$or": bson.A{
+					bson.M{"seq": bson.M{"$lt": s.Seq}}, bson.M{"seq": bson.M{"$exists": false}},
+				}}).
+				SetUpdate(bson.M{"$set": bson.M{"seq": s.Seq, "root": s.Root}}),
+		)
+	}
+
+	_, err := m.c.Database(m.database).Collection(collectionTrees).BulkWrite(ctx, models)
+	if err != nil {
+		return fmt.Errorf("advance trees: %w", err)
+	}
+	return nil
+}
+
+func (m Mongo) FetchTrees(ctx context.Context) ([]types.Tree, error) {
+	cur, err := m.apiDB().Collection(collectionTrees).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
 	if err != nil {
-		return fmt.Errorf("insert documents: %w", err)
+		return nil, fmt.Errorf("fetch trees: %w", err)
+	}
+
+	var trees []types.Tree
+	if err := cur.All(ctx, &trees); err != nil {
+		return nil, fmt.Errorf("fetch trees: %w", err)
+	}
+	return trees, nil
+}
+
+func (m Mongo) SaveEvents(ctx context.Context, events []types.Event) error {
+	documents := make([]any, len(events))
+	for i := range events {
+		documents[i] = events[i]
+	}
+
+	opts := options.InsertMany().SetOrdered(false)
+
+	_, err := m.c.Database(m.database).Collection(collectionBroadcasts).InsertMany(ctx, documents, opts)
+	if err != nil && !onlyDuplicates(err) {
+		return fmt.Errorf("insert events: %w", err)
 	}
 	return nil
 }
 
-func (m Mongo) FetchRelations(ctx context.Context, from, to string, providers []string, after string, limit uint) ([]graph.Relation, error) {
-	handleErr := func(err error) ([]graph.Relation, error) {
-		return nil, fmt.Errorf("fetch events: %w", err)
+func (m Mongo) FetchEvents(ctx context.Context, q EventsQuery) ([]types.Event, string, error) {
+	handleErr := func(err error) ([]types.Event, string, error) {
+		return nil, "", fmt.Errorf("fetch events: %w", err)
+	}
+
+	after, err := decodeEventsCursor(q)
+	if err != nil {
+		return handleErr(err)
 	}
 
-	c := m.c.Database(m.database).Collection(collectionEvents)
+	c := m.apiDB().Collection(collectionBroadcasts)
 
-	opts := options.Find().SetSort(bson.D{{"_id", -1}}).SetLimit(int64(limit))
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(q.Limit))
 
 	query := primitive.M{}
-	if from != "" {
-		query["from"] = from
+	if q.Actor != "" {
+		query["actor"] = q.Actor
+	}
+
+	if q.Target != "" {
+		query["target"] = q.Target
+	}
+
+	if len(q.Providers) > 0 {
+		query["provider"] = bson.M{"$in": q.Providers}
 	}
 
-	if to != "" {
-		query["to"] = to
+	if !q.IncludeUnverified {
+		query["verified"] = true
 	}
 
-	fmt.Println(providers)
-	if len(providers) > 0 {
-		query["provider"] = bson.M{"$in": providers}
+	emittedAt := primitive.M{}
+	if !q.Since.IsZero() {
+		emittedAt["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		emittedAt["$lt"] = q.Until
+	}
+	if len(emittedAt) > 0 {
+		query["emitted_at"] = emittedAt
 	}
 
 	if after != "" {
 		oid, err := primitive.ObjectIDFromHex(after)
 		if err != nil {
-			return handleErr(err)
+			return handleErr(ErrInvalidCursor)
 		}
 		query["_id"] = primitive.M{"$lt": oid}
 	}
@@ -80,34 +931,273 @@ func (m Mongo) FetchRelations(ctx context.Context, from, to string, providers []
 		return handleErr(fmt.Errorf("find records: %w", err))
 	}
 
+	var events []types.Event
+	if err := cur.All(ctx, &events); err != nil {
+		return handleErr(fmt.Errorf("decode cursor: %w", err))
+	}
+
+	next, err := nextEventsCursor(q, events, func(i int) string { return events[i].ID.Hex() })
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return events, next, nil
+}
+
+// onlyDuplicates reports if every error of unordered bulk write is a duplicate key error
+func onlyDuplicates(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+
+	for _, e := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m Mongo) FetchRelations(ctx context.Context, q RelationsQuery) ([]types.Relation, string, error) {
+	handleErr := func(err error) ([]types.Relation, string, error) {
+		return nil, "", fmt.Errorf("fetch relations: %w", err)
+	}
+
+	after, err := decodeCursor(q)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	c := m.apiDB().Collection(collectionEvents)
+
+	field, dir, cmp := mongoSort(q)
+	sort := bson.D{{Key: field, Value: dir}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: dir})
+	}
+	opts := options.Find().SetSort(sort).SetLimit(int64(q.Limit))
+
+	query := primitive.M{}
+	if q.From != "" {
+		query["from"] = q.From
+	}
+
+	if q.To != "" {
+		query["to"] = q.To
+	}
+
+	if len(q.Pairs) > 0 {
+		// every clause is served by relationsPairIndex
+		query["$or"] = sliceMap(q.Pairs, func(p RelationPair) bson.M { return bson.M{"from": p.From, "to": p.To} })
+	}
+
+	if len(q.Providers) > 0 {
+		query["provider"] = bson.M{"$in": q.Providers}
+	}
+
+	if q.Tree != "" {
+		query["tree"] = q.Tree
+	}
+
+	conds := mongoPointConds(q)
+
+	if q.AsOf == nil {
+		if len(q.Kinds) > 0 {
+			query["kind"] = bson.M{"$in": q.Kinds}
+		}
+		for field, value := range q.ExtraFields {
+			query["extra_decoded."+field] = value
+		}
+	} else if len(q.Kinds) > 0 || len(q.ExtraFields) > 0 {
+		conds = append(conds, mongoStateConds(q)...)
+	}
+
+	if after != nil {
+		cond, err := mongoCursorCond(*after, field, cmp)
+		if err != nil {
+			return handleErr(err)
+		}
+		conds = append(conds, cond)
+	}
+	if len(conds) > 0 {
+		query["$and"] = conds
+	}
+
+	cur, err := c.Find(ctx, query, opts)
+	if err != nil {
+		return handleErr(fmt.Errorf("find records: %w", err))
+	}
+
 	var relations []types.Relation
 	if err := cur.All(ctx, &relations); err != nil {
 		return handleErr(fmt.Errorf("decode cursor: %w", err))
 	}
 
-	return sliceMap(relations, parseRelation), nil
+	next, err := nextCursor(q, relations, func(i int) string { return relations[i].ID.Hex() })
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return sliceMap(relations, q.asOf), next, nil
 }
 
-func transformRelation(r graph.Relation) types.Relation {
-	return types.Relation{
-		From:           r.From.ToBase58(),
-		To:             r.To.ToBase58(),
-		Provider:       r.Provider.ToBase58(),
-		ConnectedAt:    time.Unix(r.ConnectedAt, 0),
-		DisconnectedAt: optionMap(r.DisconnectedAt, func(ts int64) time.Time { return time.Unix(ts, 0) }),
-		Extra:          r.Extra,
+// mongoStateConds select relations by kind and decoded fields of extra they had at AsOf
+func mongoStateConds(q RelationsQuery) []bson.M {
+	var conds []bson.M
+
+	// any relation that ever had one of kinds, served by kind index
+	if len(q.Kinds) > 0 {
+		conds = append(conds, bson.M{"$or": bson.A{
+			bson.M{"kind": bson.M{"$in": q.Kinds}},
+			bson.M{"history.kind": bson.M{"$in": q.Kinds}},
+		}})
 	}
+
+	// extra replaced by the first edit made after the point, current one if there is none
+	replacedAfter := bson.M{"$gt": bson.A{"$$this.slot", int64(q.AsOf.Slot)}}
+	if q.AsOf.Time != nil {
+		replacedAfter = bson.M{"$gt": bson.A{"$$this.edited_at", *q.AsOf.Time}}
+	}
+	state := bson.M{"$let": bson.M{
+		"vars": bson.M{"later": bson.M{"$filter": bson.M{
+			"input": bson.M{"$ifNull": bson.A{"$history", bson.A{}}},
+			"cond":  replacedAfter,
+		}}},
+		"in": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{bson.M{"$size": "$$later"}, 0}},
+			bson.M{"$arrayElemAt": bson.A{"$$later", 0}},
+			bson.M{"kind": "$kind", "extra_decoded": "$extra_decoded"},
+		}},
+	}}
+
+	matches := bson.A{}
+	if len(q.Kinds) > 0 {
+		matches = append(matches, bson.M{"$in": bson.A{bson.M{"$ifNull": bson.A{"$$state.kind", ""}}, q.Kinds}})
+	}
+	for field, value := range q.ExtraFields {
+		matches = append(matches, bson.M{"$eq": bson.A{"$$state.extra_decoded." + field, bson.M{"$literal": value}}})
+	}
+
+	return append(conds, bson.M{"$expr": bson.M{"$let": bson.M{
+		"vars": bson.M{"state": state},
+		"in":   bson.M{"$and": matches},
+	}}})
 }
 
-func parseRelation(r types.Relation) graph.Relation {
-	return graph.Relation{
-		From:           common.PublicKeyFromString(r.From),
-		To:             common.PublicKeyFromString(r.To),
-		Provider:       common.PublicKeyFromString(r.Provider),
-		ConnectedAt:    r.ConnectedAt.Unix(),
-		DisconnectedAt: optionMap(r.DisconnectedAt, func(ts time.Time) int64 { return ts.Unix() }),
-		Extra:          r.Extra,
+// mongoSort returns field relations are sorted by, direction of sort and operator selecting relations after a cursor
+func mongoSort(q RelationsQuery) (field string, dir int, cmp string) {
+	switch q.Sort {
+	case SortConnectedAt:
+		field = "connected_at"
+	case SortSlot:
+		field = "slot"
+	default:
+		field = "_id"
 	}
+
+	if q.Order == OrderAsc {
+		return field, 1, "$gt"
+	}
+	return field, -1, "$lt"
+}
+
+// mongoCursorCond selects relations after the cursor, ties of sort field are ordered by _id
+func mongoCursorCond(c relationsCursor, field, cmp string) (bson.M, error) {
+	oid, err := primitive.ObjectIDFromHex(c.ID)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var value any
+	switch field {
+	case "connected_at":
+		value = *c.Time
+	case "slot":
+		value = int64(c.Slot)
+	default:
+		return bson.M{"_id": bson.M{cmp: oid}}, nil
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{cmp: value}},
+		bson.M{field: value, "_id": bson.M{cmp: oid}},
+	}}, nil
+}
+
+// ScanRelations calls fn for every stored relation, oldest first
+func (m Mongo) ScanRelations(ctx context.Context, fn func(types.Relation) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := m.c.Database(m.database).Collection(collectionEvents).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return fmt.Errorf("scan relations: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var r types.Relation
+		if err := cur.Decode(&r); err != nil {
+			return fmt.Errorf("scan relations: %w", err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("scan relations: %w", err)
+	}
+
+	return nil
+}
+
+// ScanSkipped calls fn for every skipped relation, in order of execution
+func (m Mongo) ScanSkipped(ctx context.Context, fn func(types.SkippedRelation) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := m.c.Database(m.database).Collection(collectionSkipped).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return fmt.Errorf("scan skipped relations: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var s types.SkippedRelation
+		if err := cur.Decode(&s); err != nil {
+			return fmt.Errorf("scan skipped relations: %w", err)
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("scan skipped relations: %w", err)
+	}
+
+	return nil
+}
+
+// ScanProviders calls fn for every stored provider
+func (m Mongo) ScanProviders(ctx context.Context, fn func(types.Provider) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := m.c.Database(m.database).Collection(collectionProviders).Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return fmt.Errorf("scan providers: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var p types.Provider
+		if err := cur.Decode(&p); err != nil {
+			return fmt.Errorf("scan providers: %w", err)
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("scan providers: %w", err)
+	}
+
+	return nil
 }
 
 func optionMap[T, G any](ptr *T, f func(T) G) *G {
@@ -125,3 +1215,47 @@ func sliceMap[T, U any](input []T, f func(T) U) []U {
 	}
 	return output
 }
+
+// mongoPointConds selects relations by Status at AsOf, and bounds of AddedAfter and ClosedBy
+func mongoPointConds(q RelationsQuery) []bson.M {
+	var conds []bson.M
+
+	// relations of unknown slots can't be placed in time by slot
+	if q.bySlot() {
+		conds = append(conds, bson.M{"slot": bson.M{"$gt": int64(0)}})
+	}
+
+	if q.AddedAfter != nil {
+		added, _, value := mongoPointFields(*q.AddedAfter)
+		conds = append(conds, bson.M{added: bson.M{"$gt": value}})
+	}
+	if q.ClosedBy != nil {
+		_, closed, value := mongoPointFields(*q.ClosedBy)
+		conds = append(conds, bson.M{closed: bson.M{"$lte": value}})
+	}
+
+	// closed is null or missing while relation is active
+	closedAt := bson.M{"disconnected_at": bson.M{"$ne": nil}}
+	if q.AsOf != nil {
+		added, closed, value := mongoPointFields(*q.AsOf)
+		conds = append(conds, bson.M{added: bson.M{"$lte": value}})
+		closedAt = bson.M{closed: bson.M{"$lte": value}}
+	}
+
+	switch q.Status {
+	case RelationsActive:
+		conds = append(conds, bson.M{"$nor": bson.A{closedAt}})
+	case RelationsClosed:
+		conds = append(conds, closedAt)
+	}
+
+	return conds
+}
+
+// mongoPointFields returns fields relations are added and closed at, in units of the point, and its value
+func mongoPointFields(p Point) (added, closed string, value any) {
+	if p.Time != nil {
+		return "connected_at", "disconnected_at", *p.Time
+	}
+	return "slot", "closed_slot", int64(p.Slot)
+}
@@ -0,0 +1,78 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+func TestMongoCountsRelationsOfRetriedBatch(t *testing.T) {
+	ctx := context.Background()
+	db := newTestMongo(t)
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		transactions bool
+		to, tree     string
+	}{
+		{"standalone", false, "b", "t1"},
+		{"replica set", true, "c", "t2"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.transactions && !db.transactions {
+				t.Skip("mongo is a standalone server")
+			}
+			m := db
+			m.transactions = tt.transactions
+
+			followers := func() int64 {
+				t.Helper()
+				counters, err := m.FetchCounters(ctx, []string{tt.to})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return counters[0].Followers
+			}
+
+			batch := []types.Relation{leafRelation("a", tt.to, 0), leafRelation("d", tt.to, 1)}
+			for i := range batch {
+				batch[i].Tree = tt.tree
+			}
+
+			// attempt failed between inserting relations and counting them
+			if _, err := m.projection(collectionEvents).InsertOne(ctx, storedRelation{Relation: batch[0]}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := m.SaveRelations(ctx, batch); err != nil {
+					t.Fatal(err)
+				}
+				if n := followers(); n != 2 {
+					t.Fatalf("attempt %d: followers = %d, want 2", i, n)
+				}
+			}
+
+			// attempt failed between closing relation and counting it
+			close := types.RelationUpdate{Tree: tt.tree, LeafIndex: 0, Seq: 1, Slot: 2, Close: true, UpdatedAt: time.Unix(2, 0)}
+			if _, _, err := m.updateRelation(ctx, close); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := m.UpdateRelations(ctx, []types.RelationUpdate{close}); err != nil {
+					t.Fatal(err)
+				}
+				if n := followers(); n != 1 {
+					t.Fatalf("attempt %d: followers after close = %d, want 1", i, n)
+				}
+			}
+		})
+	}
+}
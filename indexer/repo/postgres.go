@@ -0,0 +1,1382 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+// Postgres implements the same storage as Mongo on top of PostgreSQL.
+// Pagination cursors are decimal ids of rows
+type Postgres struct {
+	pool *pgxpool.Pool
+	l    lgr.L
+
+	// suffix of projection tables, set while they are rebuilt
+	staging string
+}
+
+func NewPostgres(pool *pgxpool.Pool, l lgr.L) Postgres {
+	return Postgres{pool, l, ""}
+}
+
+// pgMigrations are applied in order, exactly once. Never edit released migrations, add a new one instead
+var pgMigrations = []struct {
+	version     int
+	description string
+	sql         string
+}{
+	{1, "relations", `
+		CREATE TABLE relations (
+			id              BIGSERIAL PRIMARY KEY,
+			from_key        TEXT NOT NULL,
+			to_key          TEXT NOT NULL,
+			provider        TEXT NOT NULL,
+			connected_at    TIMESTAMPTZ NOT NULL,
+			disconnected_at TIMESTAMPTZ,
+			extra           BYTEA NOT NULL
+		);
+		CREATE INDEX relations_from_idx ON relations (from_key, id DESC);
+		CREATE INDEX relations_to_idx ON relations (to_key, id DESC);
+		CREATE INDEX relations_provider_idx ON relations (provider, id DESC);
+	`},
+	{2, "quarantine", `
+		CREATE TABLE quarantine (
+			id             BIGSERIAL PRIMARY KEY,
+			slot           BIGINT NOT NULL,
+			signature      TEXT NOT NULL,
+			stage          TEXT NOT NULL,
+			error          TEXT NOT NULL,
+			raw            BYTEA,
+			quarantined_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX quarantine_slot_idx ON quarantine (slot);
+	`},
+	{3, "providers", `
+		CREATE TABLE providers (
+			address    TEXT PRIMARY KEY,
+			authority  TEXT NOT NULL,
+			name       TEXT NOT NULL,
+			website    TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL
+		);
+	`},
+	{4, "events", `
+		CREATE TABLE events (
+			id         BIGSERIAL PRIMARY KEY,
+			provider   TEXT NOT NULL,
+			actor      TEXT NOT NULL,
+			target     TEXT NOT NULL,
+			extra      BYTEA NOT NULL,
+			program    TEXT NOT NULL,
+			verified   BOOLEAN NOT NULL,
+			signature  TEXT NOT NULL,
+			idx        INT NOT NULL,
+			slot       BIGINT NOT NULL,
+			emitted_at TIMESTAMPTZ NOT NULL,
+			UNIQUE (signature, idx)
+		);
+		CREATE INDEX events_actor_idx ON events (actor, id DESC);
+		CREATE INDEX events_target_idx ON events (target, id DESC);
+		CREATE INDEX events_provider_idx ON events (provider, id DESC);
+		CREATE INDEX events_emitted_at_idx ON events (emitted_at);
+	`},
+	{5, "instructions", `
+		CREATE TABLE instructions (
+			slot       BIGINT NOT NULL,
+			block_time TIMESTAMPTZ NOT NULL,
+			signature  TEXT NOT NULL,
+			tx_index   INT NOT NULL,
+			outer_idx  INT NOT NULL,
+			inner_idx  INT NOT NULL,
+			program    TEXT NOT NULL,
+			accounts   JSONB NOT NULL,
+			data       BYTEA NOT NULL,
+			UNIQUE (signature, outer_idx, inner_idx)
+		);
+		CREATE INDEX instructions_order_idx ON instructions (slot, tx_index, outer_idx, inner_idx);
+	`},
+	{6, "relation counters", `
+		CREATE TABLE counters (
+			address   TEXT NOT NULL,
+			provider  TEXT NOT NULL, -- empty for total over all providers
+			followers BIGINT NOT NULL,
+			following BIGINT NOT NULL,
+			PRIMARY KEY (address, provider)
+		);
+		INSERT INTO counters (address, provider, followers, following)
+		SELECT address, provider, sum(followers), sum(following) FROM (
+			SELECT to_key AS address, provider, 1 AS followers, 0 AS following FROM relations WHERE disconnected_at IS NULL
+			UNION ALL
+			SELECT from_key, provider, 0, 1 FROM relations WHERE disconnected_at IS NULL
+			UNION ALL
+			SELECT to_key, '', 1, 0 FROM relations WHERE disconnected_at IS NULL
+			UNION ALL
+			SELECT from_key, '', 0, 1 FROM relations WHERE disconnected_at IS NULL
+		) AS counted
+		GROUP BY address, provider;
+	`},
+	{7, "skipped relations", `
+		CREATE TABLE skipped (
+			position   TEXT PRIMARY KEY,
+			slot       BIGINT NOT NULL,
+			signature  TEXT NOT NULL,
+			provider   TEXT NOT NULL,
+			leaf       BYTEA NOT NULL,
+			skipped_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX skipped_provider_idx ON skipped (provider, position);
+	`},
+	{8, "relation trees", `
+		ALTER TABLE relations ADD COLUMN tree TEXT NOT NULL DEFAULT '', ADD COLUMN leaf_index BIGINT;
+		CREATE INDEX relations_tree_idx ON relations (tree, id DESC);
+		ALTER TABLE skipped ADD COLUMN tree TEXT NOT NULL DEFAULT '', ADD COLUMN leaf_index BIGINT;
+		ALTER TABLE instructions ADD COLUMN change_log BYTEA;
+		CREATE TABLE trees (
+			address    TEXT PRIMARY KEY,
+			controller TEXT NOT NULL DEFAULT '',
+			authority  TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT 'epoch',
+			seq        BIGINT NOT NULL DEFAULT 0,
+			leaf_count BIGINT NOT NULL DEFAULT 0,
+			root       BYTEA
+		);
+	`},
+	{9, "relation updates", `
+		ALTER TABLE relations ADD COLUMN seq BIGINT NOT NULL DEFAULT 0, ADD COLUMN history JSONB NOT NULL DEFAULT '[]';
+		CREATE INDEX relations_leaf_idx ON relations (tree, leaf_index);
+	`},
+	{10, "decoded extra", `
+		ALTER TABLE relations ADD COLUMN extra_decoded JSONB;
+		CREATE INDEX relations_extra_decoded_idx ON relations USING GIN (extra_decoded jsonb_path_ops);
+	`},
+	{11, "relation kinds", `
+		ALTER TABLE relations ADD COLUMN kind TEXT NOT NULL DEFAULT '';
+		CREATE INDEX relations_kind_idx ON relations (kind, id DESC);
+	`},
+	{12, "relation slots", `
+		ALTER TABLE relations ADD COLUMN slot BIGINT NOT NULL DEFAULT 0, ADD COLUMN closed_slot BIGINT;
+	`},
+	{13, "relations sort indexes", `
+		CREATE INDEX relations_from_connected_idx ON relations (from_key, connected_at DESC, id DESC);
+		CREATE INDEX relations_to_connected_idx ON relations (to_key, connected_at DESC, id DESC);
+		CREATE INDEX relations_from_slot_idx ON relations (from_key, slot DESC, id DESC);
+		CREATE INDEX relations_to_slot_idx ON relations (to_key, slot DESC, id DESC);
+	`},
+	{14, "relations pair index", `
+		CREATE INDEX relations_pair_idx ON relations (from_key, to_key, id DESC);
+	`},
+	{15, "unique relation leaves and distinct follows", `
+		DELETE FROM relations a USING relations b
+			WHERE a.tree = b.tree AND a.leaf_index = b.leaf_index AND a.id > b.id;
+		DROP INDEX relations_leaf_idx;
+		CREATE UNIQUE INDEX relations_leaf_idx ON relations (tree, leaf_index) WHERE leaf_index IS NOT NULL;
+		CREATE TABLE follows (
+			from_key  TEXT NOT NULL,
+			to_key    TEXT NOT NULL,
+			provider  TEXT NOT NULL, -- empty for any provider
+			relations BIGINT NOT NULL,
+			PRIMARY KEY (from_key, to_key, provider)
+		);
+		INSERT INTO follows (from_key, to_key, provider, relations)
+		SELECT from_key, to_key, provider, count(*) FROM relations WHERE disconnected_at IS NULL
+			GROUP BY from_key, to_key, provider
+		UNION ALL
+		SELECT from_key, to_key, '', count(*) FROM relations WHERE disconnected_at IS NULL
+			GROUP BY from_key, to_key;
+		DELETE FROM counters;
+		INSERT INTO counters (address, provider, followers, following)
+		SELECT address, provider, sum(followers), sum(following) FROM (
+			SELECT to_key AS address, provider, 1 AS followers, 0 AS following FROM follows
+			UNION ALL
+			SELECT from_key, provider, 0, 1 FROM follows
+		) AS counted
+		GROUP BY address, provider;
+	`},
+	{16, "pending updates", `
+		CREATE TABLE pending_updates (
+			tree       TEXT NOT NULL,
+			leaf_index BIGINT NOT NULL,
+			seq        BIGINT NOT NULL,
+			body       JSONB NOT NULL,
+			PRIMARY KEY (tree, leaf_index, seq)
+		);
+	`},
+	{17, "relation and edit slots from instructions log", ""}, // done by its step
+}
+
+// pgMigrationSteps are done in Go, after SQL of migration of the same version and in its transaction
+var pgMigrationSteps = map[int]func(ctx context.Context, tx pgx.Tx) error{
+	8: func(ctx context.Context, tx pgx.Tx) error {
+		tree, err := programTree(func(fn func(types.Instruction) error) error {
+			rows, err := tx.Query(ctx, "SELECT program, accounts, data FROM instructions WHERE program = $1 ORDER BY slot",
+				graph.GraphProgramAddress.ToBase58())
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var inst types.Instruction
+				if err := rows.Scan(&inst.Program, &inst.Accounts, &inst.Data); err != nil {
+					return err
+				}
+				if err := fn(inst); err != nil {
+					return err
+				}
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("find program tree: %w", err)
+		}
+
+		// relations and skipped ones recorded before trees were tracked, nothing to fill them with until
+		// the log names the tree
+		if tree == "" {
+			return nil
+		}
+		for _, table := range []string{"relations", "skipped"} {
+			if _, err := tx.Exec(ctx, "UPDATE "+table+" SET tree = $1 WHERE tree = ''", tree); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	11: func(ctx context.Context, tx pgx.Tx) error {
+		// relations indexed before kinds were extracted, extras declaring no kind keep the empty default
+		rows, err := tx.Query(ctx, "SELECT id, extra FROM relations")
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		var kinds []string
+		for rows.Next() {
+			var id int64
+			var extra []byte
+			if err := rows.Scan(&id, &extra); err != nil {
+				rows.Close()
+				return err
+			}
+			if kind := extraKind(extra); kind != "" {
+				ids, kinds = append(ids, id), append(kinds, kind)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE relations SET kind = k.kind FROM unnest($1::BIGINT[], $2::TEXT[]) AS k(id, kind)
+			WHERE relations.id = k.id`, ids, kinds)
+		return err
+	},
+	17: func(ctx context.Context, tx pgx.Tx) error {
+		leaves, err := logSlots(func(fn func(types.Instruction) error) error {
+			rows, err := tx.Query(ctx, `SELECT slot, program, accounts, data, change_log FROM instructions
+				WHERE program = $1 AND change_log IS NOT NULL`, graph.GraphProgramAddress.ToBase58())
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var inst types.Instruction
+				var slot int64
+				if err := rows.Scan(&slot, &inst.Program, &inst.Accounts, &inst.Data, &inst.ChangeLog); err != nil {
+					return err
+				}
+				inst.Slot = uint64(slot)
+				if err := fn(inst); err != nil {
+					return err
+				}
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return fmt.Errorf("collect slots: %w", err)
+		}
+
+		rows, err := tx.Query(ctx, "SELECT "+relationColumns+", id FROM relations WHERE slot = 0 OR history <> '[]'")
+		if err != nil {
+			return err
+		}
+		b := &pgx.Batch{}
+		for rows.Next() {
+			var id int64
+			r, err := scanRelation(rows, &id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if fillSlots(&r, leaves) {
+				closedSlot := optionMap(r.ClosedSlot, func(s uint64) int64 { return int64(s) })
+				b.Queue("UPDATE relations SET slot = $2, closed_slot = $3, history = $4 WHERE id = $1",
+					id, int64(r.Slot), closedSlot, nonNil(r.History))
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return tx.SendBatch(ctx, b).Close()
+	},
+}
+
+// pgProjections are rebuilt from instructions log. Relations go last, so they are never newer than providers
+var pgProjections = []string{"providers", "counters", "follows", "pending_updates", "skipped", "relations"}
+
+// arbitrary key of advisory lock guarding migrations
+const pgMigrationLock = 0x73677261 // "sgra"
+
+// arbitrary first key of advisory locks of leaves, taken by writers of relations and their updates
+const pgLeafLock = 0x6c656166 // "leaf"
+
+// Migrate applies pending migrations. Session-level advisory lock makes concurrent instances wait for each other
+func (p Postgres) Migrate(ctx context.Context) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", pgMigrationLock); err != nil {
+		return handleErr(fmt.Errorf("acquire lock: %w", err))
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", pgMigrationLock); err != nil {
+			p.l.Logf("[ERROR] release migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INT PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  TIMESTAMPTZ NOT NULL
+	)`)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	for _, mig := range pgMigrations {
+		var applied bool
+		err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", mig.version).Scan(&applied)
+		if err != nil {
+			return handleErr(err)
+		}
+		if applied {
+			continue
+		}
+
+		p.l.Logf("[INFO] applying migration #%d: %s", mig.version, mig.description)
+
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if mig.sql != "" {
+				if _, err := tx.Exec(ctx, mig.sql); err != nil {
+					return err
+				}
+			}
+			if step, ok := pgMigrationSteps[mig.version]; ok {
+				if err := step(ctx, tx); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)",
+				mig.version, mig.description, time.Now())
+			return err
+		})
+		if err != nil {
+			return handleErr(fmt.Errorf("migration #%d: %w", mig.version, err))
+		}
+	}
+
+	return nil
+}
+
+// PruneEvents removes events older than retention
+func (p Postgres) PruneEvents(ctx context.Context, retention time.Duration) error {
+	if _, err := p.pool.Exec(ctx, "DELETE FROM events WHERE emitted_at < $1", time.Now().Add(-retention)); err != nil {
+		return fmt.Errorf("prune events: %w", err)
+	}
+	return nil
+}
+
+// relationColumns are read by scanRelation, followed by columns of extra destinations
+const relationColumns = "from_key, to_key, provider, connected_at, disconnected_at, extra, kind, extra_decoded, " +
+	"tree, leaf_index, seq, history, slot, closed_slot"
+
+func scanRelation(row pgx.Row, extra ...any) (types.Relation, error) {
+	var (
+		r          types.Relation
+		leafIndex  *int64
+		seq, slot  int64
+		closedSlot *int64
+	)
+	dest := []any{&r.From, &r.To, &r.Provider, &r.ConnectedAt, &r.DisconnectedAt, &r.Extra, &r.Kind, &r.ExtraDecoded,
+		&r.Tree, &leafIndex, &seq, &r.History, &slot, &closedSlot}
+	err := row.Scan(append(dest, extra...)...)
+	r.LeafIndex = optionMap(leafIndex, func(i int64) uint32 { return uint32(i) })
+	r.Seq, r.Slot = uint64(seq), uint64(slot)
+	r.ClosedSlot = optionMap(closedSlot, func(s int64) uint64 { return uint64(s) })
+	if len(r.History) == 0 {
+		r.History = nil
+	}
+	return r, err
+}
+
+func (p Postgres) SaveRelations(ctx context.Context, relations []types.Relation) error {
+	rows := sliceMap(relations, func(r types.Relation) []any {
+		leafIndex := optionMap(r.LeafIndex, func(i uint32) int64 { return int64(i) })
+		closedSlot := optionMap(r.ClosedSlot, func(s uint64) int64 { return int64(s) })
+		return []any{r.From, r.To, r.Provider, r.ConnectedAt, r.DisconnectedAt, nonNil(r.Extra), r.Kind, r.ExtraDecoded,
+			r.Tree, leafIndex, int64(r.Seq), nonNil(r.History), int64(r.Slot), closedSlot}
+	})
+
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		// leaves are unique, so retried batches insert only relations they haven't inserted before
+		var inserted []types.Relation
+
+		b := &pgx.Batch{}
+		for i, row := range rows {
+			r := relations[i]
+			b.Queue(`INSERT INTO relations`+p.staging+` (from_key, to_key, provider, connected_at, disconnected_at, extra,
+					kind, extra_decoded, tree, leaf_index, seq, history, slot, closed_slot)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+				ON CONFLICT (tree, leaf_index) WHERE leaf_index IS NOT NULL DO NOTHING`, row...,
+			).Exec(func(ct pgconn.CommandTag) error {
+				if ct.RowsAffected() > 0 {
+					inserted = append(inserted, r)
+				}
+				return nil
+			})
+		}
+		if err := tx.SendBatch(ctx, b).Close(); err != nil {
+			return fmt.Errorf("insert relations: %w", err)
+		}
+
+		if err := p.applyFollowDeltas(ctx, tx, followDeltas(inserted, 1)); err != nil {
+			return fmt.Errorf("update counters: %w", err)
+		}
+
+		// updates may have been written before relations they update
+		var (
+			trees   []string
+			indexes []int64
+		)
+		for _, r := range inserted {
+			if r.LeafIndex != nil {
+				trees, indexes = append(trees, r.Tree), append(indexes, int64(*r.LeafIndex))
+			}
+		}
+		if len(trees) == 0 {
+			return nil
+		}
+
+		// in the same order in all writers
+		_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1, hashtext(tree || '|' || leaf_index))
+			FROM unnest($2::text[], $3::bigint[]) AS leaf (tree, leaf_index) ORDER BY tree, leaf_index`,
+			pgLeafLock, trees, indexes)
+		if err != nil {
+			return fmt.Errorf("lock leaves: %w", err)
+		}
+
+		rows, err := tx.Query(ctx, `DELETE FROM pending_updates`+p.staging+`
+			WHERE (tree, leaf_index) IN (SELECT * FROM unnest($1::text[], $2::bigint[]))
+			RETURNING body`, trees, indexes)
+		if err != nil {
+			return fmt.Errorf("take pending updates: %w", err)
+		}
+		updates, err := pgx.CollectRows(rows, pgx.RowTo[types.RelationUpdate])
+		if err != nil {
+			return fmt.Errorf("take pending updates: %w", err)
+		}
+		sort.SliceStable(updates, func(i, j int) bool { return updates[i].Seq < updates[j].Seq })
+
+		var closed []types.Relation
+		for _, u := range updates {
+			relations, err := p.updateRelation(ctx, tx, u)
+			if err != nil {
+				return fmt.Errorf("apply pending update: %w", err)
+			}
+			if u.Close {
+				closed = append(closed, relations...)
+			}
+		}
+		if err := p.applyFollowDeltas(ctx, tx, followDeltas(closed, -1)); err != nil {
+			return fmt.Errorf("update counters: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("save relations: %w", err)
+	}
+	return nil
+}
+
+// UpdateRelations applies updates in order and returns relations they have changed.
+// Already applied updates are ignored, updates of relations not stored yet wait for them in pending updates
+func (p Postgres) UpdateRelations(ctx context.Context, updates []types.RelationUpdate) ([]types.Relation, error) {
+	var updated []types.Relation
+
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		updated = nil
+
+		var closed []types.Relation
+		for _, u := range updates {
+			// relation saved concurrently either is seen by the update, or sees the parked update
+			if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))",
+				pgLeafLock, leafKey(u.Tree, u.LeafIndex)); err != nil {
+				return fmt.Errorf("lock leaf: %w", err)
+			}
+
+			relations, err := p.updateRelation(ctx, tx, u)
+			if err != nil {
+				return err
+			}
+
+			if len(relations) == 0 {
+				var stored bool
+				err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM relations`+p.staging+`
+					WHERE tree = $1 AND leaf_index = $2)`, u.Tree, int64(u.LeafIndex)).Scan(&stored)
+				if err != nil {
+					return err
+				}
+				if !stored {
+					_, err := tx.Exec(ctx, `INSERT INTO pending_updates`+p.staging+` (tree, leaf_index, seq, body)
+						VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, u.Tree, int64(u.LeafIndex), int64(u.Seq), u)
+					if err != nil {
+						return fmt.Errorf("park update: %w", err)
+					}
+				}
+				continue
+			}
+
+			updated = append(updated, relations...)
+			if u.Close {
+				closed = append(closed, relations...)
+			}
+		}
+
+		if err := p.applyFollowDeltas(ctx, tx, followDeltas(closed, -1)); err != nil {
+			return fmt.Errorf("update counters: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update relations: %w", err)
+	}
+
+	return updated, nil
+}
+
+// updateRelation applies update to stored relation and returns it, unless update is applied already
+func (p Postgres) updateRelation(ctx context.Context, tx pgx.Tx, u types.RelationUpdate) ([]types.Relation, error) {
+	var (
+		sql  string
+		args = []any{u.Tree, int64(u.LeafIndex), int64(u.Seq), u.UpdatedAt}
+	)
+	if u.Close {
+		sql = `UPDATE relations` + p.staging + ` SET disconnected_at = $4, closed_slot = $5, seq = $3
+			WHERE tree = $1 AND leaf_index = $2 AND seq < $3 AND disconnected_at IS NULL
+			RETURNING ` + relationColumns
+		args = append(args, int64(u.Slot))
+	} else {
+		// right side of SET sees extra before update
+		sql = `UPDATE relations` + p.staging + ` SET extra = $5, kind = $6, extra_decoded = $7, seq = $3,
+			history = history || jsonb_build_array(jsonb_build_object(
+				'extra', translate(encode(extra, 'base64'), E'\n', ''), 'kind', kind, 'extraDecoded', extra_decoded,
+				'editedAt', $4::timestamptz, 'slot', $8::bigint))
+			WHERE tree = $1 AND leaf_index = $2 AND seq < $3
+			RETURNING ` + relationColumns
+		args = append(args, nonNil(u.Extra), u.Kind, u.ExtraDecoded, int64(u.Slot))
+	}
+
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (types.Relation, error) {
+		return scanRelation(row)
+	})
+}
+
+// applyFollowDeltas updates follows, and counters of the ones that have started or stopped
+func (p Postgres) applyFollowDeltas(ctx context.Context, tx pgx.Tx, deltas map[followKey]int64) error {
+	changes := make(map[followKey]int64)
+
+	b := &pgx.Batch{}
+	for _, key := range sortedFollowKeys(deltas) {
+		key, d := key, deltas[key]
+		b.Queue(`INSERT INTO follows`+p.staging+` (from_key, to_key, provider, relations) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (from_key, to_key, provider) DO UPDATE SET relations = follows`+p.staging+`.relations + $4
+			RETURNING relations`,
+			key.from, key.to, key.provider, d,
+		).QueryRow(func(row pgx.Row) error {
+			var after int64
+			if err := row.Scan(&after); err != nil {
+				return err
+			}
+			if change := followChange(after-d, after); change != 0 {
+				changes[key] = change
+			}
+			return nil
+		})
+		if d < 0 {
+			b.Queue(`DELETE FROM follows`+p.staging+` WHERE from_key = $1 AND to_key = $2 AND provider = $3 AND relations <= 0`,
+				key.from, key.to, key.provider)
+		}
+	}
+	if err := tx.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("update follows: %w", err)
+	}
+
+	return p.applyCounterDeltas(ctx, tx, followCounterDeltas(changes))
+}
+
+func (p Postgres) applyCounterDeltas(ctx context.Context, tx pgx.Tx, deltas map[counterKey]counterDelta) error {
+	b := &pgx.Batch{}
+	for _, key := range sortedCounterKeys(deltas) {
+		d := deltas[key]
+		b.Queue(`INSERT INTO counters`+p.staging+` (address, provider, followers, following) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (address, provider) DO UPDATE
+			SET followers = counters`+p.staging+`.followers + $3, following = counters`+p.staging+`.following + $4`,
+			key.address, key.provider, d.Followers, d.Following)
+	}
+
+	return tx.SendBatch(ctx, b).Close()
+}
+
+// FetchCounters returns counters of addresses, in the same order
+func (p Postgres) FetchCounters(ctx context.Context, addresses []string) ([]types.Counters, error) {
+	rows, err := p.pool.Query(ctx,
+		"SELECT address, provider, followers, following FROM counters WHERE address = ANY($1)", addresses)
+	if err != nil {
+		return nil, fmt.Errorf("fetch counters: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[counterKey]counterDelta)
+	for rows.Next() {
+		var (
+			key counterKey
+			d   counterDelta
+		)
+		if err := rows.Scan(&key.address, &key.provider, &d.Followers, &d.Following); err != nil {
+			return nil, fmt.Errorf("fetch counters: %w", err)
+		}
+		found[key] = d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("fetch counters: %w", err)
+	}
+
+	return assembleCounters(addresses, found), nil
+}
+
+func (p Postgres) FetchRelations(ctx context.Context, q RelationsQuery) ([]types.Relation, string, error) {
+	handleErr := func(err error) ([]types.Relation, string, error) {
+		return nil, "", fmt.Errorf("fetch relations: %w", err)
+	}
+
+	after, err := decodeCursor(q)
+	if err != nil {
+		return handleErr(err)
+	}
+	column, dir, cmp := pgSort(q)
+
+	var w where
+	if q.From != "" {
+		w.add("from_key = ?", q.From)
+	}
+	if q.To != "" {
+		w.add("to_key = ?", q.To)
+	}
+	if len(q.Pairs) > 0 {
+		froms := sliceMap(q.Pairs, func(p RelationPair) string { return p.From })
+		tos := sliceMap(q.Pairs, func(p RelationPair) string { return p.To })
+		w.add("(from_key, to_key) IN (SELECT * FROM unnest(?::text[], ?::text[]))", froms, tos)
+	}
+	if len(q.Providers) > 0 {
+		w.add("provider = ANY(?)", q.Providers)
+	}
+	if q.Tree != "" {
+		w.add("tree = ?", q.Tree)
+	}
+	if q.AsOf == nil {
+		if len(q.Kinds) > 0 {
+			w.add("kind = ANY(?)", q.Kinds)
+		}
+		if len(q.ExtraFields) > 0 {
+			w.add("extra_decoded @> ?", q.ExtraFields)
+		}
+	} else {
+		pgStateConds(&w, q)
+	}
+	pgPointConds(&w, q)
+	if after != nil {
+		id, err := strconv.ParseInt(after.ID, 10, 64)
+		if err != nil {
+			return handleErr(ErrInvalidCursor)
+		}
+		// ties of sort column are ordered by id
+		switch column {
+		case "connected_at":
+			w.add("(connected_at, id) "+cmp+" (?, ?)", *after.Time, id)
+		case "slot":
+			w.add("(slot, id) "+cmp+" (?, ?)", int64(after.Slot), id)
+		default:
+			w.add("id "+cmp+" ?", id)
+		}
+	}
+
+	order := column + " " + dir
+	if column != "id" {
+		order += ", id " + dir
+	}
+	query := "SELECT " + relationColumns + ", id FROM relations" +
+		w.String() + " ORDER BY " + order + " LIMIT " + w.arg(int64(q.Limit))
+
+	rows, err := p.pool.Query(ctx, query, w.args...)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var ids []int64
+	relations, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (types.Relation, error) {
+		var id int64
+		r, err := scanRelation(row, &id)
+		ids = append(ids, id)
+		return r, err
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	next, err := nextCursor(q, relations, func(i int) string { return strconv.FormatInt(ids[i], 10) })
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return sliceMap(relations, q.asOf), next, nil
+}
+
+// pgSort returns column relations are sorted by, direction of sort and operator selecting relations after a cursor
+func pgSort(q RelationsQuery) (column, dir, cmp string) {
+	switch q.Sort {
+	case SortConnectedAt:
+		column = "connected_at"
+	case SortSlot:
+		column = "slot"
+	default:
+		column = "id"
+	}
+
+	if q.Order == OrderAsc {
+		return column, "ASC", ">"
+	}
+	return column, "DESC", "<"
+}
+
+// ScanRelations calls fn for every stored relation, oldest first
+func (p Postgres) ScanRelations(ctx context.Context, fn func(types.Relation) error) error {
+	rows, err := p.pool.Query(ctx, "SELECT "+relationColumns+" FROM relations ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("scan relations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanRelation(rows)
+		if err != nil {
+			return fmt.Errorf("scan relations: %w", err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scan relations: %w", err)
+	}
+
+	return nil
+}
+
+// QuarantinedSlots returns slots with quarantined transactions
+func (p Postgres) QuarantinedSlots(ctx context.Context) ([]uint64, error) {
+	rows, err := p.pool.Query(ctx, "SELECT DISTINCT slot FROM quarantine")
+	if err != nil {
+		return nil, fmt.Errorf("find quarantined slots: %w", err)
+	}
+
+	slots, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("find quarantined slots: %w", err)
+	}
+	return sliceMap(slots, func(s int64) uint64 { return uint64(s) }), nil
+}
+
+// ReleaseQuarantine removes transactions quarantined in slots
+func (p Postgres) ReleaseQuarantine(ctx context.Context, slots []uint64) error {
+	_, err := p.pool.Exec(ctx, "DELETE FROM quarantine WHERE slot = ANY($1)", sliceMap(slots, func(s uint64) int64 { return int64(s) }))
+	if err != nil {
+		return fmt.Errorf("release quarantine: %w", err)
+	}
+	return nil
+}
+
+func (p Postgres) QuarantineTransactions(ctx context.Context, txs []types.QuarantinedTx) error {
+	rows := sliceMap(txs, func(t types.QuarantinedTx) []any {
+		return []any{int64(t.Slot), t.Signature, t.Stage, t.Error, t.Raw, t.QuarantinedAt}
+	})
+
+	_, err := p.pool.CopyFrom(ctx,
+		pgx.Identifier{"quarantine"},
+		[]string{"slot", "signature", "stage", "error", "raw", "quarantined_at"},
+		pgx.CopyFromRows(rows),
+	)
+	if err != nil {
+		return fmt.Errorf("insert quarantined transactions: %w", err)
+	}
+	return nil
+}
+
+func (p Postgres) SaveProviders(ctx context.Context, providers []types.Provider) error {
+	b := &pgx.Batch{}
+	for _, pr := range providers {
+		b.Queue(`INSERT INTO providers`+p.staging+` (address, authority, name, website, created_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (address) DO UPDATE SET authority = $2, name = $3, website = $4, created_at = $5`,
+			pr.Address, pr.Authority, pr.Name, pr.Website, pr.CreatedAt)
+	}
+
+	if err := p.pool.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("upsert providers: %w", err)
+	}
+	return nil
+}
+
+func (p Postgres) FetchProviders(ctx context.Context, addresses []string) ([]types.Provider, error) {
+	rows, err := p.pool.Query(ctx,
+		"SELECT address, authority, name, website, created_at FROM providers WHERE address = ANY($1)", addresses)
+	if err != nil {
+		return nil, fmt.Errorf("fetch providers: %w", err)
+	}
+
+	providers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (types.Provider, error) {
+		var pr types.Provider
+		err := row.Scan(&pr.Address, &pr.Authority, &pr.Name, &pr.Website, &pr.CreatedAt)
+		return pr, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch providers: %w", err)
+	}
+
+	return providers, nil
+}
+
+// ScanProviders calls fn for every stored provider
+func (p Postgres) ScanProviders(ctx context.Context, fn func(types.Provider) error) error {
+	rows, err := p.pool.Query(ctx, "SELECT address, authority, name, website, created_at FROM providers ORDER BY address")
+	if err != nil {
+		return fmt.Errorf("scan providers: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pr types.Provider
+		if err := rows.Scan(&pr.Address, &pr.Authority, &pr.Name, &pr.Website, &pr.CreatedAt); err != nil {
+			return fmt.Errorf("scan providers: %w", err)
+		}
+		if err := fn(pr); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scan providers: %w", err)
+	}
+
+	return nil
+}
+
+// SaveInstructions appends instructions to the log. Instructions that are already there are skipped
+func (p Postgres) SaveInstructions(ctx context.Context, insts []types.Instruction) error {
+	b := &pgx.Batch{}
+	for _, inst := range insts {
+		b.Queue(`INSERT INTO instructions (slot, block_time, signature, tx_index, outer_idx, inner_idx, program, accounts, data, change_log)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (signature, outer_idx, inner_idx) DO NOTHING`,
+			int64(inst.Slot), inst.BlockTime, inst.Signature, inst.TxIndex, inst.Outer, inst.Inner, inst.Program,
+			inst.Accounts, nonNil(inst.Data), inst.ChangeLog)
+	}
+
+	if err := p.pool.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("insert instructions: %w", err)
+	}
+	return nil
+}
+
+// ScanInstructions calls fn for every logged instruction, in order of execution
+func (p Postgres) ScanInstructions(ctx context.Context, fn func(types.Instruction) error) error {
+	rows, err := p.pool.Query(ctx, `SELECT slot, block_time, signature, tx_index, outer_idx, inner_idx, program, accounts, data,
+		change_log FROM instructions ORDER BY slot, tx_index, outer_idx, inner_idx`)
+	if err != nil {
+		return fmt.Errorf("scan instructions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			inst types.Instruction
+			slot int64
+		)
+		err := rows.Scan(&slot, &inst.BlockTime, &inst.Signature, &inst.TxIndex, &inst.Outer, &inst.Inner,
+			&inst.Program, &inst.Accounts, &inst.Data, &inst.ChangeLog)
+		if err != nil {
+			return fmt.Errorf("scan instructions: %w", err)
+		}
+		inst.Slot = uint64(slot)
+		if err := fn(inst); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scan instructions: %w", err)
+	}
+
+	return nil
+}
+
+// RebuildProjections lets build fill fresh projection tables, then swaps them with current ones in a single
+// transaction. Indexer must be stopped during rebuild, otherwise whatever it writes meanwhile is lost
+func (p Postgres) RebuildProjections(ctx context.Context, build func(Projections) error) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("rebuild projections: %w", err)
+	}
+
+	staging := p
+	staging.staging = "_rebuild"
+
+	for _, table := range pgProjections {
+		// leftovers of interrupted rebuild are dropped. Staging relations share id sequence with current ones,
+		// so cursors handed out before rebuild keep pointing into the past
+		sql := fmt.Sprintf("DROP TABLE IF EXISTS %[1]s_rebuild; CREATE TABLE %[1]s_rebuild (LIKE %[1]s INCLUDING ALL)", table)
+		if _, err := p.pool.Exec(ctx, sql); err != nil {
+			return handleErr(err)
+		}
+	}
+
+	if err := build(staging); err != nil {
+		return handleErr(err)
+	}
+
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		// sequence would be dropped along with table owning it
+		if _, err := tx.Exec(ctx, "ALTER SEQUENCE relations_id_seq OWNED BY relations_rebuild.id"); err != nil {
+			return err
+		}
+		for _, table := range pgProjections {
+			canonical, err := pgIndexNames(ctx, tx, table)
+			if err != nil {
+				return fmt.Errorf("swap %s: %w", table, err)
+			}
+
+			sql := fmt.Sprintf("DROP TABLE %[1]s; ALTER TABLE %[1]s_rebuild RENAME TO %[1]s", table)
+			if _, err := tx.Exec(ctx, sql); err != nil {
+				return fmt.Errorf("swap %s: %w", table, err)
+			}
+
+			// indexes copied by LIKE have generated names, while migrations refer to them by the canonical ones
+			copied, err := pgIndexNames(ctx, tx, table)
+			if err != nil {
+				return fmt.Errorf("swap %s: %w", table, err)
+			}
+			for def, name := range copied {
+				if want, ok := canonical[def]; ok && want != name {
+					if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER INDEX %s RENAME TO %s", name, want)); err != nil {
+						return fmt.Errorf("swap %s: rename index %s: %w", table, name, err)
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return nil
+}
+
+// pgIndexNames returns names of indexes of the table by their definitions
+func pgIndexNames(ctx context.Context, tx pgx.Tx, table string) (map[string]string, error) {
+	rows, err := tx.Query(ctx, `SELECT indexname, indexdef FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = $1`, table)
+	if err != nil {
+		return nil, fmt.Errorf("list indexes: %w", err)
+	}
+
+	var (
+		names     = map[string]string{}
+		name, def string
+	)
+	_, err = pgx.ForEachRow(rows, []any{&name, &def}, func() error {
+		names[pgIndexKey(def)] = name
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list indexes: %w", err)
+	}
+	return names, nil
+}
+
+// pgIndexKey is index definition without index name: "CREATE INDEX name ON ..." becomes "CREATE INDEX ON ..."
+func pgIndexKey(def string) string {
+	head, tail, ok := strings.Cut(def, " ON ")
+	if !ok {
+		return def
+	}
+	if i := strings.LastIndex(head, " "); i >= 0 {
+		head = head[:i]
+	}
+	return head + " ON " + tail
+}
+
+// SaveSkipped records relations left out by ingest rules. Already recorded ones are skipped
+func (p Postgres) SaveSkipped(ctx context.Context, skipped []types.SkippedRelation) error {
+	b := &pgx.Batch{}
+	for _, s := range skipped {
+		b.Queue(`INSERT INTO skipped`+p.staging+` (position, slot, signature, provider, tree, leaf_index, leaf, skipped_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (position) DO NOTHING`,
+			s.Position, int64(s.Slot), s.Signature, s.Provider, s.Tree,
+			optionMap(s.LeafIndex, func(i uint32) int64 { return int64(i) }), s.Leaf, s.SkippedAt)
+	}
+
+	if err := p.pool.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("insert skipped relations: %w", err)
+	}
+	return nil
+}
+
+// FetchSkipped returns skipped relations of provider in order of execution, starting after given position
+func (p Postgres) FetchSkipped(ctx context.Context, provider, after string, limit uint) ([]types.SkippedRelation, error) {
+	rows, err := p.pool.Query(ctx, `SELECT position, slot, signature, provider, tree, leaf_index, leaf, skipped_at FROM skipped
+		WHERE provider = $1 AND position > $2 ORDER BY position LIMIT $3`, provider, after, int64(limit))
+	if err != nil {
+		return nil, fmt.Errorf("fetch skipped relations: %w", err)
+	}
+
+	skipped, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (types.SkippedRelation, error) {
+		return scanSkipped(row)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch skipped relations: %w", err)
+	}
+
+	return skipped, nil
+}
+
+// ScanSkipped calls fn for every skipped relation, in order of execution
+func (p Postgres) ScanSkipped(ctx context.Context, fn func(types.SkippedRelation) error) error {
+	rows, err := p.pool.Query(ctx, `SELECT position, slot, signature, provider, tree, leaf_index, leaf, skipped_at FROM skipped
+		ORDER BY position`)
+	if err != nil {
+		return fmt.Errorf("scan skipped relations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSkipped(rows)
+		if err != nil {
+			return fmt.Errorf("scan skipped relations: %w", err)
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("scan skipped relations: %w", err)
+	}
+
+	return nil
+}
+
+func scanSkipped(row pgx.Row) (types.SkippedRelation, error) {
+	var (
+		s         types.SkippedRelation
+		slot      int64
+		leafIndex *int64
+	)
+	err := row.Scan(&s.Position, &slot, &s.Signature, &s.Provider, &s.Tree, &leafIndex, &s.Leaf, &s.SkippedAt)
+	s.Slot = uint64(slot)
+	s.LeafIndex = optionMap(leafIndex, func(i int64) uint32 { return uint32(i) })
+	return s, err
+}
+
+// FetchLedger counts indexed and skipped relations of providers
+func (p Postgres) FetchLedger(ctx context.Context, providers []string) ([]types.LedgerEntry, error) {
+	ledger := make([]types.LedgerEntry, len(providers))
+	for i, provider := range providers {
+		ledger[i].Provider = provider
+		err := p.pool.QueryRow(ctx, `SELECT
+			(SELECT count(*) FROM relations WHERE provider = $1),
+			(SELECT count(*) FROM skipped WHERE provider = $1)`, provider).Scan(&ledger[i].Indexed, &ledger[i].Skipped)
+		if err != nil {
+			return nil, fmt.Errorf("fetch ledger: %w", err)
+		}
+	}
+
+	return ledger, nil
+}
+
+// SaveTrees records discovered trees. State of already known trees is kept
+func (p Postgres) SaveTrees(ctx context.Context, trees []types.Tree) error {
+	b := &pgx.Batch{}
+	for _, t := range trees {
+		b.Queue(`INSERT INTO trees (address, controller, authority, created_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (address) DO UPDATE
+			SET controller = EXCLUDED.controller, authority = EXCLUDED.authority, created_at = EXCLUDED.created_at`,
+			t.Address, t.Controller, t.Authority, t.CreatedAt)
+	}
+
+	if err := p.pool.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("upsert trees: %w", err)
+	}
+	return nil
+}
+
+// AdvanceTrees applies states of trees. Root is only replaced by the one of a later change log
+func (p Postgres) AdvanceTrees(ctx context.Context, states map[string]types.TreeState) error {
+	b := &pgx.Batch{}
+	for address, s := range states {
+		b.Queue(`INSERT INTO trees (address, seq, leaf_count, root) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (address) DO UPDATE SET
+				leaf_count = GREATEST(trees.leaf_count, EXCLUDED.leaf_count),
+				root = CASE WHEN EXCLUDED.seq > trees.seq THEN EXCLUDED.root ELSE trees.root END,
+				seq = GREATEST(trees.seq, EXCLUDED.seq)`,
+			address, int64(s.Seq), int64(s.LeafCount), s.Root)
+	}
+
+	if err := p.pool.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("advance trees: %w", err)
+	}
+	return nil
+}
+
+func (p Postgres) FetchTrees(ctx context.Context) ([]types.Tree, error) {
+	rows, err := p.pool.Query(ctx,
+		"SELECT address, controller, authority, created_at, seq, leaf_count, root FROM trees ORDER BY address")
+	if err != nil {
+		return nil, fmt.Errorf("fetch trees: %w", err)
+	}
+
+	trees, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (types.Tree, error) {
+		var (
+			t              types.Tree
+			seq, leafCount int64
+		)
+		err := row.Scan(&t.Address, &t.Controller, &t.Authority, &t.CreatedAt, &seq, &leafCount, &t.Root)
+		t.Seq, t.LeafCount = uint64(seq), uint64(leafCount)
+		return t, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch trees: %w", err)
+	}
+
+	return trees, nil
+}
+
+func (p Postgres) SaveEvents(ctx context.Context, events []types.Event) error {
+	b := &pgx.Batch{}
+	for _, e := range events {
+		// retried batches must not duplicate events
+		b.Queue(`INSERT INTO events (provider, actor, target, extra, program, verified, signature, idx, slot, emitted_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (signature, idx) DO NOTHING`,
+			e.Provider, e.Actor, e.Target, nonNil(e.Extra), e.Program, e.Verified, e.Signature, e.Index, int64(e.Slot), e.EmittedAt)
+	}
+
+	if err := p.pool.SendBatch(ctx, b).Close(); err != nil {
+		return fmt.Errorf("insert events: %w", err)
+	}
+	return nil
+}
+
+func (p Postgres) FetchEvents(ctx context.Context, q EventsQuery) ([]types.Event, string, error) {
+	handleErr := func(err error) ([]types.Event, string, error) {
+		return nil, "", fmt.Errorf("fetch events: %w", err)
+	}
+
+	after, err := decodeEventsCursor(q)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var w where
+	if q.Actor != "" {
+		w.add("actor = ?", q.Actor)
+	}
+	if q.Target != "" {
+		w.add("target = ?", q.Target)
+	}
+	if len(q.Providers) > 0 {
+		w.add("provider = ANY(?)", q.Providers)
+	}
+	if !q.IncludeUnverified {
+		w.add("verified")
+	}
+	if !q.Since.IsZero() {
+		w.add("emitted_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		w.add("emitted_at < ?", q.Until)
+	}
+	if after != "" {
+		id, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return handleErr(ErrInvalidCursor)
+		}
+		w.add("id < ?", id)
+	}
+
+	query := "SELECT provider, actor, target, extra, program, verified, signature, idx, slot, emitted_at, id FROM events" +
+		w.String() + " ORDER BY id DESC LIMIT " + w.arg(int64(q.Limit))
+
+	rows, err := p.pool.Query(ctx, query, w.args...)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var ids []int64
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (types.Event, error) {
+		var (
+			e        types.Event
+			slot, id int64
+		)
+		err := row.Scan(&e.Provider, &e.Actor, &e.Target, &e.Extra, &e.Program, &e.Verified, &e.Signature, &e.Index, &slot, &e.EmittedAt, &id)
+		e.Slot = uint64(slot)
+		ids = append(ids, id)
+		return e, err
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	next, err := nextEventsCursor(q, events, func(i int) string { return strconv.FormatInt(ids[i], 10) })
+	if err != nil {
+		return handleErr(err)
+	}
+
+	return events, next, nil
+}
+
+// pgPointConds selects relations by Status at AsOf, and bounds of AddedAfter and ClosedBy
+func pgPointConds(w *where, q RelationsQuery) {
+	// relations of unknown slots can't be placed in time by slot
+	if q.bySlot() {
+		w.add("slot > 0")
+	}
+	if q.AddedAfter != nil {
+		added, _, value := pgPointColumns(*q.AddedAfter)
+		w.add(added+" > ?", value)
+	}
+	if q.ClosedBy != nil {
+		_, closed, value := pgPointColumns(*q.ClosedBy)
+		w.add(closed+" <= ?", value)
+	}
+
+	// placeholder is registered only when condition is used
+	closedAt := func() string { return "disconnected_at IS NOT NULL" }
+	if q.AsOf != nil {
+		added, closed, value := pgPointColumns(*q.AsOf)
+		w.add(added+" <= ?", value)
+		closedAt = func() string { return closed + " <= " + w.arg(value) }
+	}
+
+	switch q.Status {
+	case RelationsActive:
+		// comparisons with null are null, hence coalesce
+		w.add("NOT COALESCE(" + closedAt() + ", false)")
+	case RelationsClosed:
+		w.add(closedAt())
+	}
+}
+
+// pgStateConds select relations by kind and decoded fields of extra they had at AsOf
+func pgStateConds(w *where, q RelationsQuery) {
+	if len(q.Kinds) == 0 && len(q.ExtraFields) == 0 {
+		return
+	}
+
+	// extra replaced by the first edit made after the point, current one if there is none
+	replacedAfter := "(e->>'slot')::bigint > ?"
+	var value any = int64(q.AsOf.Slot)
+	if q.AsOf.Time != nil {
+		replacedAfter, value = "(e->>'editedAt')::timestamptz > ?", *q.AsOf.Time
+	}
+	state := func() string {
+		return "COALESCE((SELECT e FROM jsonb_array_elements(history) WITH ORDINALITY AS h(e, i) WHERE " +
+			strings.Replace(replacedAfter, "?", w.arg(value), 1) +
+			" ORDER BY i LIMIT 1), jsonb_build_object('kind', kind, 'extraDecoded', extra_decoded))"
+	}
+
+	if len(q.Kinds) > 0 {
+		w.add(state()+"->>'kind' = ANY(?)", q.Kinds)
+	}
+	if len(q.ExtraFields) > 0 {
+		w.add(state()+"->'extraDecoded' @> ?", q.ExtraFields)
+	}
+}
+
+// pgPointColumns returns columns relations are added and closed at, in units of the point, and its value
+func pgPointColumns(p Point) (added, closed string, value any) {
+	if p.Time != nil {
+		return "connected_at", "disconnected_at", *p.Time
+	}
+	return "slot", "closed_slot", int64(p.Slot)
+}
+
+// where builds WHERE clause. Conditions use `?` for arguments, which are turned into $n placeholders
+type where struct {
+	conds []string
+	args  []any
+}
+
+func (w *where) add(cond string, args ...any) {
+	for _, a := range args {
+		cond = strings.Replace(cond, "?", w.arg(a), 1)
+	}
+	w.conds = append(w.conds, cond)
+}
+
+// arg registers argument and returns its placeholder
+func (w *where) arg(a any) string {
+	w.args = append(w.args, a)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+func (w where) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+// bytea and jsonb columns are NOT NULL
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
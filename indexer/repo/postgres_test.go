@@ -0,0 +1,102 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWhere(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(w *where)
+		want  string
+		args  []any
+	}{
+		{"no conditions", func(w *where) {}, "", nil},
+		{"single", func(w *where) { w.add("from_address = ?", "a") }, " WHERE from_address = $1", []any{"a"}},
+		{"numbered across conditions", func(w *where) {
+			w.add("from_address = ?", "a")
+			w.add("slot > ? AND slot <= ?", int64(1), int64(5))
+		}, " WHERE from_address = $1 AND slot > $2 AND slot <= $3", []any{"a", int64(1), int64(5)}},
+		{"without arguments", func(w *where) {
+			w.add("disconnected_at IS NULL")
+			w.add("tree = ?", "t")
+		}, " WHERE disconnected_at IS NULL AND tree = $1", []any{"t"}},
+		{"arg shares numbering", func(w *where) {
+			w.add("provider = ANY(" + w.arg([]string{"p"}) + ")")
+			w.add("tree = ?", "t")
+		}, " WHERE provider = ANY($1) AND tree = $2", []any{[]string{"p"}, "t"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var w where
+			tt.build(&w)
+			if got := w.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if fmt.Sprint(w.args) != fmt.Sprint(tt.args) {
+				t.Errorf("args = %v, want %v", w.args, tt.args)
+			}
+		})
+	}
+}
+
+func TestPgPointConds(t *testing.T) {
+	at := time.Unix(100, 0).UTC()
+
+	tests := []struct {
+		name string
+		q    RelationsQuery
+		want string
+		args []any
+	}{
+		{"all", RelationsQuery{Status: RelationsAll}, "", nil},
+		{"active now", RelationsQuery{Status: RelationsActive},
+			" WHERE NOT COALESCE(disconnected_at IS NOT NULL, false)", nil},
+		{"closed now", RelationsQuery{Status: RelationsClosed}, " WHERE disconnected_at IS NOT NULL", nil},
+		{"active as of slot", RelationsQuery{Status: RelationsActive, AsOf: &Point{Slot: 10}},
+			" WHERE slot > 0 AND slot <= $1 AND NOT COALESCE(closed_slot <= $2, false)", []any{int64(10), int64(10)}},
+		{"closed as of time", RelationsQuery{Status: RelationsClosed, AsOf: &Point{Time: &at}},
+			" WHERE connected_at <= $1 AND disconnected_at <= $2", []any{at, at}},
+		{"all as of slot", RelationsQuery{Status: RelationsAll, AsOf: &Point{Slot: 10}},
+			" WHERE slot > 0 AND slot <= $1", []any{int64(10)}},
+		{"bounds", RelationsQuery{Status: RelationsAll, AddedAfter: &Point{Slot: 3}, ClosedBy: &Point{Slot: 8}},
+			" WHERE slot > 0 AND slot > $1 AND closed_slot <= $2", []any{int64(3), int64(8)}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var w where
+			pgPointConds(&w, tt.q)
+			if got := w.String(); got != tt.want {
+				t.Errorf("conditions = %q, want %q", got, tt.want)
+			}
+			if fmt.Sprint(w.args) != fmt.Sprint(tt.args) {
+				t.Errorf("args = %v, want %v", w.args, tt.args)
+			}
+		})
+	}
+}
+
+func TestPgIndexKey(t *testing.T) {
+	tests := []struct {
+		def, want string
+	}{
+		{"CREATE INDEX relations_from_idx ON public.relations USING btree (from_key, id DESC)",
+			"CREATE INDEX ON public.relations USING btree (from_key, id DESC)"},
+		{"CREATE INDEX relations_rebuild_from_key_id_idx ON public.relations USING btree (from_key, id DESC)",
+			"CREATE INDEX ON public.relations USING btree (from_key, id DESC)"},
+		{"CREATE UNIQUE INDEX relations_leaf_idx ON public.relations USING btree (tree, leaf_index) WHERE (leaf_index IS NOT NULL)",
+			"CREATE UNIQUE INDEX ON public.relations USING btree (tree, leaf_index) WHERE (leaf_index IS NOT NULL)"},
+	}
+
+	for _, tt := range tests {
+		if got := pgIndexKey(tt.def); got != tt.want {
+			t.Errorf("pgIndexKey(%q) = %q, want %q", tt.def, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/portto/solana-go-sdk/common"
+	soltypes "github.com/portto/solana-go-sdk/types"
+
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+// Projections is state derived from instructions log. Rebuilds write fresh projections through it,
+// and stores swap them in once they are complete
+type Projections interface {
+	SaveRelations(ctx context.Context, relations []types.Relation) error
+	UpdateRelations(ctx context.Context, updates []types.RelationUpdate) ([]types.Relation, error)
+	SaveProviders(ctx context.Context, providers []types.Provider) error
+	SaveSkipped(ctx context.Context, skipped []types.SkippedRelation) error
+}
+
+// programTree finds tree of graph program in instructions log. Program keeps a single tree, so relations
+// indexed before trees were tracked were appended to it. Empty if no logged instruction names it
+func programTree(scan func(fn func(types.Instruction) error) error) (string, error) {
+	errFound := errors.New("found")
+
+	var tree string
+	err := scan(func(inst types.Instruction) error {
+		if tree = instructionTree(inst); tree != "" {
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return "", err
+	}
+	return tree, nil
+}
+
+// instructionTree returns tree logged instruction is applied to, if any
+func instructionTree(inst types.Instruction) string {
+	decoded, err := decodeLogged(inst)
+	if err != nil {
+		return ""
+	}
+
+	switch ix := decoded.(type) {
+	case graph.DecodedInitializeTree:
+		return ix.Accounts.Tree.ToBase58()
+	case graph.DecodedAddRelation:
+		return ix.Accounts.Tree.ToBase58()
+	case graph.DecodedCloseRelation:
+		return ix.Accounts.Tree.ToBase58()
+	case graph.DecodedEditExtra:
+		return ix.Accounts.Tree.ToBase58()
+	}
+	return ""
+}
+
+// extraKind returns kind extra declares. Malformed kind header declares none, as when relations are indexed
+func extraKind(extra []byte) string {
+	kind, _, err := graph.DecodeKind(extra)
+	if err != nil {
+		return ""
+	}
+	return kind
+}
+
+func decodeLogged(inst types.Instruction) (graph.DecodedInstruction, error) {
+	return graph.DecodeInstruction(soltypes.Instruction{
+		ProgramID: common.PublicKeyFromString(inst.Program),
+		Accounts: sliceMap(inst.Accounts, func(a types.InstructionAccount) soltypes.AccountMeta {
+			return soltypes.AccountMeta{PubKey: common.PublicKeyFromString(a.Address), IsSigner: a.Signer, IsWritable: a.Writable}
+		}),
+		Data: inst.Data,
+	})
+}
+
+// leafSlots are slots of logged instructions of a relation leaf
+type leafSlots struct {
+	added  uint64
+	closed *uint64
+	edits  []leafEdit
+}
+
+type leafEdit struct {
+	seq, slot uint64
+}
+
+// logSlots collects slots of relation leaves, keyed by leafKey, from instructions log
+func logSlots(scan func(fn func(types.Instruction) error) error) (map[string]*leafSlots, error) {
+	leaves := make(map[string]*leafSlots)
+
+	err := scan(func(inst types.Instruction) error {
+		// instructions without change log were not applied to a leaf
+		if inst.ChangeLog == nil {
+			return nil
+		}
+		decoded, err := decodeLogged(inst)
+		if err != nil {
+			return nil
+		}
+		changeLog, err := graph.DecodeChangeLog(inst.ChangeLog)
+		if err != nil {
+			return nil
+		}
+
+		key := leafKey(changeLog.Tree.ToBase58(), changeLog.Index)
+		leaf := leaves[key]
+		if leaf == nil {
+			leaf = &leafSlots{}
+			leaves[key] = leaf
+		}
+
+		slot := inst.Slot
+		switch decoded.(type) {
+		case graph.DecodedAddRelation:
+			leaf.added = slot
+		case graph.DecodedCloseRelation:
+			leaf.closed = &slot
+		case graph.DecodedEditExtra:
+			leaf.edits = append(leaf.edits, leafEdit{changeLog.Seq, slot})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, leaf := range leaves {
+		sort.Slice(leaf.edits, func(i, j int) bool { return leaf.edits[i].seq < leaf.edits[j].seq })
+	}
+	return leaves, nil
+}
+
+// fillSlots sets slots relation and its edits were not recorded with, and kinds of its replaced extras.
+// Slots are taken from the log only if it has every edit of the leaf, otherwise relation is left (or made) of unknown
+// slot: with edits that can't be placed in time by slot, nor can its extra. Reports whether relation has changed
+func fillSlots(r *types.Relation, leaves map[string]*leafSlots) bool {
+	changed, placed := false, true
+	for i, e := range r.History {
+		if e.Kind == "" {
+			if kind := extraKind(e.Extra); kind != "" {
+				r.History[i].Kind, changed = kind, true
+			}
+		}
+		placed = placed && e.Slot != 0
+	}
+	if r.Slot != 0 && placed {
+		return changed
+	}
+
+	var leaf *leafSlots
+	if r.LeafIndex != nil {
+		leaf = leaves[leafKey(r.Tree, *r.LeafIndex)]
+	}
+	if leaf == nil || len(leaf.edits) != len(r.History) ||
+		(r.Slot == 0 && (leaf.added == 0 || (r.DisconnectedAt != nil && r.ClosedSlot == nil && leaf.closed == nil))) {
+		if r.Slot != 0 {
+			r.Slot = 0
+			return true
+		}
+		return changed
+	}
+
+	if r.Slot == 0 {
+		r.Slot = leaf.added
+	}
+	if r.DisconnectedAt != nil && r.ClosedSlot == nil {
+		r.ClosedSlot = leaf.closed
+	}
+	for i, e := range leaf.edits {
+		r.History[i].Slot = e.slot
+	}
+	return true
+}
@@ -0,0 +1,14 @@
+package repo
+
+import "time"
+
+// EventsQuery filters events. Zero values mean no filtering
+type EventsQuery struct {
+	Actor, Target     string
+	Providers         []string
+	Since, Until      time.Time
+	IncludeUnverified bool
+	// nextCursor of the previous page
+	After string
+	Limit uint
+}
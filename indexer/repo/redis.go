@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -16,15 +17,31 @@ import (
 type Redis struct {
 	pool *redis.Pool
 	l    lgr.L
+
+	// prefix of every key, lets several indexers share one redis
+	namespace string
 }
 
-func NewRedis(l lgr.L, pool *redis.Pool) (r Redis) {
+func NewRedis(l lgr.L, pool *redis.Pool, namespace string) (r Redis) {
 	return Redis{
 		pool,
 		l,
+		namespace,
 	}
 }
 
+func (r Redis) key(name string) string {
+	return namespaced(r.namespace, name)
+}
+
+// namespaced applies namespace. Empty namespace keeps keys as is, so existing deployments keep their state
+func namespaced(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + ":" + name
+}
+
 func (h Redis) InitializeRedis(ctx context.Context) error {
 	handleErr := func(err error) error {
 		return fmt.Errorf("error registering handlers library: %w", err)
@@ -36,7 +53,7 @@ func (h Redis) InitializeRedis(ctx context.Context) error {
 	}
 
 	// create consumer group
-	_, err = redis.String(conn.Do("XGROUP", "CREATE", blockStreamKey, groupName, 0, "MKSTREAM"))
+	_, err = redis.String(conn.Do("XGROUP", "CREATE", h.key(blockStreamKey), h.key(groupName), 0, "MKSTREAM"))
 	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
 		return handleErr(fmt.Errorf("create consumer group: %w", err))
 	}
@@ -44,25 +61,49 @@ func (h Redis) InitializeRedis(ctx context.Context) error {
 	return nil
 }
 
-const lastSeenBlockKey = "last_seen_block"
+const namespaceMetaKey = "indexer:meta"
 
-func (h Redis) SaveLastSeenBlock(ctx context.Context, block uint64) error {
+// ErrNamespaceMismatch means namespace is already used by an indexer of another network or program
+var ErrNamespaceMismatch = errors.New("redis namespace belongs to another indexer")
+
+// GuardNamespace records network (genesis hash) and program ID on first start,
+// and refuses to proceed if they differ from recorded ones afterwards
+func (r Redis) GuardNamespace(ctx context.Context, genesisHash, programID string) error {
 	handleErr := func(err error) error {
-		return fmt.Errorf("error saving last seen block: %w", err)
+		return fmt.Errorf("guard namespace %q: %w", r.namespace, err)
 	}
 
-	conn, err := h.pool.GetContext(ctx)
+	conn, err := r.pool.GetContext(ctx)
 	if err != nil {
 		return handleErr(err)
 	}
+	defer conn.Close()
 
-	if _, err := redis.String(conn.Do("SET", lastSeenBlockKey, fmt.Sprint(block))); err != nil {
-		return handleErr(err)
+	expected := map[string]string{
+		"genesis_hash": genesisHash,
+		"program_id":   programID,
+	}
+
+	for field, value := range expected {
+		if _, err := conn.Do("HSETNX", r.key(namespaceMetaKey), field, value); err != nil {
+			return handleErr(err)
+		}
+
+		recorded, err := redis.String(conn.Do("HGET", r.key(namespaceMetaKey), field))
+		if err != nil {
+			return handleErr(err)
+		}
+
+		if recorded != value {
+			return handleErr(fmt.Errorf("%w: recorded %s is %s, configured is %s", ErrNamespaceMismatch, field, recorded, value))
+		}
 	}
 
 	return nil
 }
 
+const lastSeenBlockKey = "last_seen_block"
+
 func (h Redis) GetLastSeenBlock(ctx context.Context) (uint64, error) {
 	handleErr := func(err error) (uint64, error) {
 		return 0, fmt.Errorf("error getting last seen block: %w", err)
@@ -73,7 +114,7 @@ func (h Redis) GetLastSeenBlock(ctx context.Context) (uint64, error) {
 		return handleErr(err)
 	}
 
-	n, err := redis.String(conn.Do("GET", lastSeenBlockKey))
+	n, err := redis.String(conn.Do("GET", h.key(lastSeenBlockKey)))
 	if err == redis.ErrNil {
 		return 0, nil
 	} else if err != nil {
@@ -108,8 +149,6 @@ func (r Redis) AddBlocks(ctx context.Context, blocks []uint64) error {
 	}
 	defer conn.Close()
 
-	const maxStreamLen = "2000000" // TODO adjust or use MINID. Enough to sustain two weeks of harvester downtime
-
 	// use pipelining
 	for _, e := range blocks {
 		e, err := json.Marshal(e)
@@ -117,7 +156,8 @@ func (r Redis) AddBlocks(ctx context.Context, blocks []uint64) error {
 			return handleErr(fmt.Errorf("failed to marshal event: %w", err))
 		}
 
-		if err := conn.Send("XADD", blockStreamKey, "MAXLEN", "~", maxStreamLen, "*", "block", string(e)); err != nil {
+		// stream is trimmed by TrimStream, only after entries are acknowledged
+		if err := conn.Send("XADD", r.key(blockStreamKey), "*", "block", string(e)); err != nil {
 			return handleErr(err)
 		}
 	}
@@ -137,6 +177,60 @@ func (r Redis) AddBlocks(ctx context.Context, blocks []uint64) error {
 	return nil
 }
 
+// ErrCheckpointRegress is returned when enqueueing would move last seen block backwards,
+// e.g. when another harvester works on the same namespace
+var ErrCheckpointRegress = errors.New("last seen block checkpoint can't go backwards")
+
+// enqueueScript adds blocks to the stream and advances last seen block in one step,
+// so crash can neither lose blocks nor enqueue them twice. Blocks before last seen one are enqueued already,
+// so retried call adds nothing. Returns number of added blocks.
+// KEYS: stream, last seen block. ARGV: new last seen block, blocks...
+var enqueueScript = redis.NewScript(2, `
+local current = tonumber(redis.call('GET', KEYS[2]) or '0')
+local next = tonumber(ARGV[1])
+if next < current then
+	return redis.error_reply('CHECKPOINT_REGRESS ' .. current .. ' > ' .. next)
+end
+
+local added = 0
+for i = 2, #ARGV do
+	if tonumber(ARGV[i]) >= current then
+		redis.call('XADD', KEYS[1], '*', 'block', ARGV[i])
+		added = added + 1
+	end
+end
+redis.call('SET', KEYS[2], ARGV[1])
+
+return added
+`)
+
+// EnqueueBlocks atomically adds blocks to the processing stream and saves lastSeen checkpoint
+func (r Redis) EnqueueBlocks(ctx context.Context, blocks []uint64, lastSeen uint64) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("enqueue blocks: %w", err)
+	}
+
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer conn.Close()
+
+	args := []any{r.key(blockStreamKey), r.key(lastSeenBlockKey), fmt.Sprint(lastSeen)}
+	for _, b := range blocks {
+		args = append(args, fmt.Sprint(b))
+	}
+
+	if _, err := redis.Int(enqueueScript.Do(conn, args...)); err != nil {
+		if strings.HasPrefix(err.Error(), "CHECKPOINT_REGRESS") {
+			return handleErr(fmt.Errorf("%w: %v", ErrCheckpointRegress, err))
+		}
+		return handleErr(err)
+	}
+
+	return nil
+}
+
 // EventID is opaque identifier used identifying and ack'ing prococessed events
 // In Redis implementations corresponds to entry ID returned by XADD, e.g. `1518951480106-0`
 type EventID = string
@@ -156,7 +250,7 @@ func (r Redis) FetchStreamEvents(ctx context.Context, consumerID string, batchSi
 	}
 	defer conn.Close()
 
-	args := []any{"GROUP", groupName, consumerID, "BLOCK", 500, "COUNT", batchSize, "STREAMS", blockStreamKey, ">"}
+	args := []any{"GROUP", r.key(groupName), consumerID, "BLOCK", 500, "COUNT", batchSize, "STREAMS", r.key(blockStreamKey), ">"}
 	notifications, err := StreamNotifications[blockEvent](conn.Do("XREADGROUP", args...))
 	if err == redis.ErrNil {
 		return make(map[EventID]uint64), nil // return empty batch
@@ -164,7 +258,7 @@ func (r Redis) FetchStreamEvents(ctx context.Context, consumerID string, batchSi
 		return handleErr(fmt.Errorf("read transactions stream: %w", err))
 	}
 
-	events, ok := notifications[blockStreamKey]
+	events, ok := notifications[r.key(blockStreamKey)]
 	if !ok {
 		return handleErr(fmt.Errorf("unexpected response: no items from subscribed stream"))
 	}
@@ -192,7 +286,7 @@ func (r Redis) FindStaleBlocks(ctx context.Context, consumerID string, timeout t
 	minIdleTime := timeout.Milliseconds()
 	startID := "0"
 
-	args := []any{blockStreamKey, groupName, consumerID, minIdleTime, startID, "COUNT", batchSize}
+	args := []any{r.key(blockStreamKey), r.key(groupName), consumerID, minIdleTime, startID, "COUNT", batchSize}
 	resp, err := redis.Values(conn.Do("XAUTOCLAIM", args...))
 	if err != nil {
 		return handleErr(fmt.Errorf("find stale events: %w", err))
@@ -223,7 +317,7 @@ func (r Redis) AcknowledgeBlocks(ctx context.Context, events []EventID) error {
 	}
 	defer conn.Close()
 
-	args := []any{blockStreamKey, groupName}
+	args := []any{r.key(blockStreamKey), r.key(groupName)}
 
 	for _, e := range events {
 		args = append(args, e)
@@ -236,6 +330,314 @@ func (r Redis) AcknowledgeBlocks(ctx context.Context, events []EventID) error {
 	return nil
 }
 
+// TrimStream drops entries that are processed: everything below the lowest pending entry,
+// or below last delivered entry if nothing is pending. Undelivered entries are never trimmed
+func (r Redis) TrimStream(ctx context.Context) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("trim stream: %w", err)
+	}
+
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer conn.Close()
+
+	group, err := r.readGroupInfo(conn)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	pending, err := r.readPendingSummary(conn)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	minID := group.lastDeliveredID
+	if pending.count > 0 {
+		minID = pending.smallestID
+	}
+
+	if minID == "" || minID == "0-0" {
+		return nil // nothing was delivered yet
+	}
+
+	// approximate trimming is cheaper and never removes entries at or above MINID
+	trimmed, err := redis.Int64(conn.Do("XTRIM", r.key(blockStreamKey), "MINID", "~", minID))
+	if err != nil {
+		return handleErr(err)
+	}
+
+	r.l.Logf("[DEBUG] trimmed %d entries of block stream below %s", trimmed, minID)
+	return nil
+}
+
+// Checkpoint is position of the queue: blocks before NextBlock are processed, except Pending ones
+type Checkpoint struct {
+	NextBlock uint64   // lowest block that is not delivered to consumers yet
+	Pending   []uint64 // blocks delivered, but not acknowledged
+	// blocks not delivered yet, which are queued behind higher ones: queued again after failed fetch, or replayed
+	Requeued []uint64
+}
+
+// undelivered sets NextBlock and Requeued out of blocks not delivered yet, in order of the queue.
+// Blocks are queued in slot order, except ones queued again
+func (c *Checkpoint) undelivered(blocks []uint64) {
+	var highest uint64
+	for i, block := range blocks {
+		if i == 0 || block < c.NextBlock {
+			c.NextBlock = block
+		}
+		if block < highest {
+			c.Requeued = append(c.Requeued, block)
+		}
+		if block > highest {
+			highest = block
+		}
+	}
+}
+
+// Checkpoint returns current queue position. It's consistent only when indexer is stopped
+func (r Redis) Checkpoint(ctx context.Context) (Checkpoint, error) {
+	handleErr := func(err error) (Checkpoint, error) {
+		return Checkpoint{}, fmt.Errorf("checkpoint: %w", err)
+	}
+
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer conn.Close()
+
+	group, err := r.readGroupInfo(conn)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	var checkpoint Checkpoint
+
+	// entries are delivered in order, so undelivered ones are right after last delivered
+	const pageSize = 1000
+	var undelivered []uint64
+	for after := group.lastDeliveredID; ; {
+		page, err := Entries[blockEvent](conn.Do("XRANGE", r.key(blockStreamKey), "("+after, "+", "COUNT", pageSize))
+		if err != nil {
+			return handleErr(fmt.Errorf("read undelivered entries: %w", err))
+		}
+		for _, e := range page {
+			undelivered = append(undelivered, e.Value.BlockID)
+		}
+		if len(page) < pageSize {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+
+	if len(undelivered) > 0 {
+		checkpoint.undelivered(undelivered)
+	} else {
+		n, err := redis.Uint64(conn.Do("GET", r.key(lastSeenBlockKey)))
+		if err != nil && err != redis.ErrNil {
+			return handleErr(err)
+		}
+		checkpoint.NextBlock = n
+	}
+
+	pending, err := redis.Values(conn.Do("XPENDING", r.key(blockStreamKey), r.key(groupName), "-", "+", math.MaxInt32))
+	if err != nil {
+		return handleErr(fmt.Errorf("read pending entries: %w", err))
+	}
+
+	for _, p := range pending {
+		fields, err := redis.Values(p, nil)
+		if err != nil || len(fields) == 0 {
+			return handleErr(fmt.Errorf("invalid xpending response: %v", p))
+		}
+		id, err := redis.String(fields[0], nil)
+		if err != nil {
+			return handleErr(err)
+		}
+
+		entries, err := Entries[blockEvent](conn.Do("XRANGE", r.key(blockStreamKey), id, id))
+		if err != nil {
+			return handleErr(fmt.Errorf("read pending entry: %w", err))
+		}
+		for _, e := range entries {
+			checkpoint.Pending = append(checkpoint.Pending, e.Value.BlockID)
+		}
+	}
+
+	return checkpoint, nil
+}
+
+// StreamHealth is a snapshot of the block queue state
+type StreamHealth struct {
+	Length           int64         // entries kept in the queue
+	Pending          int64         // entries delivered, but not acknowledged yet
+	OldestPendingAge time.Duration // age of the oldest pending entry, zero if nothing is pending
+	Lag              int64         // entries not delivered to any consumer yet, -1 if unknown
+
+	Consumers []ConsumerHealth
+}
+
+type ConsumerHealth struct {
+	Name    string
+	Pending int64         // entries delivered to consumer and not acknowledged yet
+	Idle    time.Duration // since last delivery to consumer
+}
+
+func (r Redis) StreamHealth(ctx context.Context) (StreamHealth, error) {
+	handleErr := func(err error) (StreamHealth, error) {
+		return StreamHealth{}, fmt.Errorf("stream health: %w", err)
+	}
+
+	conn, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer conn.Close()
+
+	length, err := redis.Int64(conn.Do("XLEN", r.key(blockStreamKey)))
+	if err != nil {
+		return handleErr(err)
+	}
+
+	group, err := r.readGroupInfo(conn)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	pending, err := r.readPendingSummary(conn)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	health := StreamHealth{
+		Length:  length,
+		Pending: pending.count,
+		Lag:     group.lag,
+	}
+
+	if pending.count > 0 {
+		added, err := entryTime(pending.smallestID)
+		if err != nil {
+			return handleErr(err)
+		}
+		health.OldestPendingAge = time.Since(added)
+	}
+
+	consumers, err := redis.Values(conn.Do("XINFO", "CONSUMERS", r.key(blockStreamKey), r.key(groupName)))
+	if err != nil {
+		return handleErr(fmt.Errorf("consumers info: %w", err))
+	}
+
+	for _, c := range consumers {
+		fields, err := redis.Values(c, nil)
+		if err != nil {
+			return handleErr(err)
+		}
+
+		var consumer ConsumerHealth
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := redis.String(fields[i], nil)
+			switch key {
+			case "name":
+				consumer.Name, _ = redis.String(fields[i+1], nil)
+			case "pending":
+				consumer.Pending, _ = redis.Int64(fields[i+1], nil)
+			case "idle":
+				idle, _ := redis.Int64(fields[i+1], nil)
+				consumer.Idle = time.Duration(idle) * time.Millisecond
+			}
+		}
+		health.Consumers = append(health.Consumers, consumer)
+	}
+
+	return health, nil
+}
+
+type groupInfo struct {
+	lastDeliveredID string
+	lag             int64
+}
+
+func (r Redis) readGroupInfo(conn redis.Conn) (groupInfo, error) {
+	groups, err := redis.Values(conn.Do("XINFO", "GROUPS", r.key(blockStreamKey)))
+	if err != nil {
+		return groupInfo{}, fmt.Errorf("groups info: %w", err)
+	}
+
+	for _, g := range groups {
+		fields, err := redis.Values(g, nil)
+		if err != nil {
+			return groupInfo{}, err
+		}
+
+		info := groupInfo{lag: -1}
+		var name string
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, _ := redis.String(fields[i], nil)
+			switch key {
+			case "name":
+				name, _ = redis.String(fields[i+1], nil)
+			case "last-delivered-id":
+				info.lastDeliveredID, _ = redis.String(fields[i+1], nil)
+			case "lag":
+				// reported since redis 7, nil when it can't be computed
+				if lag, err := redis.Int64(fields[i+1], nil); err == nil {
+					info.lag = lag
+				}
+			}
+		}
+
+		if name == r.key(groupName) {
+			return info, nil
+		}
+	}
+
+	return groupInfo{}, fmt.Errorf("consumer group %s not found", r.key(groupName))
+}
+
+type pendingSummary struct {
+	count      int64
+	smallestID string
+}
+
+func (r Redis) readPendingSummary(conn redis.Conn) (pendingSummary, error) {
+	resp, err := redis.Values(conn.Do("XPENDING", r.key(blockStreamKey), r.key(groupName)))
+	if err != nil {
+		return pendingSummary{}, fmt.Errorf("pending summary: %w", err)
+	}
+	if len(resp) != 4 {
+		return pendingSummary{}, fmt.Errorf("invalid xpending response: %v", resp)
+	}
+
+	count, err := redis.Int64(resp[0], nil)
+	if err != nil {
+		return pendingSummary{}, err
+	}
+	if count == 0 {
+		return pendingSummary{}, nil
+	}
+
+	smallest, err := redis.String(resp[1], nil)
+	if err != nil {
+		return pendingSummary{}, err
+	}
+
+	return pendingSummary{count, smallest}, nil
+}
+
+// entryTime extracts time entry was added at from its ID
+func entryTime(id EventID) (time.Time, error) {
+	ms, _, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid entry id %q: %w", id, err)
+	}
+	return time.UnixMilli(n), nil
+}
+
 // streamEntry represents a single stream entry.
 type streamEntry[inner any] struct {
 	ID    string
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+	"github.com/gomodule/redigo/redis"
+)
+
+// newTestRedis connects to REDIS_TEST_ADDR and uses a fresh namespace, deleted after the test
+func newTestRedis(t *testing.T) Redis {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }}
+	namespace := fmt.Sprintf("sgraph_test_%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		defer pool.Close()
+
+		conn := pool.Get()
+		defer conn.Close()
+		keys, err := redis.Strings(conn.Do("KEYS", namespace+":*"))
+		if err != nil {
+			t.Errorf("list test keys: %v", err)
+			return
+		}
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", redis.Args{}.AddFlat(keys)...); err != nil {
+				t.Errorf("delete test keys: %v", err)
+			}
+		}
+	})
+
+	r := NewRedis(lgr.NoOp, pool, namespace)
+	if err := r.InitializeRedis(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// queue is what harvester and pipeline need of both queues
+type queue interface {
+	GetLastSeenBlock(ctx context.Context) (uint64, error)
+	EnqueueBlocks(ctx context.Context, blocks []uint64, lastSeen uint64) error
+	FetchStreamEvents(ctx context.Context, consumerID string, batchSize uint) (map[EventID]uint64, error)
+}
+
+func TestEnqueueBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	queues := []struct {
+		name string
+		open func(t *testing.T) queue
+	}{
+		{"redis", func(t *testing.T) queue { return newTestRedis(t) }},
+		{"bolt", func(t *testing.T) queue {
+			db, closeDB, err := OpenBolt(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { closeDB() })
+			q, err := NewBoltQueue(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return q
+		}},
+	}
+
+	for _, tt := range queues {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.open(t)
+
+			check := func(wantLastSeen uint64) {
+				t.Helper()
+				lastSeen, err := q.GetLastSeenBlock(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lastSeen != wantLastSeen {
+					t.Errorf("last seen block = %d, want %d", lastSeen, wantLastSeen)
+				}
+			}
+
+			if err := q.EnqueueBlocks(ctx, []uint64{5, 6}, 7); err != nil {
+				t.Fatal(err)
+			}
+			check(7)
+
+			// retried call adds nothing
+			if err := q.EnqueueBlocks(ctx, []uint64{5, 6}, 7); err != nil {
+				t.Fatal(err)
+			}
+			check(7)
+
+			// another harvester behind this one neither enqueues nor moves checkpoint back
+			if err := q.EnqueueBlocks(ctx, []uint64{3}, 4); !errors.Is(err, ErrCheckpointRegress) {
+				t.Fatalf("EnqueueBlocks() behind checkpoint error = %v, want %v", err, ErrCheckpointRegress)
+			}
+			check(7)
+
+			if err := q.EnqueueBlocks(ctx, []uint64{7, 8}, 9); err != nil {
+				t.Fatal(err)
+			}
+			check(9)
+
+			events, err := q.FetchStreamEvents(ctx, "test", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var blocks []uint64
+			for _, block := range events {
+				blocks = append(blocks, block)
+			}
+			sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+			if want := []uint64{5, 6, 7, 8}; fmt.Sprint(blocks) != fmt.Sprint(want) {
+				t.Errorf("enqueued blocks %v, want %v", blocks, want)
+			}
+		})
+	}
+}
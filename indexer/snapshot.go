@@ -0,0 +1,596 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+
+	"github.com/sgraph-protocol/sgraph/indexer/cli"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+	graph "github.com/sgraph-protocol/sgraph/sdk/go"
+)
+
+// Snapshot is a tar.gz archive of manifest.json followed by NDJSON files, one record per line.
+// Restoring it lets new indexer continue from the snapshot instead of the latest block
+
+const (
+	// version 2 added trees and instructions log
+	snapshotVersion = 2
+
+	snapshotManifest     = "manifest.json"
+	snapshotRelations    = "relations.ndjson"
+	snapshotProviders    = "providers.ndjson"
+	snapshotTrees        = "trees.ndjson"
+	snapshotInstructions = "instructions.ndjson"
+
+	snapshotBatchSize = 1000
+
+	// consumer that read the stream this recently may still be writing
+	snapshotQuietPeriod = 30 * time.Second
+)
+
+// snapshotFiles are files snapshot may have
+var snapshotFiles = []string{snapshotInstructions, snapshotTrees, snapshotProviders, snapshotRelations}
+
+type manifest struct {
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"createdAt"`
+	GenesisHash string    `json:"genesisHash"`
+	ProgramID   string    `json:"programId"`
+
+	// every slot up to LastSlot is indexed, except PendingSlots which are processed again after restore
+	LastSlot     uint64   `json:"lastSlot"`
+	PendingSlots []uint64 `json:"pendingSlots"`
+
+	Files map[string]manifestFile `json:"files"`
+	// sha256 of file hashes concatenated in order of file names
+	ContentHash string `json:"contentHash"`
+}
+
+type manifestFile struct {
+	Records int    `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+// snapshotRelation is portable form of a relation, independent of storage
+type snapshotRelation struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Provider       string `json:"provider"`
+	ConnectedAt    int64  `json:"connectedAt"`
+	DisconnectedAt *int64 `json:"disconnectedAt"`
+	Extra          []byte `json:"extra"`
+
+	// absent in snapshots of relations indexed before trees were tracked
+	Tree      string  `json:"tree,omitempty"`
+	LeafIndex *uint32 `json:"leafIndex,omitempty"`
+	Seq       uint64  `json:"seq,omitempty"`
+
+	// absent in snapshots of relations indexed before slots were recorded
+	Slot       uint64  `json:"slot,omitempty"`
+	ClosedSlot *uint64 `json:"closedSlot,omitempty"`
+
+	History []types.ExtraEdit `json:"history,omitempty"`
+
+	Kind         string         `json:"kind,omitempty"`
+	ExtraDecoded map[string]any `json:"extraDecoded,omitempty"`
+}
+
+func toSnapshotRelation(r types.Relation) snapshotRelation {
+	return snapshotRelation{
+		From:           r.From,
+		To:             r.To,
+		Provider:       r.Provider,
+		ConnectedAt:    r.ConnectedAt.Unix(),
+		DisconnectedAt: optionMap(r.DisconnectedAt, time.Time.Unix),
+		Extra:          r.Extra,
+		Tree:           r.Tree,
+		LeafIndex:      r.LeafIndex,
+		Seq:            r.Seq,
+		Slot:           r.Slot,
+		ClosedSlot:     r.ClosedSlot,
+		History:        r.History,
+		Kind:           r.Kind,
+		ExtraDecoded:   r.ExtraDecoded,
+	}
+}
+
+func fromSnapshotRelation(r snapshotRelation) types.Relation {
+	// edits exported before they recorded slots can't be placed in time by slot, nor can their relation
+	for _, e := range r.History {
+		if e.Slot == 0 {
+			r.Slot = 0
+		}
+	}
+
+	return types.Relation{
+		From:           r.From,
+		To:             r.To,
+		Provider:       r.Provider,
+		ConnectedAt:    time.Unix(r.ConnectedAt, 0),
+		DisconnectedAt: optionMap(r.DisconnectedAt, func(ts int64) time.Time { return time.Unix(ts, 0) }),
+		Extra:          r.Extra,
+		Tree:           r.Tree,
+		LeafIndex:      r.LeafIndex,
+		Seq:            r.Seq,
+		Slot:           r.Slot,
+		ClosedSlot:     r.ClosedSlot,
+		History:        r.History,
+		Kind:           r.Kind,
+		ExtraDecoded:   r.ExtraDecoded,
+	}
+}
+
+// runSnapshot handles `snapshot export <file>` and `snapshot import <file>`.
+// Indexer must be stopped while snapshot is exported, export refuses to run while consumers read the stream
+func runSnapshot(ctx context.Context, l lgr.L, rpc cli.RPC, queue Redis, store Store, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: indexer snapshot export|import <file>")
+	}
+
+	genesisHash, err := rpc.GetGenesisHash(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "export":
+		return exportSnapshot(ctx, l, queue, store, genesisHash, args[1])
+	case "import":
+		return importSnapshot(ctx, l, queue, store, genesisHash, args[1])
+	default:
+		return fmt.Errorf("unknown snapshot command %q", args[0])
+	}
+}
+
+func exportSnapshot(ctx context.Context, l lgr.L, queue Redis, store Store, genesisHash, path string) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("export snapshot: %w", err)
+	}
+
+	// checkpoint is taken before store is read, so nothing may be written in between
+	if err := ensureQuiet(ctx, queue); err != nil {
+		return handleErr(err)
+	}
+
+	checkpoint, err := queue.Checkpoint(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	if checkpoint.NextBlock == 0 {
+		return handleErr(errors.New("nothing is indexed yet"))
+	}
+
+	dir, err := os.MkdirTemp("", "snapshot")
+	if err != nil {
+		return handleErr(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := manifest{
+		Version:      snapshotVersion,
+		CreatedAt:    time.Now().UTC(),
+		GenesisHash:  genesisHash,
+		ProgramID:    graph.GraphProgramAddress.ToBase58(),
+		LastSlot:     checkpoint.NextBlock - 1,
+		PendingSlots: checkpoint.Pending,
+		Files:        make(map[string]manifestFile),
+	}
+
+	m.Files[snapshotInstructions], err = writeNDJSON(filepath.Join(dir, snapshotInstructions), func(emit func(any) error) error {
+		return store.ScanInstructions(ctx, func(inst types.Instruction) error {
+			return emit(inst)
+		})
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	m.Files[snapshotTrees], err = writeNDJSON(filepath.Join(dir, snapshotTrees), func(emit func(any) error) error {
+		trees, err := store.FetchTrees(ctx)
+		if err != nil {
+			return err
+		}
+		for _, t := range trees {
+			if err := emit(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	m.Files[snapshotRelations], err = writeNDJSON(filepath.Join(dir, snapshotRelations), func(emit func(any) error) error {
+		return store.ScanRelations(ctx, func(r types.Relation) error {
+			return emit(toSnapshotRelation(r))
+		})
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	m.Files[snapshotProviders], err = writeNDJSON(filepath.Join(dir, snapshotProviders), func(emit func(any) error) error {
+		return store.ScanProviders(ctx, func(p types.Provider) error {
+			return emit(p)
+		})
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	// indexer started while the store was read
+	if err := ensureQuiet(ctx, queue); err != nil {
+		return handleErr(err)
+	}
+
+	m.ContentHash = m.contentHash()
+
+	// write next to destination and rename, so there's never a half written snapshot
+	tmp := path + ".tmp"
+	if err := writeArchive(tmp, dir, m); err != nil {
+		os.Remove(tmp)
+		return handleErr(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return handleErr(err)
+	}
+
+	l.Logf("[INFO] exported snapshot to %s: %d relations, %d providers, %d trees, %d instructions, last slot %d, %d pending slots",
+		path, m.Files[snapshotRelations].Records, m.Files[snapshotProviders].Records, m.Files[snapshotTrees].Records,
+		m.Files[snapshotInstructions].Records, m.LastSlot, len(m.PendingSlots))
+	return nil
+}
+
+// ensureQuiet fails if any consumer has read the stream within snapshotQuietPeriod
+func ensureQuiet(ctx context.Context, queue Redis) error {
+	health, err := queue.StreamHealth(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range health.Consumers {
+		if c.Idle < snapshotQuietPeriod {
+			return fmt.Errorf("consumer %s has read blocks %s ago, stop the indexer and retry in %s",
+				c.Name, c.Idle.Truncate(time.Second), snapshotQuietPeriod)
+		}
+	}
+	return nil
+}
+
+func importSnapshot(ctx context.Context, l lgr.L, queue Redis, store Store, genesisHash, path string) error {
+	handleErr := func(err error) error {
+		return fmt.Errorf("import snapshot: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "snapshot")
+	if err != nil {
+		return handleErr(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nothing is written until the whole archive is verified
+	m, err := readArchive(path, dir)
+	if err != nil {
+		return handleErr(err)
+	}
+
+	if m.GenesisHash != genesisHash {
+		return handleErr(fmt.Errorf("snapshot is of network %s, indexer is configured for %s", m.GenesisHash, genesisHash))
+	}
+	if programID := graph.GraphProgramAddress.ToBase58(); m.ProgramID != programID {
+		return handleErr(fmt.Errorf("snapshot is of program %s, indexer is built for %s", m.ProgramID, programID))
+	}
+
+	// restoring on top of existing data would duplicate relations
+	lastSeen, err := queue.GetLastSeenBlock(ctx)
+	if err != nil {
+		return handleErr(err)
+	}
+	if lastSeen != 0 {
+		return handleErr(fmt.Errorf("indexer has already started at block %d, snapshot can only be restored to a new one", lastSeen))
+	}
+
+	errNotEmpty := errors.New("store is not empty")
+	if err := store.ScanRelations(ctx, func(types.Relation) error { return errNotEmpty }); err != nil {
+		return handleErr(err)
+	}
+	if err := store.ScanInstructions(ctx, func(types.Instruction) error { return errNotEmpty }); err != nil {
+		return handleErr(err)
+	}
+
+	// the log goes first, as the source of truth. Snapshots of version 1 have neither the log nor trees
+	if _, ok := m.Files[snapshotInstructions]; ok {
+		err = readNDJSON(filepath.Join(dir, snapshotInstructions), func(batch []types.Instruction) error {
+			return store.SaveInstructions(ctx, batch)
+		})
+		if err != nil {
+			return handleErr(err)
+		}
+	}
+
+	if _, ok := m.Files[snapshotTrees]; ok {
+		err = readNDJSON(filepath.Join(dir, snapshotTrees), func(batch []types.Tree) error {
+			if err := store.SaveTrees(ctx, batch); err != nil {
+				return err
+			}
+			states := make(map[string]types.TreeState, len(batch))
+			for _, t := range batch {
+				states[t.Address] = t.TreeState
+			}
+			return store.AdvanceTrees(ctx, states)
+		})
+		if err != nil {
+			return handleErr(err)
+		}
+	}
+
+	err = readNDJSON(filepath.Join(dir, snapshotProviders), func(batch []types.Provider) error {
+		return store.SaveProviders(ctx, batch)
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	err = readNDJSON(filepath.Join(dir, snapshotRelations), func(batch []snapshotRelation) error {
+		return store.SaveRelations(ctx, sliceMap(batch, fromSnapshotRelation))
+	})
+	if err != nil {
+		return handleErr(err)
+	}
+
+	// checkpoint goes last: if import fails midway, indexer won't start from a partial snapshot.
+	// store has to be cleaned up before retrying
+	if err := queue.EnqueueBlocks(ctx, m.PendingSlots, m.LastSlot+1); err != nil {
+		return handleErr(err)
+	}
+
+	l.Logf("[INFO] imported snapshot %s: %d relations, %d providers, %d trees, %d instructions, indexing continues from slot %d",
+		path, m.Files[snapshotRelations].Records, m.Files[snapshotProviders].Records, m.Files[snapshotTrees].Records,
+		m.Files[snapshotInstructions].Records, m.LastSlot+1)
+	return nil
+}
+
+func (m manifest) contentHash() string {
+	names := keys(m.Files)
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(m.Files[name].SHA256))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeNDJSON(path string, scan func(emit func(any) error) error) (manifestFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return manifestFile{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	enc := json.NewEncoder(w)
+
+	var records int
+	err = scan(func(record any) error {
+		records++
+		return enc.Encode(record)
+	})
+	if err != nil {
+		return manifestFile{}, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return manifestFile{}, err
+	}
+
+	return manifestFile{Records: records, SHA256: hex.EncodeToString(h.Sum(nil))}, f.Close()
+}
+
+func readNDJSON[T any](path string, save func([]T) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+
+	batch := make([]T, 0, snapshotBatchSize)
+	for {
+		var record T
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("decode %s: %w", filepath.Base(path), err)
+		}
+
+		batch = append(batch, record)
+		if len(batch) == snapshotBatchSize {
+			if err := save(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		return save(batch)
+	}
+	return nil
+}
+
+func writeArchive(path, dir string, m manifest) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// manifest goes first, so import knows what to expect
+	err = tw.WriteHeader(&tar.Header{Name: snapshotManifest, Mode: 0o644, Size: int64(len(data)), ModTime: m.CreatedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	names := keys(m.Files)
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := addToArchive(tw, filepath.Join(dir, name), m.CreatedAt); err != nil {
+			return fmt.Errorf("add %s: %w", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addToArchive(tw *tar.Writer, path string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: filepath.Base(path), Mode: 0o644, Size: info.Size(), ModTime: modTime})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// readArchive extracts snapshot files to dir and verifies them against manifest
+func readArchive(path, dir string) (manifest, error) {
+	handleErr := func(err error) (manifest, error) {
+		return manifest{}, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return handleErr(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return handleErr(err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return handleErr(err)
+	}
+	if hdr.Name != snapshotManifest {
+		return handleErr(fmt.Errorf("archive must start with %s, found %s", snapshotManifest, hdr.Name))
+	}
+
+	var m manifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return handleErr(fmt.Errorf("decode manifest: %w", err))
+	}
+	if m.Version < 1 || m.Version > snapshotVersion {
+		return handleErr(fmt.Errorf("unsupported snapshot version %d", m.Version))
+	}
+	for name := range m.Files {
+		// names become paths, accept only known ones
+		if !contains(snapshotFiles, name) {
+			return handleErr(fmt.Errorf("unexpected file %s in manifest", name))
+		}
+	}
+	if m.contentHash() != m.ContentHash {
+		return handleErr(errors.New("manifest content hash doesn't match its files"))
+	}
+
+	hashes := make(map[string]hash.Hash)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return handleErr(err)
+		}
+
+		if _, ok := m.Files[hdr.Name]; !ok {
+			return handleErr(fmt.Errorf("unexpected file %s", hdr.Name))
+		}
+		if _, ok := hashes[hdr.Name]; ok {
+			return handleErr(fmt.Errorf("duplicate file %s", hdr.Name))
+		}
+
+		h := sha256.New()
+		if err := extract(tr, filepath.Join(dir, hdr.Name), h); err != nil {
+			return handleErr(fmt.Errorf("extract %s: %w", hdr.Name, err))
+		}
+		hashes[hdr.Name] = h
+	}
+
+	for name, file := range m.Files {
+		h, ok := hashes[name]
+		if !ok {
+			return handleErr(fmt.Errorf("missing file %s", name))
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != file.SHA256 {
+			return handleErr(fmt.Errorf("%s is corrupted: sha256 %s, expected %s", name, sum, file.SHA256))
+		}
+	}
+
+	return m, nil
+}
+
+func extract(r io.Reader, path string, h hash.Hash) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	}
+	return f.Close()
+}
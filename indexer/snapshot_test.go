@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lgr"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/types"
+)
+
+func newTestQueue(t *testing.T) repo.BoltQueue {
+	t.Helper()
+
+	db, closeDB, err := repo.OpenBolt(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeDB() })
+
+	queue, err := repo.NewBoltQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+
+	store, queue := newTestBolt(t), newTestQueue(t)
+	if err := queue.EnqueueBlocks(ctx, []uint64{5}, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	leafIndex := uint32(0)
+	inst := types.Instruction{Slot: 5, Signature: "sig", Program: "program", Data: []byte{1}, Inner: -1}
+	tree := types.Tree{Address: "tree", Controller: "controller", CreatedAt: time.Unix(1, 0).UTC(),
+		TreeState: types.TreeState{Seq: 3, LeafCount: 1, Root: []byte{7}}}
+	relation := types.Relation{From: "a", To: "b", Provider: "p", Tree: "tree", LeafIndex: &leafIndex, Slot: 5,
+		ConnectedAt: time.Unix(2, 0)}
+
+	if err := store.SaveInstructions(ctx, []types.Instruction{inst}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveTrees(ctx, []types.Tree{tree}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AdvanceTrees(ctx, map[string]types.TreeState{tree.Address: tree.TreeState}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveProviders(ctx, []types.Provider{{Address: "p", Name: "provider"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveRelations(ctx, []types.Relation{relation}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exportSnapshot(ctx, lgr.NoOp, queue, store, "genesis", path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, restoredQueue := newTestBolt(t), newTestQueue(t)
+	if err := importSnapshot(ctx, lgr.NoOp, restoredQueue, restored, "genesis", path); err != nil {
+		t.Fatal(err)
+	}
+
+	var insts []types.Instruction
+	err := restored.ScanInstructions(ctx, func(inst types.Instruction) error {
+		insts = append(insts, inst)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 1 || insts[0].Signature != inst.Signature || insts[0].Slot != inst.Slot {
+		t.Errorf("restored instructions = %+v, want %+v", insts, inst)
+	}
+
+	trees, err := restored.FetchTrees(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trees) != 1 || trees[0].Controller != tree.Controller || trees[0].Seq != tree.Seq || trees[0].LeafCount != tree.LeafCount {
+		t.Errorf("restored trees = %+v, want %+v", trees, tree)
+	}
+
+	relations, _, err := restored.FetchRelations(ctx, repo.RelationsQuery{Tree: "tree", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relations) != 1 || relations[0].From != "a" {
+		t.Errorf("restored relations = %+v, want the exported one", relations)
+	}
+
+	checkpoint, err := restoredQueue.Checkpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.NextBlock != 5 {
+		t.Errorf("restored queue continues from %d, want 5", checkpoint.NextBlock)
+	}
+}
+
+func TestSnapshotExportRefusesWhileIndexing(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.tar.gz")
+
+	store, queue := newTestBolt(t), newTestQueue(t)
+	if err := queue.EnqueueBlocks(ctx, []uint64{5, 6}, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	// consumer has just read a block
+	if _, err := queue.FetchStreamEvents(ctx, "indexer", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exportSnapshot(ctx, lgr.NoOp, queue, store, "genesis", path); err == nil {
+		t.Fatal("exportSnapshot() succeeded while consumer reads the stream")
+	}
+}
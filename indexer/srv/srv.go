@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type RpcRequest struct {
@@ -17,12 +18,33 @@ type RpcRequest struct {
 }
 
 type RpcResponse struct {
-	Jsonrpc string          `json:"jsonrpc"`
-	Result  json.RawMessage `json:"result,omitempty"`
-	Error   *RpcError       `json:"error,omitempty"`
-	ID      any             `json:"id,omitempty"`
+	Jsonrpc   string          `json:"jsonrpc"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *RpcError       `json:"error,omitempty"`
+	ID        any             `json:"id,omitempty"`
+	Watermark *Watermark      `json:"watermark,omitempty"`
+}
+
+// Watermark is how fresh the response is: everything up to Slot was processed, at ProcessedAt
+type Watermark struct {
+	Slot        uint64    `json:"slot"`
+	ProcessedAt time.Time `json:"processedAt"`
+	// slots up to Slot with transactions in quarantine, their graph instructions are not indexed until replayed
+	Quarantined []uint64 `json:"quarantined,omitempty"`
+}
+
+// WatermarkFunc returns current watermark. With minSlot it waits for watermark to reach it,
+// and fails if it doesn't in time
+type WatermarkFunc func(ctx context.Context, minSlot uint64) (Watermark, error)
+
+// consistencyParams are accepted by every method, next to its own params
+type consistencyParams struct {
+	MinSlot uint64 `json:"minSlot"`
 }
 
+// error codes of the server, beyond ones of JSON-RPC
+const ErrCodeMinSlot = -32004
+
 type RpcError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
@@ -46,11 +68,12 @@ func WrapH[REQ, RES any](h func(ctx context.Context, r REQ) (RES, error)) Handle
 }
 
 type Server struct {
-	handlers map[string]HandlerFunc
+	handlers  map[string]HandlerFunc
+	watermark WatermarkFunc // nil if responses carry none
 }
 
-func NewServer() Server {
-	return Server{handlers: make(map[string]HandlerFunc)}
+func NewServer(watermark WatermarkFunc) Server {
+	return Server{handlers: make(map[string]HandlerFunc), watermark: watermark}
 }
 
 func (s Server) Register(method string, h HandlerFunc) {
@@ -100,6 +123,27 @@ func (s Server) process(ctx context.Context, req RpcRequest) RpcResponse {
 		}
 	}
 
+	// watermark is taken before handling, so the response is at least as fresh as it
+	var watermark *Watermark
+	if s.watermark != nil {
+		// params of some methods are not objects, they have no min slot
+		var params consistencyParams
+		_ = json.Unmarshal(req.Params, &params)
+
+		w, err := s.watermark(ctx, params.MinSlot)
+		if err != nil {
+			return RpcResponse{
+				Jsonrpc: "2.0",
+				Error: &RpcError{
+					Code:    ErrCodeMinSlot,
+					Message: err.Error(),
+				},
+				Watermark: &w,
+			}
+		}
+		watermark = &w
+	}
+
 	response, err := handler(ctx, req.Params)
 	if err != nil {
 		return RpcResponse{
@@ -108,13 +152,15 @@ func (s Server) process(ctx context.Context, req RpcRequest) RpcResponse {
 				Code:    -32000,
 				Message: err.Error(),
 			},
+			Watermark: watermark,
 		}
 	}
 
 	return RpcResponse{
-		Jsonrpc: "2.0",
-		ID:      req.ID,
-		Result:  response,
+		Jsonrpc:   "2.0",
+		ID:        req.ID,
+		Result:    response,
+		Watermark: watermark,
 	}
 }
 
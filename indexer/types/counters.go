@@ -0,0 +1,14 @@
+package types
+
+// Counters are numbers of active relations of an account, in total and by provider
+type Counters struct {
+	Address   string                      `bson:"_id" json:"address"`
+	Followers int64                       `bson:"followers" json:"followers"`
+	Following int64                       `bson:"following" json:"following"`
+	Providers map[string]ProviderCounters `bson:"providers" json:"providers"`
+}
+
+type ProviderCounters struct {
+	Followers int64 `bson:"followers" json:"followers"`
+	Following int64 `bson:"following" json:"following"`
+}
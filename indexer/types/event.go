@@ -0,0 +1,27 @@
+package types
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is a one-time broadcast sent by provider
+type Event struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Provider string             `bson:"provider" json:"provider"`
+	Actor    string             `bson:"actor" json:"actor"`
+	Target   string             `bson:"target" json:"target"`
+	Extra    []byte             `bson:"extra" json:"extra"`
+
+	// Program that emitted the event
+	Program string `bson:"program" json:"program"`
+	// Verified is true if the event is known to be sent by provider:
+	// transaction is signed by provider authority, or it was emitted by graph program (which emits no events yet)
+	Verified bool `bson:"verified" json:"verified"`
+
+	Signature string    `bson:"signature" json:"signature"`
+	Index     int       `bson:"index" json:"index"` // position among events of the transaction
+	Slot      uint64    `bson:"slot" json:"slot"`
+	EmittedAt time.Time `bson:"emitted_at" json:"emittedAt"`
+}
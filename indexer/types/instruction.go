@@ -0,0 +1,27 @@
+package types
+
+import "time"
+
+// Instruction is a graph program instruction as it was executed on chain.
+// Instructions log is append-only, relations, providers and other projections can be rebuilt from it
+type Instruction struct {
+	Slot      uint64    `bson:"slot" json:"slot"`
+	BlockTime time.Time `bson:"block_time" json:"blockTime"`
+	Signature string    `bson:"signature" json:"signature"`
+	TxIndex   int       `bson:"tx_index" json:"txIndex"` // position of transaction among indexed ones of the block
+	Outer     int       `bson:"outer" json:"outer"`
+	Inner     int       `bson:"inner" json:"inner"` // -1 for top level instruction
+
+	Program  string               `bson:"program" json:"program"`
+	Accounts []InstructionAccount `bson:"accounts" json:"accounts"`
+	Data     []byte               `bson:"data" json:"data"`
+
+	// data of account compression change log the instruction has emitted, if any
+	ChangeLog []byte `bson:"change_log,omitempty" json:"changeLog,omitempty"`
+}
+
+type InstructionAccount struct {
+	Address  string `bson:"address" json:"address"`
+	Signer   bool   `bson:"signer" json:"signer"`
+	Writable bool   `bson:"writable" json:"writable"`
+}
@@ -0,0 +1,24 @@
+package types
+
+import "time"
+
+// SkippedRelation is a relation left out by ingest rules. Its leaf keeps the tree verifiable without the relation
+type SkippedRelation struct {
+	// position of the instruction on chain, orders and identifies skipped relations
+	Position  string    `bson:"_id" json:"position"`
+	Slot      uint64    `bson:"slot" json:"slot"`
+	Signature string    `bson:"signature" json:"signature"`
+	Provider  string    `bson:"provider" json:"provider"`
+	Tree      string    `bson:"tree" json:"tree"`
+	LeafIndex *uint32   `bson:"leaf_index" json:"leafIndex"`
+	Leaf      []byte    `bson:"leaf" json:"leaf"` // node relation was appended to the tree as
+	SkippedAt time.Time `bson:"skipped_at" json:"skippedAt"`
+}
+
+// LedgerEntry accounts for relations of a provider. Indexed and skipped relations add up
+// to `relations_count` of the provider account once indexer has caught up
+type LedgerEntry struct {
+	Provider string `json:"provider"`
+	Indexed  int64  `json:"indexed"`
+	Skipped  int64  `json:"skipped"`
+}
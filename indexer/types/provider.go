@@ -0,0 +1,11 @@
+package types
+
+import "time"
+
+type Provider struct {
+	Address   string    `bson:"_id" json:"address"`
+	Authority string    `bson:"authority" json:"authority"`
+	Name      string    `bson:"name" json:"name"`
+	Website   string    `bson:"website" json:"website"`
+	CreatedAt time.Time `bson:"created_at" json:"createdAt"`
+}
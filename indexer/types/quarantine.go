@@ -0,0 +1,19 @@
+package types
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// QuarantinedTx is a transaction indexer failed to decode.
+// It is stored along with raw rpc data so it can be inspected, and its slot replayed once decoding is fixed
+type QuarantinedTx struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Slot          uint64             `bson:"slot" json:"slot"`
+	Signature     string             `bson:"signature" json:"signature"`
+	Stage         string             `bson:"stage" json:"stage"`
+	Error         string             `bson:"error" json:"error"`
+	Raw           []byte             `bson:"raw" json:"raw"` // transaction json as returned by rpc
+	QuarantinedAt time.Time          `bson:"quarantined_at" json:"quarantinedAt"`
+}
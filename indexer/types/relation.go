@@ -14,4 +14,48 @@ type Relation struct {
 	ConnectedAt    time.Time          `bson:"connected_at" json:"connectedAt"`
 	DisconnectedAt *time.Time         `bson:"disconnected_at" json:"disconnectedAt"`
 	Extra          []byte             `bson:"extra" json:"extra"`
+	// kind Extra declares with kind header, see graph.DecodeKind. Empty when it declares none
+	Kind string `bson:"kind,omitempty" json:"kind,omitempty"`
+	// fields of Extra payload, when its provider has a decoder configured
+	ExtraDecoded map[string]any `bson:"extra_decoded,omitempty" json:"extraDecoded,omitempty"`
+
+	// tree relation is appended to, and index of its leaf there. Leaf index is unknown for relations
+	// indexed before trees were tracked, their tree is the only one of the program, found in the log
+	Tree      string  `bson:"tree,omitempty" json:"tree,omitempty"`
+	LeafIndex *uint32 `bson:"leaf_index,omitempty" json:"leafIndex,omitempty"`
+	// sequence number of change log of the latest modification of the leaf
+	Seq uint64 `bson:"seq,omitempty" json:"seq,omitempty"`
+
+	// slots relation was added and closed at, next to their block times. Slot is zero when unknown,
+	// for relations indexed before slots were recorded, which the instructions log has no trace of
+	Slot       uint64  `bson:"slot" json:"slot,omitempty"`
+	ClosedSlot *uint64 `bson:"closed_slot,omitempty" json:"closedSlot,omitempty"`
+
+	// previous values of Extra, oldest first
+	History []ExtraEdit `bson:"history,omitempty" json:"history,omitempty"`
+}
+
+// ExtraEdit is value of Extra replaced by edit_extra, along with fields derived from it
+type ExtraEdit struct {
+	Extra        []byte         `bson:"extra" json:"extra"`
+	Kind         string         `bson:"kind,omitempty" json:"kind,omitempty"`
+	ExtraDecoded map[string]any `bson:"extra_decoded,omitempty" json:"extraDecoded,omitempty"`
+	// when it was replaced. Slot is zero when unknown, as of Relation
+	EditedAt time.Time `bson:"edited_at" json:"editedAt"`
+	Slot     uint64    `bson:"slot,omitempty" json:"slot,omitempty"`
+}
+
+// RelationUpdate replaces leaf of indexed relation, either closing it or editing its extra.
+// It applies only to relations modified by earlier change logs than its Seq, so retried writes never apply it twice
+type RelationUpdate struct {
+	Tree      string
+	LeafIndex uint32
+	Seq       uint64
+	Slot      uint64
+
+	Close        bool
+	Extra        []byte // new extra, unless Close
+	Kind         string
+	ExtraDecoded map[string]any
+	UpdatedAt    time.Time
 }
@@ -0,0 +1,21 @@
+package types
+
+import "time"
+
+// Tree is a merkle tree of relations, discovered from `initialize_tree`
+type Tree struct {
+	Address    string    `bson:"_id" json:"address"`
+	Controller string    `bson:"controller" json:"controller"`
+	Authority  string    `bson:"authority" json:"authority"`
+	CreatedAt  time.Time `bson:"created_at" json:"createdAt"`
+
+	TreeState `bson:",inline"`
+}
+
+// TreeState follows change logs of the tree. Change logs are applied in order of Seq,
+// older ones arriving late are ignored
+type TreeState struct {
+	Seq       uint64 `bson:"seq" json:"seq"`
+	LeafCount uint64 `bson:"leaf_count" json:"leafCount"`
+	Root      []byte `bson:"root" json:"root"`
+}
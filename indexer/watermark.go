@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+	"github.com/sgraph-protocol/sgraph/indexer/srv"
+)
+
+// watermark tracks the highest slot every block up to which is processed. Batches are processed
+// concurrently, so it trails the latest processed block until blocks before it are done as well.
+// It assumes a single consumer of the queue, which fills it in slot order
+type watermark struct {
+	mu sync.Mutex
+
+	// blocks read from the queue and not processed yet, including failed ones until they are retried
+	outstanding map[uint64]struct{}
+	// highest block read from the queue
+	highest uint64
+
+	// blocks with quarantined transactions. They count as processed, but are reported until replayed
+	quarantined map[uint64]struct{}
+
+	slot        uint64
+	processedAt time.Time
+
+	// closed and replaced whenever slot advances
+	advanced chan struct{}
+}
+
+var errWatermarkBehind = errors.New("indexer hasn't reached min slot yet")
+
+// newWatermark starts from position of the queue. Blocks delivered before restart are outstanding
+// until they are picked up again as stale, and so are blocks queued again behind higher ones
+func newWatermark(checkpoint repo.Checkpoint) *watermark {
+	w := &watermark{
+		outstanding: make(map[uint64]struct{}),
+		quarantined: make(map[uint64]struct{}),
+		processedAt: time.Now(),
+		advanced:    make(chan struct{}),
+	}
+	if checkpoint.NextBlock > 0 {
+		w.highest = checkpoint.NextBlock - 1
+	}
+	for _, slot := range append(checkpoint.Pending, checkpoint.Requeued...) {
+		w.outstanding[slot] = struct{}{}
+		if slot > w.highest {
+			w.highest = slot
+		}
+	}
+	w.slot = w.current()
+	return w
+}
+
+// read registers blocks delivered by the queue
+func (w *watermark) read(slots []uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, slot := range slots {
+		w.outstanding[slot] = struct{}{}
+		if slot > w.highest {
+			w.highest = slot
+		}
+	}
+}
+
+// processed registers blocks done with, failed ones stay outstanding as they are queued again
+func (w *watermark) processed(slots, failed []uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, slot := range slots {
+		delete(w.outstanding, slot)
+	}
+	for _, slot := range failed {
+		w.outstanding[slot] = struct{}{}
+	}
+
+	if slot := w.current(); slot > w.slot {
+		w.slot, w.processedAt = slot, time.Now()
+		close(w.advanced)
+		w.advanced = make(chan struct{})
+	}
+}
+
+// quarantine records which of processed blocks have quarantined transactions.
+// Blocks processed again without any, once they are replayed, are released
+func (w *watermark) quarantine(processed, quarantined []uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, slot := range processed {
+		delete(w.quarantined, slot)
+	}
+	for _, slot := range quarantined {
+		w.quarantined[slot] = struct{}{}
+	}
+}
+
+// quarantinedAmong returns which of slots have quarantined transactions
+func (w *watermark) quarantinedAmong(slots []uint64) []uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var found []uint64
+	for _, slot := range slots {
+		if _, ok := w.quarantined[slot]; ok {
+			found = append(found, slot)
+		}
+	}
+	return found
+}
+
+// current computes watermark, mu must be held
+func (w *watermark) current() uint64 {
+	slot := w.highest
+	for s := range w.outstanding {
+		if s == 0 {
+			return 0
+		}
+		if s <= slot {
+			slot = s - 1
+		}
+	}
+	return slot
+}
+
+func (w *watermark) get() srv.Watermark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.report()
+}
+
+// report returns watermark with quarantined blocks it has passed, mu must be held
+func (w *watermark) report() srv.Watermark {
+	wm := srv.Watermark{Slot: w.slot, ProcessedAt: w.processedAt}
+	for slot := range w.quarantined {
+		if slot <= w.slot {
+			wm.Quarantined = append(wm.Quarantined, slot)
+		}
+	}
+	sort.Slice(wm.Quarantined, func(i, j int) bool { return wm.Quarantined[i] < wm.Quarantined[j] })
+	return wm
+}
+
+// wait returns watermark once it reaches minSlot, waiting up to timeout for it
+func (w *watermark) wait(ctx context.Context, minSlot uint64, timeout time.Duration) (srv.Watermark, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		w.mu.Lock()
+		current, advanced := w.report(), w.advanced
+		w.mu.Unlock()
+
+		if current.Slot >= minSlot {
+			return current, nil
+		}
+
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return current, fmt.Errorf("%w: at slot %d, min slot is %d", errWatermarkBehind, current.Slot, minSlot)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sgraph-protocol/sgraph/indexer/repo"
+)
+
+func TestWatermark(t *testing.T) {
+	// block 8 was delivered before restart and is not acknowledged
+	w := newWatermark(repo.Checkpoint{NextBlock: 11, Pending: []uint64{8}})
+	if got := w.get().Slot; got != 7 {
+		t.Fatalf("initial slot = %d, want 7", got)
+	}
+
+	w.read([]uint64{11, 12})
+	w.read([]uint64{13, 14})
+
+	// later batch is done first
+	w.processed([]uint64{13, 14}, nil)
+	if got := w.get().Slot; got != 7 {
+		t.Errorf("slot = %d, want 7", got)
+	}
+
+	w.read([]uint64{8})
+	w.processed([]uint64{8}, nil)
+	if got := w.get().Slot; got != 10 {
+		t.Errorf("slot = %d, want 10", got)
+	}
+
+	// failed block holds watermark back until it is retried
+	w.processed([]uint64{11, 12}, []uint64{12})
+	if got := w.get().Slot; got != 11 {
+		t.Errorf("slot = %d, want 11", got)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := w.wait(context.Background(), 14, time.Minute)
+		done <- err
+	}()
+
+	w.read([]uint64{12})
+	w.processed([]uint64{12}, nil)
+	if err := <-done; err != nil {
+		t.Errorf("wait() error = %v", err)
+	}
+
+	if _, err := w.wait(context.Background(), 15, time.Millisecond); !errors.Is(err, errWatermarkBehind) {
+		t.Errorf("wait() error = %v, want %v", err, errWatermarkBehind)
+	}
+}
+
+func TestWatermarkReportsQuarantined(t *testing.T) {
+	w := newWatermark(repo.Checkpoint{NextBlock: 5})
+	w.quarantine(nil, []uint64{3})
+
+	w.read([]uint64{5, 6})
+	w.quarantine([]uint64{5, 6}, []uint64{6})
+	w.processed([]uint64{5, 6}, nil)
+	if got := w.get().Quarantined; !reflect.DeepEqual(got, []uint64{3, 6}) {
+		t.Errorf("quarantined = %v, want [3 6]", got)
+	}
+
+	// quarantined block beyond watermark is not reported yet
+	w.read([]uint64{7, 8})
+	w.quarantine([]uint64{8}, []uint64{8})
+	w.processed([]uint64{8}, nil)
+	if got := w.get(); got.Slot != 6 || !reflect.DeepEqual(got.Quarantined, []uint64{3, 6}) {
+		t.Errorf("watermark = %+v, want slot 6 with [3 6] quarantined", got)
+	}
+
+	// replayed without failures
+	w.read([]uint64{3})
+	w.quarantine([]uint64{3}, nil)
+	w.processed([]uint64{3}, nil)
+	if got := w.get().Quarantined; !reflect.DeepEqual(got, []uint64{6}) {
+		t.Errorf("quarantined = %v, want [6]", got)
+	}
+}
+
+func TestWatermarkWaitsForRequeuedBlocks(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t)
+
+	// block 5 failed to fetch and was queued again, behind blocks 10 and 11
+	if err := queue.EnqueueBlocks(ctx, []uint64{10, 11}, 12); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.AddBlocks(ctx, []uint64{5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	checkpoint, err := queue.Checkpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.NextBlock != 5 || !reflect.DeepEqual(checkpoint.Requeued, []uint64{5}) {
+		t.Fatalf("checkpoint = %+v, want next block 5 requeued behind higher ones", checkpoint)
+	}
+	w := newWatermark(checkpoint)
+
+	w.read([]uint64{10, 11})
+	w.processed([]uint64{10, 11}, nil)
+	if got := w.get().Slot; got != 4 {
+		t.Errorf("slot = %d, want 4 until requeued block is processed", got)
+	}
+
+	w.read([]uint64{5})
+	w.processed([]uint64{5}, nil)
+	if got := w.get().Slot; got != 11 {
+		t.Errorf("slot = %d, want 11", got)
+	}
+}
@@ -0,0 +1,85 @@
+package solana
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/portto/solana-go-sdk/common"
+)
+
+// NoopProgramAddress is the program account compression logs tree changes through
+var NoopProgramAddress = common.PublicKeyFromString("noopb9bkMVfRPU8AsbpTUg8AQkHtKwMYZiFUjNRtMmV")
+
+var ErrNotChangeLog = errors.New("data is not a change log event")
+
+// ChangeLog is `ChangeLogEventV1` account compression emits on every modification of a tree
+type ChangeLog struct {
+	Tree  common.PublicKey
+	Path  []PathNode // from modified leaf up to the root
+	Seq   uint64     // number of modifications of the tree so far
+	Index uint32     // index of modified leaf
+}
+
+type PathNode struct {
+	Node  [32]byte
+	Index uint32
+}
+
+// Root is root of the tree after modification
+func (c ChangeLog) Root() [32]byte {
+	if len(c.Path) == 0 {
+		return [32]byte{}
+	}
+	return c.Path[len(c.Path)-1].Node
+}
+
+// DecodeChangeLog parses data of noop instruction, `AccountCompressionEvent::ChangeLog(ChangeLogEvent::V1)`
+func DecodeChangeLog(data []byte) (ChangeLog, error) {
+	const (
+		eventChangeLog = 0
+		changeLogV1    = 0
+		pathNodeSize   = 32 + 4
+	)
+
+	r := reader{data: data}
+
+	header := r.next(2)
+	if r.err != nil {
+		return ChangeLog{}, r.err
+	}
+	if header[0] != eventChangeLog || header[1] != changeLogV1 {
+		return ChangeLog{}, ErrNotChangeLog
+	}
+
+	var c ChangeLog
+	c.Tree = r.pubkey()
+
+	if l := r.next(4); l != nil {
+		n := uint64(binary.LittleEndian.Uint32(l))
+		// length is checked against remaining data, so no huge allocations here
+		if nodes := r.next(n * pathNodeSize); nodes != nil {
+			c.Path = make([]PathNode, n)
+			for i := range c.Path {
+				node := nodes[i*pathNodeSize:]
+				copy(c.Path[i].Node[:], node)
+				c.Path[i].Index = binary.LittleEndian.Uint32(node[32:])
+			}
+		}
+	}
+
+	if seq := r.next(8); seq != nil {
+		c.Seq = binary.LittleEndian.Uint64(seq)
+	}
+	if index := r.next(4); index != nil {
+		c.Index = binary.LittleEndian.Uint32(index)
+	}
+
+	if r.err != nil {
+		return ChangeLog{}, r.err
+	}
+	if len(r.data) != 0 {
+		return ChangeLog{}, ErrTrailingBytes
+	}
+
+	return c, nil
+}
@@ -0,0 +1,45 @@
+package solana
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestDecodeChangeLog(t *testing.T) {
+	data := []byte{0, 0}
+	data = append(data, testFrom[:]...)
+	data = binary.LittleEndian.AppendUint32(data, 2)
+	for i, index := range []uint32{1<<30 + 5, 1} {
+		node := [32]byte{byte(i + 1)}
+		data = append(data, node[:]...)
+		data = binary.LittleEndian.AppendUint32(data, index)
+	}
+	data = binary.LittleEndian.AppendUint64(data, 6)
+	data = binary.LittleEndian.AppendUint32(data, 5)
+
+	c, err := DecodeChangeLog(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Tree != testFrom || c.Seq != 6 || c.Index != 5 || len(c.Path) != 2 {
+		t.Fatalf("unexpected change log: %+v", c)
+	}
+	if c.Path[0].Index != 1<<30+5 || c.Root() != [32]byte{2} {
+		t.Fatalf("unexpected path: %+v", c.Path)
+	}
+
+	if _, err := DecodeChangeLog(data[:len(data)-1]); !errors.Is(err, ErrShortData) {
+		t.Errorf("expected short data error, got %v", err)
+	}
+	if _, err := DecodeChangeLog([]byte{1, 0}); !errors.Is(err, ErrNotChangeLog) {
+		t.Errorf("expected not change log error, got %v", err)
+	}
+
+	// path length is never trusted
+	huge := append([]byte{0, 0}, testFrom[:]...)
+	huge = binary.LittleEndian.AppendUint32(huge, 1<<31)
+	if _, err := DecodeChangeLog(huge); !errors.Is(err, ErrShortData) {
+		t.Errorf("expected short data error, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package solana
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/portto/solana-go-sdk/common"
+	"github.com/portto/solana-go-sdk/types"
+)
+
+var (
+	ErrNotGraphInstruction = errors.New("instruction does not belong to graph program")
+	ErrShortData           = errors.New("instruction data is too short")
+	ErrNotEnoughAccounts   = errors.New("not enough accounts")
+	ErrTrailingBytes       = errors.New("trailing bytes after instruction args")
+	ErrInvalidString       = errors.New("string is not valid utf-8")
+	ErrInvalidOption       = errors.New("invalid option tag")
+)
+
+// DecodedInstruction is one of DecodedInitializeTree, DecodedInitializeProvider,
+// DecodedAddRelation, DecodedCloseRelation, DecodedEditExtra or UnknownInstruction
+type DecodedInstruction interface {
+	isDecodedInstruction()
+}
+
+type DecodedInitializeTree struct {
+	Accounts InitializeTreeAccounts
+}
+
+type DecodedInitializeProvider struct {
+	Accounts InitializeProviderAccounts
+	Args     InitializeProviderParams
+}
+
+type DecodedAddRelation struct {
+	Accounts AddRelationAccounts
+	Args     AddRelationParams
+}
+
+// UnknownInstruction is a graph program instruction this version of sdk does not know about
+type UnknownInstruction struct {
+	Discriminator [8]byte
+	Data          []byte
+}
+
+func (DecodedInitializeTree) isDecodedInstruction()     {}
+func (DecodedInitializeProvider) isDecodedInstruction() {}
+func (DecodedAddRelation) isDecodedInstruction()        {}
+func (UnknownInstruction) isDecodedInstruction()        {}
+
+// DecodeInstruction parses graph program instruction.
+// Unlike borsh.Deserialize it never trusts length prefixes, checks that there are enough accounts
+// and that args are followed by no trailing bytes, so it's safe to feed it arbitrary on-chain data
+func DecodeInstruction(inst types.Instruction) (DecodedInstruction, error) {
+	if inst.ProgramID != GraphProgramAddress {
+		return nil, ErrNotGraphInstruction
+	}
+
+	if len(inst.Data) < 8 {
+		return nil, ErrShortData
+	}
+
+	var discriminator [8]byte
+	copy(discriminator[:], inst.Data)
+
+	r := reader{data: inst.Data[8:]}
+
+	var decoded DecodedInstruction
+
+	switch discriminator {
+	case InitializeTreeInstructionDiscriminator:
+		var ix DecodedInitializeTree
+		if err := decodeAccounts(&ix.Accounts, inst.Accounts, 1); err != nil {
+			return nil, fmt.Errorf("initialize_tree: %w", err)
+		}
+		decoded = ix
+
+	case InitializeProviderInstructionDiscriminator:
+		var ix DecodedInitializeProvider
+		if err := decodeAccounts(&ix.Accounts, inst.Accounts, 1); err != nil {
+			return nil, fmt.Errorf("initialize_provider: %w", err)
+		}
+		ix.Args.Authority = r.pubkey()
+		ix.Args.Name = r.string()
+		ix.Args.Website = r.string()
+		decoded = ix
+
+	case AddRelationInstructionDiscriminator:
+		var ix DecodedAddRelation
+		if err := decodeAccounts(&ix.Accounts, inst.Accounts, 0); err != nil {
+			return nil, fmt.Errorf("add_relation: %w", err)
+		}
+		ix.Args.From = r.pubkey()
+		ix.Args.To = r.pubkey()
+		ix.Args.Extra = r.bytes()
+		decoded = ix
+
+	case CloseRelationInstructionDiscriminator:
+		var ix DecodedCloseRelation
+		if err := decodeAccounts(&ix.Accounts, inst.Accounts, 0); err != nil {
+			return nil, fmt.Errorf("close_relation: %w", err)
+		}
+		ix.Args.Root = r.node()
+		ix.Args.Relation = r.relation()
+		ix.Args.Index = r.u32()
+		decoded = ix
+
+	case EditExtraInstructionDiscriminator:
+		var ix DecodedEditExtra
+		if err := decodeAccounts(&ix.Accounts, inst.Accounts, 0); err != nil {
+			return nil, fmt.Errorf("edit_extra: %w", err)
+		}
+		ix.Args.Root = r.node()
+		ix.Args.Relation = r.relation()
+		ix.Args.Index = r.u32()
+		ix.Args.Extra = r.bytes()
+		decoded = ix
+
+	default:
+		return UnknownInstruction{discriminator, inst.Data[8:]}, nil
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if len(r.data) != 0 {
+		return nil, ErrTrailingBytes
+	}
+
+	return decoded, nil
+}
+
+// decodeAccounts fills *Accounts struct in order of its fields.
+// implicit is number of accounts instruction requires on top of struct fields (e.g. system program)
+func decodeAccounts(dst any, accounts []types.AccountMeta, implicit int) error {
+	v := reflect.ValueOf(dst).Elem()
+
+	if required := v.NumField() + implicit; len(accounts) < required {
+		return fmt.Errorf("%w: expected %d, got %d", ErrNotEnoughAccounts, required, len(accounts))
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		v.Field(i).Set(reflect.ValueOf(accounts[i].PubKey))
+	}
+
+	return nil
+}
+
+// reader is a minimal borsh reader. First error sticks, subsequent reads return zero values
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = ErrShortData
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) pubkey() common.PublicKey {
+	return common.PublicKeyFromBytes(r.next(common.PublicKeyLength))
+}
+
+func (r *reader) node() [32]byte {
+	var node [32]byte
+	copy(node[:], r.next(32))
+	return node
+}
+
+func (r *reader) u32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) i64() int64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (r *reader) optionI64() *int64 {
+	tag := r.next(1)
+	if tag == nil {
+		return nil
+	}
+	switch tag[0] {
+	case 0:
+		return nil
+	case 1:
+		v := r.i64()
+		return &v
+	default:
+		if r.err == nil {
+			r.err = ErrInvalidOption
+		}
+		return nil
+	}
+}
+
+func (r *reader) relation() Relation {
+	return Relation{
+		From:           r.pubkey(),
+		To:             r.pubkey(),
+		Provider:       r.pubkey(),
+		ConnectedAt:    r.i64(),
+		DisconnectedAt: r.optionI64(),
+		Extra:          r.bytes(),
+	}
+}
+
+func (r *reader) bytes() []byte {
+	l := r.next(4)
+	if l == nil {
+		return nil
+	}
+	// length is checked against remaining data, so no huge allocations here
+	return append([]byte{}, r.next(uint64(binary.LittleEndian.Uint32(l)))...)
+}
+
+func (r *reader) string() string {
+	b := r.bytes()
+	if r.err == nil && !utf8.Valid(b) {
+		r.err = ErrInvalidString
+	}
+	return string(b)
+}
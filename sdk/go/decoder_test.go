@@ -0,0 +1,214 @@
+package solana
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/portto/solana-go-sdk/common"
+	"github.com/portto/solana-go-sdk/types"
+)
+
+var (
+	testFrom = common.PublicKeyFromString("8MgDy6gEztWYsS2PKhBkYPCVDb6VQJ4XkTChtwayXvyB")
+	testTo   = common.PublicKeyFromString("HS1pxuGdbkHs6kAX9h1DZ2hQ48pWFZhqaVFqVhqMyPb")
+)
+
+func testAddRelation(t testing.TB, extra []byte) types.Instruction {
+	ix, err := AddRelationInstruction(AddRelationAccounts{
+		Provider:  testFrom,
+		Authority: testTo,
+		Tree:      testFrom,
+	}, AddRelationParams{From: testFrom, To: testTo, Extra: extra})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func testInitializeProvider(t testing.TB) types.Instruction {
+	ix, err := InitializeProviderInstruction(InitializeProviderAccounts{
+		Provider: testFrom,
+		Payer:    testTo,
+	}, InitializeProviderParams{Authority: testTo, Name: "usersig", Website: "https://sgraph.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func testInitializeTree(t testing.TB) types.Instruction {
+	ix, err := InitializeTreeInstruction(InitializeTreeAccounts{Tree: testFrom, Authority: testTo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func testEditExtra(t testing.TB, extra []byte) types.Instruction {
+	connectedAt := int64(1700000000)
+	ix, err := EditExtraInstruction(EditExtraAccounts{Provider: testFrom, Tree: testFrom}, EditExtraParams{
+		Relation: Relation{From: testFrom, To: testTo, Provider: testFrom, ConnectedAt: connectedAt, DisconnectedAt: &connectedAt},
+		Index:    5,
+		Extra:    extra,
+	}, [][32]byte{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func testCloseRelation(t testing.TB) types.Instruction {
+	ix, err := CloseRelationInstruction(CloseRelationAccounts{Provider: testFrom, Tree: testFrom}, CloseRelationParams{
+		Relation: Relation{From: testFrom, To: testTo, Provider: testFrom, ConnectedAt: 1700000000},
+		Index:    7,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func TestDecodeInstruction(t *testing.T) {
+	add := testAddRelation(t, []byte{1, 2, 3})
+
+	decoded, err := DecodeInstruction(add)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ix, ok := decoded.(DecodedAddRelation)
+	if !ok {
+		t.Fatalf("expected add_relation, got %T", decoded)
+	}
+	if ix.Args.From != testFrom || ix.Args.To != testTo || !bytes.Equal(ix.Args.Extra, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected args: %+v", ix.Args)
+	}
+	if ix.Accounts.Provider != testFrom || ix.Accounts.Tree != testFrom {
+		t.Fatalf("unexpected accounts: %+v", ix.Accounts)
+	}
+
+	provider, err := DecodeInstruction(testInitializeProvider(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := provider.(DecodedInitializeProvider); !ok || p.Args.Name != "usersig" {
+		t.Fatalf("unexpected initialize_provider: %+v", provider)
+	}
+
+	tree, err := DecodeInstruction(testInitializeTree(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr, ok := tree.(DecodedInitializeTree); !ok || tr.Accounts.Tree != testFrom {
+		t.Fatalf("unexpected initialize_tree: %+v", tree)
+	}
+
+	edit, err := DecodeInstruction(testEditExtra(t, []byte("mutual")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := edit.(DecodedEditExtra); !ok || e.Args.Index != 5 || string(e.Args.Extra) != "mutual" ||
+		e.Args.Relation.To != testTo || *e.Args.Relation.DisconnectedAt != 1700000000 {
+		t.Fatalf("unexpected edit_extra: %+v", edit)
+	}
+
+	closed, err := DecodeInstruction(testCloseRelation(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := closed.(DecodedCloseRelation); !ok || c.Args.Index != 7 || c.Args.Relation.DisconnectedAt != nil {
+		t.Fatalf("unexpected close_relation: %+v", closed)
+	}
+}
+
+func TestDecodeInstructionErrors(t *testing.T) {
+	valid := testAddRelation(t, []byte{1, 2, 3})
+
+	withData := func(data []byte) types.Instruction {
+		ix := valid
+		ix.Data = data
+		return ix
+	}
+
+	unknown := append([]byte{1, 2, 3, 4, 5, 6, 7, 8}, valid.Data[8:]...)
+
+	cases := []struct {
+		name string
+		ix   types.Instruction
+		err  error
+	}{
+		{"other program", types.Instruction{ProgramID: common.SystemProgramID, Data: valid.Data}, ErrNotGraphInstruction},
+		{"empty data", withData(nil), ErrShortData},
+		{"discriminator only", withData(valid.Data[:8]), ErrShortData},
+		{"truncated extra", withData(valid.Data[:len(valid.Data)-1]), ErrShortData},
+		{"trailing bytes", withData(append(append([]byte{}, valid.Data...), 0)), ErrTrailingBytes},
+		{"huge length prefix", withData(append(append([]byte{}, valid.Data[:72]...), 0xff, 0xff, 0xff, 0xff)), ErrShortData},
+		{"not enough accounts", types.Instruction{ProgramID: GraphProgramAddress, Accounts: valid.Accounts[:6], Data: valid.Data}, ErrNotEnoughAccounts},
+		{"unknown discriminator", withData(unknown), nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := DecodeInstruction(c.ix)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+// FuzzDecodeInstruction makes sure decoder never panics, and everything it accepts
+// is encoded back into exactly the same bytes
+func FuzzDecodeInstruction(f *testing.F) {
+	f.Add(testAddRelation(f, nil).Data, uint8(7))
+	f.Add(testAddRelation(f, []byte("follow")).Data, uint8(7))
+	f.Add(testInitializeProvider(f).Data, uint8(3))
+	f.Add(testInitializeTree(f).Data, uint8(7))
+	f.Add(testEditExtra(f, []byte("follow")).Data, uint8(9))
+	f.Add(testCloseRelation(f).Data, uint8(7))
+	f.Add([]byte{}, uint8(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, accountsCount uint8) {
+		accounts := make([]types.AccountMeta, accountsCount)
+		for i := range accounts {
+			accounts[i].PubKey = common.PublicKeyFromBytes([]byte{byte(i)})
+		}
+
+		decoded, err := DecodeInstruction(types.Instruction{
+			ProgramID: GraphProgramAddress,
+			Accounts:  accounts,
+			Data:      data,
+		})
+		if err != nil {
+			return
+		}
+
+		var encoded types.Instruction
+
+		switch ix := decoded.(type) {
+		case DecodedAddRelation:
+			encoded, err = AddRelationInstruction(ix.Accounts, ix.Args)
+		case DecodedInitializeProvider:
+			encoded, err = InitializeProviderInstruction(ix.Accounts, ix.Args)
+		case DecodedInitializeTree:
+			encoded, err = InitializeTreeInstruction(ix.Accounts)
+		case DecodedCloseRelation:
+			encoded, err = CloseRelationInstruction(ix.Accounts, ix.Args, nil)
+		case DecodedEditExtra:
+			encoded, err = EditExtraInstruction(ix.Accounts, ix.Args, nil)
+		case UnknownInstruction:
+			return
+		default:
+			t.Fatalf("unexpected decoded type %T", decoded)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(encoded.Data, data) {
+			t.Fatalf("roundtrip mismatch:\n%x\n%x", data, encoded.Data)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package solana
+
+import (
+	"errors"
+
+	"github.com/portto/solana-go-sdk/common"
+)
+
+// Event is a one-time broadcast about user activity sent by a provider.
+// Events are not stored in the tree: they are emitted once in transaction as anchor event
+// named `Event`, for indexers to catch.
+// Draft: graph program emits no events yet, layout is a proposal and may change once it does.
+// Until then events of this layout come from other programs, which are not trusted by default
+type Event struct {
+	Provider common.PublicKey
+
+	Actor common.PublicKey
+
+	Target common.PublicKey
+
+	Extra []byte
+}
+
+var GraphEventDiscriminator = EventDiscriminator("Event")
+
+var ErrNotGraphEvent = errors.New("event discriminator mismatch")
+
+// DecodeEvent parses sgraph event from anchor event payload
+func DecodeEvent(e AnchorEvent) (Event, error) {
+	if e.Discriminator != GraphEventDiscriminator {
+		return Event{}, ErrNotGraphEvent
+	}
+
+	r := reader{data: e.Data}
+
+	event := Event{
+		Provider: r.pubkey(),
+		Actor:    r.pubkey(),
+		Target:   r.pubkey(),
+		Extra:    r.bytes(),
+	}
+
+	if r.err != nil {
+		return Event{}, r.err
+	}
+
+	if len(r.data) != 0 {
+		return Event{}, ErrTrailingBytes
+	}
+
+	return event, nil
+}
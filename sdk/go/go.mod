@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/near/borsh-go v0.3.2-0.20220516180422-1ff87d108454
 	github.com/portto/solana-go-sdk v1.23.0
+	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90
 )
 
 require (
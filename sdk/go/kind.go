@@ -0,0 +1,88 @@
+package solana
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Kind header opens Extra of relations that declare their kind, the rest of Extra is payload:
+//
+//	"sgk" | version u8 | kind length u8 | kind | payload
+//
+// Kind is lowercase ASCII letters, digits, '_' and '-', subtypes are separated with '/', as in "flag/spam".
+// Extra without the header has no kind and is payload as a whole
+var kindMagic = []byte("sgk")
+
+const (
+	KindHeaderVersion = 1
+	MaxKindLength     = 32
+)
+
+// kinds of relations README talks about. Any other valid kind may be used as well
+const (
+	KindFollow    = "follow"
+	KindSubscribe = "subscribe"
+	KindFlag      = "flag"
+)
+
+var (
+	ErrInvalidKind       = errors.New("invalid relation kind")
+	ErrKindHeaderVersion = errors.New("unsupported kind header version")
+)
+
+// ValidKind reports whether kind fits into kind header
+func ValidKind(kind string) bool {
+	if kind == "" || len(kind) > MaxKindLength || kind[0] == '/' || kind[len(kind)-1] == '/' {
+		return false
+	}
+	for i := 0; i < len(kind); i++ {
+		c := kind[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '/') {
+			return false
+		}
+		if c == '/' && kind[i-1] == '/' {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeKind prepends kind header to payload
+func EncodeKind(kind string, payload []byte) ([]byte, error) {
+	if !ValidKind(kind) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidKind, kind)
+	}
+
+	extra := make([]byte, 0, len(kindMagic)+2+len(kind)+len(payload))
+	extra = append(extra, kindMagic...)
+	extra = append(extra, KindHeaderVersion, byte(len(kind)))
+	extra = append(extra, kind...)
+	return append(extra, payload...), nil
+}
+
+// DecodeKind splits Extra into kind and payload. Extra without kind header has empty kind and is returned as payload
+func DecodeKind(extra []byte) (kind string, payload []byte, err error) {
+	if !bytes.HasPrefix(extra, kindMagic) {
+		return "", extra, nil
+	}
+
+	r := reader{data: extra[len(kindMagic):]}
+
+	header := r.next(2)
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	if header[0] != KindHeaderVersion {
+		return "", nil, fmt.Errorf("%w %d", ErrKindHeaderVersion, header[0])
+	}
+
+	name := r.next(uint64(header[1]))
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	if kind = string(name); !ValidKind(kind) {
+		return "", nil, fmt.Errorf("%w: %q", ErrInvalidKind, kind)
+	}
+	return kind, r.data, nil
+}
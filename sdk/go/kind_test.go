@@ -0,0 +1,80 @@
+package solana
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestKindRoundTrip(t *testing.T) {
+	extra, err := EncodeKind("flag/spam", []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kind, payload, err := DecodeKind(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != "flag/spam" || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected kind %q and payload %v", kind, payload)
+	}
+}
+
+func TestDecodeKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   []byte
+		kind    string
+		payload []byte
+		err     error
+	}{
+		{"no header", []byte(`{"a":1}`), "", []byte(`{"a":1}`), nil},
+		{"empty", nil, "", nil, nil},
+		{"empty payload", []byte("sgk\x01\x06follow"), KindFollow, []byte{}, nil},
+		{"short header", []byte("sgk\x01"), "", nil, ErrShortData},
+		{"short kind", []byte("sgk\x01\x07follow"), "", nil, ErrShortData},
+		{"unknown version", []byte("sgk\x02\x06follow"), "", nil, ErrKindHeaderVersion},
+		{"invalid kind", []byte("sgk\x01\x06Follow"), "", nil, ErrInvalidKind},
+		{"empty kind", []byte("sgk\x01\x00"), "", nil, ErrInvalidKind},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, payload, err := DecodeKind(tt.extra)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("DecodeKind() error = %v, want %v", err, tt.err)
+			}
+			if kind != tt.kind || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("DecodeKind() = %q, %v, want %q, %v", kind, payload, tt.kind, tt.payload)
+			}
+		})
+	}
+}
+
+func TestValidKind(t *testing.T) {
+	for kind, want := range map[string]bool{
+		"follow":         true,
+		"flag/spam":      true,
+		"new-content_v2": true,
+		"":               false,
+		"/flag":          false,
+		"flag/":          false,
+		"flag//spam":     false,
+		"Flag":           false,
+		"flag spam":      false,
+	} {
+		if got := ValidKind(kind); got != want {
+			t.Errorf("ValidKind(%q) = %v, want %v", kind, got, want)
+		}
+	}
+
+	if ValidKind(strings.Repeat("a", MaxKindLength+1)) {
+		t.Errorf("kind longer than %d is valid", MaxKindLength)
+	}
+
+	if _, err := EncodeKind("Flag", nil); !errors.Is(err, ErrInvalidKind) {
+		t.Errorf("expected invalid kind error, got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package solana
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// LeafHash is the node relation is appended to the tree as, same as `RelationLeaf::to_node` of the program
+func LeafHash(r Relation) [32]byte {
+	var disconnectedAt int64
+	if r.DisconnectedAt != nil {
+		disconnectedAt = *r.DisconnectedAt
+	}
+
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte{byte(LeafTypeRelationV1)})
+	h.Write(r.From[:])
+	h.Write(r.To[:])
+	h.Write(r.Provider[:])
+	h.Write(binary.LittleEndian.AppendUint64(nil, uint64(r.ConnectedAt)))
+	h.Write(binary.LittleEndian.AppendUint64(nil, uint64(disconnectedAt)))
+	h.Write(r.Extra)
+
+	var node [32]byte
+	h.Sum(node[:0])
+	return node
+}
@@ -0,0 +1,84 @@
+package solana
+
+import (
+	"github.com/near/borsh-go"
+	"github.com/portto/solana-go-sdk/common"
+	"github.com/portto/solana-go-sdk/types"
+)
+
+// close_relation and edit_extra are not deployed yet. They replace leaf of relation in the tree it was
+// appended to, proof of the leaf is passed as remaining accounts, same as for spl-account-compression `replace_leaf`.
+// Layouts follow anchor conventions, so decoding keeps working once program implements them
+
+var (
+	CloseRelationInstructionDiscriminator = [8]uint8{0xa9, 0xf1, 0x78, 0xe0, 0xe9, 0xda, 0x4e, 0x82}
+
+	EditExtraInstructionDiscriminator = [8]uint8{0x98, 0xf, 0x7c, 0x61, 0x9b, 0x6f, 0x49, 0x80}
+)
+
+// CloseRelationAccounts are the same as of add_relation
+type CloseRelationAccounts = AddRelationAccounts
+
+type CloseRelationParams struct {
+	Root     [32]byte // root proof is checked against
+	Relation Relation // current leaf
+	Index    uint32   // index of the leaf
+}
+
+// EditExtraAccounts are the same as of add_relation
+type EditExtraAccounts = AddRelationAccounts
+
+type EditExtraParams struct {
+	Root     [32]byte // root proof is checked against
+	Relation Relation // current leaf
+	Index    uint32   // index of the leaf
+	Extra    []byte   // replaces extra of the relation
+}
+
+type DecodedCloseRelation struct {
+	Accounts CloseRelationAccounts
+	Args     CloseRelationParams
+}
+
+type DecodedEditExtra struct {
+	Accounts EditExtraAccounts
+	Args     EditExtraParams
+}
+
+func (DecodedCloseRelation) isDecodedInstruction() {}
+func (DecodedEditExtra) isDecodedInstruction()     {}
+
+// CloseRelationInstruction creates closeRelation instruction. proof is from the leaf up to the root
+func CloseRelationInstruction(accounts CloseRelationAccounts, args CloseRelationParams, proof [][32]byte) (types.Instruction, error) {
+	return leafInstruction(CloseRelationInstructionDiscriminator, accounts, args, proof)
+}
+
+// EditExtraInstruction creates editExtra instruction. proof is from the leaf up to the root
+func EditExtraInstruction(accounts EditExtraAccounts, args EditExtraParams, proof [][32]byte) (types.Instruction, error) {
+	return leafInstruction(EditExtraInstructionDiscriminator, accounts, args, proof)
+}
+
+func leafInstruction[T any](discriminator [8]byte, accounts AddRelationAccounts, args T, proof [][32]byte) (types.Instruction, error) {
+	data, err := borsh.Serialize(struct {
+		Desc [8]byte
+		Args T
+	}{discriminator, args})
+	if err != nil {
+		return types.Instruction{}, err
+	}
+
+	metas := []types.AccountMeta{
+		{PubKey: accounts.Provider, IsSigner: false, IsWritable: true},
+		{PubKey: accounts.Authority, IsSigner: true, IsWritable: false},
+		{PubKey: accounts.Tree, IsSigner: false, IsWritable: true},
+		{PubKey: accounts.TreeController, IsSigner: false, IsWritable: false},
+		{PubKey: accounts.Payer, IsSigner: true, IsWritable: true},
+		{PubKey: accounts.AcProgram, IsSigner: false, IsWritable: false},
+		{PubKey: accounts.NoopProgram, IsSigner: false, IsWritable: false},
+	}
+	for _, node := range proof {
+		metas = append(metas, types.AccountMeta{PubKey: common.PublicKeyFromBytes(node[:]), IsSigner: false, IsWritable: false})
+	}
+
+	return types.Instruction{ProgramID: GraphProgramAddress, Accounts: metas, Data: data}, nil
+}
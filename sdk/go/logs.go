@@ -0,0 +1,333 @@
+package solana
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/portto/solana-go-sdk/common"
+)
+
+// Invocation is a single program invocation reconstructed from transaction logs
+type Invocation struct {
+	ProgramID common.PublicKey
+	Depth     int
+
+	Success bool
+	Err     string // reason of failure, as logged by runtime
+
+	Logs []string // "Program log:" messages
+	Data [][]byte // "Program data:" payloads, fields of a single line are concatenated
+
+	Inner []*Invocation // CPIs made by this invocation, in order
+
+	done bool // false if logs are truncated before invocation result
+}
+
+// TxLogs is a tree of program invocations of a transaction
+type TxLogs struct {
+	Invocations []*Invocation // one per top level instruction, except of precompiles
+
+	// runtime stops logging after log limit is reached. Invocations after that are missing
+	Truncated bool
+
+	// index of invocation of each top level instruction, -1 for precompiles. nil if programs are unknown
+	outer []int
+}
+
+// AnchorEvent is a payload emitted with `emit!` (or sol_log_data) by a successful invocation
+type AnchorEvent struct {
+	ProgramID     common.PublicKey
+	Instruction   int // index of top level instruction
+	Discriminator [8]byte
+	Data          []byte // borsh encoded event, without discriminator
+}
+
+const (
+	logPrefixProgram   = "Program "
+	logPrefixLog       = "Program log: "
+	logPrefixData      = "Program data: "
+	logPrefixReturn    = "Program return: "
+	logPrefixConsumed  = " consumed "
+	logTruncated       = "Log truncated"
+	logSuffixSuccess   = " success"
+	logInfixInvoke     = " invoke ["
+	logInfixFailed     = " failed: "
+	maxInvocationDepth = 5 // solana limits CPI depth to 4, plus top level
+)
+
+var ErrMalformedLogs = errors.New("malformed transaction logs")
+
+// precompiles are executed by runtime without invocation, so they log nothing
+var precompiles = []common.PublicKey{
+	common.PublicKeyFromString("Ed25519SigVerify111111111111111111111111111"),
+	common.Secp256k1ProgramID,
+	common.PublicKeyFromString("Secp256r1SigVerify1111111111111111111111111"),
+}
+
+// ParseLogs rebuilds invocation tree from `meta.logMessages` of a transaction.
+// programs are program ids of top level instructions, they match instructions to invocations
+// past precompiles. With nil programs instructions are matched by position
+func ParseLogs(logs []string, programs []common.PublicKey) (TxLogs, error) {
+	var (
+		result TxLogs
+		stack  []*Invocation
+	)
+
+	handleErr := func(line int, err string) (TxLogs, error) {
+		return TxLogs{}, fmt.Errorf("%w: line %d: %s", ErrMalformedLogs, line, err)
+	}
+
+	for i, line := range logs {
+		var current *Invocation
+		if len(stack) > 0 {
+			current = stack[len(stack)-1]
+		}
+
+		switch {
+		case line == logTruncated:
+			result.Truncated = true
+			result.matchInstructions(programs)
+			return result, nil
+
+		case strings.HasPrefix(line, logPrefixLog):
+			if current == nil {
+				return handleErr(i, "log outside of invocation")
+			}
+			current.Logs = append(current.Logs, strings.TrimPrefix(line, logPrefixLog))
+
+		case strings.HasPrefix(line, logPrefixData):
+			if current == nil {
+				return handleErr(i, "data outside of invocation")
+			}
+			var data []byte
+			for _, field := range strings.Fields(strings.TrimPrefix(line, logPrefixData)) {
+				decoded, err := base64.StdEncoding.DecodeString(field)
+				if err != nil {
+					return handleErr(i, err.Error())
+				}
+				data = append(data, decoded...)
+			}
+			current.Data = append(current.Data, data)
+
+		case strings.HasPrefix(line, logPrefixReturn):
+			// return data is not interesting for us
+
+		case strings.HasPrefix(line, logPrefixProgram):
+			rest := strings.TrimPrefix(line, logPrefixProgram)
+			id, tail, _ := strings.Cut(rest, " ")
+			tail = " " + tail
+
+			switch {
+			case strings.HasPrefix(tail, logInfixInvoke):
+				if len(stack) >= maxInvocationDepth {
+					return handleErr(i, "invocation is too deep")
+				}
+
+				inv := &Invocation{ProgramID: common.PublicKeyFromString(id), Depth: len(stack) + 1}
+				if current == nil {
+					result.Invocations = append(result.Invocations, inv)
+				} else {
+					current.Inner = append(current.Inner, inv)
+				}
+				stack = append(stack, inv)
+
+			case tail == logSuffixSuccess, strings.HasPrefix(tail, logInfixFailed):
+				if current == nil || current.ProgramID.ToBase58() != id {
+					return handleErr(i, "result of program that was not invoked")
+				}
+				current.done = true
+				current.Success = tail == logSuffixSuccess
+				current.Err = strings.TrimPrefix(tail, logInfixFailed)
+				if current.Success {
+					current.Err = ""
+				}
+				stack = stack[:len(stack)-1]
+
+			case strings.HasPrefix(tail, logPrefixConsumed):
+				// compute units report
+
+			default:
+				// anything else is a plain msg! from a native program or runtime
+			}
+
+		default:
+			// unknown line, e.g. raw sol_log call
+		}
+	}
+
+	if len(stack) != 0 {
+		return TxLogs{}, fmt.Errorf("%w: invocation of %s has no result", ErrMalformedLogs, stack[len(stack)-1].ProgramID.ToBase58())
+	}
+
+	result.matchInstructions(programs)
+	return result, nil
+}
+
+func (t *TxLogs) matchInstructions(programs []common.PublicKey) {
+	if programs == nil {
+		return
+	}
+
+	t.outer = make([]int, len(programs))
+	next := 0
+	for i, program := range programs {
+		if isPrecompile(program) {
+			t.outer[i] = -1
+			continue
+		}
+		t.outer[i] = next
+		next++
+	}
+}
+
+func isPrecompile(program common.PublicKey) bool {
+	for _, p := range precompiles {
+		if p == program {
+			return true
+		}
+	}
+	return false
+}
+
+// invocation returns index of invocation of top level instruction, -1 if it has none
+func (t TxLogs) invocation(outer int) int {
+	if t.outer == nil {
+		return outer
+	}
+	if outer < 0 || outer >= len(t.outer) {
+		return -1
+	}
+	return t.outer[outer]
+}
+
+// Instruction returns invocation of top level instruction. Returns false if logs are truncated before it,
+// or instruction is a precompile
+func (t TxLogs) Instruction(outer int) (*Invocation, bool) {
+	i := t.invocation(outer)
+	if i < 0 || i >= len(t.Invocations) {
+		return nil, false
+	}
+	return t.Invocations[i], true
+}
+
+// InnerInstruction returns invocation matching `inner`-th instruction in meta.innerInstructions of `outer` instruction.
+// Inner instructions are listed in the order they were invoked, regardless of the depth
+func (t TxLogs) InnerInstruction(outer, inner int) (*Invocation, bool) {
+	top, ok := t.Instruction(outer)
+	if !ok || inner < 0 {
+		return nil, false
+	}
+
+	var found *Invocation
+	n := 0
+
+	var walk func(inv *Invocation)
+	walk = func(inv *Invocation) {
+		for _, child := range inv.Inner {
+			if found != nil {
+				return
+			}
+			if n == inner {
+				found = child
+				return
+			}
+			n++
+			walk(child)
+		}
+	}
+	walk(top)
+
+	return found, found != nil
+}
+
+// Succeeded reports whether instruction of `programID` at given position and its top level instruction
+// have succeeded. Pass negative `inner` to check top level instruction.
+// Returns an error if position can't be confirmed with logs, e.g. logs are truncated or don't match the program
+func (t TxLogs) Succeeded(programID common.PublicKey, outer, inner int) (bool, error) {
+	var (
+		inv *Invocation
+		ok  bool
+	)
+	if inner < 0 {
+		inv, ok = t.Instruction(outer)
+	} else {
+		inv, ok = t.InnerInstruction(outer, inner)
+	}
+
+	if !ok {
+		return false, fmt.Errorf("no invocation for instruction %d:%d in logs", outer, inner)
+	}
+	if inv.ProgramID != programID {
+		return false, fmt.Errorf("instruction %d:%d is invoked by %s, not %s", outer, inner, inv.ProgramID.ToBase58(), programID.ToBase58())
+	}
+
+	top, _ := t.Instruction(outer)
+	if !inv.done || !top.done {
+		return false, fmt.Errorf("logs are truncated before result of instruction %d:%d", outer, inner)
+	}
+
+	return inv.Success && top.Success, nil
+}
+
+// Events returns events emitted by successful invocations of programID
+func (t TxLogs) Events(programID common.PublicKey) []AnchorEvent {
+	return t.events(func(inv *Invocation) bool { return inv.ProgramID == programID })
+}
+
+// AllEvents returns events emitted by all successful invocations
+func (t TxLogs) AllEvents() []AnchorEvent {
+	return t.events(func(*Invocation) bool { return true })
+}
+
+func (t TxLogs) events(filter func(*Invocation) bool) []AnchorEvent {
+	var events []AnchorEvent
+
+	var walk func(outer int, inv *Invocation)
+	walk = func(outer int, inv *Invocation) {
+		if !inv.Success {
+			// whatever failed invocation emitted didn't happen
+			return
+		}
+
+		if filter(inv) {
+			for _, data := range inv.Data {
+				if len(data) < 8 {
+					continue
+				}
+				e := AnchorEvent{ProgramID: inv.ProgramID, Instruction: outer, Data: data[8:]}
+				copy(e.Discriminator[:], data)
+				events = append(events, e)
+			}
+		}
+
+		for _, child := range inv.Inner {
+			walk(outer, child)
+		}
+	}
+
+	instructions := t.outer
+	if instructions == nil {
+		instructions = make([]int, len(t.Invocations))
+		for i := range instructions {
+			instructions[i] = i
+		}
+	}
+	for outer, i := range instructions {
+		if i >= 0 && i < len(t.Invocations) {
+			walk(outer, t.Invocations[i])
+		}
+	}
+
+	return events
+}
+
+// EventDiscriminator computes anchor discriminator of event with given name
+func EventDiscriminator(name string) [8]byte {
+	var d [8]byte
+	h := sha256.Sum256([]byte("event:" + name))
+	copy(d[:], h[:8])
+	return d
+}
@@ -0,0 +1,141 @@
+package solana
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/portto/solana-go-sdk/common"
+)
+
+const (
+	testUsersig = "s1gsZrDJAXNYSCRhQZk5X3mYyBjAmaVBTYnNhCzj8t2"
+	testAc      = "cmtDvXumGCrqC1Age74AVPhSRVXJMd8PJS91L8KbNCK"
+	testNoop    = "noopb9bkMVfRPU8AsbpTUg8AQkHtKwMYZiFUjNRtMmV"
+)
+
+func TestParseLogs(t *testing.T) {
+	d := EventDiscriminator("Event")
+	payload := base64.StdEncoding.EncodeToString(append(d[:], 1, 2, 3))
+
+	graph := GraphProgramAddress.ToBase58()
+
+	logs := []string{
+		"Program " + testUsersig + " invoke [1]",
+		"Program log: Instruction: SignRelation",
+		"Program " + graph + " invoke [2]",
+		"Program log: Instruction: AddRelation",
+		"Program " + testAc + " invoke [3]",
+		"Program " + testNoop + " invoke [4]",
+		"Program " + testNoop + " success",
+		"Program " + testAc + " consumed 4000 of 180000 compute units",
+		"Program " + testAc + " success",
+		"Program data: " + payload,
+		"Program " + graph + " consumed 20000 of 190000 compute units",
+		"Program " + graph + " success",
+		"Program " + testUsersig + " success",
+		"Program " + graph + " invoke [1]",
+		"Program log: AnchorError occurred",
+		"Program " + graph + " failed: custom program error: 0x1770",
+	}
+
+	parsed, err := ParseLogs(logs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.Invocations) != 2 || parsed.Truncated {
+		t.Fatalf("unexpected invocations: %+v", parsed)
+	}
+
+	// graph is the first inner instruction of the usersig instruction
+	ok, err := parsed.Succeeded(GraphProgramAddress, 0, 0)
+	if err != nil || !ok {
+		t.Fatalf("expected graph cpi to succeed: %v %v", ok, err)
+	}
+
+	// noop is the third one
+	inv, found := parsed.InnerInstruction(0, 2)
+	if !found || inv.ProgramID.ToBase58() != testNoop || inv.Depth != 4 {
+		t.Fatalf("unexpected third inner instruction: %+v", inv)
+	}
+
+	ok, err = parsed.Succeeded(GraphProgramAddress, 1, -1)
+	if err != nil || ok {
+		t.Fatalf("expected second instruction to fail: %v %v", ok, err)
+	}
+	if parsed.Invocations[1].Err != "custom program error: 0x1770" {
+		t.Fatalf("unexpected error: %q", parsed.Invocations[1].Err)
+	}
+
+	if _, err := parsed.Succeeded(GraphProgramAddress, 0, 1); err == nil {
+		t.Fatal("expected program mismatch error")
+	}
+
+	events := parsed.Events(GraphProgramAddress)
+	if len(events) != 1 || events[0].Discriminator != d || !bytes.Equal(events[0].Data, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestParseLogsMalformed(t *testing.T) {
+	cases := [][]string{
+		{"Program log: hello"},
+		{"Program " + testNoop + " success"},
+		{"Program " + testNoop + " invoke [1]"},
+		{"Program " + testNoop + " invoke [1]", "Program " + testAc + " success"},
+	}
+
+	for _, logs := range cases {
+		if _, err := ParseLogs(logs, nil); !errors.Is(err, ErrMalformedLogs) {
+			t.Fatalf("expected malformed logs error for %v, got %v", logs, err)
+		}
+	}
+
+	truncated, err := ParseLogs([]string{"Program " + testNoop + " invoke [1]", "Log truncated"}, nil)
+	if err != nil || !truncated.Truncated {
+		t.Fatalf("expected truncated logs: %+v %v", truncated, err)
+	}
+}
+
+func TestParseLogsSkipsPrecompiles(t *testing.T) {
+	d := EventDiscriminator("Event")
+	payload := base64.StdEncoding.EncodeToString(append(d[:], 1))
+	graph := GraphProgramAddress.ToBase58()
+
+	// signature verification precompile logs nothing
+	logs := []string{
+		"Program " + testUsersig + " invoke [1]",
+		"Program " + testUsersig + " success",
+		"Program " + graph + " invoke [1]",
+		"Program data: " + payload,
+		"Program " + graph + " success",
+	}
+	programs := []common.PublicKey{
+		common.PublicKeyFromString("Ed25519SigVerify111111111111111111111111111"),
+		common.PublicKeyFromString(testUsersig),
+		GraphProgramAddress,
+	}
+
+	parsed, err := ParseLogs(logs, programs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := parsed.Instruction(0); ok {
+		t.Error("precompile instruction has an invocation")
+	}
+	ok, err := parsed.Succeeded(GraphProgramAddress, 2, -1)
+	if err != nil || !ok {
+		t.Fatalf("expected graph instruction after precompile to succeed: %v %v", ok, err)
+	}
+	if _, err := parsed.Succeeded(GraphProgramAddress, 1, -1); err == nil {
+		t.Fatal("expected program mismatch error")
+	}
+
+	events := parsed.Events(GraphProgramAddress)
+	if len(events) != 1 || events[0].Instruction != 2 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
@@ -40,6 +40,9 @@ type FindRelationParams = {
   from?: string;
   providers?: string[];
   limit?: number;
+  sort?: 'inserted' | 'connectedAt' | 'slot';
+  order?: 'desc' | 'asc';
+  // nextCursor of the previous page
   after?: string;
 };
 